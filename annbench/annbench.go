@@ -5,7 +5,6 @@ import (
 	lsh "github.com/gasparian/lsh-search-go/lsh"
 	"github.com/gasparian/lsh-search-go/store"
 	guuid "github.com/google/uuid"
-	"gonum.org/v1/gonum/blas/blas64"
 	"gonum.org/v1/hdf5"
 	"math"
 	"path/filepath"
@@ -73,11 +72,13 @@ func (nn *NNMock) Train(vecs [][]float64, ids []string) error {
 	if err != nil {
 		return err
 	}
-	for i, vec := range vecs {
-		nn.index.SetVector(ids[i], vec)
-		nn.index.SetHash("0", ids[i])
+	err = nn.index.SetVectors(ids, vecs)
+	if err != nil {
+		return err
 	}
-	return nil
+	// NOTE: all vectors go to the single bucket
+	bucketKeys := make([]store.BucketKey, len(ids))
+	return nn.index.SetHashes(bucketKeys, ids)
 }
 
 func (nn *NNMock) Search(query []float64, maxNN int, distanceThrsh float64) ([]lsh.Neighbor, error) {
@@ -88,7 +89,11 @@ func (nn *NNMock) Search(query []float64, maxNN int, distanceThrsh float64) ([]l
 	closestSet := make(map[string]bool)
 	minHeap := new(lsh.FloatMinHeap)
 
-	iter, _ := nn.index.GetHashIterator("0")
+	iter, err := nn.index.GetHashIterator(store.BucketKey{})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
 	for {
 		if minHeap.Len() >= maxCandidates {
 			break
@@ -237,8 +242,7 @@ func PrepHdf5BenchDataset(config *BenchDataConfig) (*BenchData, error) {
 	for i := 0; i <= len(train)-config.TrainDim; i = i + config.TrainDim {
 		idx := i / config.TrainDim
 		vec := lsh.ConvertTo64(train[i : i+config.TrainDim])
-		inpVec := lsh.NewVec(vec)
-		data.TrainNorms[idx] = blas64.Nrm2(inpVec)
+		data.TrainNorms[idx] = lsh.Norm(vec)
 		data.TrainVecs[idx] = vec
 		data.TrainIds[idx] = guuid.NewString()
 	}
@@ -249,7 +253,7 @@ func PrepHdf5BenchDataset(config *BenchDataConfig) (*BenchData, error) {
 		data.TrainIndices[data.TrainIds[i]] = i
 	}
 
-	data.Mean, data.Std, err = lsh.GetMeanStdSampledRecords(data.TrainVecs, config.SampleSize)
+	data.Mean, data.Std, err = lsh.GetMeanStdSampled(data.TrainVecs, config.SampleSize)
 	if err != nil {
 		return nil, err
 	}
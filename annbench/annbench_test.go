@@ -3,7 +3,10 @@ package annbench_test
 import (
 	bench "github.com/gasparian/lsh-search-go/annbench"
 	lsh "github.com/gasparian/lsh-search-go/lsh"
+	"github.com/gasparian/lsh-search-go/store"
+	"github.com/gasparian/lsh-search-go/store/compact"
 	"github.com/gasparian/lsh-search-go/store/kv"
+	"runtime"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -294,3 +297,216 @@ func TestAngularGlove(t *testing.T) {
 		testLSH(t, config, data)
 	})
 }
+
+// plainMetric hides NormedMetric and ExtendedMetric methods of the wrapped metric
+type plainMetric struct {
+	lsh.Metric
+}
+
+// benchmarkScoring compares search time with and without precomputed norms and block scoring
+func benchmarkScoring(b *testing.B, dataConfig *bench.BenchDataConfig, config *bench.SearchConfig) {
+	data, err := bench.PrepHdf5BenchDataset(dataConfig)
+	if err != nil {
+		b.Fatal(err)
+	}
+	lshConfig := lsh.Config{
+		IndexConfig: lsh.IndexConfig{
+			BatchSize:     config.BatchSize,
+			MaxCandidates: config.MaxCandidates,
+		},
+		HasherConfig: lsh.HasherConfig{
+			NTrees:   config.NTrees,
+			KMinVecs: config.KMinVecs,
+			Dims:     config.NDims,
+		},
+	}
+	s := kv.NewKVStore()
+	lshIndex, err := lsh.NewLsh(lshConfig, s, config.Metric)
+	if err != nil {
+		b.Fatal(err)
+	}
+	err = lshIndex.Train(data.TrainVecs, data.TrainIds)
+	if err != nil {
+		b.Fatal(err)
+	}
+	dump, err := lshIndex.DumpHasher()
+	if err != nil {
+		b.Fatal(err)
+	}
+	// NOTE: the same trees and the same store, only the metric differs
+	plainIndex, err := lsh.NewLsh(lshConfig, s, plainMetric{config.Metric})
+	if err != nil {
+		b.Fatal(err)
+	}
+	err = plainIndex.LoadHasher(dump)
+	if err != nil {
+		b.Fatal(err)
+	}
+	search := func(b *testing.B, index *lsh.LSHIndex) {
+		for i := 0; i < b.N; i++ {
+			_, err := index.Search(data.Test[i%len(data.Test)], config.MaxNN, config.MaxDist)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+
+	b.Run("Regular", func(b *testing.B) {
+		search(b, plainIndex)
+	})
+
+	b.Run("Normed", func(b *testing.B) {
+		search(b, lshIndex)
+	})
+}
+
+func BenchmarkScoringFashionMnist(b *testing.B) {
+	dataConfig := &bench.BenchDataConfig{
+		DatasetPath:  "../test-data/fashion-mnist-784-euclidean.hdf5",
+		SampleSize:   30000,
+		TrainDim:     784,
+		NeighborsDim: 100,
+	}
+	config := &bench.SearchConfig{
+		Metric:        lsh.NewL2(),
+		NDims:         784,
+		BatchSize:     500,
+		NTrees:        10,
+		KMinVecs:      200,
+		MaxNN:         10,
+		MaxDist:       2200,
+		MaxCandidates: 5000,
+	}
+	benchmarkScoring(b, dataConfig, config)
+}
+
+func BenchmarkScoringSift(b *testing.B) {
+	dataConfig := &bench.BenchDataConfig{
+		DatasetPath:  "../test-data/sift-128-euclidean.hdf5",
+		SampleSize:   200000,
+		TrainDim:     128,
+		NeighborsDim: 100,
+	}
+	config := &bench.SearchConfig{
+		Metric:        lsh.NewL2(),
+		NDims:         128,
+		BatchSize:     500,
+		NTrees:        40,
+		KMinVecs:      300,
+		MaxNN:         10,
+		MaxDist:       300,
+		MaxCandidates: 10000,
+	}
+	benchmarkScoring(b, dataConfig, config)
+}
+
+func BenchmarkScoringNYTimes(b *testing.B) {
+	dataConfig := &bench.BenchDataConfig{
+		DatasetPath:  "../test-data/nytimes-256-angular.hdf5",
+		SampleSize:   60000,
+		TrainDim:     256,
+		NeighborsDim: 100,
+	}
+	config := &bench.SearchConfig{
+		Metric:        lsh.NewAngular(),
+		NDims:         256,
+		BatchSize:     500,
+		NTrees:        200,
+		KMinVecs:      200,
+		MaxNN:         10,
+		MaxDist:       0.81,
+		MaxCandidates: 20000,
+	}
+	benchmarkScoring(b, dataConfig, config)
+}
+
+func BenchmarkScoringGlove(b *testing.B) {
+	dataConfig := &bench.BenchDataConfig{
+		DatasetPath:  "../test-data/glove-200-angular.hdf5",
+		SampleSize:   200000,
+		TrainDim:     200,
+		NeighborsDim: 100,
+	}
+	config := &bench.SearchConfig{
+		Metric:        lsh.NewAngular(),
+		NDims:         200,
+		BatchSize:     500,
+		NTrees:        150,
+		KMinVecs:      300,
+		MaxNN:         10,
+		MaxDist:       0.75,
+		MaxCandidates: 20000,
+	}
+	benchmarkScoring(b, dataConfig, config)
+}
+
+// benchmarkStore trains LSH index on top of the given store and reports its heap size and search time
+func benchmarkStore(b *testing.B, data *bench.BenchData, config *bench.SearchConfig, newStore func() store.Store) {
+	lshConfig := lsh.Config{
+		IndexConfig: lsh.IndexConfig{
+			BatchSize:     config.BatchSize,
+			MaxCandidates: config.MaxCandidates,
+		},
+		HasherConfig: lsh.HasherConfig{
+			NTrees:   config.NTrees,
+			KMinVecs: config.KMinVecs,
+			Dims:     config.NDims,
+		},
+	}
+	var memStats runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&memStats)
+	before := memStats.HeapAlloc
+	lshIndex, err := lsh.NewLsh(lshConfig, newStore(), config.Metric)
+	if err != nil {
+		b.Fatal(err)
+	}
+	err = lshIndex.Train(data.TrainVecs, data.TrainIds)
+	if err != nil {
+		b.Fatal(err)
+	}
+	runtime.GC()
+	runtime.ReadMemStats(&memStats)
+	// NOTE: kv store keeps the train vectors themselves, so they're not counted here
+	heapMB := float64(memStats.HeapAlloc-before) / (1 << 20)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := lshIndex.Search(data.Test[i%len(data.Test)], config.MaxNN, config.MaxDist)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(heapMB, "heap-MB")
+}
+
+func BenchmarkStoreSift(b *testing.B) {
+	dataConfig := &bench.BenchDataConfig{
+		DatasetPath:  "../test-data/sift-128-euclidean.hdf5",
+		SampleSize:   200000,
+		TrainDim:     128,
+		NeighborsDim: 100,
+	}
+	data, err := bench.PrepHdf5BenchDataset(dataConfig)
+	if err != nil {
+		b.Fatal(err)
+	}
+	config := &bench.SearchConfig{
+		Metric:        lsh.NewL2(),
+		NDims:         128,
+		BatchSize:     500,
+		NTrees:        40,
+		KMinVecs:      300,
+		MaxNN:         10,
+		MaxDist:       300,
+		MaxCandidates: 10000,
+	}
+
+	b.Run("KVStore", func(b *testing.B) {
+		benchmarkStore(b, data, config, func() store.Store { return kv.NewKVStore() })
+	})
+
+	b.Run("CompactStore", func(b *testing.B) {
+		benchmarkStore(b, data, config, func() store.Store { return compact.NewCompactStore() })
+	})
+}
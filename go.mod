@@ -4,6 +4,7 @@ go 1.13
 
 require (
 	github.com/google/uuid v1.2.0
+	github.com/mattn/go-sqlite3 v1.14.6
 	gonum.org/v1/gonum v0.9.1
 	gonum.org/v1/hdf5 v0.0.0-20200504100616-496fefe91614
 )
@@ -0,0 +1,200 @@
+package lsh
+
+import (
+	"errors"
+	"github.com/gasparian/lsh-search-go/store"
+	"sort"
+	"sync"
+)
+
+var (
+	unknownMetricErr       = errors.New("Unknown metric kind")
+	collectionExistsErr    = errors.New("Collection already exists")
+	collectionNotFoundErr  = errors.New("Collection not found")
+	namespacesRequiredErr  = errors.New("Store must implement store.Namespacer to keep collections")
+	collectionsDumpFormErr = errors.New("Collections dump has wrong format")
+)
+
+// MetricKind defines the built-in distance metric, so it can be saved along with the collection config
+type MetricKind int
+
+const (
+	L2Metric MetricKind = iota
+	AngularMetric
+)
+
+// NewMetric creates the built-in metric by its kind
+func NewMetric(kind MetricKind) (Metric, error) {
+	switch kind {
+	case L2Metric:
+		return NewL2(), nil
+	case AngularMetric:
+		return NewAngular(), nil
+	}
+	return nil, unknownMetricErr
+}
+
+// CollectionConfig holds the index config and metric of the single collection
+type CollectionConfig struct {
+	Config
+	Metric MetricKind
+}
+
+type collection struct {
+	config CollectionConfig
+	index  *LSHIndex
+}
+
+// Collections manages independently configured indexes (different dims, metrics and hashers),
+// which share one backend: every index is kept in its own namespace of the store,
+// so indexes don't collide and Train of one of them doesn't affect the others.
+// Configs and hashers of the collections are saved with Dump and restored with Load
+type Collections struct {
+	mx          sync.RWMutex
+	namespacer  store.Namespacer
+	collections map[string]*collection
+}
+
+// NewCollections creates empty collections manager on top of the store, which must implement store.Namespacer
+func NewCollections(backend store.Store) (*Collections, error) {
+	namespacer, ok := backend.(store.Namespacer)
+	if !ok {
+		return nil, namespacesRequiredErr
+	}
+	return &Collections{
+		namespacer:  namespacer,
+		collections: make(map[string]*collection),
+	}, nil
+}
+
+// open creates the index of the collection on top of its namespace
+func (c *Collections) open(name string, config CollectionConfig) (*LSHIndex, error) {
+	metric, err := NewMetric(config.Metric)
+	if err != nil {
+		return nil, err
+	}
+	ns, err := c.namespacer.Namespace(name)
+	if err != nil {
+		return nil, err
+	}
+	return NewLsh(config.Config, ns, metric)
+}
+
+// Create creates the new empty collection; the name must be accepted by store.ValidateNamespace
+func (c *Collections) Create(name string, config CollectionConfig) (*LSHIndex, error) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if _, ok := c.collections[name]; ok {
+		return nil, collectionExistsErr
+	}
+	index, err := c.open(name, config)
+	if err != nil {
+		return nil, err
+	}
+	c.collections[name] = &collection{config: config, index: index}
+	return index, nil
+}
+
+// Open returns the index of the existing collection
+func (c *Collections) Open(name string) (*LSHIndex, error) {
+	c.mx.RLock()
+	defer c.mx.RUnlock()
+	coll, ok := c.collections[name]
+	if !ok {
+		return nil, collectionNotFoundErr
+	}
+	return coll.index, nil
+}
+
+// List returns sorted names of the collections
+func (c *Collections) List() []string {
+	c.mx.RLock()
+	defer c.mx.RUnlock()
+	names := make([]string, 0, len(c.collections))
+	for name := range c.collections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Config returns the config the collection has been created with
+func (c *Collections) Config(name string) (CollectionConfig, error) {
+	c.mx.RLock()
+	defer c.mx.RUnlock()
+	coll, ok := c.collections[name]
+	if !ok {
+		return CollectionConfig{}, collectionNotFoundErr
+	}
+	return coll.config, nil
+}
+
+// Drop removes the collection with all its data from the store.
+// NOTE: the dropped index must not be used anymore
+func (c *Collections) Drop(name string) error {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	coll, ok := c.collections[name]
+	if !ok {
+		return collectionNotFoundErr
+	}
+	// NOTE: the background drop of the replaced generation must not write into the dropped namespace
+	coll.index.WaitGC()
+	err := c.namespacer.DropNamespace(name)
+	if err != nil {
+		return err
+	}
+	delete(c.collections, name)
+	return nil
+}
+
+// collectionDump holds everything needed to reopen the collection
+type collectionDump struct {
+	Config CollectionConfig
+	Hasher []byte // NOTE: empty, if the index hasn't been trained yet
+}
+
+// Dump encodes configs and hashers of all the collections
+func (c *Collections) Dump() ([]byte, error) {
+	c.mx.RLock()
+	defer c.mx.RUnlock()
+	dump := make(map[string]collectionDump, len(c.collections))
+	for name, coll := range c.collections {
+		hasher, err := coll.index.DumpHasher()
+		if err != nil && err != hasherEmptyInstancesErr {
+			return nil, err
+		}
+		dump[name] = collectionDump{Config: coll.config, Hasher: hasher}
+	}
+	return gobEncode(dump)
+}
+
+// Load reopens the collections saved with Dump on top of the same store;
+// collections which already exist are replaced
+func (c *Collections) Load(inp []byte) error {
+	dump := make(map[string]collectionDump)
+	err := gobDecode(inp, &dump)
+	if err != nil {
+		return collectionsDumpFormErr
+	}
+	loaded := make(map[string]*collection, len(dump))
+	for name, collDump := range dump {
+		index, err := c.open(name, collDump.Config)
+		if err != nil {
+			return err
+		}
+		if len(collDump.Hasher) > 0 {
+			err = index.LoadHasher(collDump.Hasher)
+			if err != nil {
+				return err
+			}
+		}
+		loaded[name] = &collection{config: collDump.Config, index: index}
+	}
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	for name, coll := range loaded {
+		c.collections[name] = coll
+	}
+	return nil
+}
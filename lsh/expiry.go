@@ -0,0 +1,258 @@
+package lsh
+
+import (
+	"errors"
+	"github.com/gasparian/lsh-search-go/store"
+	"sync"
+	"time"
+)
+
+// NOTE: table of the expiry buckets, coded by the expiry time in milliseconds; the bit is combined
+// with the generation's table bit, so expiry times are dropped along with their generation
+const expiryTableBit = 1 << 28
+
+var (
+	expiresLengthErr = errors.New("Expiry times must be set for every vector or not set at all")
+	notTrainedErr    = errors.New("Index must be trained before inserting vectors")
+	vectorExistsErr  = errors.New("Vector with this id is already in the index")
+	idsLengthErr     = errors.New("Ids must be set for every vector")
+)
+
+// WriteOptions holds optional data of the written vectors; slices must be nil or have the same length as vectors
+type WriteOptions struct {
+	Payloads  []Payload   // NOTE: nil payloads of the single vectors are allowed
+	ExpiresAt []time.Time // NOTE: zero time means the vector never expires
+}
+
+// expiryMillis converts the expiry time to the stored format, zero time is converted to zero
+func expiryMillis(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// expiryKey returns the bucket, which holds ids of the vectors of the generation expiring at the given time
+func expiryKey(generation uint32, at int64) store.BucketKey {
+	return store.BucketKey{Table: tableKey(generation, 0) | expiryTableBit, Code: uint64(at)}
+}
+
+// expiries holds expiry times of the expiring vectors of the single generation
+type expiries struct {
+	mx sync.RWMutex
+	at map[string]int64
+}
+
+func newExpiries() *expiries {
+	return &expiries{at: make(map[string]int64)}
+}
+
+// loadExpiries reads expiry times of the generation from the store
+func loadExpiries(index store.Store, generation uint32) (*expiries, error) {
+	e := newExpiries()
+	buckets, err := index.ListTableBuckets(expiryKey(generation, 0).Table)
+	if err != nil {
+		return nil, err
+	}
+	for _, bucket := range buckets {
+		iter, err := index.GetHashIterator(bucket)
+		if errors.Is(err, store.BucketNotFoundErr) {
+			continue // NOTE: bucket could be removed after listing
+		}
+		if err != nil {
+			return nil, err
+		}
+		for {
+			page := iter.NextN(1024)
+			if len(page) == 0 {
+				break
+			}
+			for _, id := range page {
+				e.at[id] = int64(bucket.Code)
+			}
+		}
+		err = iter.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+// set keeps expiry times of the vectors, zero times are skipped
+func (e *expiries) set(ids []string, at []int64) {
+	if at == nil {
+		return
+	}
+	e.mx.Lock()
+	defer e.mx.Unlock()
+	for i, id := range ids {
+		if at[i] > 0 {
+			e.at[id] = at[i]
+		}
+	}
+}
+
+func (e *expiries) get(id string) (int64, bool) {
+	e.mx.RLock()
+	defer e.mx.RUnlock()
+	at, ok := e.at[id]
+	return at, ok
+}
+
+func (e *expiries) remove(ids []string) {
+	e.mx.Lock()
+	defer e.mx.Unlock()
+	for _, id := range ids {
+		delete(e.at, id)
+	}
+}
+
+func (e *expiries) len() int {
+	e.mx.RLock()
+	defer e.mx.RUnlock()
+	return len(e.at)
+}
+
+func (e *expiries) copy() map[string]int64 {
+	e.mx.RLock()
+	defer e.mx.RUnlock()
+	at := make(map[string]int64, len(e.at))
+	for id, t := range e.at {
+		at[id] = t
+	}
+	return at
+}
+
+// due returns ids of the vectors expired by now
+func (e *expiries) due(now int64) []string {
+	e.mx.RLock()
+	defer e.mx.RUnlock()
+	ids := make([]string, 0)
+	for id, at := range e.at {
+		if at <= now {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// filter returns the ids, which aren't expired by now; the slice is returned as is if nothing expires
+func (e *expiries) filter(ids []string, now int64) []string {
+	e.mx.RLock()
+	defer e.mx.RUnlock()
+	if len(e.at) == 0 {
+		return ids
+	}
+	alive := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if at, ok := e.at[id]; !ok || at > now {
+			alive = append(alive, id)
+		}
+	}
+	return alive
+}
+
+// encodeOptions validates the write options and converts them to the stored format
+func (lsh *LSHIndex) encodeOptions(n int, options WriteOptions) ([][]byte, []int64, error) {
+	var encoded [][]byte
+	if options.Payloads != nil {
+		if len(options.Payloads) != n {
+			return nil, nil, payloadsLengthErr
+		}
+		if _, ok := lsh.index.(store.PayloadStore); !ok {
+			return nil, nil, payloadsUnsupportedErr
+		}
+		var err error
+		encoded, err = encodePayloads(options.Payloads)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	var expires []int64
+	if options.ExpiresAt != nil {
+		if len(options.ExpiresAt) != n {
+			return nil, nil, expiresLengthErr
+		}
+		expires = make([]int64, n)
+		for i, t := range options.ExpiresAt {
+			expires[i] = expiryMillis(t)
+		}
+	}
+	return encoded, expires, nil
+}
+
+// Insert adds vectors to the current index without retraining, e.g. to serve a rolling time window
+// along with the expiry times: vectors are hashed by the current trees, so the search quality degrades
+// if the data drifts away from what the index has been trained on.
+// Ids must be unique and must not be in the index already, including the deleted, but not yet purged ones.
+// Unlike Train, Insert isn't atomic and doesn't roll back: if the *TrainError is returned, vectors which ids
+// aren't listed in its FailedIDs are written and stay searchable, while the failed ones could be partially
+// written (e.g. stored, but not hashed into every tree), so the stored ones must be deleted before the retry.
+// NOTE: inserts are serialized with Train and purges
+func (lsh *LSHIndex) Insert(vecs [][]float64, ids []string, options WriteOptions) error {
+	if len(ids) != len(vecs) {
+		return idsLengthErr
+	}
+	err := checkIds(ids)
+	if err != nil {
+		return err
+	}
+	encoded, expires, err := lsh.encodeOptions(len(vecs), options)
+	if err != nil {
+		return err
+	}
+	lsh.trainMx.Lock()
+	defer lsh.trainMx.Unlock()
+	lsh.mx.RLock()
+	hasher, expiring := lsh.hasher, lsh.expiring
+	lsh.mx.RUnlock()
+	if !hasher.trained() {
+		return notTrainedErr
+	}
+	seen := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		if seen[id] {
+			return vectorExistsErr
+		}
+		seen[id] = true
+	}
+	// NOTE: multi-get fails if any vector is absent, so it can't tell the stored ids from the new ones
+	for _, key := range vectorKeys(hasher.generation, ids) {
+		_, err := lsh.index.GetVector(key)
+		if err == nil {
+			return vectorExistsErr
+		}
+		if !errors.Is(err, store.KeyNotFoundErr) {
+			return err
+		}
+	}
+	// NOTE: expiry times are known before the vectors become searchable, so the expired ones never show up
+	expiring.set(ids, expires)
+	err = lsh.write(hasher, vecs, ids, encoded, expires)
+	if trainErr, ok := err.(*TrainError); ok {
+		expiring.remove(trainErr.FailedIDs)
+	}
+	return err
+}
+
+// expire tombstones the vectors of the current generation expired by now, so they are purged
+// along with the deleted ones, and returns their number
+func (lsh *LSHIndex) expire(now time.Time) (int, error) {
+	hasher, deleted, expiring, searches := lsh.pin()
+	defer searches.Done()
+	ids := deleted.filter(expiring.due(expiryMillis(now)))
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	keys := make([]store.BucketKey, len(ids))
+	for i := range keys {
+		keys[i] = tombstoneKey(hasher.generation)
+	}
+	err := lsh.index.SetHashes(keys, ids)
+	if err != nil {
+		return 0, err
+	}
+	deleted.add(ids)
+	return len(ids), nil
+}
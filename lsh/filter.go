@@ -0,0 +1,338 @@
+package lsh
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gasparian/lsh-search-go/store"
+	"hash/fnv"
+)
+
+// NOTE: tables of the payload fields inverted index; the bit is combined with the generation's table bit,
+// so the inverted index is dropped along with its generation
+const payloadTableBit = 1 << 30
+
+// Filter is the predicate over the vector payload, which is evaluated during the search.
+// Vectors without payload are matched against the nil payload
+type Filter interface {
+	Match(payload Payload) bool
+}
+
+// normalize converts the value to the type it gets after the payload JSON round trip,
+// so the filter values compare equal to the stored ones (e.g. ints become float64)
+func normalize(value interface{}) interface{} {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return value
+	}
+	var normalized interface{}
+	err = json.Unmarshal(data, &normalized)
+	if err != nil {
+		return value
+	}
+	return normalized
+}
+
+// isScalar returns true for the normalized values, which are compared and indexed
+func isScalar(value interface{}) bool {
+	switch value.(type) {
+	case string, float64, bool:
+		return true
+	}
+	return false
+}
+
+// compare returns the sign of a - b for the numbers or strings; ok is false for the other types
+func compare(a, b interface{}) (int, bool) {
+	switch a := a.(type) {
+	case float64:
+		b, ok := b.(float64)
+		if !ok {
+			return 0, false
+		}
+		if a < b {
+			return -1, true
+		}
+		if a > b {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		b, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		if a < b {
+			return -1, true
+		}
+		if a > b {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+type eqFilter struct {
+	field string
+	value interface{}
+}
+
+// Eq matches payloads, which field is equal to the value; only strings, numbers and bools are compared
+func Eq(field string, value interface{}) Filter {
+	return &eqFilter{field: field, value: normalize(value)}
+}
+
+func (f *eqFilter) Match(payload Payload) bool {
+	value, ok := payload[f.field]
+	return ok && isScalar(value) && value == f.value
+}
+
+type inFilter struct {
+	field  string
+	values []interface{}
+}
+
+// In matches payloads, which field is equal to any of the values
+func In(field string, values ...interface{}) Filter {
+	f := &inFilter{field: field, values: make([]interface{}, len(values))}
+	for i, value := range values {
+		f.values[i] = normalize(value)
+	}
+	return f
+}
+
+func (f *inFilter) Match(payload Payload) bool {
+	value, ok := payload[f.field]
+	if !ok || !isScalar(value) {
+		return false
+	}
+	for _, v := range f.values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+type rangeFilter struct {
+	field            string
+	min, max         interface{} // NOTE: nil means unbounded
+	minIncl, maxIncl bool
+}
+
+func (f *rangeFilter) Match(payload Payload) bool {
+	value, ok := payload[f.field]
+	if !ok {
+		return false
+	}
+	if f.min != nil {
+		c, ok := compare(value, f.min)
+		if !ok || c < 0 || (c == 0 && !f.minIncl) {
+			return false
+		}
+	}
+	if f.max != nil {
+		c, ok := compare(value, f.max)
+		if !ok || c > 0 || (c == 0 && !f.maxIncl) {
+			return false
+		}
+	}
+	return true
+}
+
+// Gt matches payloads, which field is greater than the value; numbers and strings can be compared
+func Gt(field string, value interface{}) Filter {
+	return &rangeFilter{field: field, min: normalize(value)}
+}
+
+func Gte(field string, value interface{}) Filter {
+	return &rangeFilter{field: field, min: normalize(value), minIncl: true}
+}
+
+func Lt(field string, value interface{}) Filter {
+	return &rangeFilter{field: field, max: normalize(value)}
+}
+
+func Lte(field string, value interface{}) Filter {
+	return &rangeFilter{field: field, max: normalize(value), maxIncl: true}
+}
+
+// Between matches payloads, which field is within the range, including both ends
+func Between(field string, min, max interface{}) Filter {
+	return &rangeFilter{field: field, min: normalize(min), max: normalize(max), minIncl: true, maxIncl: true}
+}
+
+type andFilter []Filter
+
+// And matches payloads matched by all the filters
+func And(filters ...Filter) Filter {
+	return andFilter(filters)
+}
+
+func (f andFilter) Match(payload Payload) bool {
+	for _, filter := range f {
+		if !filter.Match(payload) {
+			return false
+		}
+	}
+	return true
+}
+
+type orFilter []Filter
+
+// Or matches payloads matched by any of the filters
+func Or(filters ...Filter) Filter {
+	return orFilter(filters)
+}
+
+func (f orFilter) Match(payload Payload) bool {
+	for _, filter := range f {
+		if filter.Match(payload) {
+			return true
+		}
+	}
+	return false
+}
+
+type notFilter struct {
+	filter Filter
+}
+
+// Not matches payloads not matched by the filter
+func Not(filter Filter) Filter {
+	return &notFilter{filter: filter}
+}
+
+func (f *notFilter) Match(payload Payload) bool {
+	return !f.filter.Match(payload)
+}
+
+// postingKey returns the inverted index bucket of the field value in the given generation
+func postingKey(generation uint32, field string, value interface{}) (store.BucketKey, bool) {
+	if !isScalar(value) {
+		return store.BucketKey{}, false
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return store.BucketKey{}, false
+	}
+	h := fnv.New64a()
+	h.Write([]byte(field))
+	h.Write([]byte{0})
+	h.Write(data)
+	return store.BucketKey{Table: tableKey(generation, 0) | payloadTableBit, Code: h.Sum64()}, true
+}
+
+// postingKeys returns inverted index buckets of the indexed payload fields
+func postingKeys(generation uint32, payload Payload, indexed []string) []store.BucketKey {
+	keys := make([]store.BucketKey, 0, len(indexed))
+	for _, field := range indexed {
+		value, ok := payload[field]
+		if !ok {
+			continue
+		}
+		if key, ok := postingKey(generation, field, value); ok {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// postings returns ids of the vectors, which could match the filter, read from the inverted index;
+// ok is false when the filter can't be answered by the index.
+// NOTE: buckets could be shared by different values on hash collisions, so the filter must be still checked
+func (lsh *LSHIndex) postings(f Filter, generation uint32, indexed map[string]bool) (map[string]struct{}, bool, error) {
+	switch f := f.(type) {
+	case *eqFilter:
+		return lsh.readPostings(generation, f.field, []interface{}{f.value}, indexed)
+	case *inFilter:
+		return lsh.readPostings(generation, f.field, f.values, indexed)
+	case andFilter:
+		var ids map[string]struct{}
+		for _, filter := range f {
+			found, ok, err := lsh.postings(filter, generation, indexed)
+			if err != nil {
+				return nil, false, err
+			}
+			if !ok {
+				continue
+			}
+			if ids == nil {
+				ids = found
+				continue
+			}
+			for id := range ids {
+				if _, ok := found[id]; !ok {
+					delete(ids, id)
+				}
+			}
+		}
+		return ids, ids != nil, nil
+	case orFilter:
+		ids := make(map[string]struct{})
+		for _, filter := range f {
+			found, ok, err := lsh.postings(filter, generation, indexed)
+			if err != nil || !ok {
+				return nil, false, err
+			}
+			for id := range found {
+				ids[id] = struct{}{}
+			}
+		}
+		return ids, true, nil
+	}
+	return nil, false, nil
+}
+
+func (lsh *LSHIndex) readPostings(generation uint32, field string, values []interface{}, indexed map[string]bool) (map[string]struct{}, bool, error) {
+	if !indexed[field] {
+		return nil, false, nil
+	}
+	ids := make(map[string]struct{})
+	for _, value := range values {
+		key, ok := postingKey(generation, field, value)
+		if !ok {
+			continue // NOTE: non-scalar values never match
+		}
+		iter, err := lsh.index.GetHashIterator(key)
+		if errors.Is(err, store.BucketNotFoundErr) {
+			continue // NOTE: no vectors with this value
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		for {
+			page := iter.NextN(1024)
+			if len(page) == 0 {
+				break
+			}
+			for _, id := range page {
+				ids[id] = struct{}{}
+			}
+		}
+		err = iter.Close()
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	return ids, true, nil
+}
+
+// filterBlock returns the candidates, which payloads match the filter
+func (lsh *LSHIndex) filterBlock(filter Filter, generation uint32, ids []string) ([]string, error) {
+	payloads, err := lsh.index.(store.PayloadStore).GetPayloads(vectorKeys(generation, ids))
+	if err != nil {
+		return nil, err
+	}
+	matched := make([]string, 0, len(ids))
+	for i, id := range ids {
+		payload, err := decodePayload(payloads[i], nil)
+		if err != nil {
+			return nil, err
+		}
+		if filter.Match(payload) {
+			matched = append(matched, id)
+		}
+	}
+	return matched, nil
+}
@@ -0,0 +1,196 @@
+package lsh
+
+import (
+	"errors"
+	"github.com/gasparian/lsh-search-go/store"
+	"strings"
+	"sync"
+)
+
+// Every Train builds the index of the next generation next to the current one,
+// so the current index stays searchable until the new one is completely written.
+// Then the new generation is swapped in, and the replaced one is dropped in background
+// once the searches and snapshot scans, which have started before the swap, are finished.
+// Even and odd generations use different store layouts:
+//   - even generations keep vectors under their own ids and buckets in tables numbered by the tree index,
+//     which is the layout of the indexes built by older versions;
+//   - odd generations prefix vectors ids with oddVectorPrefix and set the oddTableBit in tables numbers.
+//
+// Buckets always hold the original vectors ids.
+// NOTE: since every vector key without the prefix belongs to the even generations, the store must be used
+// by the single index only (see store.Namespacer to keep several indexes in one backend),
+// and ids starting with oddVectorPrefix are rejected by Train and Insert.
+// The prefix is printable, since some stores keep ids in text columns, which don't accept NUL bytes
+const (
+	oddVectorPrefix = "~odd:"
+	oddTableBit     = 1 << 31
+)
+
+var (
+	reservedIdErr = errors.New("Vector id must not start with the reserved prefix")
+)
+
+// checkIds rejects ids, which would be taken for the vectors of the odd generations
+func checkIds(ids []string) error {
+	for _, id := range ids {
+		if strings.HasPrefix(id, oddVectorPrefix) {
+			return reservedIdErr
+		}
+	}
+	return nil
+}
+
+func isOdd(generation uint32) bool {
+	return generation%2 == 1
+}
+
+// tableKey returns the table number of the tree in the given generation
+func tableKey(generation uint32, perm int) uint32 {
+	if isOdd(generation) {
+		return uint32(perm) | oddTableBit
+	}
+	return uint32(perm)
+}
+
+// vectorKey returns the id, under which the vector is stored in the given generation
+func vectorKey(generation uint32, id string) string {
+	if isOdd(generation) {
+		return oddVectorPrefix + id
+	}
+	return id
+}
+
+// vectorID returns the original id of the vector stored under the key in the given generation
+func vectorID(generation uint32, key string) string {
+	if isOdd(generation) {
+		return strings.TrimPrefix(key, oddVectorPrefix)
+	}
+	return key
+}
+
+func vectorKeys(generation uint32, ids []string) []string {
+	if !isOdd(generation) {
+		return ids
+	}
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = vectorKey(generation, id)
+	}
+	return keys
+}
+
+// ownsVector returns true if the stored vector key belongs to the layout of the given generation
+func ownsVector(generation uint32, key string) bool {
+	return isOdd(generation) == strings.HasPrefix(key, oddVectorPrefix)
+}
+
+// dropGeneration removes all vectors, norms and buckets stored under the layout of the given generation;
+// tables are dropped at once if the store implements the store.TableDropper, otherwise entry by entry
+func dropGeneration(index store.Store, generation uint32) error {
+	buckets, err := index.ListBuckets()
+	if err != nil {
+		return err
+	}
+	dropper, canDrop := index.(store.TableDropper)
+	dropped := make(map[uint32]bool)
+	for _, bucket := range buckets {
+		if isOdd(generation) != (bucket.Table&oddTableBit != 0) {
+			continue
+		}
+		if canDrop {
+			if !dropped[bucket.Table] {
+				err = dropper.DropTable(bucket.Table)
+				if err != nil {
+					return err
+				}
+				dropped[bucket.Table] = true
+			}
+			continue
+		}
+		iter, err := index.GetHashIterator(bucket)
+		if err != nil {
+			continue // NOTE: bucket could be removed after listing
+		}
+		ids := make([]string, 0)
+		for {
+			page := iter.NextN(1024)
+			if len(page) == 0 {
+				break
+			}
+			ids = append(ids, page...)
+		}
+		err = iter.Close()
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			err = index.RemoveHash(bucket, id)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	// NOTE: keys are collected first, since not every store allows to write while iterating
+	iter, err := index.GetVectorIterator()
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0)
+	for {
+		key, _, ok := iter.Next()
+		if !ok {
+			break
+		}
+		if ownsVector(generation, key) {
+			keys = append(keys, key)
+		}
+	}
+	err = iter.Close()
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		err = index.DeleteVector(key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// collector drops the replaced generation in background, after the searches and scans pinning it have finished
+type collector struct {
+	mx   sync.Mutex
+	done chan struct{}
+	err  error
+}
+
+func (c *collector) start(index store.Store, generation uint32, searches, scans *sync.WaitGroup) {
+	done := make(chan struct{})
+	c.mx.Lock()
+	c.done = done
+	c.err = nil
+	c.mx.Unlock()
+	go func() {
+		searches.Wait()
+		scans.Wait()
+		err := dropGeneration(index, generation)
+		c.mx.Lock()
+		c.err = err
+		c.mx.Unlock()
+		close(done)
+	}()
+}
+
+// wait blocks until the last started collection is finished and returns its error
+func (c *collector) wait() error {
+	c.mx.Lock()
+	done := c.done
+	c.mx.Unlock()
+	if done != nil {
+		<-done
+	}
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return c.err
+}
@@ -1,8 +1,6 @@
 package lsh
 
 import (
-	"bytes"
-	"encoding/gob"
 	"errors"
 	"gonum.org/v1/gonum/blas/blas64"
 	"math"
@@ -57,17 +55,22 @@ func (node *treeNode) getHash(vec blas64.Vector) uint64 {
 }
 
 type HasherConfig struct {
-	NTrees          int
-	KMinVecs        int
-	Dims            int
-	isAngularMetric bool
+	NTrees              int
+	KMinVecs            int
+	Dims                int
+	Transformers        []TransformerConfig // NOTE: preprocessing applied before hashing
+	TransformSampleSize int                 // NOTE: number of vectors to fit transformers on, all vectors are used when <= 0
+	isAngularMetric     bool
 }
 
 // Hasher holds N_PERMUTS number of trees
 type Hasher struct {
-	mutex  sync.RWMutex
-	Config HasherConfig
-	trees  []*treeNode
+	mutex    sync.RWMutex
+	Config   HasherConfig
+	trees    []*treeNode
+	pipeline *Pipeline
+	// generation defines the store layout of the index built with the hasher, see generation.go
+	generation uint32
 }
 
 func NewHasher(config HasherConfig) *Hasher {
@@ -168,11 +171,27 @@ func buildTree(vecs [][]float64, config HasherConfig) *treeNode {
 	return tree
 }
 
-// build method creates the hasher instances
-func (hasher *Hasher) build(vecs [][]float64) {
+// build method fits preprocessing pipeline and creates the hasher instances
+// in the transformed space
+func (hasher *Hasher) build(vecs [][]float64) error {
 	hasher.mutex.Lock()
 	defer hasher.mutex.Unlock()
 
+	pipeline, err := NewPipeline(hasher.Config.Transformers)
+	if err != nil {
+		return err
+	}
+	if !pipeline.Empty() {
+		err = pipeline.Fit(sampleVecs(vecs, hasher.Config.TransformSampleSize))
+		if err != nil {
+			return err
+		}
+		transformed := make([][]float64, len(vecs))
+		for i, vec := range vecs {
+			transformed[i] = pipeline.Transform(vec)
+		}
+		vecs = transformed
+	}
 	trees := make([]*treeNode, hasher.Config.NTrees)
 	wg := sync.WaitGroup{}
 	wg.Add(len(trees))
@@ -185,6 +204,8 @@ func (hasher *Hasher) build(vecs [][]float64) {
 	}
 	wg.Wait()
 	hasher.trees = trees
+	hasher.pipeline = pipeline
+	return nil
 }
 
 // getHashes returns map of calculated lsh values for a given vector
@@ -192,6 +213,9 @@ func (hasher *Hasher) getHashes(inpVec []float64) map[int]uint64 {
 	hasher.mutex.RLock()
 	defer hasher.mutex.RUnlock()
 
+	if !hasher.pipeline.Empty() {
+		inpVec = hasher.pipeline.Transform(inpVec)
+	}
 	vec := NewVec(make([]float64, len(inpVec)))
 	copy(vec.Data, inpVec)
 	// NOTE: norm vector when using angular matric (since normed vectors has been used for planes generation in this case)
@@ -218,21 +242,83 @@ func (hasher *Hasher) getHashes(inpVec []float64) map[int]uint64 {
 	return hashes.v
 }
 
-// dump encodes Hasher object as a byte-array
-func (hasher *Hasher) dump() ([]byte, error) {
+// treeNodeDump mirrors treeNode with exported fields, so it could be serialized
+type treeNodeDump struct {
+	Left     *treeNodeDump
+	Right    *treeNodeDump
+	HasPlane bool
+	N        []float64
+	D        float64
+}
+
+func dumpTree(node *treeNode) *treeNodeDump {
+	if node == nil {
+		return nil
+	}
+	dump := &treeNodeDump{
+		Left:  dumpTree(node.left),
+		Right: dumpTree(node.right),
+	}
+	if node.plane != nil {
+		dump.HasPlane = true
+		dump.N = node.plane.n.Data
+		dump.D = node.plane.d
+	}
+	return dump
+}
+
+func loadTree(dump *treeNodeDump) *treeNode {
+	if dump == nil {
+		return nil
+	}
+	node := &treeNode{
+		left:  loadTree(dump.Left),
+		right: loadTree(dump.Right),
+	}
+	if dump.HasPlane {
+		node.plane = &plane{
+			n: NewVec(dump.N),
+			d: dump.D,
+		}
+	}
+	return node
+}
+
+// hasherDump holds everything needed to restore the Hasher
+type hasherDump struct {
+	Config     HasherConfig
+	IsAngular  bool
+	Trees      []*treeNodeDump
+	Pipeline   *Pipeline
+	Generation uint32 // NOTE: zero in dumps made by older versions, which is the legacy layout
+}
+
+// trained returns true if the trees have been built or loaded
+func (hasher *Hasher) trained() bool {
 	hasher.mutex.RLock()
 	defer hasher.mutex.RUnlock()
+	// NOTE: trees aren't built until the training
+	return len(hasher.trees) > 0 && hasher.trees[0] != nil
+}
 
-	if len(hasher.trees) == 0 {
+// dump encodes Hasher object as a byte-array
+func (hasher *Hasher) dump() ([]byte, error) {
+	if !hasher.trained() {
 		return nil, hasherEmptyInstancesErr
 	}
-	buf := &bytes.Buffer{}
-	enc := gob.NewEncoder(buf)
-	err := enc.Encode(hasher)
-	if err != nil {
-		return nil, err
+	hasher.mutex.RLock()
+	defer hasher.mutex.RUnlock()
+	dump := hasherDump{
+		Config:     hasher.Config,
+		IsAngular:  hasher.Config.isAngularMetric,
+		Trees:      make([]*treeNodeDump, len(hasher.trees)),
+		Pipeline:   hasher.pipeline,
+		Generation: hasher.generation,
 	}
-	return buf.Bytes(), nil
+	for i, tree := range hasher.trees {
+		dump.Trees[i] = dumpTree(tree)
+	}
+	return gobEncode(dump)
 }
 
 // load loads Hasher struct from the byte-array file
@@ -240,12 +326,27 @@ func (hasher *Hasher) load(inp []byte) error {
 	hasher.mutex.Lock()
 	defer hasher.mutex.Unlock()
 
-	buf := &bytes.Buffer{}
-	buf.Write(inp)
-	dec := gob.NewDecoder(buf)
-	err := dec.Decode(&hasher)
+	dump := hasherDump{}
+	err := gobDecode(inp, &dump)
 	if err != nil {
 		return err
 	}
+	hasher.Config = dump.Config
+	hasher.Config.isAngularMetric = dump.IsAngular
+	hasher.trees = make([]*treeNode, len(dump.Trees))
+	for i, tree := range dump.Trees {
+		hasher.trees[i] = loadTree(tree)
+	}
+	hasher.pipeline = dump.Pipeline
+	hasher.generation = dump.Generation
 	return nil
 }
+
+// next creates an empty hasher of the following generation with the same config
+func (hasher *Hasher) next() *Hasher {
+	hasher.mutex.RLock()
+	defer hasher.mutex.RUnlock()
+	next := NewHasher(hasher.Config)
+	next.generation = hasher.generation + 1
+	return next
+}
@@ -2,16 +2,16 @@ package lsh
 
 import (
 	"errors"
-	"fmt"
+	"gonum.org/v1/gonum/blas"
 	"gonum.org/v1/gonum/blas/blas64"
-	"gonum.org/v1/gonum/mat"
 	"math"
-	"math/rand"
 	"sync"
 )
 
 const (
 	tol = 1e-6
+	// NOTE: how often (in dimensions) the partial distance is compared with the bound
+	boundCheckStep = 16
 )
 
 var (
@@ -41,82 +41,6 @@ func ConvertToInt(ar []int32) []int {
 	return newar
 }
 
-// GetMeanStd returns mean and std based on incoming NxM matrix
-func GetMeanStdSampled(data [][]float64, sampleSize int) ([]float64, []float64, error) {
-	if len(data) == 0 {
-		return nil, nil, dataSliceEmptyErr
-	}
-	if sampleSize <= 0 {
-		return nil, nil, sampleSizeErr
-	}
-	sample := make([]int, sampleSize)
-	if len(data) <= sampleSize {
-		sampleSize = len(data)
-		for i := 0; i < sampleSize; i++ {
-			sample[i] = i
-		}
-	} else {
-		for i := 0; i < sampleSize; i++ {
-			sample[i] = rand.Intn(len(data))
-		}
-	}
-	sampleSizeF := float64(sampleSize)
-	vecLen := len(data[0])
-	mean := mat.NewVecDense(vecLen, nil)
-	for _, idx := range sample {
-		mean.AddVec(mean, mat.NewVecDense(vecLen, data[idx]))
-	}
-	mean.ScaleVec(1/sampleSizeF, mean)
-	std := make([]float64, len(data[0]))
-	for _, idx := range sample {
-		for j, val := range data[idx] {
-			shifted := val - mean.AtVec(j)
-			std[j] += math.Sqrt(shifted * shifted)
-		}
-	}
-	stdVec := mat.NewVecDense(vecLen, std)
-	stdVec.ScaleVec(1/sampleSizeF, stdVec)
-	return mean.RawVector().Data, stdVec.RawVector().Data, nil
-}
-
-// GetMeanStdSampledRecords duplucate of GetMeanStdSample but for the Record data type, must be refactored later
-func GetMeanStdSampledRecords(vecs [][]float64, sampleSize int) ([]float64, []float64, error) {
-	if len(vecs) == 0 {
-		return nil, nil, dataSliceEmptyErr
-	}
-	if sampleSize <= 0 {
-		return nil, nil, sampleSizeErr
-	}
-	sample := make([]int, sampleSize)
-	if len(vecs) <= sampleSize {
-		sampleSize = len(vecs)
-		for i := 0; i < sampleSize; i++ {
-			sample[i] = i
-		}
-	} else {
-		for i := 0; i < sampleSize; i++ {
-			sample[i] = rand.Intn(len(vecs))
-		}
-	}
-	sampleSizeF := float64(sampleSize)
-	vecLen := len(vecs[0])
-	mean := mat.NewVecDense(vecLen, nil)
-	for _, idx := range sample {
-		mean.AddVec(mean, mat.NewVecDense(vecLen, vecs[idx]))
-	}
-	mean.ScaleVec(1/sampleSizeF, mean)
-	std := make([]float64, len(vecs[0]))
-	for _, idx := range sample {
-		for j, val := range vecs[idx] {
-			shifted := val - mean.AtVec(j)
-			std[j] += math.Sqrt(shifted * shifted)
-		}
-	}
-	stdVec := mat.NewVecDense(vecLen, std)
-	stdVec.ScaleVec(1/sampleSizeF, stdVec)
-	return mean.RawVector().Data, stdVec.RawVector().Data, nil
-}
-
 // NewVec creates new blas vector
 func NewVec(data []float64) blas64.Vector {
 	if data == nil {
@@ -148,46 +72,83 @@ func (l2 L2) IsAngular() bool {
 	return bool(l2)
 }
 
-// StandartScaler ...
-type StandartScaler struct {
-	sync.RWMutex
-	mean *mat.VecDense
-	std  *mat.VecDense
+// GetDistBounded calculates l2-distance, but stops as soon as the partial sum exceeds the bound;
+// returns false if the calculation has been abandoned
+func (l2 L2) GetDistBounded(l, r []float64, bound float64) (float64, bool) {
+	if bound < 0 {
+		return math.Inf(1), false
+	}
+	boundSq := bound * bound
+	var sum float64
+	for i := range l {
+		diff := l[i] - r[i]
+		sum += diff * diff
+		if (i+1)%boundCheckStep == 0 && sum > boundSq {
+			return math.Sqrt(sum), false
+		}
+	}
+	return math.Sqrt(sum), sum <= boundSq
+}
+
+// GetDistMany calculates l2-distances between the query and the block of candidates
+// using single matrix product
+func (l2 L2) GetDistMany(query []float64, candidates [][]float64) []float64 {
+	return l2.GetDistManyNormed(query, Norm(query), candidates, normsOf(candidates))
 }
 
-func checkConvertVec(inp []float64, fill float64, nDims int) blas64.Vector {
-	inpVecInternal := NewVec(make([]float64, nDims))
-	if inp != nil && len(inp) == nDims {
-		inpVecInternal.Data = inp
-		copy(inpVecInternal.Data, inp)
-		return inpVecInternal
+// GetDistNormed calculates l2-distance with a single dot product: ||l-r||^2 = ||l||^2 + ||r||^2 - 2*l*r
+func (l2 L2) GetDistNormed(l, r []float64, lNorm, rNorm float64) float64 {
+	return l2DistByProd(blas64.Dot(NewVec(l), NewVec(r)), lNorm, rNorm)
+}
+
+// GetDistManyNormed calculates l2-distances between the query and the block of candidates
+// using single matrix product and precomputed norms
+func (l2 L2) GetDistManyNormed(query []float64, qNorm float64, candidates [][]float64, norms []float64) []float64 {
+	dists := make([]float64, len(candidates))
+	if len(candidates) == 0 {
+		return dists
 	}
-	if fill > 0 {
-		for i := range inpVecInternal.Data {
-			inpVecInternal.Data[i] = fill
-		}
+	prods := dotMany(query, candidates)
+	for i := range candidates {
+		dists[i] = l2DistByProd(prods[i], qNorm, norms[i])
+	}
+	return dists
+}
+
+// l2DistByProd calculates l2-distance by the dot product and norms of both vectors
+func l2DistByProd(prod, lNorm, rNorm float64) float64 {
+	distSq := lNorm*lNorm + rNorm*rNorm - 2*prod
+	if distSq < tol*tol { // NOTE: could be negative due to the rounding errors
+		return 0.0
 	}
-	return inpVecInternal
+	return math.Sqrt(distSq)
+}
+
+// Norm returns l2 norm of the vector
+func Norm(vec []float64) float64 {
+	return blas64.Nrm2(NewVec(vec))
 }
 
-func NewStandartScaler(mean, std []float64, nDims int) *StandartScaler {
-	scaler := &StandartScaler{}
-	scaler.mean = mat.NewVecDense(len(mean), nil)
-	scaler.mean.SetRawVector(checkConvertVec(mean, 0.0, nDims))
-	scaler.std = mat.NewVecDense(len(mean), nil)
-	scaler.std.SetRawVector(checkConvertVec(std, 1.0, nDims))
-	return scaler
+func normsOf(vecs [][]float64) []float64 {
+	res := make([]float64, len(vecs))
+	for i, vec := range vecs {
+		res[i] = Norm(vec)
+	}
+	return res
 }
 
-func (s *StandartScaler) Scale(vec []float64) blas64.Vector {
-	s.RLock()
-	defer s.RUnlock()
-	cpy := make([]float64, len(vec))
-	copy(cpy, vec)
-	res := mat.NewVecDense(len(cpy), cpy)
-	res.AddScaledVec(res, -1.0, s.mean)
-	res.DivElemVec(res, s.std)
-	return res.RawVector()
+// dotMany calculates dot products between the query and each candidate using gemm
+func dotMany(query []float64, candidates [][]float64) []float64 {
+	nDims := len(query)
+	data := make([]float64, len(candidates)*nDims)
+	for i, c := range candidates {
+		copy(data[i*nDims:(i+1)*nDims], c)
+	}
+	a := blas64.General{Rows: len(candidates), Cols: nDims, Stride: nDims, Data: data}
+	b := blas64.General{Rows: nDims, Cols: 1, Stride: 1, Data: query}
+	prods := blas64.General{Rows: len(candidates), Cols: 1, Stride: 1, Data: make([]float64, len(candidates))}
+	blas64.Gemm(blas.NoTrans, blas.NoTrans, 1.0, a, b, 0.0, prods)
+	return prods.Data
 }
 
 // Angular calculates cosine distance between two given vectors
@@ -221,11 +182,50 @@ func (c Angular) GetDist(l, r []float64) float64 {
 	rBlas := NewVec(r)
 	lNorm := blas64.Nrm2(lBlas)
 	rNorm := blas64.Nrm2(rBlas)
+	return cosineDist(blas64.Dot(lBlas, rBlas), lNorm*rNorm)
+}
+
+func (c Angular) IsAngular() bool {
+	return bool(c)
+}
+
+// GetDistBounded calculates cosine distance and compares it with the bound;
+// dot product can't be bounded partially, so the distance is always calculated fully
+func (c Angular) GetDistBounded(l, r []float64, bound float64) (float64, bool) {
+	dist := c.GetDist(l, r)
+	return dist, dist <= bound
+}
+
+// GetDistMany calculates cosine distances between the query and the block of candidates
+// using single matrix product
+func (c Angular) GetDistMany(query []float64, candidates [][]float64) []float64 {
+	return c.GetDistManyNormed(query, Norm(query), candidates, normsOf(candidates))
+}
+
+// GetDistNormed calculates cosine distance with a single dot product
+func (c Angular) GetDistNormed(l, r []float64, lNorm, rNorm float64) float64 {
+	return cosineDist(blas64.Dot(NewVec(l), NewVec(r)), lNorm*rNorm)
+}
+
+// GetDistManyNormed calculates cosine distances between the query and the block of candidates
+// using single matrix product and precomputed norms
+func (c Angular) GetDistManyNormed(query []float64, qNorm float64, candidates [][]float64, norms []float64) []float64 {
+	dists := make([]float64, len(candidates))
+	if len(candidates) == 0 {
+		return dists
+	}
+	prods := dotMany(query, candidates)
+	for i := range candidates {
+		dists[i] = cosineDist(prods[i], qNorm*norms[i])
+	}
+	return dists
+}
+
+// cosineDist calculates cosine distance by the dot product and the product of norms
+func cosineDist(prod, lrNorm float64) float64 {
 	var dist float64 = 1.0
-	lrNorm := lNorm * rNorm
 	if lrNorm > tol {
-		cosine := blas64.Dot(lBlas, rBlas) / lrNorm
-		dist = 1.0 - cosine
+		dist = 1.0 - prod/lrNorm
 	}
 	if dist < tol {
 		return 0.0
@@ -233,10 +233,6 @@ func (c Angular) GetDist(l, r []float64) float64 {
 	return dist
 }
 
-func (c Angular) IsAngular() bool {
-	return bool(c)
-}
-
 func AngularToCosineDist(angular float64) float64 {
 	return (angular * angular) / 2
 }
@@ -274,7 +270,3 @@ func (s *StringSet) Remove(key string) {
 	defer s.mx.Unlock()
 	delete(s.Items, key)
 }
-
-func getBucketName(perm int, hash uint64) string {
-	return fmt.Sprintf("%v_%v", perm, hash)
-}
@@ -5,7 +5,14 @@ import (
 	"errors"
 	"github.com/gasparian/lsh-search-go/store"
 	"math"
+	"strconv"
 	"sync"
+	"time"
+)
+
+const (
+	// NOTE: number of candidates scored together by the NormedMetric and ExtendedMetric
+	scoreBlockSize = 64
 )
 
 var (
@@ -14,9 +21,10 @@ var (
 
 // Neighbor represent neighbor vector with distance to the query vector
 type Neighbor struct {
-	Vec  []float64
-	ID   string
-	Dist float64
+	Vec     []float64
+	ID      string
+	Dist    float64
+	Payload Payload // NOTE: filled only if asked with SearchOptions
 }
 
 type FloatMinHeap []Neighbor
@@ -44,12 +52,55 @@ func (h *FloatMinHeap) Pop() interface{} {
 	return tail
 }
 
+// FloatMaxHeap holds neighbors with the largest distance on top
+type FloatMaxHeap []Neighbor
+
+func (h FloatMaxHeap) Len() int {
+	return len(h)
+}
+
+func (h FloatMaxHeap) Less(i, j int) bool {
+	return h[i].Dist > h[j].Dist
+}
+
+func (h FloatMaxHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+func (h *FloatMaxHeap) Push(x interface{}) {
+	*h = append(*h, x.(Neighbor))
+}
+
+func (h *FloatMaxHeap) Pop() interface{} {
+	tailIndex := h.Len() - 1
+	tail := (*h)[tailIndex]
+	*h = (*h)[:tailIndex]
+	return tail
+}
+
 // Metric holds implementation of needed distance metric
 type Metric interface {
 	GetDist(l, r []float64) float64
 	IsAngular() bool
 }
 
+// ExtendedMetric is an optional Metric extension, which Search uses when it's available:
+// GetDistBounded abandons calculation when distance exceeds the bound (returns false then),
+// GetDistMany scores the whole block of candidates at once
+type ExtendedMetric interface {
+	Metric
+	GetDistBounded(l, r []float64, bound float64) (float64, bool)
+	GetDistMany(query []float64, candidates [][]float64) []float64
+}
+
+// NormedMetric is an optional Metric extension, which uses norms precomputed at insert time,
+// so the distance calculation becomes a single dot product
+type NormedMetric interface {
+	Metric
+	GetDistNormed(l, r []float64, lNorm, rNorm float64) float64
+	GetDistManyNormed(query []float64, qNorm float64, candidates [][]float64, norms []float64) []float64
+}
+
 // Indexer holds implementation of NN search index
 type Indexer interface {
 	Train(vecs [][]float64, ids []string) error
@@ -61,6 +112,10 @@ type IndexConfig struct {
 	mx            *sync.RWMutex
 	BatchSize     int
 	MaxCandidates int
+	// IndexedFields are the payload fields, which values are kept in the inverted index,
+	// so the filters on them are answered without scanning the buckets.
+	// NOTE: the fields must be the same as the index has been trained with
+	IndexedFields []string
 }
 
 func (c *IndexConfig) getBatchSize() int {
@@ -75,6 +130,12 @@ func (c *IndexConfig) getMaxCandidates() int {
 	return c.MaxCandidates
 }
 
+func (c *IndexConfig) getIndexedFields() []string {
+	c.mx.RLock()
+	defer c.mx.RUnlock()
+	return c.IndexedFields
+}
+
 // Config holds all needed constants for creating the Hasher instance
 type Config struct {
 	IndexConfig
@@ -83,6 +144,13 @@ type Config struct {
 
 // LSHIndex holds buckets with vectors and hasher instance
 type LSHIndex struct {
+	mx             sync.RWMutex // NOTE: guards the hasher, its tombstones, expiries and searches, which are replaced by Train
+	trainMx        sync.Mutex
+	searches       *sync.WaitGroup // NOTE: searches running on the current hasher
+	scans          *sync.WaitGroup // NOTE: snapshot scans of the current hasher, which aren't drained by purges
+	deleted        *tombstones     // NOTE: deleted vectors of the current generation, see Delete
+	expiring       *expiries       // NOTE: expiry times of the current generation's vectors, see WriteOptions
+	collector      collector
 	config         IndexConfig
 	index          store.Store
 	hasher         *Hasher
@@ -91,25 +159,174 @@ type LSHIndex struct {
 
 // New creates new instance of hasher and index, where generated hashes will be stored
 func NewLsh(config Config, store store.Store, metric Metric) (*LSHIndex, error) {
+	_, err := NewPipeline(config.HasherConfig.Transformers)
+	if err != nil {
+		return nil, err
+	}
 	config.HasherConfig.isAngularMetric = metric.IsAngular()
 	hasher := NewHasher(config.HasherConfig)
 	config.IndexConfig.mx = new(sync.RWMutex)
 	return &LSHIndex{
 		config:         config.IndexConfig,
 		hasher:         hasher,
+		searches:       new(sync.WaitGroup),
+		scans:          new(sync.WaitGroup),
+		deleted:        newTombstones(),
+		expiring:       newExpiries(),
 		index:          store,
 		distanceMetric: metric,
 	}, nil
 }
 
-// Train fills new search index with vectors
+// TrainError holds the store errors occured while writing the new index,
+// along with ids of the vectors, which batches haven't been written
+type TrainError struct {
+	FailedIDs []string
+	Errs      []error
+}
+
+func (e *TrainError) Error() string {
+	return strconv.Itoa(len(e.Errs)) + " batches of vectors haven't been written to the store, the first error: " + e.Errs[0].Error()
+}
+
+// Unwrap returns the first write error
+func (e *TrainError) Unwrap() error {
+	return e.Errs[0]
+}
+
+func (lsh *LSHIndex) getHasher() *Hasher {
+	lsh.mx.RLock()
+	defer lsh.mx.RUnlock()
+	return lsh.hasher
+}
+
+func (lsh *LSHIndex) getDeleted() *tombstones {
+	lsh.mx.RLock()
+	defer lsh.mx.RUnlock()
+	return lsh.deleted
+}
+
+func (lsh *LSHIndex) getExpiring() *expiries {
+	lsh.mx.RLock()
+	defer lsh.mx.RUnlock()
+	return lsh.expiring
+}
+
+// pin returns the current hasher with its tombstones and expiries and registers the search on it;
+// the search must call Done on the returned group after it has finished reading the store
+func (lsh *LSHIndex) pin() (*Hasher, *tombstones, *expiries, *sync.WaitGroup) {
+	lsh.mx.RLock()
+	defer lsh.mx.RUnlock()
+	lsh.searches.Add(1)
+	return lsh.hasher, lsh.deleted, lsh.expiring, lsh.searches
+}
+
+// pinScan pins the current hasher like pin does, but for the long scan, which purges don't wait for
+func (lsh *LSHIndex) pinScan() (*Hasher, *tombstones, *expiries, *sync.WaitGroup) {
+	lsh.mx.RLock()
+	defer lsh.mx.RUnlock()
+	lsh.scans.Add(1)
+	return lsh.hasher, lsh.deleted, lsh.expiring, lsh.scans
+}
+
+// swap replaces the current hasher, its tombstones and expiries and returns the replaced hasher
+// along with its searches and scans
+func (lsh *LSHIndex) swap(hasher *Hasher, deleted *tombstones, expiring *expiries) (*Hasher, *sync.WaitGroup, *sync.WaitGroup) {
+	lsh.mx.Lock()
+	defer lsh.mx.Unlock()
+	replaced, searches, scans := lsh.hasher, lsh.searches, lsh.scans
+	lsh.hasher, lsh.deleted, lsh.expiring = hasher, deleted, expiring
+	lsh.searches, lsh.scans = new(sync.WaitGroup), new(sync.WaitGroup)
+	return replaced, searches, scans
+}
+
+// Generation returns the number of the current index generation, which is incremented by every successful Train
+func (lsh *LSHIndex) Generation() uint32 {
+	return lsh.getHasher().generation
+}
+
+// WaitGC blocks until the generation replaced by the last Train is dropped from the store and returns the drop error
+func (lsh *LSHIndex) WaitGC() error {
+	return lsh.collector.wait()
+}
+
+// Train builds the new search index next to the current one and atomically swaps it in only if all the writes succeeded,
+// otherwise the *TrainError is returned and the current index stays intact.
+// Search can be called during the training: it uses the current index until the swap.
+// The replaced index is dropped in background (see WaitGC).
+// Wrap the store with the retry.RetryStore to retry transient errors.
+// NOTE: failing to drop the replaced index doesn't fail the training,
+// since its leftovers are removed by the next Train
 func (lsh *LSHIndex) Train(vecs [][]float64, ids []string) error {
-	err := lsh.index.Clear()
+	return lsh.TrainWithPayloads(vecs, ids, nil)
+}
+
+// TrainWithPayloads works like Train, but also stores payloads along with vectors,
+// so they can be returned by SearchWithOptions; payloads must be nil or have the same length as vectors,
+// nil payloads of the single vectors are allowed. The store must implement store.PayloadStore
+func (lsh *LSHIndex) TrainWithPayloads(vecs [][]float64, ids []string, payloads []Payload) error {
+	return lsh.TrainWithOptions(vecs, ids, WriteOptions{Payloads: payloads})
+}
+
+// TrainWithOptions works like Train, but also stores payloads and expiry times of the vectors:
+// expired vectors are excluded from the search results and purged by the Compactor
+func (lsh *LSHIndex) TrainWithOptions(vecs [][]float64, ids []string, options WriteOptions) error {
+	err := checkIds(ids)
+	if err != nil {
+		return err
+	}
+	encoded, expires, err := lsh.encodeOptions(len(vecs), options)
+	if err != nil {
+		return err
+	}
+	lsh.trainMx.Lock()
+	defer lsh.trainMx.Unlock()
+	// NOTE: the replaced generation occupies the same layout as the new one
+	lsh.collector.wait()
+	hasher := lsh.getHasher().next()
+	err = hasher.build(vecs)
+	if err != nil {
+		return err
+	}
+	expiring := newExpiries()
+	expiring.set(ids, expires)
+	return lsh.install(hasher, func() error {
+		return lsh.write(hasher, vecs, ids, encoded, expires)
+	}, expiring, nil)
+}
+
+// install writes the index of the hasher's generation with the write function, along with the tombstones
+// of the deleted vectors, and swaps it in; must be called under the trainMx, after the previous collection has finished
+func (lsh *LSHIndex) install(hasher *Hasher, write func() error, expiring *expiries, deleted []string) error {
+	// NOTE: leftovers of the previous failed training or drop
+	err := dropGeneration(lsh.index, hasher.generation)
+	if err != nil {
+		return err
+	}
+	err = write()
+	if err == nil && len(deleted) > 0 {
+		keys := make([]store.BucketKey, len(deleted))
+		for i := range keys {
+			keys[i] = tombstoneKey(hasher.generation)
+		}
+		err = lsh.index.SetHashes(keys, deleted)
+	}
 	if err != nil {
+		dropGeneration(lsh.index, hasher.generation) // NOTE: best effort, the next Train retries it anyway
 		return err
 	}
-	lsh.hasher.build(vecs)
+	tombstones := newTombstones()
+	tombstones.add(deleted)
+	replaced, searches, scans := lsh.swap(hasher, tombstones, expiring)
+	lsh.collector.start(lsh.index, replaced.generation, searches, scans)
+	return nil
+}
+
+// write stores vectors, norms, payloads, expiry times and hashes in batches concurrently and collects the failed batches
+func (lsh *LSHIndex) write(hasher *Hasher, vecs [][]float64, ids []string, payloads [][]byte, expires []int64) error {
 	batchSize := lsh.config.getBatchSize()
+	trainErr := &TrainError{}
+	errMx := sync.Mutex{}
 	wg := sync.WaitGroup{}
 	for i := 0; i < len(vecs); i += batchSize {
 		wg.Add(1)
@@ -117,30 +334,350 @@ func (lsh *LSHIndex) Train(vecs [][]float64, ids []string) error {
 		if end > len(vecs) {
 			end = len(vecs)
 		}
-		go func(vecs [][]float64, ids []string, wg *sync.WaitGroup) {
+		var batchPayloads [][]byte
+		if payloads != nil {
+			batchPayloads = payloads[i:end]
+		}
+		var batchExpires []int64
+		if expires != nil {
+			batchExpires = expires[i:end]
+		}
+		go func(vecs [][]float64, ids []string, payloads [][]byte, expires []int64, wg *sync.WaitGroup) {
 			defer wg.Done()
-			for i := range vecs {
-				hashes := lsh.hasher.getHashes(vecs[i])
-				lsh.index.SetVector(ids[i], vecs[i])
-				for perm, hash := range hashes {
-					bucketName := getBucketName(perm, hash)
-					lsh.index.SetHash(bucketName, ids[i])
-				}
+			err := lsh.writeBatch(hasher, vecs, ids, payloads, expires)
+			if err != nil {
+				errMx.Lock()
+				trainErr.FailedIDs = append(trainErr.FailedIDs, ids...)
+				trainErr.Errs = append(trainErr.Errs, err)
+				errMx.Unlock()
 			}
-		}(vecs[i:end], ids[i:end], &wg)
+		}(vecs[i:end], ids[i:end], batchPayloads, batchExpires, &wg)
 	}
 	wg.Wait()
+	if len(trainErr.Errs) > 0 {
+		return trainErr
+	}
+	return nil
+}
+
+func (lsh *LSHIndex) writeBatch(hasher *Hasher, vecs [][]float64, ids []string, payloads [][]byte, expires []int64) error {
+	norms := make([]float64, len(vecs))
+	bucketKeys := make([]store.BucketKey, 0, len(vecs)*hasher.Config.NTrees)
+	bucketIds := make([]string, 0, len(vecs)*hasher.Config.NTrees)
+	for i := range vecs {
+		norms[i] = Norm(vecs[i])
+		hashes := hasher.getHashes(vecs[i])
+		for perm, hash := range hashes {
+			bucketKeys = append(bucketKeys, store.BucketKey{Table: tableKey(hasher.generation, perm), Code: hash})
+			bucketIds = append(bucketIds, ids[i])
+		}
+	}
+	if indexed := lsh.config.getIndexedFields(); payloads != nil && len(indexed) > 0 {
+		for i, data := range payloads {
+			payload, err := decodePayload(data, nil)
+			if err != nil {
+				return err
+			}
+			for _, key := range postingKeys(hasher.generation, payload, indexed) {
+				bucketKeys = append(bucketKeys, key)
+				bucketIds = append(bucketIds, ids[i])
+			}
+		}
+	}
+	for i, at := range expires {
+		if at > 0 {
+			bucketKeys = append(bucketKeys, expiryKey(hasher.generation, at))
+			bucketIds = append(bucketIds, ids[i])
+		}
+	}
+	keys := vectorKeys(hasher.generation, ids)
+	err := lsh.index.SetVectors(keys, vecs)
+	if err != nil {
+		return err
+	}
+	err = lsh.index.SetNorms(keys, norms)
+	if err != nil {
+		return err
+	}
+	if payloads != nil {
+		// NOTE: payloads are stored under the generation's keys, so they are dropped along with vectors;
+		// vectors without payload are skipped, since some stores can't keep nil
+		payloadKeys := make([]string, 0, len(payloads))
+		payloadData := make([][]byte, 0, len(payloads))
+		for i, data := range payloads {
+			if data != nil {
+				payloadKeys = append(payloadKeys, keys[i])
+				payloadData = append(payloadData, data)
+			}
+		}
+		if len(payloadKeys) > 0 {
+			err = lsh.index.(store.PayloadStore).SetPayloads(payloadKeys, payloadData)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return lsh.index.SetHashes(bucketKeys, bucketIds)
+}
+
+// scorer holds maxNN closest candidates found so far
+type scorer struct {
+	metric        Metric
+	extended      ExtendedMetric
+	isExtended    bool
+	normed        NormedMetric
+	isNormed      bool
+	query         []float64
+	qNorm         float64
+	maxNN         int
+	maxCandidates int
+	distanceThrsh float64
+	filter        Filter      // NOTE: candidates not matching the filter aren't scored nor counted
+	deleted       *tombstones // NOTE: tombstoned candidates are skipped the same way
+	expiring      *expiries   // NOTE: and so are the candidates expired by now
+	now           int64
+	nCandidates   int
+	closest       *FloatMaxHeap
+}
+
+func newScorer(metric Metric, query []float64, maxNN, maxCandidates int, distanceThrsh float64) *scorer {
+	extended, isExtended := metric.(ExtendedMetric)
+	normed, isNormed := metric.(NormedMetric)
+	return &scorer{
+		metric:        metric,
+		extended:      extended,
+		isExtended:    isExtended,
+		normed:        normed,
+		isNormed:      isNormed,
+		query:         query,
+		qNorm:         Norm(query),
+		maxNN:         maxNN,
+		maxCandidates: maxCandidates,
+		distanceThrsh: distanceThrsh,
+		closest:       new(FloatMaxHeap),
+	}
+}
+
+// done returns true when the candidates limit has been reached
+func (s *scorer) done() bool {
+	return s.nCandidates >= s.maxCandidates
+}
+
+func (s *scorer) full() bool {
+	return s.closest.Len() >= s.maxNN
+}
+
+// bound returns the largest distance which still can get candidate into the result
+func (s *scorer) bound() float64 {
+	if s.maxNN > 0 && s.full() {
+		return (*s.closest)[0].Dist
+	}
+	return s.distanceThrsh
+}
+
+// score calculates distances to the block of candidates.
+// NormedMetric scores the whole block with a single matrix product and the precomputed norms.
+// ExtendedMetric scores the whole block at once while the result isn't filled yet,
+// then the k-th best distance is used to abandon calculations early.
+// Norms are used only by the NormedMetric and can be nil otherwise
+func (s *scorer) score(ids []string, vecs [][]float64, norms []float64) {
+	if s.isNormed || (s.isExtended && !s.full()) {
+		var dists []float64
+		if s.isNormed {
+			dists = s.normed.GetDistManyNormed(s.query, s.qNorm, vecs, norms)
+		} else {
+			dists = s.extended.GetDistMany(s.query, vecs)
+		}
+		for i := range ids {
+			s.add(ids[i], vecs[i], dists[i])
+		}
+		return
+	}
+	for i := range ids {
+		if s.done() {
+			return
+		}
+		if !s.isExtended {
+			s.add(ids[i], vecs[i], s.metric.GetDist(vecs[i], s.query))
+			continue
+		}
+		bound := s.bound()
+		dist, ok := s.extended.GetDistBounded(vecs[i], s.query, bound)
+		if !ok && bound < s.distanceThrsh {
+			// NOTE: abandoned candidate doesn't get into the result, but it's counted towards
+			// the MaxCandidates if it's within the threshold, so it's confirmed the same way
+			dist, ok = s.extended.GetDistBounded(vecs[i], s.query, s.distanceThrsh)
+		}
+		if !ok {
+			continue
+		}
+		s.add(ids[i], vecs[i], dist)
+	}
+}
+
+func (s *scorer) add(id string, vec []float64, dist float64) {
+	if s.done() || dist > s.distanceThrsh {
+		return
+	}
+	s.nCandidates++
+	if s.maxNN <= 0 {
+		return
+	}
+	neighbor := Neighbor{
+		ID:   id,
+		Vec:  vec,
+		Dist: dist,
+	}
+	if !s.full() {
+		heap.Push(s.closest, neighbor)
+		return
+	}
+	if dist < (*s.closest)[0].Dist {
+		(*s.closest)[0] = neighbor
+		heap.Fix(s.closest, 0)
+	}
+}
+
+// result returns found neighbors sorted by distance
+func (s *scorer) result() []Neighbor {
+	closest := make([]Neighbor, s.closest.Len())
+	for i := len(closest) - 1; i >= 0; i-- {
+		closest[i] = heap.Pop(s.closest).(Neighbor)
+	}
+	return closest
+}
+
+// scoreBlock fetches vectors (and norms, if metric uses them) of the candidates and scores them;
+// deleted and expired candidates are skipped and the rest are filtered first, if the filter is set
+func (lsh *LSHIndex) scoreBlock(s *scorer, generation uint32, ids []string) error {
+	if s.deleted != nil {
+		ids = s.deleted.filter(ids)
+		if len(ids) == 0 {
+			return nil
+		}
+	}
+	if s.expiring != nil {
+		ids = s.expiring.filter(ids, s.now)
+		if len(ids) == 0 {
+			return nil
+		}
+	}
+	if s.filter != nil {
+		var err error
+		ids, err = lsh.filterBlock(s.filter, generation, ids)
+		if err != nil || len(ids) == 0 {
+			return err
+		}
+	}
+	keys := vectorKeys(generation, ids)
+	vecs, err := lsh.index.GetVectors(keys)
+	if err != nil {
+		return err
+	}
+	var norms []float64
+	if s.isNormed {
+		norms, err = lsh.index.GetNorms(keys)
+		if errors.Is(err, store.KeyNotFoundErr) {
+			norms = normsOf(vecs) // NOTE: norms could be absent if vectors have been stored by an older version
+		} else if err != nil {
+			return err
+		}
+	}
+	s.score(ids, vecs, norms)
+	return nil
+}
+
+// collectCandidates reads not yet seen vectors ids from the bucket iterator into the block
+// and scores the block each time it's full
+func (lsh *LSHIndex) collectCandidates(s *scorer, generation uint32, iter store.Iterator, closestSet map[string]bool, block *[]string) error {
+	for !s.done() {
+		ids := iter.NextN(scoreBlockSize)
+		if len(ids) == 0 {
+			return nil
+		}
+		for _, id := range ids {
+			if closestSet[id] {
+				continue
+			}
+			closestSet[id] = true
+			*block = append(*block, id)
+			if len(*block) < scoreBlockSize {
+				continue
+			}
+			err := lsh.scoreBlock(s, generation, *block)
+			if err != nil {
+				return err
+			}
+			*block = (*block)[:0]
+		}
+	}
 	return nil
 }
 
 // Search returns NNs for the query point
 func (lsh *LSHIndex) Search(query []float64, maxNN int, distanceThrsh float64) ([]Neighbor, error) {
+	return lsh.SearchWithOptions(query, maxNN, distanceThrsh, SearchOptions{})
+}
+
+// SearchWithOptions works like Search, but also filters candidates and returns what's asked in the options.
+// Filters on the IndexedFields are answered by the inverted index: when it yields no more than MaxCandidates vectors,
+// all of them are scored instead of the buckets of the query, so the selective filters don't miss the neighbors
+func (lsh *LSHIndex) SearchWithOptions(query []float64, maxNN int, distanceThrsh float64, options SearchOptions) ([]Neighbor, error) {
+	if options.Filter != nil || options.WithPayload {
+		if _, ok := lsh.index.(store.PayloadStore); !ok {
+			return nil, payloadsUnsupportedErr
+		}
+	}
 	maxCandidates := lsh.config.getMaxCandidates()
-	hashes := lsh.hasher.getHashes(query)
+	hasher, deleted, expiring, searches := lsh.pin()
+	defer searches.Done()
+	s := newScorer(lsh.distanceMetric, query, maxNN, maxCandidates, distanceThrsh)
+	s.filter = options.Filter
+	s.deleted = deleted
+	s.expiring = expiring
+	s.now = expiryMillis(time.Now())
+	scanned := false
+	if options.Filter != nil {
+		indexed := make(map[string]bool)
+		for _, field := range lsh.config.getIndexedFields() {
+			indexed[field] = true
+		}
+		ids, ok, err := lsh.postings(options.Filter, hasher.generation, indexed)
+		if err != nil {
+			return nil, err
+		}
+		if ok && len(ids) <= maxCandidates {
+			err = lsh.scorePostings(s, hasher.generation, ids)
+			if err != nil {
+				return nil, err
+			}
+			scanned = true
+		}
+	}
+	if !scanned {
+		err := lsh.scanBuckets(s, hasher, query)
+		if err != nil {
+			return nil, err
+		}
+	}
+	neighbors := s.result()
+	if options.WithPayload {
+		// NOTE: the search is still pinned, so the generation can't be dropped meanwhile
+		err := lsh.attachPayloads(neighbors, hasher.generation, options.Fields)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return neighbors, nil
+}
+
+// scanBuckets scores candidates from the query buckets (and the neighboring ones) of every tree
+func (lsh *LSHIndex) scanBuckets(s *scorer, hasher *Hasher, query []float64) error {
+	hashes := hasher.getHashes(query)
 	closestSet := make(map[string]bool)
-	minHeap := new(FloatMinHeap)
+	block := make([]string, 0, scoreBlockSize)
 	for perm, hash := range hashes {
-		if minHeap.Len() >= maxCandidates {
+		if s.done() {
 			break
 		}
 		// NOTE: look in the neigbors' "bucket" too
@@ -149,59 +686,71 @@ func (lsh *LSHIndex) Search(query []float64, maxNN int, distanceThrsh float64) (
 			neighborPos = int(math.Floor(math.Log2(float64(hash))))
 		}
 		neighborHash := hash ^ (1 << neighborPos)
-		bucketsNames := []string{
-			getBucketName(perm, hash),
-			getBucketName(perm, neighborHash),
+		bucketKeys := [2]store.BucketKey{
+			{Table: tableKey(hasher.generation, perm), Code: hash},
+			{Table: tableKey(hasher.generation, perm), Code: neighborHash},
 		}
-		for _, bucketName := range bucketsNames {
-			iter, err := lsh.index.GetHashIterator(bucketName)
+		for _, bucketKey := range bucketKeys {
+			iter, err := lsh.index.GetHashIterator(bucketKey)
 			if err != nil {
 				continue // NOTE: it's normal when we couldn't find bucket for the query point
 			}
-			for {
-				if minHeap.Len() >= maxCandidates {
-					break
-				}
-				id, opened := iter.Next()
-				if !opened {
-					break
-				}
-				if closestSet[id] {
-					continue
-				}
-				vec, err := lsh.index.GetVector(id)
-				if err != nil {
-					return nil, err
-				}
-				dist := lsh.distanceMetric.GetDist(vec, query)
-				if dist <= distanceThrsh {
-					closestSet[id] = true
-					heap.Push(
-						minHeap,
-						Neighbor{
-							ID:   id,
-							Vec:  vec,
-							Dist: dist,
-						},
-					)
-				}
+			err = lsh.collectCandidates(s, hasher.generation, iter, closestSet, &block)
+			iter.Close()
+			if err != nil {
+				return err
 			}
+		}
+	}
+	if len(block) > 0 {
+		return lsh.scoreBlock(s, hasher.generation, block)
+	}
+	return nil
+}
 
+// scorePostings scores all the vectors found by the inverted index
+func (lsh *LSHIndex) scorePostings(s *scorer, generation uint32, ids map[string]struct{}) error {
+	block := make([]string, 0, scoreBlockSize)
+	for id := range ids {
+		block = append(block, id)
+		if len(block) < scoreBlockSize {
+			continue
 		}
+		err := lsh.scoreBlock(s, generation, block)
+		if err != nil {
+			return err
+		}
+		block = block[:0]
 	}
-	closest := make([]Neighbor, 0)
-	for i := 0; i < maxNN && minHeap.Len() > 0; i++ {
-		closest = append(closest, heap.Pop(minHeap).(Neighbor))
+	if len(block) > 0 {
+		return lsh.scoreBlock(s, generation, block)
 	}
-	return closest, nil
+	return nil
 }
 
 // DumpHasher serializes hasher
 func (lsh *LSHIndex) DumpHasher() ([]byte, error) {
-	return lsh.hasher.dump()
+	return lsh.getHasher().dump()
 }
 
-// LoadHasher fills hasher from byte array
+// LoadHasher fills hasher from byte array; the dump defines which generation of the stored index is used,
+// along with its deleted and expiring vectors
 func (lsh *LSHIndex) LoadHasher(inp []byte) error {
-	return lsh.hasher.load(inp)
+	hasher := NewHasher(HasherConfig{})
+	err := hasher.load(inp)
+	if err != nil {
+		return err
+	}
+	lsh.trainMx.Lock()
+	defer lsh.trainMx.Unlock()
+	deleted, err := loadTombstones(lsh.index, hasher.generation)
+	if err != nil {
+		return err
+	}
+	expiring, err := loadExpiries(lsh.index, hasher.generation)
+	if err != nil {
+		return err
+	}
+	lsh.swap(hasher, deleted, expiring)
+	return nil
 }
@@ -1,15 +1,28 @@
 package lsh
 
 import (
+	dbsql "database/sql"
+	"errors"
+	"github.com/gasparian/lsh-search-go/store"
+	"github.com/gasparian/lsh-search-go/store/compact"
 	"github.com/gasparian/lsh-search-go/store/kv"
+	"github.com/gasparian/lsh-search-go/store/retry"
+	"github.com/gasparian/lsh-search-go/store/sql"
 	guuid "github.com/google/uuid"
+	_ "github.com/mattn/go-sqlite3"
 	"gonum.org/v1/gonum/blas/blas64"
+	"io/ioutil"
 	"math"
 	"math/rand"
+	"os"
+	"reflect"
+	"runtime"
 	"sort"
+	"strconv"
 	"sync"
 	"testing"
 	"time"
+	"unicode"
 )
 
 func TestPlane(t *testing.T) {
@@ -105,6 +118,1675 @@ func TestL2(t *testing.T) {
 	}
 }
 
+func TestExtendedMetrics(t *testing.T) {
+	query := []float64{0.5, -1.0, 2.0}
+	candidates := [][]float64{
+		[]float64{0.5, -1.0, 2.0},
+		[]float64{0.0, 0.0, 0.0},
+		[]float64{-3.0, 1.0, 0.5},
+		[]float64{10.0, 4.0, -2.0},
+	}
+	metrics := map[string]ExtendedMetric{
+		"L2":      NewL2(),
+		"Angular": NewAngular(),
+	}
+	for name, metric := range metrics {
+		t.Run(name, func(t *testing.T) {
+			dists := metric.GetDistMany(query, candidates)
+			if len(dists) != len(candidates) {
+				t.Fatalf("Expected %v distances, got %v", len(candidates), len(dists))
+			}
+			normed := metric.(NormedMetric)
+			qNorm := Norm(query)
+			for i, c := range candidates {
+				dist := metric.GetDist(c, query)
+				if math.Abs(dists[i]-dist) > tol {
+					t.Errorf("Block distance differs from the regular one: %v vs %v", dists[i], dist)
+				}
+				normedDist := normed.GetDistNormed(c, query, Norm(c), qNorm)
+				if math.Abs(normedDist-dist) > tol {
+					t.Errorf("Distance calculated with norms differs from the regular one: %v vs %v", normedDist, dist)
+				}
+				bounded, ok := metric.GetDistBounded(c, query, dist+tol)
+				if !ok || math.Abs(bounded-dist) > tol {
+					t.Errorf("Bounded distance must be calculated fully when it's lower than the bound")
+				}
+				if dist > tol {
+					_, ok = metric.GetDistBounded(c, query, dist/2)
+					if ok {
+						t.Errorf("Bounded distance must be abandoned when it's larger than the bound")
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestSearchGoroutinesLeak(t *testing.T) {
+	inpVecs, trainIds := getTestLSHData()
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:     2,
+			MaxCandidates: 1,
+		},
+		HasherConfig: HasherConfig{
+			NTrees:   10,
+			KMinVecs: 10,
+			Dims:     2,
+		},
+	}
+	lsh, err := NewLsh(config, kv.NewKVStore(), NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsh.Train(inpVecs, trainIds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := runtime.NumGoroutine()
+	// NOTE: search stops after the first candidate, so buckets are left not exhausted
+	for i := 0; i < 100; i++ {
+		_, err := lsh.Search(inpVecs[0], 1, 1.0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Fatalf("Search leaked %v goroutines", after-before)
+	}
+}
+
+// plainMetric hides ExtendedMetric methods of the wrapped metric
+type plainMetric struct {
+	Metric
+}
+
+func TestSearchExtendedMetric(t *testing.T) {
+	rand.Seed(time.Now().UnixNano())
+	vecs := make([][]float64, 500)
+	ids := make([]string, len(vecs))
+	for i := range vecs {
+		vecs[i] = []float64{rand.NormFloat64(), rand.NormFloat64(), rand.NormFloat64()}
+		ids[i] = guuid.NewString()
+	}
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:     100,
+			MaxCandidates: len(vecs),
+		},
+		HasherConfig: HasherConfig{
+			NTrees:   5,
+			KMinVecs: 20,
+			Dims:     3,
+		},
+	}
+	s := kv.NewKVStore()
+	lsh, err := NewLsh(config, s, NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsh.Train(vecs, ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := &LSHIndex{
+		config:         lsh.config,
+		index:          lsh.index,
+		hasher:         lsh.hasher,
+		searches:       new(sync.WaitGroup),
+		distanceMetric: plainMetric{NewL2()},
+	}
+	for _, query := range vecs[:10] {
+		extendedNNs, err := lsh.Search(query, 10, 1.0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plainNNs, err := plain.Search(query, 10, 1.0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(extendedNNs) != len(plainNNs) {
+			t.Fatalf("Number of neighbors differs: %v vs %v", len(extendedNNs), len(plainNNs))
+		}
+		for i := range plainNNs {
+			if math.Abs(extendedNNs[i].Dist-plainNNs[i].Dist) > tol {
+				t.Fatalf("Neighbors differ: %v vs %v", extendedNNs[i], plainNNs[i])
+			}
+		}
+	}
+}
+
+// extendedMetric hides NormedMetric methods of the wrapped metric
+type extendedMetric struct {
+	ExtendedMetric
+}
+
+func TestSearchBoundedCandidates(t *testing.T) {
+	rand.Seed(time.Now().UnixNano())
+	nDims := 4 * boundCheckStep
+	vecs := make([][]float64, 500)
+	ids := make([]string, len(vecs))
+	for i := range vecs {
+		vecs[i] = make([]float64, nDims)
+		for j := range vecs[i] {
+			vecs[i][j] = rand.NormFloat64()
+		}
+		ids[i] = strconv.Itoa(i)
+	}
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:     100,
+			MaxCandidates: 150,
+		},
+		// NOTE: trees are scanned in random order, so the single one keeps candidates order the same
+		HasherConfig: HasherConfig{
+			NTrees:   1,
+			KMinVecs: 200,
+			Dims:     nDims,
+		},
+	}
+	// NOTE: candidates must be read in the same order by both indexes
+	s := compact.NewCompactStore()
+	bounded, err := NewLsh(config, s, extendedMetric{NewL2()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bounded.Train(vecs, ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dump, err := bounded.DumpHasher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := NewLsh(config, s, plainMetric{NewL2()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = plain.LoadHasher(dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// NOTE: the threshold lets the abandoned candidates be counted, the limit stops the search early
+	for _, query := range vecs[:100] {
+		boundedNNs, err := bounded.Search(query, 3, 12.0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plainNNs, err := plain.Search(query, 3, 12.0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(boundedNNs) != len(plainNNs) {
+			t.Fatalf("Number of neighbors differs: %v vs %v", boundedNNs, plainNNs)
+		}
+		for i := range plainNNs {
+			if boundedNNs[i].ID != plainNNs[i].ID {
+				t.Fatalf("Neighbors differ: %v vs %v", boundedNNs[i], plainNNs[i])
+			}
+		}
+	}
+}
+
+var writeFailedErr = errors.New("Write failed")
+
+// normsStore fails norms reads with the given error
+type normsStore struct {
+	*kv.KVStore
+	err error
+}
+
+func (s *normsStore) GetNorms(ids []string) ([]float64, error) {
+	return nil, s.err
+}
+
+// vectorsStore fails vectors reads with the given error
+type vectorsStore struct {
+	*kv.KVStore
+	err error
+}
+
+func (s *vectorsStore) GetVector(id string) ([]float64, error) {
+	return nil, s.err
+}
+
+// bucketsStore fails bucket reads with the given error
+type bucketsStore struct {
+	*kv.KVStore
+	err error
+}
+
+func (s *bucketsStore) GetHashIterator(key store.BucketKey) (store.Iterator, error) {
+	return nil, s.err
+}
+
+// postingsStore fails reads of the payload fields inverted index with the given error
+type postingsStore struct {
+	*kv.KVStore
+	err error
+}
+
+func (s *postingsStore) GetHashIterator(key store.BucketKey) (store.Iterator, error) {
+	if key.Table&payloadTableBit != 0 {
+		return nil, s.err
+	}
+	return s.KVStore.GetHashIterator(key)
+}
+
+// strictPayloadsStore rejects nil payloads, as the stores with NOT NULL columns do
+type strictPayloadsStore struct {
+	*kv.KVStore
+}
+
+func (s *strictPayloadsStore) SetPayloads(ids []string, payloads [][]byte) error {
+	for _, payload := range payloads {
+		if payload == nil {
+			return errors.New("Nil payload")
+		}
+	}
+	return s.KVStore.SetPayloads(ids, payloads)
+}
+
+// blockingStore blocks the vectors scan, which takes the token, until it's released
+type blockingStore struct {
+	*kv.KVStore
+	token   chan struct{}
+	started chan struct{}
+	release chan struct{}
+}
+
+func newBlockingStore() *blockingStore {
+	return &blockingStore{
+		KVStore: kv.NewKVStore(),
+		token:   make(chan struct{}, 1),
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+}
+
+func (s *blockingStore) GetVectorIterator() (store.VectorIterator, error) {
+	select {
+	case <-s.token:
+		close(s.started)
+		<-s.release
+	default:
+	}
+	return s.KVStore.GetVectorIterator()
+}
+
+func TestSearchNorms(t *testing.T) {
+	vecs, ids := getTestLSHData()
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:     2,
+			MaxCandidates: len(vecs),
+		},
+		HasherConfig: HasherConfig{
+			NTrees:   5,
+			KMinVecs: 2,
+			Dims:     2,
+		},
+	}
+	s := &normsStore{KVStore: kv.NewKVStore()}
+	lsh, err := NewLsh(config, s, NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsh.Train(vecs, ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// NOTE: absent norms are calculated from the vectors
+	s.err = store.KeyNotFoundErr
+	nns, err := lsh.Search(vecs[0], 1, 1e-6)
+	if err != nil || len(nns) != 1 || nns[0].ID != ids[0] {
+		t.Fatalf("Vector must be found without the stored norms: %v, %v", nns, err)
+	}
+	s.err = writeFailedErr
+	_, err = lsh.Search(vecs[0], 1, 1e-6)
+	if err != writeFailedErr {
+		t.Fatalf("Store failure must be returned, got %v", err)
+	}
+}
+
+type temporaryErr struct{}
+
+func (temporaryErr) Error() string   { return "Temporary failure" }
+func (temporaryErr) Temporary() bool { return true }
+
+// failingStore fails hashes writes of the batches containing the given id;
+// the transient failures are returned the given number of times only
+type failingStore struct {
+	*kv.KVStore
+	mx        sync.Mutex
+	failId    string
+	err       error
+	transient int
+}
+
+func (s *failingStore) SetHashes(keys []store.BucketKey, vecIds []string) error {
+	s.mx.Lock()
+	if s.transient > 0 {
+		s.transient--
+		s.mx.Unlock()
+		return temporaryErr{}
+	}
+	failId, err := s.failId, s.err
+	s.mx.Unlock()
+	for _, id := range vecIds {
+		if id == failId {
+			return err
+		}
+	}
+	return s.KVStore.SetHashes(keys, vecIds)
+}
+
+func searchIds(t *testing.T, lsh *LSHIndex, queries [][]float64) [][]string {
+	result := make([][]string, len(queries))
+	for i, query := range queries {
+		nns, err := lsh.Search(query, 5, 10.0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, nn := range nns {
+			result[i] = append(result[i], nn.ID)
+		}
+	}
+	return result
+}
+
+// checkLayout checks that the store holds the single current generation of nVecs vectors
+func checkLayout(t *testing.T, lsh *LSHIndex, generation uint32, nVecs int) {
+	if lsh.Generation() != generation {
+		t.Fatalf("Current generation must be %v, got %v", generation, lsh.Generation())
+	}
+	err := lsh.WaitGC()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := lsh.index
+	count, err := s.CountVectors()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != nVecs {
+		t.Errorf("Store must contain %v vectors, got %v", nVecs, count)
+	}
+	iter, err := s.GetVectorIterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer iter.Close()
+	for {
+		key, _, ok := iter.Next()
+		if !ok {
+			break
+		}
+		if !ownsVector(generation, key) {
+			t.Fatalf("Vector %q doesn't belong to the generation %v", key, generation)
+		}
+	}
+	buckets, err := s.ListBuckets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bucket := range buckets {
+		if bucket.Table&^oddTableBit >= 10 || tableKey(generation, int(bucket.Table&^oddTableBit)) != bucket.Table {
+			t.Fatalf("Bucket %v doesn't belong to the generation %v", bucket, generation)
+		}
+	}
+}
+
+func TestTrainGenerations(t *testing.T) {
+	rand.Seed(time.Now().UnixNano())
+	nVecs := 200
+	genData := func(prefix string) ([][]float64, []string) {
+		vecs := make([][]float64, nVecs)
+		ids := make([]string, nVecs)
+		for i := range vecs {
+			vecs[i] = []float64{rand.NormFloat64(), rand.NormFloat64()}
+			ids[i] = prefix + strconv.Itoa(i)
+		}
+		return vecs, ids
+	}
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:     50,
+			MaxCandidates: nVecs,
+		},
+		HasherConfig: HasherConfig{
+			NTrees:   10,
+			KMinVecs: 10,
+			Dims:     2,
+		},
+	}
+	s := &failingStore{KVStore: kv.NewKVStore()}
+	lsh, err := NewLsh(config, s, NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldVecs, oldIds := genData("old")
+	err = lsh.Train(oldVecs, oldIds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queries := oldVecs[:10]
+	oldResult := searchIds(t, lsh, queries)
+
+	t.Run("Failed", func(t *testing.T) {
+		s.failId, s.err = "new7", writeFailedErr
+		defer func() {
+			s.failId, s.err = "", nil
+		}()
+		newVecs, newIds := genData("new")
+		err := lsh.Train(newVecs, newIds)
+		trainErr := &TrainError{}
+		if !errors.As(err, &trainErr) {
+			t.Fatalf("Train must return TrainError, got %v", err)
+		}
+		if !errors.Is(err, writeFailedErr) || len(trainErr.Errs) != 1 {
+			t.Errorf("Wrong write errors: %v", trainErr.Errs)
+		}
+		// NOTE: the batch size is 50, so the first batch fails
+		failedIds := append([]string{}, newIds[:50]...)
+		sort.Strings(failedIds)
+		sort.Strings(trainErr.FailedIDs)
+		if !reflect.DeepEqual(trainErr.FailedIDs, failedIds) {
+			t.Errorf("Failed ids must be the ones of the failed batch, got %v", trainErr.FailedIDs)
+		}
+		if !reflect.DeepEqual(searchIds(t, lsh, queries), oldResult) {
+			t.Error("Previous index must stay intact")
+		}
+		checkLayout(t, lsh, 1, nVecs)
+	})
+
+	t.Run("Swapped", func(t *testing.T) {
+		newVecs, newIds := genData("new")
+		err := lsh.Train(newVecs, newIds)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkLayout(t, lsh, 2, nVecs)
+		for _, ids := range searchIds(t, lsh, newVecs[:10]) {
+			if len(ids) == 0 || ids[0][:3] != "new" {
+				t.Fatalf("New vectors must be found, got %v", ids)
+			}
+		}
+		dump, err := lsh.DumpHasher()
+		if err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := NewLsh(config, s, NewL2())
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = loaded.LoadHasher(dump)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(searchIds(t, loaded, newVecs[:10]), searchIds(t, lsh, newVecs[:10])) {
+			t.Error("Loaded hasher must search the same generation")
+		}
+		err = lsh.Train(oldVecs, oldIds)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkLayout(t, lsh, 3, nVecs)
+	})
+
+	t.Run("Retry", func(t *testing.T) {
+		s.transient = 3
+		retried, err := NewLsh(config, retry.NewRetryStore(s, retry.Config{InitialBackoff: time.Microsecond}), NewL2())
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = retried.Train(oldVecs, oldIds)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.transient != 0 {
+			t.Error("Transient errors must be retried")
+		}
+		// NOTE: the new index is trained into the first generation, the leftovers of the same layout are dropped
+		checkLayout(t, retried, 1, nVecs)
+	})
+
+	t.Run("ReservedIds", func(t *testing.T) {
+		ids := append([]string{}, oldIds...)
+		ids[7] = oddVectorPrefix + ids[7]
+		if err := lsh.Train(oldVecs, ids); err != reservedIdErr {
+			t.Errorf("Ids with the reserved prefix must not be trained, got %v", err)
+		}
+		if err := lsh.Insert(oldVecs[:1], ids[7:8], WriteOptions{}); err != reservedIdErr {
+			t.Errorf("Ids with the reserved prefix must not be inserted, got %v", err)
+		}
+		checkLayout(t, lsh, 3, nVecs)
+	})
+
+	t.Run("SQL", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "lsh-sql")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		db, err := dbsql.Open("sqlite3", dir+"/index.db")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		sqlStore, err := sql.NewSQLStore(db, sql.Config{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sqlStore.Close()
+		sqlLsh, err := NewLsh(config, sqlStore, NewL2())
+		if err != nil {
+			t.Fatal(err)
+		}
+		// NOTE: the first Train writes the odd generation
+		err = sqlLsh.Train(oldVecs, oldIds)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkLayout(t, sqlLsh, 1, nVecs)
+		it, err := sqlStore.GetVectorIterator()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer it.Close()
+		for {
+			id, _, ok := it.Next()
+			if !ok {
+				break
+			}
+			for _, r := range id {
+				if !unicode.IsPrint(r) {
+					t.Fatalf("Vector key must be printable to fit the text columns, got %q", id)
+				}
+			}
+		}
+	})
+}
+
+func TestShadowRetrain(t *testing.T) {
+	rand.Seed(time.Now().UnixNano())
+	vecs := make([][]float64, 300)
+	for i := range vecs {
+		vecs[i] = []float64{rand.NormFloat64(), rand.NormFloat64(), rand.NormFloat64()}
+	}
+	genIds := func(round int) []string {
+		ids := make([]string, len(vecs))
+		for i := range ids {
+			ids[i] = strconv.Itoa(round) + "_" + strconv.Itoa(i)
+		}
+		return ids
+	}
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:     20,
+			MaxCandidates: len(vecs),
+		},
+		HasherConfig: HasherConfig{
+			NTrees:   5,
+			KMinVecs: 10,
+			Dims:     3,
+		},
+	}
+	lsh, err := NewLsh(config, kv.NewKVStore(), NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsh.Train(vecs, genIds(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	errs := make(chan error, 1)
+	wg := sync.WaitGroup{}
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := g; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				// NOTE: every generation holds the same vectors, so the query must always find itself
+				nns, err := lsh.Search(vecs[i%len(vecs)], 3, 1.0)
+				if err == nil && (len(nns) == 0 || nns[0].Dist > tol) {
+					err = errors.New("Query vector hasn't been found")
+				}
+				if err != nil {
+					select {
+					case errs <- err:
+					default:
+					}
+					return
+				}
+			}
+		}(g)
+	}
+	nRounds := 5
+	for round := 1; round <= nRounds; round++ {
+		err = lsh.Train(vecs, genIds(round))
+		if err != nil {
+			t.Fatal(err)
+		}
+		runtime.Gosched()
+	}
+	close(stop)
+	wg.Wait()
+	select {
+	case err := <-errs:
+		t.Fatalf("Search must be available during retraining: %v", err)
+	default:
+	}
+	checkLayout(t, lsh, uint32(nRounds+1), len(vecs))
+	nns, err := lsh.Search(vecs[0], 1, 1.0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nns[0].ID != genIds(nRounds)[0] {
+		t.Errorf("The last generation must be searched, got %v", nns[0].ID)
+	}
+}
+
+func TestCollections(t *testing.T) {
+	backend := kv.NewKVStore()
+	c, err := NewCollections(backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewCollections(struct{ store.Store }{backend})
+	if err == nil {
+		t.Error("Store without namespaces must not be used for collections")
+	}
+	configs := map[string]CollectionConfig{
+		"planar": {
+			Config: Config{
+				IndexConfig:  IndexConfig{BatchSize: 10, MaxCandidates: 100},
+				HasherConfig: HasherConfig{NTrees: 5, KMinVecs: 5, Dims: 2},
+			},
+			Metric: L2Metric,
+		},
+		"spatial": {
+			Config: Config{
+				IndexConfig:  IndexConfig{BatchSize: 20, MaxCandidates: 100},
+				HasherConfig: HasherConfig{NTrees: 3, KMinVecs: 10, Dims: 3},
+			},
+			Metric: AngularMetric,
+		},
+	}
+	data := make(map[string][][]float64)
+	ids := make([]string, 50)
+	for i := range ids {
+		ids[i] = strconv.Itoa(i)
+	}
+	for name, config := range configs {
+		_, err := c.Create(name, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vecs := make([][]float64, len(ids))
+		for i := range vecs {
+			vecs[i] = make([]float64, config.Dims)
+			for j := range vecs[i] {
+				vecs[i][j] = rand.NormFloat64()
+			}
+		}
+		data[name] = vecs
+	}
+	if _, err = c.Create("planar", configs["planar"]); err == nil {
+		t.Error("Collection must not be created twice")
+	}
+	if _, err = c.Create("Bad-Name", configs["planar"]); err == nil {
+		t.Error("Collection with the invalid name must not be created")
+	}
+	if !reflect.DeepEqual(c.List(), []string{"planar", "spatial"}) {
+		t.Errorf("Wrong collections: %v", c.List())
+	}
+	// NOTE: both collections use the same ids
+	for name, vecs := range data {
+		index, err := c.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = index.Train(vecs, ids)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkSearch := func(t *testing.T, c *Collections) {
+		for name, vecs := range data {
+			index, err := c.Open(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, vec := range vecs[:10] {
+				nns, err := index.Search(vec, 1, 1e-3)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(nns) != 1 || nns[0].ID != ids[i] || !reflect.DeepEqual(nns[0].Vec, vec) {
+					t.Fatalf("Collection %v must find its own vector, got %v", name, nns)
+				}
+			}
+		}
+	}
+
+	t.Run("Isolation", func(t *testing.T) {
+		checkSearch(t, c)
+		if count, _ := backend.CountVectors(); count != 0 {
+			t.Errorf("Collections must not write to the store itself, got %v vectors", count)
+		}
+		err := backend.Clear()
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkSearch(t, c)
+	})
+
+	t.Run("Load", func(t *testing.T) {
+		dump, err := c.Dump()
+		if err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := NewCollections(backend)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = loaded.Load(dump)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(loaded.List(), c.List()) {
+			t.Fatalf("Wrong loaded collections: %v", loaded.List())
+		}
+		config, err := loaded.Config("spatial")
+		if err != nil || config.Metric != AngularMetric || config.Dims != 3 || config.BatchSize != 20 {
+			t.Errorf("Wrong loaded config: %+v, %v", config, err)
+		}
+		checkSearch(t, loaded)
+		if loaded.Load([]byte("garbage")) == nil {
+			t.Error("Wrong dump must not be loaded")
+		}
+	})
+
+	t.Run("Drop", func(t *testing.T) {
+		err := c.Drop("planar")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = c.Open("planar"); err == nil {
+			t.Error("Dropped collection must not be opened")
+		}
+		if c.Drop("planar") == nil {
+			t.Error("Collection must not be dropped twice")
+		}
+		names, _ := backend.ListNamespaces()
+		if !reflect.DeepEqual(names, []string{"spatial"}) || !reflect.DeepEqual(c.List(), names) {
+			t.Errorf("Dropped collection must be removed from the store: %v", names)
+		}
+		delete(data, "planar")
+		checkSearch(t, c)
+		// NOTE: untrained collection is dumped with its config only
+		_, err = c.Create("planar", configs["planar"])
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = c.Dump()
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestPayloads(t *testing.T) {
+	rand.Seed(time.Now().UnixNano())
+	nVecs := 100
+	config := Config{
+		IndexConfig:  IndexConfig{BatchSize: 30, MaxCandidates: nVecs},
+		HasherConfig: HasherConfig{NTrees: 5, KMinVecs: 10, Dims: 2},
+	}
+	vecs := make([][]float64, nVecs)
+	ids := make([]string, nVecs)
+	payloads := make([]Payload, nVecs)
+	for i := range vecs {
+		vecs[i] = []float64{rand.NormFloat64(), rand.NormFloat64()}
+		ids[i] = strconv.Itoa(i)
+		// NOTE: vectors without payload are allowed
+		if i%2 == 0 {
+			payloads[i] = Payload{"title": "doc" + ids[i], "rank": i, "tags": []string{"a", "b"}}
+		}
+	}
+	s := kv.NewKVStore()
+	lsh, err := NewLsh(config, s, NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// checkPayloads checks that the vectors themselves are found with their payloads
+	checkPayloads := func(t *testing.T, options SearchOptions, expected func(i int) Payload) {
+		for i, vec := range vecs {
+			nns, err := lsh.SearchWithOptions(vec, 1, 0.1, options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(nns) == 0 || nns[0].ID != ids[i] {
+				t.Fatalf("Vector %v must be found, got %v", ids[i], nns)
+			}
+			if !reflect.DeepEqual(nns[0].Payload, expected(i)) {
+				t.Fatalf("Wrong payload of the vector %v: %v", ids[i], nns[0].Payload)
+			}
+		}
+	}
+
+	t.Run("Errors", func(t *testing.T) {
+		err := lsh.TrainWithPayloads(vecs, ids, payloads[:10])
+		if err == nil {
+			t.Error("Payloads must be set for every vector")
+		}
+		plain, err := NewLsh(config, struct{ store.Store }{s}, NewL2())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = plain.TrainWithPayloads(vecs, ids, payloads); err == nil {
+			t.Error("Payloads must not be trained into the store without payloads support")
+		}
+	})
+
+	t.Run("Search", func(t *testing.T) {
+		err := lsh.TrainWithPayloads(vecs, ids, payloads)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkPayloads(t, SearchOptions{WithPayload: true}, func(i int) Payload {
+			if i%2 != 0 {
+				return nil
+			}
+			// NOTE: payloads are read back with the JSON types
+			return Payload{"title": "doc" + ids[i], "rank": float64(i), "tags": []interface{}{"a", "b"}}
+		})
+		checkPayloads(t, SearchOptions{WithPayload: true, Fields: []string{"title", "absent"}}, func(i int) Payload {
+			if i%2 != 0 {
+				return nil
+			}
+			return Payload{"title": "doc" + ids[i]}
+		})
+		checkPayloads(t, SearchOptions{}, func(i int) Payload {
+			return nil
+		})
+	})
+
+	t.Run("Mixed", func(t *testing.T) {
+		strict, err := NewLsh(config, &strictPayloadsStore{kv.NewKVStore()}, NewL2())
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = strict.TrainWithPayloads(vecs, ids, payloads)
+		if err != nil {
+			t.Fatalf("Vectors without payload must not be written as nil payloads: %v", err)
+		}
+		payload, err := decodePayload([]byte{}, nil)
+		if err != nil || payload != nil {
+			t.Errorf("Empty payload must be read as absent: %v, %v", payload, err)
+		}
+	})
+
+	t.Run("Retrain", func(t *testing.T) {
+		err := lsh.Train(vecs, ids)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkPayloads(t, SearchOptions{WithPayload: true}, func(i int) Payload {
+			return nil
+		})
+		err = lsh.WaitGC()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored, err := s.GetPayloads(vectorKeys(1, ids))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range stored {
+			if stored[i] != nil {
+				t.Fatalf("Payloads must be dropped along with the replaced generation, got %q", stored[i])
+			}
+		}
+	})
+}
+
+func TestFilters(t *testing.T) {
+	payload := Payload{"category": "shoes", "in_stock": true, "price": 120.0, "tags": []interface{}{"a"}}
+	cases := []struct {
+		name     string
+		filter   Filter
+		expected bool
+	}{
+		{"Eq", Eq("category", "shoes"), true},
+		{"EqInt", Eq("price", 120), true},
+		{"EqMissing", Eq("color", "red"), false},
+		{"EqNonScalar", Eq("tags", []string{"a"}), false},
+		{"In", In("category", "hats", "shoes"), true},
+		{"NotIn", In("category", "hats", "coats"), false},
+		{"Gt", Gt("price", 100), true},
+		{"GtEqual", Gt("price", 120), false},
+		{"Gte", Gte("price", 120), true},
+		{"Lt", Lt("price", 120.5), true},
+		{"Lte", Lte("price", 119), false},
+		{"Between", Between("price", 100, 120), true},
+		{"StringRange", Between("category", "s", "t"), true},
+		{"MixedTypes", Gt("category", 1), false},
+		{"And", And(Eq("category", "shoes"), Eq("in_stock", true)), true},
+		{"AndFailed", And(Eq("category", "shoes"), Eq("in_stock", false)), false},
+		{"Or", Or(Eq("category", "hats"), Lt("price", 200)), true},
+		{"Not", Not(Eq("category", "hats")), true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if c.filter.Match(payload) != c.expected {
+				t.Errorf("Filter must return %v", c.expected)
+			}
+		})
+	}
+	if Eq("category", "shoes").Match(nil) || !Not(Eq("category", "shoes")).Match(nil) {
+		t.Error("Vectors without payload must be matched against the empty payload")
+	}
+}
+
+func TestFilteredSearch(t *testing.T) {
+	rand.Seed(time.Now().UnixNano())
+	nVecs := 300
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:     40,
+			MaxCandidates: 50,
+			IndexedFields: []string{"category", "in_stock"},
+		},
+		HasherConfig: HasherConfig{NTrees: 5, KMinVecs: 20, Dims: 2},
+	}
+	vecs := make([][]float64, nVecs)
+	ids := make([]string, nVecs)
+	payloads := make([]Payload, nVecs)
+	for i := range vecs {
+		vecs[i] = []float64{rand.NormFloat64(), rand.NormFloat64()}
+		ids[i] = strconv.Itoa(i)
+		category := "hats"
+		if i%10 == 0 {
+			category = "shoes"
+		}
+		payloads[i] = Payload{"category": category, "in_stock": i%4 == 0, "price": i}
+	}
+	s := kv.NewKVStore()
+	lsh, err := NewLsh(config, s, NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsh.TrainWithPayloads(vecs, ids, payloads)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metric := NewL2()
+	// exact returns ids of the closest matching vectors found by the brute force
+	exact := func(query []float64, filter Filter, maxNN int) []string {
+		matched := make([]Neighbor, 0)
+		for i, vec := range vecs {
+			if filter.Match(Payload(normalize(payloads[i]).(map[string]interface{}))) {
+				matched = append(matched, Neighbor{ID: ids[i], Dist: metric.GetDist(vec, query)})
+			}
+		}
+		sort.Slice(matched, func(i, j int) bool { return matched[i].Dist < matched[j].Dist })
+		result := make([]string, 0, maxNN)
+		for i := 0; i < maxNN && i < len(matched); i++ {
+			result = append(result, matched[i].ID)
+		}
+		return result
+	}
+	search := func(t *testing.T, query []float64, filter Filter, maxNN int) []Neighbor {
+		nns, err := lsh.SearchWithOptions(query, maxNN, 1e6, SearchOptions{Filter: filter, WithPayload: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, nn := range nns {
+			if !filter.Match(nn.Payload) {
+				t.Fatalf("Neighbor %v doesn't match the filter: %v", nn.ID, nn.Payload)
+			}
+		}
+		return nns
+	}
+
+	t.Run("Indexed", func(t *testing.T) {
+		// NOTE: 30 shoes and 15 of them in stock, so the index yields less than MaxCandidates vectors
+		filters := []Filter{
+			Eq("category", "shoes"),
+			And(Eq("category", "shoes"), Eq("in_stock", true), Lt("price", 200)),
+			Or(Eq("category", "shoes"), In("in_stock", "absent")),
+		}
+		for _, filter := range filters {
+			for _, query := range vecs[:20] {
+				nns := search(t, query, filter, 5)
+				found := make([]string, len(nns))
+				for i, nn := range nns {
+					found[i] = nn.ID
+				}
+				if expected := exact(query, filter, 5); !reflect.DeepEqual(found, expected) {
+					t.Fatalf("Selective filter must find the exact neighbors %v, got %v", expected, found)
+				}
+			}
+		}
+	})
+
+	t.Run("Scanned", func(t *testing.T) {
+		filters := []Filter{
+			Between("price", 100, 200),
+			Not(Eq("category", "shoes")),
+			Eq("category", "hats"), // NOTE: indexed, but too many vectors match
+		}
+		for _, filter := range filters {
+			for _, query := range vecs[:20] {
+				search(t, query, filter, 5)
+			}
+		}
+	})
+
+	t.Run("ReadFailed", func(t *testing.T) {
+		dump, err := lsh.DumpHasher()
+		if err != nil {
+			t.Fatal(err)
+		}
+		failing, err := NewLsh(config, &postingsStore{KVStore: s, err: writeFailedErr}, NewL2())
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = failing.LoadHasher(dump)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = failing.SearchWithOptions(vecs[0], 5, 1e6, SearchOptions{Filter: Eq("category", "shoes")})
+		if !errors.Is(err, writeFailedErr) {
+			t.Errorf("Inverted index read errors must be returned, got %v", err)
+		}
+	})
+
+	t.Run("Retrain", func(t *testing.T) {
+		err := lsh.TrainWithPayloads(vecs, ids, payloads)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = lsh.WaitGC()
+		if err != nil {
+			t.Fatal(err)
+		}
+		buckets, err := s.ListBuckets()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, bucket := range buckets {
+			if bucket.Table&payloadTableBit != 0 && bucket.Table != tableKey(lsh.Generation(), 0)|payloadTableBit {
+				t.Fatalf("Inverted index must be dropped along with its generation, got %v", bucket)
+			}
+		}
+		query := vecs[0]
+		filter := Eq("category", "shoes")
+		nns := search(t, query, filter, 5)
+		if len(nns) != 5 || nns[0].ID != exact(query, filter, 1)[0] {
+			t.Errorf("Inverted index of the new generation must be used, got %v", nns)
+		}
+	})
+}
+
+func TestDelete(t *testing.T) {
+	rand.Seed(time.Now().UnixNano())
+	nVecs := 200
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:     50,
+			MaxCandidates: nVecs,
+			IndexedFields: []string{"group"},
+		},
+		HasherConfig: HasherConfig{NTrees: 5, KMinVecs: 10, Dims: 2},
+	}
+	vecs := make([][]float64, nVecs)
+	ids := make([]string, nVecs)
+	payloads := make([]Payload, nVecs)
+	for i := range vecs {
+		vecs[i] = []float64{rand.NormFloat64(), rand.NormFloat64()}
+		ids[i] = strconv.Itoa(i)
+		payloads[i] = Payload{"group": i % 5}
+	}
+	s := kv.NewKVStore()
+	lsh, err := NewLsh(config, s, NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsh.TrainWithPayloads(vecs, ids, payloads)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// checkDeleted checks that the deleted vectors aren't found, while the rest are
+	checkDeleted := func(t *testing.T, lsh *LSHIndex, deleted map[string]bool) {
+		for i, vec := range vecs {
+			for _, options := range []SearchOptions{{}, {Filter: Eq("group", i%5)}} {
+				nns, err := lsh.SearchWithOptions(vec, 1, 1e-6, options)
+				if err != nil {
+					t.Fatal(err)
+				}
+				found := len(nns) > 0 && nns[0].ID == ids[i]
+				if found == deleted[ids[i]] {
+					t.Fatalf("Vector %v must be found: %v, got %v", ids[i], !deleted[ids[i]], nns)
+				}
+			}
+		}
+	}
+	deleted := make(map[string]bool)
+	for _, id := range ids[:40] {
+		deleted[id] = true
+	}
+
+	t.Run("Tombstones", func(t *testing.T) {
+		err := lsh.Delete(ids[:40])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = lsh.Delete([]string{"absent"}); err == nil {
+			t.Error("Absent vector must not be deleted")
+		}
+		checkDeleted(t, lsh, deleted)
+		dump, err := lsh.DumpHasher()
+		if err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := NewLsh(config, s, NewL2())
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = loaded.LoadHasher(dump)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkDeleted(t, loaded, deleted)
+		failing, err := NewLsh(config, &bucketsStore{KVStore: s, err: writeFailedErr}, NewL2())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = failing.LoadHasher(dump); !errors.Is(err, writeFailedErr) {
+			t.Errorf("Tombstones read failure must be returned, got %v", err)
+		}
+	})
+
+	t.Run("Compact", func(t *testing.T) {
+		c := NewCompactor(lsh, CompactorConfig{Interval: -1, BatchSize: 7})
+		defer c.Close()
+		if stats := c.Stats(); stats.Pending != 40 {
+			t.Fatalf("All the tombstones must be pending, got %+v", stats)
+		}
+		stop := make(chan struct{})
+		wg := sync.WaitGroup{}
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					_, err := lsh.SearchWithOptions(vecs[rand.Intn(nVecs)], 5, 10, SearchOptions{WithPayload: true})
+					if err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}()
+		}
+		err := c.Compact()
+		close(stop)
+		wg.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stats := c.Stats()
+		if stats.Pending != 0 || stats.Purged != 40 || stats.Batches != 6 || stats.Runs != 1 || stats.LastErr != nil {
+			t.Errorf("Wrong compaction stats: %+v", stats)
+		}
+		checkDeleted(t, lsh, deleted)
+		count, err := s.CountVectors()
+		if err != nil || count != nVecs-40 {
+			t.Errorf("Deleted vectors must be removed from the store: %v, %v", count, err)
+		}
+		buckets, err := s.ListBuckets()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, bucket := range buckets {
+			if bucket == tombstoneKey(lsh.Generation()) {
+				t.Fatal("Tombstones bucket must be removed")
+			}
+			iter, err := s.GetHashIterator(bucket)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for {
+				id, ok := iter.Next()
+				if !ok {
+					break
+				}
+				if deleted[id] {
+					t.Fatalf("Deleted vector %v must be removed from the bucket %v", id, bucket)
+				}
+			}
+			iter.Close()
+		}
+	})
+
+	t.Run("Background", func(t *testing.T) {
+		c := NewCompactor(lsh, CompactorConfig{Interval: 5 * time.Millisecond, BatchSize: 3})
+		defer c.Close()
+		err := lsh.Delete(ids[40:50])
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, id := range ids[40:50] {
+			deleted[id] = true
+		}
+		for start := time.Now(); c.Stats().Pending > 0; time.Sleep(time.Millisecond) {
+			if time.Since(start) > 5*time.Second {
+				t.Fatalf("Tombstones must be purged in background: %+v", c.Stats())
+			}
+		}
+		checkDeleted(t, lsh, deleted)
+		// NOTE: the new index doesn't inherit tombstones
+		err = lsh.Delete(ids[50:60])
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = lsh.TrainWithPayloads(vecs, ids, payloads)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkDeleted(t, lsh, map[string]bool{})
+		if c.Close() != nil || c.Close() != nil {
+			t.Error("Compactor must be closed more than once")
+		}
+	})
+}
+
+func TestExpiry(t *testing.T) {
+	rand.Seed(time.Now().UnixNano())
+	nVecs := 200
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:     50,
+			MaxCandidates: nVecs,
+			IndexedFields: []string{"group"},
+		},
+		HasherConfig: HasherConfig{NTrees: 5, KMinVecs: 10, Dims: 2},
+	}
+	vecs := make([][]float64, nVecs)
+	ids := make([]string, nVecs)
+	payloads := make([]Payload, nVecs)
+	expires := make([]time.Time, nVecs)
+	expired := make(map[string]bool)
+	for i := range vecs {
+		vecs[i] = []float64{rand.NormFloat64(), rand.NormFloat64()}
+		ids[i] = strconv.Itoa(i)
+		payloads[i] = Payload{"group": i % 5}
+		switch i % 4 {
+		case 0:
+			expires[i] = time.Now().Add(-time.Minute)
+			expired[ids[i]] = true
+		case 1:
+			expires[i] = time.Now().Add(time.Hour)
+		}
+	}
+	s := kv.NewKVStore()
+	lsh, err := NewLsh(config, s, NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsh.Insert(vecs, ids, WriteOptions{})
+	if err != notTrainedErr {
+		t.Fatalf("Untrained index must not accept inserts, got %v", err)
+	}
+	half := nVecs / 2
+	err = lsh.TrainWithOptions(vecs[:half], ids[:half], WriteOptions{Payloads: payloads[:half], ExpiresAt: expires[:half]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// checkExpired checks that the expired vectors aren't found, while the rest are
+	checkExpired := func(t *testing.T, lsh *LSHIndex, n int) {
+		for i, vec := range vecs[:n] {
+			for _, options := range []SearchOptions{{}, {Filter: Eq("group", i%5)}} {
+				nns, err := lsh.SearchWithOptions(vec, 1, 1e-6, options)
+				if err != nil {
+					t.Fatal(err)
+				}
+				found := len(nns) > 0 && nns[0].ID == ids[i]
+				if found == expired[ids[i]] {
+					t.Fatalf("Vector %v must be found: %v, got %v", ids[i], !expired[ids[i]], nns)
+				}
+			}
+		}
+	}
+
+	t.Run("Insert", func(t *testing.T) {
+		checkExpired(t, lsh, half)
+		err := lsh.Insert(vecs[half:], ids[half:], WriteOptions{ExpiresAt: expires[:1]})
+		if err != expiresLengthErr {
+			t.Fatalf("Expiry times length must be checked, got %v", err)
+		}
+		err = lsh.Insert(vecs[:1], ids[:1], WriteOptions{})
+		if err != vectorExistsErr {
+			t.Fatalf("Vectors already in the index must not be inserted, got %v", err)
+		}
+		err = lsh.Insert(vecs[half:half+2], []string{ids[half], ids[half]}, WriteOptions{})
+		if err != vectorExistsErr {
+			t.Fatalf("Repeated ids must not be inserted, got %v", err)
+		}
+		err = lsh.Insert(vecs[half:], ids[half:half+1], WriteOptions{})
+		if err != idsLengthErr {
+			t.Fatalf("Ids length must be checked, got %v", err)
+		}
+		failing, err := NewLsh(config, &vectorsStore{KVStore: s, err: writeFailedErr}, NewL2())
+		if err != nil {
+			t.Fatal(err)
+		}
+		dump, err := lsh.DumpHasher()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = failing.LoadHasher(dump)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = failing.Insert(vecs[half:], ids[half:], WriteOptions{}); !errors.Is(err, writeFailedErr) {
+			t.Fatalf("Vectors read failure must be returned, got %v", err)
+		}
+		generation := lsh.Generation()
+		err = lsh.Insert(vecs[half:], ids[half:], WriteOptions{Payloads: payloads[half:], ExpiresAt: expires[half:]})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lsh.Generation() != generation {
+			t.Fatal("Insert must not retrain the index")
+		}
+		checkExpired(t, lsh, nVecs)
+		nns, err := lsh.SearchWithOptions(vecs[nVecs-1], 1, 1e-6, SearchOptions{WithPayload: true})
+		if err != nil || len(nns) != 1 || nns[0].Payload["group"] != float64((nVecs-1)%5) {
+			t.Fatalf("Payload of the inserted vector must be returned: %v, %v", nns, err)
+		}
+	})
+
+	t.Run("Reload", func(t *testing.T) {
+		dump, err := lsh.DumpHasher()
+		if err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := NewLsh(config, s, NewL2())
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = loaded.LoadHasher(dump)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkExpired(t, loaded, nVecs)
+	})
+
+	t.Run("Reap", func(t *testing.T) {
+		c := NewCompactor(lsh, CompactorConfig{Interval: -1, BatchSize: 7})
+		defer c.Close()
+		if stats := c.Stats(); stats.Expiring != nVecs/2 || stats.Pending != 0 {
+			t.Fatalf("Expiring vectors must be counted, got %+v", stats)
+		}
+		err := c.Compact()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stats := c.Stats()
+		if stats.Expired != uint64(len(expired)) || stats.Purged != uint64(len(expired)) || stats.Expiring != nVecs/4 || stats.Pending != 0 {
+			t.Errorf("Wrong reaping stats: %+v", stats)
+		}
+		checkExpired(t, lsh, nVecs)
+		count, err := s.CountVectors()
+		if err != nil || count != nVecs-len(expired) {
+			t.Errorf("Expired vectors must be removed from the store: %v, %v", count, err)
+		}
+		buckets, err := s.ListBuckets()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, bucket := range buckets {
+			iter, err := s.GetHashIterator(bucket)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for {
+				id, ok := iter.Next()
+				if !ok {
+					break
+				}
+				if expired[id] {
+					t.Fatalf("Expired vector %v must be removed from the bucket %v", id, bucket)
+				}
+			}
+			iter.Close()
+		}
+		// NOTE: ids of the purged vectors can be inserted again
+		err = lsh.Insert(vecs[:1], ids[:1], WriteOptions{Payloads: payloads[:1]})
+		if err != nil {
+			t.Fatal(err)
+		}
+		delete(expired, ids[0])
+		checkExpired(t, lsh, nVecs)
+	})
+}
+
+func TestSnapshots(t *testing.T) {
+	rand.Seed(time.Now().UnixNano())
+	nVecs := 300
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:     5, // NOTE: small batches, so Rollback streams vectors in several chunks
+			MaxCandidates: nVecs,
+		},
+		HasherConfig: HasherConfig{NTrees: 5, KMinVecs: 10, Dims: 2},
+	}
+	vecs := make([][]float64, nVecs)
+	ids := make([]string, nVecs)
+	payloads := make([]Payload, nVecs)
+	expires := make([]time.Time, nVecs)
+	for i := range vecs {
+		vecs[i] = []float64{rand.NormFloat64(), rand.NormFloat64()}
+		ids[i] = strconv.Itoa(i)
+		payloads[i] = Payload{"group": i % 5}
+		if i%3 == 0 {
+			expires[i] = time.Now().Add(time.Hour)
+		}
+	}
+	dir, err := ioutil.TempDir("", "lsh-snapshots")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	lsh, err := NewLsh(config, kv.NewKVStore(), NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsh.TrainWithPayloads(vecs[:100], ids[:100], payloads[:100])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsh.Insert(vecs[100:150], ids[100:150], WriteOptions{Payloads: payloads[100:150], ExpiresAt: expires[100:150]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsh.Delete(ids[:10])
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshots, err := NewSnapshots(lsh, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// search returns neighbors of the every vector, so the indexes can be compared
+	search := func(t *testing.T) [][]Neighbor {
+		results := make([][]Neighbor, nVecs)
+		for i, vec := range vecs {
+			nns, err := lsh.SearchWithOptions(vec, 5, 1e6, SearchOptions{WithPayload: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			results[i] = nns
+		}
+		return results
+	}
+
+	t.Run("Rollback", func(t *testing.T) {
+		info, err := snapshots.Create("a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Vectors != 150 || info.Deleted != 10 || info.Written != 150 || info.Parent != "" {
+			t.Fatalf("Wrong snapshot info: %+v", info)
+		}
+		if _, err := snapshots.Create("a"); err != snapshotExistsErr {
+			t.Fatalf("Snapshot must not be overwritten, got %v", err)
+		}
+		expected := search(t)
+		generation := lsh.Generation()
+		err = lsh.Insert(vecs[150:250], ids[150:250], WriteOptions{Payloads: payloads[150:250]})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = lsh.Delete(ids[10:20])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reflect.DeepEqual(search(t), expected) {
+			t.Fatal("Search results must change after the bad batch")
+		}
+		err = snapshots.Rollback("a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lsh.Generation() == generation {
+			t.Error("Restored index must be written as the new generation")
+		}
+		if restored := search(t); !reflect.DeepEqual(restored, expected) {
+			t.Fatalf("Restored index returns different results: expected %v, got %v", expected, restored)
+		}
+		if err := snapshots.Rollback("missing"); err != snapshotNotFoundErr {
+			t.Fatalf("Absent snapshot must not be restored, got %v", err)
+		}
+		if err := snapshots.Rollback("../a"); err == nil || err == snapshotNotFoundErr {
+			t.Fatalf("Snapshot name must be validated, got %v", err)
+		}
+	})
+
+	t.Run("Incremental", func(t *testing.T) {
+		err := lsh.Insert(vecs[250:], ids[250:], WriteOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := snapshots.Create("b")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Vectors != 200 || info.Written != 50 || info.Parent != "a" {
+			t.Fatalf("Only the new vectors must be written: %+v", info)
+		}
+		expected := search(t)
+		err = snapshots.Delete("a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = lsh.Delete(ids[250:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		// NOTE: vectors shared with the deleted snapshot must be kept
+		snapshots, err = NewSnapshots(lsh, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		infos, err := snapshots.List()
+		if err != nil || len(infos) != 1 || infos[0].Name != "b" {
+			t.Fatalf("Only the remaining snapshot must be listed: %+v, %v", infos, err)
+		}
+		err = snapshots.Rollback("b")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if restored := search(t); !reflect.DeepEqual(restored, expected) {
+			t.Fatalf("Restored index returns different results: expected %v, got %v", expected, restored)
+		}
+		if err := snapshots.Delete("a"); err != snapshotNotFoundErr {
+			t.Fatalf("Absent snapshot must not be deleted, got %v", err)
+		}
+	})
+
+	t.Run("Concurrent", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "lsh-snapshots")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		s := newBlockingStore()
+		scanned, err := NewLsh(config, s, NewL2())
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = scanned.Train(vecs[:100], ids[:100])
+		if err != nil {
+			t.Fatal(err)
+		}
+		generation := scanned.Generation()
+		snapshots, err := NewSnapshots(scanned, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.token <- struct{}{}
+		var info SnapshotInfo
+		created := make(chan error, 1)
+		go func() {
+			var err error
+			info, err = snapshots.Create("c")
+			created <- err
+		}()
+		<-s.started
+		written := make(chan error, 1)
+		go func() {
+			err := scanned.Insert(vecs[100:150], ids[100:150], WriteOptions{})
+			if err == nil {
+				err = scanned.Train(vecs[150:], ids[150:])
+			}
+			written <- err
+		}()
+		select {
+		case err = <-written:
+		case <-time.After(5 * time.Second):
+			err = errors.New("Writes are blocked by the snapshot")
+		}
+		close(s.release)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = <-created
+		if err != nil {
+			t.Fatal(err)
+		}
+		// NOTE: the scan has started after the insert, but before the replaced generation is dropped
+		if info.Generation != generation || info.Vectors != 150 {
+			t.Errorf("Snapshot must hold the pinned generation: %+v", info)
+		}
+		checkLayout(t, scanned, generation+1, nVecs-150)
+	})
+}
+
 func TestDumpHasher(t *testing.T) {
 	config := HasherConfig{
 		NTrees:   2,
@@ -133,6 +1815,149 @@ func TestDumpHasher(t *testing.T) {
 	if coefToTest != hasher.trees[0].plane.d {
 		t.Fatal("Seems like the deserialized hasher differs from the initial one")
 	}
+
+	loaded := NewHasher(HasherConfig{})
+	err = loaded.load(b)
+	if err != nil {
+		t.Fatalf("Could not deserialize hasher: %v", err)
+	}
+	if !reflect.DeepEqual(hasher.getHashes(vecs[0]), loaded.getHashes(vecs[0])) {
+		t.Fatal("Deserialized hasher must produce the same hashes")
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	vecs := [][]float64{
+		[]float64{1.0, 10.0, -3.0},
+		[]float64{2.0, 20.0, -1.0},
+		[]float64{3.0, 30.0, 1.0},
+		[]float64{4.0, 40.0, 3.0},
+	}
+	pipeline, err := NewPipeline([]TransformerConfig{
+		{Kind: StandardScaling},
+		{Kind: L2Normalization},
+		{Kind: RandomProjecting, Dims: 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = pipeline.Fit(vecs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transformed := pipeline.Transform(vecs[0])
+	if len(transformed) != 2 {
+		t.Fatalf("Transformed vector must have 2 dimensions, got %v", len(transformed))
+	}
+	if !reflect.DeepEqual(vecs[0], []float64{1.0, 10.0, -3.0}) {
+		t.Fatal("Input vector must stay untouched")
+	}
+
+	b, err := gobEncode(pipeline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := &Pipeline{}
+	err = gobDecode(b, loaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(transformed, loaded.Transform(vecs[0])) {
+		t.Fatal("Deserialized pipeline must produce the same vectors")
+	}
+
+	_, err = NewPipeline([]TransformerConfig{{Kind: RandomProjecting}})
+	if err == nil {
+		t.Fatal("Random projection without dimensions must not be created")
+	}
+}
+
+func TestPCA(t *testing.T) {
+	rand.Seed(time.Now().UnixNano())
+	// NOTE: points lie on the plane z = x + y, so two components must explain all the variance
+	vecs := make([][]float64, 100)
+	for i := range vecs {
+		x, y := rand.NormFloat64()*3, rand.NormFloat64()
+		vecs[i] = []float64{x, y, x + y}
+	}
+	pca := NewPCA(2, 50)
+	err := pca.Fit(vecs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ratio := pca.ExplainedVarianceRatio()
+	if len(ratio) != 2 || math.Abs(ratio[0]+ratio[1]-1.0) > tol {
+		t.Fatalf("Two components must explain all the variance, got %v", ratio)
+	}
+	if ratio[0] < ratio[1] {
+		t.Fatalf("Components must be sorted by explained variance, got %v", ratio)
+	}
+	projected := pca.Transform(vecs[0])
+	if len(projected) != 2 {
+		t.Fatalf("Projected vector must have 2 dimensions, got %v", len(projected))
+	}
+	restored := pca.InverseTransform(projected)
+	for i := range vecs[0] {
+		if math.Abs(restored[i]-vecs[0][i]) > tol {
+			t.Fatalf("Restored vector differs from the original one: %v vs %v", restored, vecs[0])
+		}
+	}
+
+	b, err := gobEncode(pca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := &PCA{}
+	err = gobDecode(b, loaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(projected, loaded.Transform(vecs[0])) {
+		t.Fatal("Deserialized PCA must produce the same vectors")
+	}
+
+	err = NewPCA(4, 0).Fit(vecs)
+	if err == nil {
+		t.Fatal("PCA must not have more components than the data dimensions")
+	}
+}
+
+func TestLshPipeline(t *testing.T) {
+	inpVecs, trainIds := getTestLSHData()
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:     2,
+			MaxCandidates: 10,
+		},
+		HasherConfig: HasherConfig{
+			NTrees:   10,
+			KMinVecs: 2,
+			Dims:     2,
+			Transformers: []TransformerConfig{
+				{Kind: StandardScaling},
+				{Kind: PCAReduction, Dims: 2},
+				{Kind: L2Normalization},
+			},
+		},
+	}
+	lsh, err := NewLsh(config, kv.NewKVStore(), NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsh.Train(inpVecs, trainIds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nns, err := lsh.Search(inpVecs[0], 4, 0.02)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nns) == 0 {
+		t.Fatal("Query point must have neighbors")
+	}
+	if nns[0].ID != trainIds[0] || !reflect.DeepEqual(nns[0].Vec, inpVecs[0]) {
+		t.Fatalf("Closest neighbor must be the original query vector, got %v", nns[0])
+	}
 }
 
 func TestNewVec(t *testing.T) {
@@ -225,6 +2050,120 @@ func TestScaler(t *testing.T) {
 	}
 }
 
+func TestStreamingStats(t *testing.T) {
+	stats := NewStats(1000)
+	for i := 0; i <= 100; i++ {
+		err := stats.Push([]float64{float64(i), 1.0})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := stats.Push([]float64{1.0})
+	if err == nil {
+		t.Fatal("Vectors with different dimensions number must not be accepted")
+	}
+	if stats.Count() != 101 {
+		t.Fatalf("Stats must count 101 vectors, got %v", stats.Count())
+	}
+	mean, std := stats.Mean(), stats.Std()
+	// NOTE: population std of 0..100 sequence is sqrt((101^2-1)/12)
+	if math.Abs(mean[0]-50.0) > tol || math.Abs(std[0]-math.Sqrt((101*101-1)/12.0)) > tol {
+		t.Errorf("Wrong mean or std: %v, %v", mean[0], std[0])
+	}
+	if math.Abs(mean[1]-1.0) > tol || std[1] > tol {
+		t.Errorf("Wrong mean or std of the constant dimension: %v, %v", mean[1], std[1])
+	}
+	if stats.Min()[0] != 0.0 || stats.Max()[0] != 100.0 {
+		t.Errorf("Wrong min or max: %v, %v", stats.Min()[0], stats.Max()[0])
+	}
+	median, err := stats.Quantile(0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(median[0]-50.0) > tol {
+		t.Errorf("Wrong median: %v", median[0])
+	}
+	_, err = NewStats(0).Quantile(0.5)
+	if err == nil {
+		t.Error("Quantiles must not be available without reservoir")
+	}
+
+	s := kv.NewKVStore()
+	err = s.SetVectors([]string{"0", "1"}, [][]float64{{1.0, 2.0}, {3.0, 4.0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	it, err := s.GetVectorIterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	scanStats := NewStats(0)
+	err = scanStats.PushIterator(it)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(scanStats.Mean(), []float64{2.0, 3.0}) {
+		t.Errorf("Wrong mean of the scanned vectors: %v", scanStats.Mean())
+	}
+}
+
+func TestScalers(t *testing.T) {
+	vecs := [][]float64{
+		[]float64{1.0, 5.0},
+		[]float64{2.0, 5.0},
+		[]float64{3.0, 5.0},
+		[]float64{4.0, 5.0},
+		[]float64{100.0, 5.0},
+	}
+	scalers := map[string]InverseTransformer{
+		"Standart": &StandartScaler{},
+		"MinMax":   NewMinMaxScaler(),
+		"Robust":   NewRobustScaler(),
+	}
+	for name, scaler := range scalers {
+		t.Run(name, func(t *testing.T) {
+			err := scaler.Fit(vecs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, vec := range vecs {
+				scaled := scaler.Transform(vec)
+				if math.Abs(scaled[1]) > tol {
+					t.Errorf("Constant dimension must be scaled to zero, got %v", scaled[1])
+				}
+				restored := scaler.InverseTransform(scaled)
+				for i := range vec {
+					if math.Abs(restored[i]-vec[i]) > tol {
+						t.Fatalf("Restored vector differs from the original one: %v vs %v", restored, vec)
+					}
+				}
+			}
+			b, err := gobEncode(&Pipeline{Steps: []Transformer{scaler}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			loaded := &Pipeline{}
+			err = gobDecode(b, loaded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(scaler.Transform(vecs[0]), loaded.Transform(vecs[0])) {
+				t.Fatal("Deserialized scaler must produce the same vectors")
+			}
+		})
+	}
+	minMax := scalers["MinMax"].Transform(vecs[4])
+	if math.Abs(minMax[0]-1.0) > tol {
+		t.Errorf("Max value must be scaled to 1.0, got %v", minMax[0])
+	}
+	// NOTE: median is 3 and IQR is 2, so the outlier doesn't affect the scale
+	robust := scalers["Robust"].Transform(vecs[0])
+	if math.Abs(robust[0]+1.0) > tol {
+		t.Errorf("Robust scaler must use median and IQR, got %v", robust[0])
+	}
+}
+
 func testLSH(metric Metric, config Config, maxNN int, distanceThrsh float64, trainSet [][]float64, trainIds []string, t *testing.T) {
 	s := kv.NewKVStore()
 	lsh, err := NewLsh(config, s, metric)
@@ -0,0 +1,84 @@
+package lsh
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gasparian/lsh-search-go/store"
+)
+
+var (
+	payloadsLengthErr      = errors.New("Payloads must be set for every vector or not set at all")
+	payloadsUnsupportedErr = errors.New("Store must implement store.PayloadStore to keep payloads")
+)
+
+// Payload holds arbitrary fields attached to the vector, like title, category or URL.
+// Payloads are stored JSON-encoded, so values read back have JSON types:
+// numbers become float64, slices - []interface{} and nested maps - map[string]interface{}
+type Payload map[string]interface{}
+
+// SearchOptions defines which candidates are considered and what is returned along with the found neighbors
+type SearchOptions struct {
+	Filter      Filter // NOTE: nil means no filtering
+	WithPayload bool
+	Fields      []string // NOTE: payload fields to return, all of them if empty
+}
+
+func encodePayloads(payloads []Payload) ([][]byte, error) {
+	encoded := make([][]byte, len(payloads))
+	for i, payload := range payloads {
+		if payload == nil {
+			continue
+		}
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		encoded[i] = data
+	}
+	return encoded, nil
+}
+
+// decodePayload decodes the stored payload, keeping the given fields only, if any
+func decodePayload(data []byte, fields []string) (Payload, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	payload := make(Payload)
+	err := json.Unmarshal(data, &payload)
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return payload, nil
+	}
+	selected := make(Payload, len(fields))
+	for _, field := range fields {
+		if value, ok := payload[field]; ok {
+			selected[field] = value
+		}
+	}
+	return selected, nil
+}
+
+// attachPayloads reads payloads of the found neighbors from the generation they have been found in;
+// neighbors without payload get nil
+func (lsh *LSHIndex) attachPayloads(neighbors []Neighbor, generation uint32, fields []string) error {
+	if len(neighbors) == 0 {
+		return nil
+	}
+	keys := make([]string, len(neighbors))
+	for i := range neighbors {
+		keys[i] = vectorKey(generation, neighbors[i].ID)
+	}
+	payloads, err := lsh.index.(store.PayloadStore).GetPayloads(keys)
+	if err != nil {
+		return err
+	}
+	for i := range neighbors {
+		neighbors[i].Payload, err = decodePayload(payloads[i], fields)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
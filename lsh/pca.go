@@ -0,0 +1,153 @@
+package lsh
+
+import (
+	"errors"
+	"gonum.org/v1/gonum/mat"
+)
+
+var (
+	pcaDimsErr       = errors.New("PCA components number must be positive and not larger than the data dimensionality")
+	pcaSampleSizeErr = errors.New("PCA needs at least two vectors to fit")
+	svdErr           = errors.New("SVD factorization failed")
+)
+
+// PCA projects vectors onto the principal components of the train data
+type PCA struct {
+	dims              int
+	sampleSize        int
+	mean              *mat.VecDense
+	components        *mat.Dense // NOTE: inDims x dims, components are stored as columns
+	explainedVariance []float64
+	totalVariance     float64
+}
+
+// NewPCA creates PCA with the given number of components,
+// which will be fitted on the random sample of vectors (all vectors are used when sampleSize <= 0)
+func NewPCA(dims, sampleSize int) *PCA {
+	return &PCA{
+		dims:       dims,
+		sampleSize: sampleSize,
+	}
+}
+
+// Fit finds principal components with SVD of the centered data sample
+func (p *PCA) Fit(vecs [][]float64) error {
+	sample := sampleVecs(vecs, p.sampleSize)
+	if len(sample) < 2 {
+		return pcaSampleSizeErr
+	}
+	nSamples, inDims := len(sample), len(sample[0])
+	if p.dims <= 0 || p.dims > inDims || p.dims > nSamples {
+		return pcaDimsErr
+	}
+	mean := mat.NewVecDense(inDims, nil)
+	for _, vec := range sample {
+		mean.AddVec(mean, mat.NewVecDense(inDims, vec))
+	}
+	mean.ScaleVec(1/float64(nSamples), mean)
+	centered := mat.NewDense(nSamples, inDims, nil)
+	for i, vec := range sample {
+		row := centered.RawRowView(i)
+		for j, val := range vec {
+			row[j] = val - mean.AtVec(j)
+		}
+	}
+
+	var svd mat.SVD
+	if !svd.Factorize(centered, mat.SVDThin) {
+		return svdErr
+	}
+	values := svd.Values(nil)
+	var v mat.Dense
+	svd.VTo(&v)
+
+	explained := make([]float64, len(values))
+	var total float64
+	for i, val := range values {
+		explained[i] = val * val / float64(nSamples-1)
+		total += explained[i]
+	}
+	components := mat.NewDense(inDims, p.dims, nil)
+	components.Copy(v.Slice(0, inDims, 0, p.dims))
+
+	p.mean = mean
+	p.components = components
+	p.explainedVariance = explained[:p.dims]
+	p.totalVariance = total
+	return nil
+}
+
+// Transform projects the vector onto the principal components
+func (p *PCA) Transform(vec []float64) []float64 {
+	centered := mat.NewVecDense(len(vec), nil)
+	centered.SubVec(mat.NewVecDense(len(vec), vec), p.mean)
+	res := mat.NewVecDense(p.dims, nil)
+	res.MulVec(p.components.T(), centered)
+	return res.RawVector().Data
+}
+
+// InverseTransform maps projected vector back to the original space
+func (p *PCA) InverseTransform(vec []float64) []float64 {
+	inDims, _ := p.components.Dims()
+	res := mat.NewVecDense(inDims, nil)
+	res.MulVec(p.components, mat.NewVecDense(len(vec), vec))
+	res.AddVec(res, p.mean)
+	return res.RawVector().Data
+}
+
+// ExplainedVariance returns variance of the data along each of the kept components
+func (p *PCA) ExplainedVariance() []float64 {
+	res := make([]float64, len(p.explainedVariance))
+	copy(res, p.explainedVariance)
+	return res
+}
+
+// ExplainedVarianceRatio returns fraction of the total data variance kept by each component
+func (p *PCA) ExplainedVarianceRatio() []float64 {
+	res := make([]float64, len(p.explainedVariance))
+	if p.totalVariance <= tol {
+		return res
+	}
+	for i, val := range p.explainedVariance {
+		res[i] = val / p.totalVariance
+	}
+	return res
+}
+
+type pcaDump struct {
+	Dims              int
+	SampleSize        int
+	Mean              []float64
+	Components        []float64
+	ExplainedVariance []float64
+	TotalVariance     float64
+}
+
+func (p *PCA) GobEncode() ([]byte, error) {
+	if p.components == nil {
+		return nil, transformerNotFitErr
+	}
+	return gobEncode(pcaDump{
+		Dims:              p.dims,
+		SampleSize:        p.sampleSize,
+		Mean:              p.mean.RawVector().Data,
+		Components:        p.components.RawMatrix().Data,
+		ExplainedVariance: p.explainedVariance,
+		TotalVariance:     p.totalVariance,
+	})
+}
+
+func (p *PCA) GobDecode(inp []byte) error {
+	dump := pcaDump{}
+	err := gobDecode(inp, &dump)
+	if err != nil {
+		return err
+	}
+	p.dims = dump.Dims
+	p.sampleSize = dump.SampleSize
+	p.mean = mat.NewVecDense(len(dump.Mean), dump.Mean)
+	p.components = mat.NewDense(len(dump.Mean), dump.Dims, dump.Components)
+	p.explainedVariance = dump.ExplainedVariance
+	p.totalVariance = dump.TotalVariance
+	return nil
+}
@@ -0,0 +1,210 @@
+package lsh
+
+import (
+	"gonum.org/v1/gonum/blas/blas64"
+	"sync"
+)
+
+const (
+	// NOTE: reservoir size used to estimate quantiles by the RobustScaler
+	robustReservoirSize = 10000
+)
+
+// affineScaler transforms each dimension independently: (x - shift) / scale
+type affineScaler struct {
+	mx    sync.RWMutex
+	shift []float64
+	scale []float64
+}
+
+// set updates scaler parameters; constant dimensions (zero scale) are only shifted
+func (s *affineScaler) set(shift, scale []float64) {
+	scaleCpy := make([]float64, len(scale))
+	for i, val := range scale {
+		scaleCpy[i] = val
+		if val <= tol {
+			scaleCpy[i] = 1.0
+		}
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.shift = copyVec(shift)
+	s.scale = scaleCpy
+}
+
+// Transform returns the scaled copy of the vector
+func (s *affineScaler) Transform(vec []float64) []float64 {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	res := make([]float64, len(vec))
+	for i, val := range vec {
+		res[i] = (val - s.shift[i]) / s.scale[i]
+	}
+	return res
+}
+
+// InverseTransform maps scaled vector back to the original space
+func (s *affineScaler) InverseTransform(vec []float64) []float64 {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	res := make([]float64, len(vec))
+	for i, val := range vec {
+		res[i] = val*s.scale[i] + s.shift[i]
+	}
+	return res
+}
+
+type affineScalerDump struct {
+	Shift []float64
+	Scale []float64
+}
+
+func (s *affineScaler) GobEncode() ([]byte, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	if s.shift == nil || s.scale == nil {
+		return nil, transformerNotFitErr
+	}
+	return gobEncode(affineScalerDump{
+		Shift: s.shift,
+		Scale: s.scale,
+	})
+}
+
+func (s *affineScaler) GobDecode(inp []byte) error {
+	dump := affineScalerDump{}
+	err := gobDecode(inp, &dump)
+	if err != nil {
+		return err
+	}
+	s.set(dump.Shift, dump.Scale)
+	return nil
+}
+
+// StandartScaler centers data and scales it to the unit variance
+type StandartScaler struct {
+	affineScaler
+}
+
+func checkConvertVec(inp []float64, fill float64, nDims int) blas64.Vector {
+	inpVecInternal := NewVec(make([]float64, nDims))
+	if inp != nil && len(inp) == nDims {
+		inpVecInternal.Data = inp
+		copy(inpVecInternal.Data, inp)
+		return inpVecInternal
+	}
+	if fill > 0 {
+		for i := range inpVecInternal.Data {
+			inpVecInternal.Data[i] = fill
+		}
+	}
+	return inpVecInternal
+}
+
+func NewStandartScaler(mean, std []float64, nDims int) *StandartScaler {
+	scaler := &StandartScaler{}
+	scaler.set(checkConvertVec(mean, 0.0, nDims).Data, checkConvertVec(std, 1.0, nDims).Data)
+	return scaler
+}
+
+// Fit calculates mean and std of the given vectors
+func (s *StandartScaler) Fit(vecs [][]float64) error {
+	stats := NewStats(0)
+	err := stats.PushMany(vecs)
+	if err != nil {
+		return err
+	}
+	return s.FitStats(stats)
+}
+
+// FitStats sets scaler parameters from the accumulated stats
+func (s *StandartScaler) FitStats(stats *Stats) error {
+	if stats.Count() == 0 {
+		return statsEmptyErr
+	}
+	s.set(stats.Mean(), stats.Std())
+	return nil
+}
+
+func (s *StandartScaler) Scale(vec []float64) blas64.Vector {
+	return NewVec(s.Transform(vec))
+}
+
+// MinMaxScaler scales data to the [0, 1] range
+type MinMaxScaler struct {
+	affineScaler
+}
+
+func NewMinMaxScaler() *MinMaxScaler {
+	return &MinMaxScaler{}
+}
+
+// Fit calculates min and max of the given vectors
+func (s *MinMaxScaler) Fit(vecs [][]float64) error {
+	stats := NewStats(0)
+	err := stats.PushMany(vecs)
+	if err != nil {
+		return err
+	}
+	return s.FitStats(stats)
+}
+
+// FitStats sets scaler parameters from the accumulated stats
+func (s *MinMaxScaler) FitStats(stats *Stats) error {
+	if stats.Count() == 0 {
+		return statsEmptyErr
+	}
+	min, max := stats.Min(), stats.Max()
+	scale := make([]float64, len(min))
+	for i := range min {
+		scale[i] = max[i] - min[i]
+	}
+	s.set(min, scale)
+	return nil
+}
+
+// RobustScaler centers data by median and scales it by the interquartile range,
+// so it's not affected by outliers
+type RobustScaler struct {
+	affineScaler
+}
+
+func NewRobustScaler() *RobustScaler {
+	return &RobustScaler{}
+}
+
+// Fit calculates median and IQR of the given vectors
+func (s *RobustScaler) Fit(vecs [][]float64) error {
+	stats := NewStats(robustReservoirSize)
+	err := stats.PushMany(vecs)
+	if err != nil {
+		return err
+	}
+	return s.FitStats(stats)
+}
+
+// FitStats sets scaler parameters from the accumulated stats;
+// stats must be created with non-empty reservoir
+func (s *RobustScaler) FitStats(stats *Stats) error {
+	if stats.Count() == 0 {
+		return statsEmptyErr
+	}
+	median, err := stats.Quantile(0.5)
+	if err != nil {
+		return err
+	}
+	lower, err := stats.Quantile(0.25)
+	if err != nil {
+		return err
+	}
+	upper, err := stats.Quantile(0.75)
+	if err != nil {
+		return err
+	}
+	iqr := make([]float64, len(median))
+	for i := range iqr {
+		iqr[i] = upper[i] - lower[i]
+	}
+	s.set(median, iqr)
+	return nil
+}
@@ -0,0 +1,569 @@
+package lsh
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/gasparian/lsh-search-go/store"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	snapshotExistsErr   = errors.New("Snapshot already exists")
+	snapshotNotFoundErr = errors.New("Snapshot not found")
+	snapshotFormErr     = errors.New("Snapshot has wrong format")
+	snapshotsDirErr     = errors.New("Snapshots directory must be set")
+)
+
+const (
+	manifestExt       = ".snap"
+	snapshotDataExt   = ".vecs"
+	snapshotTmpExt    = ".tmp"
+	snapshotBlockSize = 1024
+	restoreBatches    = 16 // NOTE: batches of the index config written at once by Rollback
+)
+
+// SnapshotInfo describes the stored snapshot
+type SnapshotInfo struct {
+	Name       string
+	Created    time.Time
+	Generation uint32 // NOTE: generation of the index at the snapshot time
+	Vectors    int    // NOTE: including the deleted, but not yet purged ones
+	Deleted    int
+	Written    int    // NOTE: vectors written by the snapshot itself, the rest are shared with the parent
+	Parent     string // NOTE: empty for the full snapshot
+}
+
+// snapshotManifest holds everything needed to restore the index, except the vectors data;
+// it's written after the info, so the info can be read alone
+type snapshotManifest struct {
+	Seq    uint64 // NOTE: number of the data file written by the snapshot
+	Hasher []byte
+	Trees  uint64 // NOTE: checksum of the hasher dump regardless of its generation
+	// Vectors holds ids of the vectors by the number of the data file, which keeps them
+	Vectors map[uint64][]string
+	Sums    map[string]uint64 // NOTE: checksums of the vectors along with their payloads
+	Deleted []string
+	Expires map[string]int64
+}
+
+// snapshotBlock is a batch of vectors in the data file
+type snapshotBlock struct {
+	IDs      []string
+	Vecs     [][]float64
+	Payloads [][]byte
+}
+
+// vectorSum returns the checksum of the vector and its payload
+func vectorSum(vec []float64, payload []byte) uint64 {
+	h := fnv.New64a()
+	var buf [8]byte
+	for _, v := range vec {
+		binary.LittleEndian.PutUint64(buf[:], math.Float64bits(v))
+		h.Write(buf[:])
+	}
+	if payload != nil {
+		h.Write([]byte{1})
+		h.Write(payload)
+	}
+	return h.Sum64()
+}
+
+// treesSum returns the checksum of the hasher dump with the generation reset, so the same trees
+// have the same sum after the rollback
+func treesSum(dump []byte) (uint64, error) {
+	decoded := hasherDump{}
+	err := gobDecode(dump, &decoded)
+	if err != nil {
+		return 0, err
+	}
+	decoded.Generation = 0
+	encoded, err := gobEncode(decoded)
+	if err != nil {
+		return 0, err
+	}
+	h := fnv.New64a()
+	h.Write(encoded)
+	return h.Sum64(), nil
+}
+
+// Snapshots keeps named point-in-time copies of the index in the directory, so the index can be rolled back
+// to any of them, e.g. after a bad batch of vectors has been inserted. Snapshot holds the hasher, vectors
+// with their payloads and expiry times, and tombstones; buckets are rebuilt from them on rollback,
+// so the restored index returns the same results. Snapshots are incremental: vectors, which are already kept
+// by the latest snapshot with the same trees, are only referenced, so after Train the next snapshot is full.
+// NOTE: the directory must be used for the snapshots of the single index
+type Snapshots struct {
+	mx    sync.Mutex
+	index *LSHIndex
+	dir   string
+}
+
+// NewSnapshots opens the snapshots directory of the index, creating it if needed
+func NewSnapshots(index *LSHIndex, dir string) (*Snapshots, error) {
+	if dir == "" {
+		return nil, snapshotsDirErr
+	}
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	s := &Snapshots{index: index, dir: dir}
+	// NOTE: interrupted Create leaves the temporary files and the data file without manifest
+	err = s.collect()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Snapshots) manifestPath(name string) string {
+	return filepath.Join(s.dir, name+manifestExt)
+}
+
+func (s *Snapshots) dataPath(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d", seq)+snapshotDataExt)
+}
+
+// readManifest reads the snapshot info and, if asked, the manifest
+func (s *Snapshots) readManifest(name string, full bool) (SnapshotInfo, *snapshotManifest, error) {
+	var info SnapshotInfo
+	file, err := os.Open(s.manifestPath(name))
+	if os.IsNotExist(err) {
+		return info, nil, snapshotNotFoundErr
+	}
+	if err != nil {
+		return info, nil, err
+	}
+	defer file.Close()
+	dec := gob.NewDecoder(bufio.NewReader(file))
+	err = dec.Decode(&info)
+	if err != nil {
+		return info, nil, snapshotFormErr
+	}
+	if !full {
+		return info, nil, nil
+	}
+	manifest := &snapshotManifest{}
+	err = dec.Decode(manifest)
+	if err != nil {
+		return info, nil, snapshotFormErr
+	}
+	return info, manifest, nil
+}
+
+// names returns names of the stored snapshots
+func (s *Snapshots) names() ([]string, error) {
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), manifestExt) {
+			names = append(names, strings.TrimSuffix(entry.Name(), manifestExt))
+		}
+	}
+	return names, nil
+}
+
+// collect removes the temporary files and the data files, which aren't referenced by any snapshot
+func (s *Snapshots) collect() error {
+	names, err := s.names()
+	if err != nil {
+		return err
+	}
+	referenced := make(map[uint64]bool)
+	for _, name := range names {
+		_, manifest, err := s.readManifest(name, true)
+		if err != nil {
+			return err
+		}
+		for seq := range manifest.Vectors {
+			referenced[seq] = true
+		}
+	}
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		remove := strings.HasSuffix(name, snapshotTmpExt)
+		if strings.HasSuffix(name, snapshotDataExt) {
+			seq, err := strconv.ParseUint(strings.TrimSuffix(name, snapshotDataExt), 10, 64)
+			remove = err == nil && !referenced[seq]
+		}
+		if !remove {
+			continue
+		}
+		err = os.Remove(filepath.Join(s.dir, name))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// List returns the stored snapshots, the oldest first
+func (s *Snapshots) List() ([]SnapshotInfo, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	names, err := s.names()
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]SnapshotInfo, 0, len(names))
+	for _, name := range names {
+		info, _, err := s.readManifest(name, false)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Created.Equal(infos[j].Created) {
+			return infos[i].Name < infos[j].Name
+		}
+		return infos[i].Created.Before(infos[j].Created)
+	})
+	return infos, nil
+}
+
+// writeFile writes the file through the temporary one, so it's either written completely or not at all;
+// the file isn't created if write returns false
+func writeFile(path string, write func(w io.Writer) (bool, error)) error {
+	tmp := path + snapshotTmpExt
+	file, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	keep, err := write(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil && keep {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil || !keep {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// Create takes the snapshot of the current index under the given name.
+// The hasher, tombstones and expiry times are captured at the start, then vectors are scanned
+// with the generation pinned, so searches, deletes, inserts and purges go on meanwhile; Train isn't blocked either,
+// but the replaced generation is dropped after the scan. Vectors deleted during the scan are kept alive by the snapshot,
+// while the inserted ones could get into it along with their expiry times, though without the payloads written
+// after their blocks were read.
+// Names follow the same rules as the store namespaces
+func (s *Snapshots) Create(name string) (SnapshotInfo, error) {
+	err := store.ValidateNamespace(name)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if _, err := os.Stat(s.manifestPath(name)); err == nil {
+		return SnapshotInfo{}, snapshotExistsErr
+	}
+	names, err := s.names()
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	manifests := make(map[string]*snapshotManifest, len(names))
+	var seq uint64 = 1
+	for _, name := range names {
+		_, manifest, err := s.readManifest(name, true)
+		if err != nil {
+			return SnapshotInfo{}, err
+		}
+		manifests[name] = manifest
+		if manifest.Seq >= seq {
+			seq = manifest.Seq + 1
+		}
+	}
+	lsh := s.index
+	// NOTE: the lock keeps the captured state from the half done inserts and purges
+	lsh.trainMx.Lock()
+	hasher, deleted, expiring, scans := lsh.pinScan()
+	deletedIds, expires := deleted.list(), expiring.copy()
+	lsh.trainMx.Unlock()
+	defer scans.Done()
+	dump, err := hasher.dump()
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	trees, err := treesSum(dump)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	info := SnapshotInfo{Name: name, Created: time.Now(), Generation: hasher.generation}
+	manifest := &snapshotManifest{
+		Seq:     seq,
+		Hasher:  dump,
+		Trees:   trees,
+		Vectors: make(map[uint64][]string),
+		Sums:    make(map[string]uint64),
+		Deleted: deletedIds,
+		Expires: expires,
+	}
+	info.Deleted = len(manifest.Deleted)
+	// NOTE: the latest snapshot with the same trees is the parent
+	var parent *snapshotManifest
+	for parentName, m := range manifests {
+		if m.Trees == trees && (parent == nil || m.Seq > parent.Seq) {
+			parent, info.Parent = m, parentName
+		}
+	}
+	owners := make(map[string]uint64)
+	if parent != nil {
+		for owner, ids := range parent.Vectors {
+			for _, id := range ids {
+				owners[id] = owner
+			}
+		}
+	}
+	err = writeFile(s.dataPath(seq), func(w io.Writer) (bool, error) {
+		enc := gob.NewEncoder(w)
+		// NOTE: vectors are compared with the parent ones block by block, only the changed ones are written
+		writeBlock := func(block *snapshotBlock) error {
+			payloads := make([][]byte, len(block.IDs))
+			if payloadStore, ok := lsh.index.(store.PayloadStore); ok {
+				var err error
+				payloads, err = payloadStore.GetPayloads(vectorKeys(hasher.generation, block.IDs))
+				if err != nil {
+					return err
+				}
+			}
+			written := &snapshotBlock{}
+			for i, id := range block.IDs {
+				sum := vectorSum(block.Vecs[i], payloads[i])
+				manifest.Sums[id] = sum
+				if owner, ok := owners[id]; ok && parent.Sums[id] == sum {
+					manifest.Vectors[owner] = append(manifest.Vectors[owner], id)
+					continue
+				}
+				manifest.Vectors[seq] = append(manifest.Vectors[seq], id)
+				written.IDs = append(written.IDs, id)
+				written.Vecs = append(written.Vecs, block.Vecs[i])
+				written.Payloads = append(written.Payloads, payloads[i])
+			}
+			if len(written.IDs) == 0 {
+				return nil
+			}
+			info.Written += len(written.IDs)
+			return enc.Encode(written)
+		}
+		iter, err := lsh.index.GetVectorIterator()
+		if err != nil {
+			return false, err
+		}
+		defer iter.Close()
+		block := &snapshotBlock{}
+		for {
+			key, vec, ok := iter.Next()
+			if !ok {
+				break
+			}
+			if !ownsVector(hasher.generation, key) {
+				continue
+			}
+			block.IDs = append(block.IDs, vectorID(hasher.generation, key))
+			block.Vecs = append(block.Vecs, vec)
+			if len(block.IDs) < snapshotBlockSize {
+				continue
+			}
+			err = writeBlock(block)
+			if err != nil {
+				return false, err
+			}
+			block = &snapshotBlock{}
+		}
+		err = writeBlock(block)
+		return info.Written > 0, err
+	})
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	info.Vectors = len(manifest.Sums)
+	// NOTE: expiry times of the vectors inserted during the scan
+	for id, at := range expiring.copy() {
+		if _, ok := manifest.Sums[id]; ok {
+			if _, ok := manifest.Expires[id]; !ok {
+				manifest.Expires[id] = at
+			}
+		}
+	}
+	err = writeFile(s.manifestPath(name), func(w io.Writer) (bool, error) {
+		enc := gob.NewEncoder(w)
+		err := enc.Encode(info)
+		if err != nil {
+			return false, err
+		}
+		return true, enc.Encode(manifest)
+	})
+	if err != nil {
+		os.Remove(s.dataPath(seq))
+		return SnapshotInfo{}, err
+	}
+	return info, nil
+}
+
+// Rollback replaces the current index with the one restored from the snapshot, the same way Train does:
+// searches use the current index until the restored one is completely written and swapped in.
+// Vectors are streamed from the data files in chunks of restoreBatches batches, so the memory use
+// is bounded by the chunk and the manifest, which holds ids and checksums of all the vectors
+func (s *Snapshots) Rollback(name string) error {
+	err := store.ValidateNamespace(name)
+	if err != nil {
+		return err
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	_, manifest, err := s.readManifest(name, true)
+	if err != nil {
+		return err
+	}
+	hasher := NewHasher(HasherConfig{})
+	err = hasher.load(manifest.Hasher)
+	if err != nil {
+		return err
+	}
+	expiring := newExpiries()
+	for id, at := range manifest.Expires {
+		expiring.set([]string{id}, []int64{at})
+	}
+	return s.index.restore(hasher, func() error {
+		return s.stream(hasher, manifest)
+	}, expiring, manifest.Deleted)
+}
+
+// stream writes the vectors of the snapshot into the hasher's generation chunk by chunk
+func (s *Snapshots) stream(hasher *Hasher, manifest *snapshotManifest) error {
+	_, canKeepPayloads := s.index.index.(store.PayloadStore)
+	chunkSize := restoreBatches * s.index.config.getBatchSize()
+	var (
+		ids         []string
+		vecs        [][]float64
+		payloads    [][]byte
+		hasPayloads bool
+		written     int
+	)
+	flush := func() error {
+		if len(ids) == 0 {
+			return nil
+		}
+		if !hasPayloads {
+			payloads = nil
+		} else if !canKeepPayloads {
+			return payloadsUnsupportedErr
+		}
+		var expires []int64
+		if len(manifest.Expires) > 0 {
+			expires = make([]int64, len(ids))
+			for i, id := range ids {
+				expires[i] = manifest.Expires[id]
+			}
+		}
+		err := s.index.write(hasher, vecs, ids, payloads, expires)
+		written += len(ids)
+		ids, vecs, payloads, hasPayloads = nil, nil, nil, false
+		return err
+	}
+	for seq, owned := range manifest.Vectors {
+		wanted := make(map[string]bool, len(owned))
+		for _, id := range owned {
+			wanted[id] = true
+		}
+		file, err := os.Open(s.dataPath(seq))
+		if err != nil {
+			return err
+		}
+		dec := gob.NewDecoder(bufio.NewReader(file))
+		for {
+			block := &snapshotBlock{}
+			err = dec.Decode(block)
+			if err != nil {
+				break
+			}
+			for i, id := range block.IDs {
+				if !wanted[id] {
+					continue
+				}
+				ids = append(ids, id)
+				vecs = append(vecs, block.Vecs[i])
+				payloads = append(payloads, block.Payloads[i])
+				hasPayloads = hasPayloads || block.Payloads[i] != nil
+			}
+			if len(ids) >= chunkSize {
+				err = flush()
+				if err != nil {
+					file.Close()
+					return err
+				}
+			}
+		}
+		file.Close()
+		if err != io.EOF {
+			return snapshotFormErr
+		}
+	}
+	err := flush()
+	if err != nil {
+		return err
+	}
+	if written != len(manifest.Sums) {
+		return snapshotFormErr
+	}
+	return nil
+}
+
+// Delete removes the snapshot; vectors it shares with the other snapshots are kept
+func (s *Snapshots) Delete(name string) error {
+	err := store.ValidateNamespace(name)
+	if err != nil {
+		return err
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	err = os.Remove(s.manifestPath(name))
+	if os.IsNotExist(err) {
+		return snapshotNotFoundErr
+	}
+	if err != nil {
+		return err
+	}
+	return s.collect()
+}
+
+// restore builds the index of the next generation with the snapshot's hasher and swaps it in
+func (lsh *LSHIndex) restore(hasher *Hasher, write func() error, expiring *expiries, deleted []string) error {
+	lsh.trainMx.Lock()
+	defer lsh.trainMx.Unlock()
+	// NOTE: the replaced generation occupies the same layout as the restored one
+	lsh.collector.wait()
+	hasher.generation = lsh.getHasher().generation + 1
+	return lsh.install(hasher, write, expiring, deleted)
+}
@@ -0,0 +1,228 @@
+package lsh
+
+import (
+	"errors"
+	"github.com/gasparian/lsh-search-go/store"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+)
+
+var (
+	dimensionsMismatchErr = errors.New("Vector dimensions number differs from the previous ones")
+	statsEmptyErr         = errors.New("Stats have no vectors yet")
+	reservoirEmptyErr     = errors.New("Quantiles can't be calculated: stats reservoir is empty")
+	quantileRangeErr      = errors.New("Quantile must be in [0, 1] range")
+)
+
+// Stats accumulates per-dimension statistics of the vectors stream:
+// mean and variance (Welford's algorithm), min/max, and approximate quantiles,
+// calculated on the uniform sample of the stream (reservoir sampling)
+type Stats struct {
+	mx            sync.RWMutex
+	count         int
+	mean          []float64
+	m2            []float64
+	min           []float64
+	max           []float64
+	reservoir     [][]float64
+	reservoirSize int
+}
+
+// NewStats creates empty stats; reservoirSize defines how many vectors are kept
+// to calculate quantiles, quantiles are not available when it's <= 0
+func NewStats(reservoirSize int) *Stats {
+	return &Stats{
+		reservoirSize: reservoirSize,
+	}
+}
+
+// Push updates stats with the new vector
+func (s *Stats) Push(vec []float64) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.count == 0 {
+		s.mean = make([]float64, len(vec))
+		s.m2 = make([]float64, len(vec))
+		s.min = make([]float64, len(vec))
+		s.max = make([]float64, len(vec))
+		for i := range vec {
+			s.min[i] = math.Inf(1)
+			s.max[i] = math.Inf(-1)
+		}
+	}
+	if len(vec) != len(s.mean) {
+		return dimensionsMismatchErr
+	}
+	s.count++
+	countF := float64(s.count)
+	for i, val := range vec {
+		delta := val - s.mean[i]
+		s.mean[i] += delta / countF
+		s.m2[i] += delta * (val - s.mean[i])
+		if val < s.min[i] {
+			s.min[i] = val
+		}
+		if val > s.max[i] {
+			s.max[i] = val
+		}
+	}
+	s.sample(vec)
+	return nil
+}
+
+// PushMany updates stats with the batch of vectors
+func (s *Stats) PushMany(vecs [][]float64) error {
+	for _, vec := range vecs {
+		err := s.Push(vec)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PushIterator updates stats with all vectors returned by the iterator,
+// so stats could be calculated with a full store scan; iterator should be closed by the caller
+func (s *Stats) PushIterator(it store.VectorIterator) error {
+	for {
+		_, vec, ok := it.Next()
+		if !ok {
+			return nil
+		}
+		err := s.Push(vec)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// sample keeps the uniform sample of the stream (algorithm R)
+func (s *Stats) sample(vec []float64) {
+	if s.reservoirSize <= 0 {
+		return
+	}
+	var idx int
+	if len(s.reservoir) < s.reservoirSize {
+		idx = len(s.reservoir)
+		s.reservoir = append(s.reservoir, nil)
+	} else {
+		idx = rand.Intn(s.count)
+		if idx >= s.reservoirSize {
+			return
+		}
+	}
+	s.reservoir[idx] = copyVec(vec)
+}
+
+// Count returns number of vectors seen
+func (s *Stats) Count() int {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	return s.count
+}
+
+func copyVec(vec []float64) []float64 {
+	cpy := make([]float64, len(vec))
+	copy(cpy, vec)
+	return cpy
+}
+
+// Mean returns per-dimension mean
+func (s *Stats) Mean() []float64 {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	return copyVec(s.mean)
+}
+
+// Var returns per-dimension (population) variance
+func (s *Stats) Var() []float64 {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	variance := make([]float64, len(s.m2))
+	for i, m2 := range s.m2 {
+		variance[i] = m2 / float64(s.count)
+	}
+	return variance
+}
+
+// Std returns per-dimension standard deviation
+func (s *Stats) Std() []float64 {
+	std := s.Var()
+	for i := range std {
+		std[i] = math.Sqrt(std[i])
+	}
+	return std
+}
+
+// Min returns per-dimension minimum
+func (s *Stats) Min() []float64 {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	return copyVec(s.min)
+}
+
+// Max returns per-dimension maximum
+func (s *Stats) Max() []float64 {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	return copyVec(s.max)
+}
+
+// Quantile returns approximate per-dimension q-quantile, calculated on the reservoir sample
+func (s *Stats) Quantile(q float64) ([]float64, error) {
+	if q < 0 || q > 1 {
+		return nil, quantileRangeErr
+	}
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	if len(s.reservoir) == 0 {
+		return nil, reservoirEmptyErr
+	}
+	res := make([]float64, len(s.mean))
+	column := make([]float64, len(s.reservoir))
+	for i := range res {
+		for j, vec := range s.reservoir {
+			column[j] = vec[i]
+		}
+		sort.Float64s(column)
+		pos := q * float64(len(column)-1)
+		lower := int(math.Floor(pos))
+		upper := int(math.Ceil(pos))
+		res[i] = column[lower] + (column[upper]-column[lower])*(pos-float64(lower))
+	}
+	return res, nil
+}
+
+// GetMeanStdSampled returns mean and std based on the random sample (with replacement) of incoming NxM matrix
+func GetMeanStdSampled(data [][]float64, sampleSize int) ([]float64, []float64, error) {
+	if len(data) == 0 {
+		return nil, nil, dataSliceEmptyErr
+	}
+	if sampleSize <= 0 {
+		return nil, nil, sampleSizeErr
+	}
+	stats := NewStats(0)
+	if len(data) <= sampleSize {
+		err := stats.PushMany(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		return stats.Mean(), stats.Std(), nil
+	}
+	for i := 0; i < sampleSize; i++ {
+		err := stats.Push(data[rand.Intn(len(data))])
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return stats.Mean(), stats.Std(), nil
+}
+
+// GetMeanStdSampledRecords returns the same as GetMeanStdSampled
+//
+// Deprecated: use GetMeanStdSampled or Stats instead
+func GetMeanStdSampledRecords(vecs [][]float64, sampleSize int) ([]float64, []float64, error) {
+	return GetMeanStdSampled(vecs, sampleSize)
+}
@@ -0,0 +1,399 @@
+package lsh
+
+import (
+	"errors"
+	"github.com/gasparian/lsh-search-go/store"
+	"sync"
+	"time"
+)
+
+// NOTE: table of the tombstones bucket; the bit is combined with the generation's table bit,
+// so tombstones are dropped along with their generation
+const tombstoneTableBit = 1 << 29
+
+// tombstoneKey returns the bucket, which holds ids of the deleted vectors of the given generation
+func tombstoneKey(generation uint32) store.BucketKey {
+	return store.BucketKey{Table: tableKey(generation, 0) | tombstoneTableBit}
+}
+
+// tombstones holds ids of the deleted, but not yet purged vectors of the single generation
+type tombstones struct {
+	mx  sync.RWMutex
+	ids map[string]struct{}
+}
+
+func newTombstones() *tombstones {
+	return &tombstones{ids: make(map[string]struct{})}
+}
+
+// loadTombstones reads the tombstones of the generation from the store
+func loadTombstones(index store.Store, generation uint32) (*tombstones, error) {
+	t := newTombstones()
+	iter, err := index.GetHashIterator(tombstoneKey(generation))
+	if errors.Is(err, store.BucketNotFoundErr) {
+		return t, nil // NOTE: nothing has been deleted
+	}
+	if err != nil {
+		return nil, err
+	}
+	for {
+		page := iter.NextN(1024)
+		if len(page) == 0 {
+			break
+		}
+		t.add(page)
+	}
+	return t, iter.Close()
+}
+
+func (t *tombstones) add(ids []string) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	for _, id := range ids {
+		t.ids[id] = struct{}{}
+	}
+}
+
+func (t *tombstones) remove(ids []string) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	for _, id := range ids {
+		delete(t.ids, id)
+	}
+}
+
+func (t *tombstones) len() int {
+	t.mx.RLock()
+	defer t.mx.RUnlock()
+	return len(t.ids)
+}
+
+func (t *tombstones) list() []string {
+	t.mx.RLock()
+	defer t.mx.RUnlock()
+	ids := make([]string, 0, len(t.ids))
+	for id := range t.ids {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// take returns up to n tombstoned ids, skipping the given ones
+func (t *tombstones) take(n int, skip map[string]bool) []string {
+	t.mx.RLock()
+	defer t.mx.RUnlock()
+	ids := make([]string, 0, n)
+	for id := range t.ids {
+		if len(ids) >= n {
+			break
+		}
+		if !skip[id] {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// filter returns the ids, which aren't tombstoned; the slice is returned as is if nothing has been deleted
+func (t *tombstones) filter(ids []string) []string {
+	t.mx.RLock()
+	defer t.mx.RUnlock()
+	if len(t.ids) == 0 {
+		return ids
+	}
+	alive := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if _, ok := t.ids[id]; !ok {
+			alive = append(alive, id)
+		}
+	}
+	return alive
+}
+
+// Delete marks vectors of the current index as deleted: they are excluded from the search results immediately,
+// while their vectors, payloads and bucket entries are removed later by the Compactor.
+// Deleting vectors, which aren't in the index, fails.
+// NOTE: deletes made during the Train are applied to the replaced index only
+func (lsh *LSHIndex) Delete(ids []string) error {
+	hasher, deleted, _, searches := lsh.pin()
+	defer searches.Done()
+	if len(ids) == 0 {
+		return nil
+	}
+	_, err := lsh.index.GetVectors(vectorKeys(hasher.generation, ids))
+	if err != nil {
+		return err
+	}
+	keys := make([]store.BucketKey, len(ids))
+	for i := range keys {
+		keys[i] = tombstoneKey(hasher.generation)
+	}
+	err = lsh.index.SetHashes(keys, ids)
+	if err != nil {
+		return err
+	}
+	deleted.add(ids)
+	return nil
+}
+
+// drain waits for the searches running on the current hasher; must be called under the trainMx,
+// so the hasher isn't swapped meanwhile and the replaced searches group covers all of them
+func (lsh *LSHIndex) drain() {
+	lsh.mx.Lock()
+	searches := lsh.searches
+	lsh.searches = new(sync.WaitGroup)
+	lsh.mx.Unlock()
+	searches.Wait()
+}
+
+// removeHash removes id from the bucket; the bucket which doesn't exist anymore isn't an error,
+// since the purge of the same id could have been interrupted
+func removeHash(index store.Store, key store.BucketKey, id string) error {
+	err := index.RemoveHash(key, id)
+	if err == nil {
+		return nil
+	}
+	iter, iterErr := index.GetHashIterator(key)
+	if errors.Is(iterErr, store.BucketNotFoundErr) {
+		return nil
+	}
+	if iterErr != nil {
+		return iterErr
+	}
+	iter.Close()
+	return err
+}
+
+// purge physically removes up to n tombstoned vectors of the current generation, except the skipped ones,
+// and returns ids of the taken and of the purged ones.
+// Bucket entries are removed first, then the searches, which could have read them, are drained,
+// and only then vectors are deleted, so the running searches never miss the vectors they've found.
+// NOTE: ids which purge has failed stay tombstoned, the first error is returned
+func (lsh *LSHIndex) purge(n int, skip map[string]bool) ([]string, []string, error) {
+	lsh.trainMx.Lock()
+	defer lsh.trainMx.Unlock()
+	lsh.mx.RLock()
+	hasher, deleted, expiring := lsh.hasher, lsh.deleted, lsh.expiring
+	lsh.mx.RUnlock()
+	ids := deleted.take(n, skip)
+	var firstErr error
+	fail := func(err error) {
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	payloadStore, hasPayloads := lsh.index.(store.PayloadStore)
+	indexed := lsh.config.getIndexedFields()
+	removed := make([]string, 0, len(ids))
+	for _, id := range ids {
+		key := vectorKey(hasher.generation, id)
+		vec, err := lsh.index.GetVector(key)
+		if err != nil {
+			fail(err)
+			continue
+		}
+		buckets := make([]store.BucketKey, 0, hasher.Config.NTrees)
+		for perm, hash := range hasher.getHashes(vec) {
+			buckets = append(buckets, store.BucketKey{Table: tableKey(hasher.generation, perm), Code: hash})
+		}
+		if hasPayloads && len(indexed) > 0 {
+			payloads, err := payloadStore.GetPayloads([]string{key})
+			if err != nil {
+				fail(err)
+				continue
+			}
+			payload, err := decodePayload(payloads[0], nil)
+			if err != nil {
+				fail(err)
+				continue
+			}
+			buckets = append(buckets, postingKeys(hasher.generation, payload, indexed)...)
+		}
+		if at, ok := expiring.get(id); ok {
+			buckets = append(buckets, expiryKey(hasher.generation, at))
+		}
+		for _, bucket := range buckets {
+			err = removeHash(lsh.index, bucket, id)
+			if err != nil {
+				break
+			}
+		}
+		if err != nil {
+			fail(err)
+			continue
+		}
+		removed = append(removed, id)
+	}
+	if len(removed) == 0 {
+		return ids, removed, firstErr
+	}
+	lsh.drain()
+	purged := make([]string, 0, len(removed))
+	for _, id := range removed {
+		err := lsh.index.DeleteVector(vectorKey(hasher.generation, id))
+		if err == nil {
+			err = removeHash(lsh.index, tombstoneKey(hasher.generation), id)
+		}
+		if err != nil {
+			fail(err)
+			continue
+		}
+		purged = append(purged, id)
+	}
+	deleted.remove(purged)
+	expiring.remove(purged)
+	return ids, purged, firstErr
+}
+
+// CompactorConfig holds the purge schedule; zero values are replaced with defaults
+type CompactorConfig struct {
+	// Interval is the period of the background purge, 1 minute by default;
+	// negative value disables the background purge, so it's run by Compact only
+	Interval  time.Duration
+	BatchSize int           // NOTE: tombstones purged at once, 100 by default
+	Pause     time.Duration // NOTE: pause between batches, which lets the searches go, none by default
+}
+
+func (c *CompactorConfig) setDefaults() {
+	if c.Interval == 0 {
+		c.Interval = time.Minute
+	}
+	if c.BatchSize <= 0 {
+		c.BatchSize = 100
+	}
+}
+
+// CompactorStats holds the purge progress since the compactor creation
+type CompactorStats struct {
+	Pending  int    // NOTE: tombstones of the current index, which aren't purged yet
+	Expiring int    // NOTE: vectors of the current index with expiry time, including the expired ones
+	Expired  uint64 // NOTE: expired vectors tombstoned by the compactor
+	Purged   uint64 // NOTE: vectors physically removed from the store
+	Batches  uint64
+	Runs     uint64
+	Running  bool
+	LastRun  time.Time // NOTE: start of the last finished run
+	LastErr  error     // NOTE: the first error of the last finished run
+	Failures uint64    // NOTE: ids, which purge has failed
+}
+
+// Compactor purges the tombstoned vectors of the index in background, batch by batch;
+// it reaps the expired vectors too, tombstoning them first
+type Compactor struct {
+	index  *LSHIndex
+	config CompactorConfig
+	runMx  sync.Mutex // NOTE: serializes runs
+	mx     sync.Mutex
+	stats  CompactorStats
+	done   chan struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// NewCompactor starts the background purge of the index; compactor must be closed after use
+func NewCompactor(index *LSHIndex, config CompactorConfig) *Compactor {
+	config.setDefaults()
+	c := &Compactor{
+		index:  index,
+		config: config,
+		done:   make(chan struct{}),
+	}
+	if config.Interval > 0 {
+		c.wg.Add(1)
+		go c.run()
+	}
+	return c
+}
+
+func (c *Compactor) run() {
+	defer c.wg.Done()
+	ticker := time.NewTicker(c.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			c.Compact()
+		}
+	}
+}
+
+// Compact tombstones the vectors of the current index expired by now, then purges all the tombstones
+// and returns the first error; ids which purge has failed are retried by the next run
+func (c *Compactor) Compact() error {
+	c.runMx.Lock()
+	defer c.runMx.Unlock()
+	start := time.Now()
+	c.mx.Lock()
+	c.stats.Running = true
+	c.mx.Unlock()
+	expired, firstErr := c.index.expire(start)
+	c.mx.Lock()
+	c.stats.Expired += uint64(expired)
+	c.mx.Unlock()
+	failed := make(map[string]bool)
+loop:
+	for {
+		select {
+		case <-c.done:
+			break loop
+		default:
+		}
+		ids, purged, err := c.index.purge(c.config.BatchSize, failed)
+		if len(ids) == 0 {
+			break
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		purgedSet := make(map[string]bool, len(purged))
+		for _, id := range purged {
+			purgedSet[id] = true
+		}
+		for _, id := range ids {
+			if !purgedSet[id] {
+				failed[id] = true
+			}
+		}
+		c.mx.Lock()
+		c.stats.Purged += uint64(len(purged))
+		c.stats.Failures += uint64(len(ids) - len(purged))
+		c.stats.Batches++
+		c.mx.Unlock()
+		if c.config.Pause > 0 {
+			time.Sleep(c.config.Pause)
+		}
+	}
+	c.mx.Lock()
+	c.stats.Running = false
+	c.stats.Runs++
+	c.stats.LastRun = start
+	c.stats.LastErr = firstErr
+	c.mx.Unlock()
+	return firstErr
+}
+
+// Stats returns the snapshot of the purge progress
+func (c *Compactor) Stats() CompactorStats {
+	c.mx.Lock()
+	stats := c.stats
+	c.mx.Unlock()
+	stats.Pending = c.index.getDeleted().len()
+	stats.Expiring = c.index.getExpiring().len()
+	return stats
+}
+
+// Close stops the background purge, waiting for the running batch; closing it again does nothing
+func (c *Compactor) Close() error {
+	c.mx.Lock()
+	if c.closed {
+		c.mx.Unlock()
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	c.mx.Unlock()
+	c.wg.Wait()
+	return nil
+}
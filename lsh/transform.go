@@ -0,0 +1,237 @@
+package lsh
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"gonum.org/v1/gonum/mat"
+	"math"
+	"math/rand"
+)
+
+var (
+	unknownTransformerErr = errors.New("Unknown transformer kind")
+	projectionDimsErr     = errors.New("Projection dimensions number must be a positive integer")
+	transformerNotFitErr  = errors.New("Transformer must be fitted first")
+)
+
+func init() {
+	gob.Register(&StandartScaler{})
+	gob.Register(&L2Normalizer{})
+	gob.Register(&RandomProjection{})
+	gob.Register(&PCA{})
+	gob.Register(&MinMaxScaler{})
+	gob.Register(&RobustScaler{})
+}
+
+// Transformer holds vectors preprocessing step, which is fitted on the train data
+type Transformer interface {
+	Fit(vecs [][]float64) error
+	Transform(vec []float64) []float64
+}
+
+// InverseTransformer can map transformed vectors back to the original space
+type InverseTransformer interface {
+	Transformer
+	InverseTransform(vec []float64) []float64
+}
+
+// TransformerKind defines the preprocessing step type
+type TransformerKind int
+
+const (
+	StandardScaling TransformerKind = iota
+	L2Normalization
+	RandomProjecting
+	PCAReduction
+	MinMaxScaling
+	RobustScaling
+)
+
+// TransformerConfig declares single preprocessing step
+type TransformerConfig struct {
+	Kind TransformerKind
+	Dims int // NOTE: output space dimensionality, used by projections and PCA
+}
+
+// NewTransformer creates not fitted transformer by given config
+func NewTransformer(config TransformerConfig) (Transformer, error) {
+	switch config.Kind {
+	case StandardScaling:
+		return &StandartScaler{}, nil
+	case MinMaxScaling:
+		return NewMinMaxScaler(), nil
+	case RobustScaling:
+		return NewRobustScaler(), nil
+	case L2Normalization:
+		return &L2Normalizer{}, nil
+	case RandomProjecting:
+		if config.Dims <= 0 {
+			return nil, projectionDimsErr
+		}
+		return NewRandomProjection(config.Dims), nil
+	case PCAReduction:
+		if config.Dims <= 0 {
+			return nil, projectionDimsErr
+		}
+		return NewPCA(config.Dims, 0), nil
+	}
+	return nil, unknownTransformerErr
+}
+
+// Pipeline applies the chain of transformers to vectors
+type Pipeline struct {
+	Steps []Transformer
+}
+
+// NewPipeline creates chain of not fitted transformers
+func NewPipeline(configs []TransformerConfig) (*Pipeline, error) {
+	steps := make([]Transformer, len(configs))
+	for i, config := range configs {
+		step, err := NewTransformer(config)
+		if err != nil {
+			return nil, err
+		}
+		steps[i] = step
+	}
+	return &Pipeline{Steps: steps}, nil
+}
+
+// Fit fits every step on the output of the previous ones
+func (p *Pipeline) Fit(vecs [][]float64) error {
+	for i, step := range p.Steps {
+		err := step.Fit(vecs)
+		if err != nil {
+			return err
+		}
+		if i == len(p.Steps)-1 {
+			break
+		}
+		transformed := make([][]float64, len(vecs))
+		for j, vec := range vecs {
+			transformed[j] = step.Transform(vec)
+		}
+		vecs = transformed
+	}
+	return nil
+}
+
+// Transform applies all steps to the vector; the input vector stays untouched
+func (p *Pipeline) Transform(vec []float64) []float64 {
+	for _, step := range p.Steps {
+		vec = step.Transform(vec)
+	}
+	return vec
+}
+
+// Empty returns true if pipeline has no steps
+func (p *Pipeline) Empty() bool {
+	return p == nil || len(p.Steps) == 0
+}
+
+// sampleVecs returns random subset of vectors (without copying them)
+func sampleVecs(vecs [][]float64, sampleSize int) [][]float64 {
+	if sampleSize <= 0 || len(vecs) <= sampleSize {
+		return vecs
+	}
+	sample := make([][]float64, sampleSize)
+	for i, idx := range rand.Perm(len(vecs))[:sampleSize] {
+		sample[i] = vecs[idx]
+	}
+	return sample
+}
+
+// L2Normalizer scales vectors to the unit length
+type L2Normalizer struct{}
+
+// Fit does nothing, since normalization doesn't need any statistics
+func (n *L2Normalizer) Fit(vecs [][]float64) error {
+	return nil
+}
+
+func (n *L2Normalizer) Transform(vec []float64) []float64 {
+	res := make([]float64, len(vec))
+	norm := Norm(vec)
+	if norm <= tol {
+		return res
+	}
+	for i, val := range vec {
+		res[i] = val / norm
+	}
+	return res
+}
+
+// RandomProjection projects vectors to the lower dimensional space with gaussian random matrix
+type RandomProjection struct {
+	dims int
+	proj *mat.Dense
+}
+
+func NewRandomProjection(dims int) *RandomProjection {
+	return &RandomProjection{dims: dims}
+}
+
+// Fit generates projection matrix for the vectors dimensionality
+func (p *RandomProjection) Fit(vecs [][]float64) error {
+	if len(vecs) == 0 {
+		return dataSliceEmptyErr
+	}
+	inDims := len(vecs[0])
+	scale := 1 / math.Sqrt(float64(p.dims))
+	data := make([]float64, p.dims*inDims)
+	for i := range data {
+		data[i] = rand.NormFloat64() * scale
+	}
+	p.proj = mat.NewDense(p.dims, inDims, data)
+	return nil
+}
+
+func (p *RandomProjection) Transform(vec []float64) []float64 {
+	res := mat.NewVecDense(p.dims, nil)
+	res.MulVec(p.proj, mat.NewVecDense(len(vec), vec))
+	return res.RawVector().Data
+}
+
+type randomProjectionDump struct {
+	Dims   int
+	InDims int
+	Proj   []float64
+}
+
+func (p *RandomProjection) GobEncode() ([]byte, error) {
+	if p.proj == nil {
+		return nil, transformerNotFitErr
+	}
+	_, inDims := p.proj.Dims()
+	return gobEncode(randomProjectionDump{
+		Dims:   p.dims,
+		InDims: inDims,
+		Proj:   p.proj.RawMatrix().Data,
+	})
+}
+
+func (p *RandomProjection) GobDecode(inp []byte) error {
+	dump := randomProjectionDump{}
+	err := gobDecode(inp, &dump)
+	if err != nil {
+		return err
+	}
+	p.dims = dump.Dims
+	p.proj = mat.NewDense(dump.Dims, dump.InDims, dump.Proj)
+	return nil
+}
+
+func gobEncode(v interface{}) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	enc := gob.NewEncoder(buf)
+	err := enc.Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func gobDecode(inp []byte, v interface{}) error {
+	dec := gob.NewDecoder(bytes.NewReader(inp))
+	return dec.Decode(v)
+}
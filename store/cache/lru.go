@@ -0,0 +1,108 @@
+package cache
+
+import (
+	"container/list"
+	"github.com/gasparian/lsh-search-go/store"
+)
+
+// entryOverhead approximates memory taken by the list element, map entry and headers of a single entry
+const entryOverhead = 96
+
+type entryKind uint8
+
+const (
+	vectorEntry entryKind = iota
+	normEntry
+	bucketEntry
+)
+
+type entryKey struct {
+	kind   entryKind
+	id     string
+	bucket store.BucketKey
+}
+
+type entry struct {
+	key  entryKey
+	vec  []float64
+	norm float64
+	ids  []string
+	size int64
+}
+
+func vectorSize(id string, vec []float64) int64 {
+	return int64(entryOverhead + len(id) + 8*len(vec))
+}
+
+func normSize(id string) int64 {
+	return int64(entryOverhead + len(id) + 8)
+}
+
+func bucketSize(ids []string) int64 {
+	size := int64(entryOverhead)
+	for _, id := range ids {
+		size += int64(len(id)) + 16 // NOTE: string header
+	}
+	return size
+}
+
+// lru keeps entries in the order of use and evicts the least recently used ones,
+// when the total size exceeds the limit. It's not thread-safe
+type lru struct {
+	maxBytes  int64
+	bytes     int64
+	ll        *list.List
+	items     map[entryKey]*list.Element
+	evictions uint64
+}
+
+func newLRU(maxBytes int64) *lru {
+	return &lru{
+		maxBytes: maxBytes,
+		ll:       list.New(),
+		items:    make(map[entryKey]*list.Element),
+	}
+}
+
+func (c *lru) get(key entryKey) (*entry, bool) {
+	elem, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(elem)
+	return elem.Value.(*entry), true
+}
+
+// add replaces the existing entry; entries larger than the quarter of the limit
+// aren't cached, so a single huge bucket can't flush the whole cache
+func (c *lru) add(e *entry) {
+	c.remove(e.key)
+	if e.size > c.maxBytes/4 {
+		return
+	}
+	c.items[e.key] = c.ll.PushFront(e)
+	c.bytes += e.size
+	for c.bytes > c.maxBytes {
+		oldest := c.ll.Back()
+		c.removeElement(oldest)
+		c.evictions++
+	}
+}
+
+func (c *lru) remove(key entryKey) {
+	if elem, ok := c.items[key]; ok {
+		c.removeElement(elem)
+	}
+}
+
+func (c *lru) removeElement(elem *list.Element) {
+	e := c.ll.Remove(elem).(*entry)
+	delete(c.items, e.key)
+	c.bytes -= e.size
+}
+
+func (c *lru) purge() {
+	c.ll.Init()
+	c.items = make(map[entryKey]*list.Element)
+	c.bytes = 0
+}
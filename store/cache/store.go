@@ -0,0 +1,392 @@
+package cache
+
+import (
+	"errors"
+	"github.com/gasparian/lsh-search-go/store"
+	"sync"
+)
+
+var (
+	namespacesUnsupportedErr = errors.New("Wrapped store doesn't support namespaces")
+	payloadsUnsupportedErr   = errors.New("Wrapped store doesn't support payloads")
+)
+
+// Config holds the cache limits; zero values are replaced with defaults
+type Config struct {
+	MaxBytes int64 // NOTE: 64MB by default
+}
+
+func (c *Config) setDefaults() {
+	if c.MaxBytes <= 0 {
+		c.MaxBytes = 64 << 20
+	}
+}
+
+// Stats holds cache counters since the store creation
+type Stats struct {
+	VectorHits   uint64
+	VectorMisses uint64
+	NormHits     uint64
+	NormMisses   uint64
+	BucketHits   uint64
+	BucketMisses uint64
+	Evictions    uint64
+	Entries      int
+	Bytes        int64
+}
+
+// CachedStore wraps any store with the LRU cache of vectors, norms and buckets, bounded by size in bytes.
+// Writes go to the wrapped store first and then invalidate the affected entries.
+// Cached vectors and bucket ids are shared between callers, so they must not be modified.
+// NOTE: writes made to the wrapped store bypassing the cache (e.g. by other processes) aren't seen
+// until the entries are evicted
+type CachedStore struct {
+	inner  store.Store
+	config Config
+	mx     sync.Mutex
+	cache  *lru
+	stats  Stats
+	// epoch is incremented on every invalidation; values read from the wrapped store
+	// are cached only if no invalidation happened during the read, so the stale value can't be cached
+	epoch uint64
+	// NOTE: every collection has its own cache with the same limits,
+	// so it's opened once to not read the stale entries of another cache
+	namespaces store.Namespaces
+}
+
+func NewCachedStore(inner store.Store, config Config) *CachedStore {
+	config.setDefaults()
+	return &CachedStore{
+		inner:  inner,
+		config: config,
+		cache:  newLRU(config.MaxBytes),
+	}
+}
+
+// Stats returns the snapshot of cache counters
+func (s *CachedStore) Stats() Stats {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	stats := s.stats
+	stats.Evictions = s.cache.evictions
+	stats.Entries = len(s.cache.items)
+	stats.Bytes = s.cache.bytes
+	return stats
+}
+
+// invalidate drops entries of the given kind; it must be called after the write to the wrapped store
+func (s *CachedStore) invalidate(kind entryKind, ids []string, buckets []store.BucketKey) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.epoch++
+	for _, id := range ids {
+		s.cache.remove(entryKey{kind: kind, id: id})
+	}
+	for _, bucket := range buckets {
+		s.cache.remove(entryKey{kind: kind, bucket: bucket})
+	}
+}
+
+// KeysIterator iterates over the cached bucket ids
+type KeysIterator struct {
+	vecIds []string
+	pos    int
+}
+
+func (it *KeysIterator) Next() (string, bool) {
+	if it.pos >= len(it.vecIds) {
+		return "", false
+	}
+	it.pos++
+	return it.vecIds[it.pos-1], true
+}
+
+func (it *KeysIterator) NextN(n int) []string {
+	end := it.pos + n
+	if end > len(it.vecIds) {
+		end = len(it.vecIds)
+	}
+	if end <= it.pos {
+		return []string{}
+	}
+	// NOTE: capacity is limited, so appending to the page can't modify the cached ids
+	vecIds := it.vecIds[it.pos:end:end]
+	it.pos = end
+	return vecIds
+}
+
+func (it *KeysIterator) Close() error {
+	it.vecIds = nil
+	it.pos = 0
+	return nil
+}
+
+func (s *CachedStore) SetVector(id string, vec []float64) error {
+	return s.SetVectors([]string{id}, [][]float64{vec})
+}
+
+// SetVectors invalidates cached vectors even if the write fails, since it could be partially applied
+func (s *CachedStore) SetVectors(ids []string, vecs [][]float64) error {
+	err := s.inner.SetVectors(ids, vecs)
+	s.invalidate(vectorEntry, ids, nil)
+	return err
+}
+
+func (s *CachedStore) GetVector(id string) ([]float64, error) {
+	vecs, err := s.GetVectors([]string{id})
+	if err != nil {
+		return nil, err
+	}
+	return vecs[0], nil
+}
+
+// GetVectors reads all the missed vectors from the wrapped store with a single call
+func (s *CachedStore) GetVectors(ids []string) ([][]float64, error) {
+	vecs := make([][]float64, len(ids))
+	missed := make([]string, 0)
+	missedPos := make(map[string][]int)
+	s.mx.Lock()
+	epoch := s.epoch
+	for i, id := range ids {
+		if e, ok := s.cache.get(entryKey{kind: vectorEntry, id: id}); ok {
+			vecs[i] = e.vec
+			s.stats.VectorHits++
+			continue
+		}
+		s.stats.VectorMisses++
+		if _, ok := missedPos[id]; !ok {
+			missed = append(missed, id)
+		}
+		missedPos[id] = append(missedPos[id], i)
+	}
+	s.mx.Unlock()
+	if len(missed) == 0 {
+		return vecs, nil
+	}
+	fetched, err := s.inner.GetVectors(missed)
+	if err != nil {
+		return nil, err
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	for i, id := range missed {
+		for _, pos := range missedPos[id] {
+			vecs[pos] = fetched[i]
+		}
+		if s.epoch == epoch {
+			s.cache.add(&entry{
+				key:  entryKey{kind: vectorEntry, id: id},
+				vec:  fetched[i],
+				size: vectorSize(id, fetched[i]),
+			})
+		}
+	}
+	return vecs, nil
+}
+
+func (s *CachedStore) DeleteVector(id string) error {
+	err := s.inner.DeleteVector(id)
+	s.invalidate(vectorEntry, []string{id}, nil)
+	s.invalidate(normEntry, []string{id}, nil)
+	return err
+}
+
+func (s *CachedStore) CountVectors() (int, error) {
+	return s.inner.CountVectors()
+}
+
+// GetVectorIterator isn't cached, since full scans would just flush the cache
+func (s *CachedStore) GetVectorIterator() (store.VectorIterator, error) {
+	return s.inner.GetVectorIterator()
+}
+
+func (s *CachedStore) SetNorm(id string, norm float64) error {
+	return s.SetNorms([]string{id}, []float64{norm})
+}
+
+func (s *CachedStore) SetNorms(ids []string, norms []float64) error {
+	err := s.inner.SetNorms(ids, norms)
+	s.invalidate(normEntry, ids, nil)
+	return err
+}
+
+func (s *CachedStore) GetNorm(id string) (float64, error) {
+	norms, err := s.GetNorms([]string{id})
+	if err != nil {
+		return 0, err
+	}
+	return norms[0], nil
+}
+
+func (s *CachedStore) GetNorms(ids []string) ([]float64, error) {
+	norms := make([]float64, len(ids))
+	missed := make([]string, 0)
+	missedPos := make(map[string][]int)
+	s.mx.Lock()
+	epoch := s.epoch
+	for i, id := range ids {
+		if e, ok := s.cache.get(entryKey{kind: normEntry, id: id}); ok {
+			norms[i] = e.norm
+			s.stats.NormHits++
+			continue
+		}
+		s.stats.NormMisses++
+		if _, ok := missedPos[id]; !ok {
+			missed = append(missed, id)
+		}
+		missedPos[id] = append(missedPos[id], i)
+	}
+	s.mx.Unlock()
+	if len(missed) == 0 {
+		return norms, nil
+	}
+	fetched, err := s.inner.GetNorms(missed)
+	if err != nil {
+		return nil, err
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	for i, id := range missed {
+		for _, pos := range missedPos[id] {
+			norms[pos] = fetched[i]
+		}
+		if s.epoch == epoch {
+			s.cache.add(&entry{
+				key:  entryKey{kind: normEntry, id: id},
+				norm: fetched[i],
+				size: normSize(id),
+			})
+		}
+	}
+	return norms, nil
+}
+
+// SetPayloads passes payloads to the wrapped store; payloads aren't cached,
+// since they are read for the final search results only
+func (s *CachedStore) SetPayloads(ids []string, payloads [][]byte) error {
+	payloadStore, ok := s.inner.(store.PayloadStore)
+	if !ok {
+		return payloadsUnsupportedErr
+	}
+	return payloadStore.SetPayloads(ids, payloads)
+}
+
+func (s *CachedStore) GetPayloads(ids []string) ([][]byte, error) {
+	payloadStore, ok := s.inner.(store.PayloadStore)
+	if !ok {
+		return nil, payloadsUnsupportedErr
+	}
+	return payloadStore.GetPayloads(ids)
+}
+
+func (s *CachedStore) SetHash(key store.BucketKey, vecId string) error {
+	return s.SetHashes([]store.BucketKey{key}, []string{vecId})
+}
+
+func (s *CachedStore) SetHashes(keys []store.BucketKey, vecIds []string) error {
+	err := s.inner.SetHashes(keys, vecIds)
+	s.invalidate(bucketEntry, nil, keys)
+	return err
+}
+
+func (s *CachedStore) RemoveHash(key store.BucketKey, vecId string) error {
+	err := s.inner.RemoveHash(key, vecId)
+	s.invalidate(bucketEntry, nil, []store.BucketKey{key})
+	return err
+}
+
+// GetHashIterator reads the whole missed bucket from the wrapped store to cache it;
+// absent buckets aren't cached
+func (s *CachedStore) GetHashIterator(key store.BucketKey) (store.Iterator, error) {
+	cacheKey := entryKey{kind: bucketEntry, bucket: key}
+	s.mx.Lock()
+	epoch := s.epoch
+	if e, ok := s.cache.get(cacheKey); ok {
+		s.stats.BucketHits++
+		s.mx.Unlock()
+		return &KeysIterator{vecIds: e.ids}, nil
+	}
+	s.stats.BucketMisses++
+	s.mx.Unlock()
+	it, err := s.inner.GetHashIterator(key)
+	if err != nil {
+		return nil, err
+	}
+	vecIds := make([]string, 0)
+	for {
+		page := it.NextN(1024)
+		if len(page) == 0 {
+			break
+		}
+		vecIds = append(vecIds, page...)
+	}
+	err = it.Close()
+	if err != nil {
+		return nil, err
+	}
+	s.mx.Lock()
+	if s.epoch == epoch {
+		s.cache.add(&entry{
+			key:  cacheKey,
+			ids:  vecIds,
+			size: bucketSize(vecIds),
+		})
+	}
+	s.mx.Unlock()
+	return &KeysIterator{vecIds: vecIds}, nil
+}
+
+func (s *CachedStore) ListBuckets() ([]store.BucketKey, error) {
+	return s.inner.ListBuckets()
+}
+
+func (s *CachedStore) ListTableBuckets(table uint32) ([]store.BucketKey, error) {
+	return s.inner.ListTableBuckets(table)
+}
+
+func (s *CachedStore) Clear() error {
+	err := s.inner.Clear()
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.epoch++
+	s.cache.purge()
+	return err
+}
+
+// Namespace wraps the collection of the wrapped store with its own cache
+func (s *CachedStore) Namespace(name string) (store.Store, error) {
+	namespacer, ok := s.inner.(store.Namespacer)
+	if !ok {
+		return nil, namespacesUnsupportedErr
+	}
+	return s.namespaces.Open(name, func() (store.Store, error) {
+		ns, err := namespacer.Namespace(name)
+		if err != nil {
+			return nil, err
+		}
+		return NewCachedStore(ns, s.config), nil
+	})
+}
+
+func (s *CachedStore) ListNamespaces() ([]string, error) {
+	namespacer, ok := s.inner.(store.Namespacer)
+	if !ok {
+		return nil, namespacesUnsupportedErr
+	}
+	return namespacer.ListNamespaces()
+}
+
+func (s *CachedStore) DropNamespace(name string) error {
+	namespacer, ok := s.inner.(store.Namespacer)
+	if !ok {
+		return namespacesUnsupportedErr
+	}
+	if ns, err := s.namespaces.Remove(name); err == nil {
+		cached := ns.(*CachedStore)
+		cached.mx.Lock()
+		cached.epoch++
+		cached.cache.purge()
+		cached.mx.Unlock()
+	}
+	return namespacer.DropNamespace(name)
+}
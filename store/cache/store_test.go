@@ -0,0 +1,243 @@
+package cache
+
+import (
+	"github.com/gasparian/lsh-search-go/store"
+	"github.com/gasparian/lsh-search-go/store/kv"
+	"github.com/gasparian/lsh-search-go/store/storetest"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// countingStore counts reads which reach the wrapped store
+type countingStore struct {
+	*kv.KVStore
+	vectorReads int
+	bucketReads int
+	// afterRead is called on every vectors read, before the result is returned
+	afterRead func()
+}
+
+func (s *countingStore) GetVectors(ids []string) ([][]float64, error) {
+	s.vectorReads++
+	vecs, err := s.KVStore.GetVectors(ids)
+	if s.afterRead != nil {
+		s.afterRead()
+	}
+	return vecs, err
+}
+
+func (s *countingStore) GetVector(id string) ([]float64, error) {
+	vecs, err := s.GetVectors([]string{id})
+	if err != nil {
+		return nil, err
+	}
+	return vecs[0], nil
+}
+
+func (s *countingStore) GetHashIterator(key store.BucketKey) (store.Iterator, error) {
+	s.bucketReads++
+	return s.KVStore.GetHashIterator(key)
+}
+
+func TestLRU(t *testing.T) {
+	c := newLRU(4 * vectorSize("0", []float64{1}))
+	for i := 0; i < 4; i++ {
+		id := strconv.Itoa(i)
+		c.add(&entry{key: entryKey{id: id}, size: vectorSize(id, []float64{1})})
+	}
+	c.get(entryKey{id: "0"})
+	c.add(&entry{key: entryKey{id: "4"}, size: vectorSize("4", []float64{1})})
+	if _, ok := c.get(entryKey{id: "1"}); ok {
+		t.Error("Least recently used entry must be evicted")
+	}
+	if _, ok := c.get(entryKey{id: "0"}); !ok {
+		t.Error("Recently used entry must not be evicted")
+	}
+	if c.evictions != 1 || c.bytes != c.maxBytes || len(c.items) != 4 {
+		t.Errorf("Wrong cache size: %v entries, %v bytes, %v evictions", len(c.items), c.bytes, c.evictions)
+	}
+	c.add(&entry{key: entryKey{id: "huge"}, size: c.maxBytes})
+	if _, ok := c.get(entryKey{id: "huge"}); ok || len(c.items) != 4 {
+		t.Error("Entry larger than the quarter of the limit must not be cached")
+	}
+	c.purge()
+	if c.bytes != 0 || len(c.items) != 0 || c.ll.Len() != 0 {
+		t.Error("Cache must be empty after purge")
+	}
+}
+
+func TestCachedStore(t *testing.T) {
+	inner := &countingStore{KVStore: kv.NewKVStore()}
+	nVecs := 10
+	ids := make([]string, nVecs)
+	vecs := make([][]float64, nVecs)
+	for i := range ids {
+		ids[i] = strconv.Itoa(i)
+		vecs[i] = []float64{float64(i), 1, 2, 3}
+	}
+	// NOTE: room for the 8 vectors only
+	s := NewCachedStore(inner, Config{MaxBytes: 8 * vectorSize("0", vecs[0])})
+	err := s.SetVectors(ids, vecs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := store.BucketKey{Table: 1, Code: 2}
+
+	t.Run("Vectors", func(t *testing.T) {
+		got, err := s.GetVectors(ids[:4])
+		if err != nil {
+			t.Fatal(err)
+		}
+		got2, err := s.GetVectors([]string{"3", "2", "1", "0", "0"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, vecs[:4]) || !reflect.DeepEqual(got2, [][]float64{vecs[3], vecs[2], vecs[1], vecs[0], vecs[0]}) {
+			t.Error("Vectors are not equal")
+		}
+		stats := s.Stats()
+		if inner.vectorReads != 1 || stats.VectorHits != 5 || stats.VectorMisses != 4 {
+			t.Errorf("Wrong cache usage: %v reads, %+v", inner.vectorReads, stats)
+		}
+	})
+
+	t.Run("Eviction", func(t *testing.T) {
+		_, err := s.GetVectors(ids)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stats := s.Stats()
+		if stats.Entries != 8 || stats.Evictions != 2 || stats.Bytes > 8*vectorSize("0", vecs[0]) {
+			t.Errorf("Cache must be bounded by size: %+v", stats)
+		}
+	})
+
+	t.Run("Invalidation", func(t *testing.T) {
+		s.GetVector("9")
+		err := s.SetVector("9", []float64{42, 42, 42, 42})
+		if err != nil {
+			t.Fatal(err)
+		}
+		vec, _ := s.GetVector("9")
+		if !reflect.DeepEqual(vec, []float64{42, 42, 42, 42}) {
+			t.Error("Updated vector must not be returned from cache")
+		}
+		err = s.DeleteVector("9")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.GetVector("9")
+		if err == nil {
+			t.Error("Deleted vector must not be returned from cache")
+		}
+		err = s.SetNorm("8", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.GetNorm("8")
+		s.SetNorm("8", 2)
+		norm, _ := s.GetNorm("8")
+		if norm != 2 {
+			t.Error("Updated norm must not be returned from cache")
+		}
+		s.GetNorm("8")
+		if stats := s.Stats(); stats.NormHits != 1 || stats.NormMisses != 2 {
+			t.Errorf("Wrong norms cache usage: %+v", stats)
+		}
+	})
+
+	t.Run("StaleRead", func(t *testing.T) {
+		// NOTE: the concurrent write happens between the wrapped store read and the cache fill
+		inner.afterRead = func() {
+			inner.afterRead = nil
+			s.SetVector("0", []float64{-1, -1, -1, -1})
+		}
+		s.SetVector("0", vecs[0])
+		vec, _ := s.GetVector("0")
+		if !reflect.DeepEqual(vec, vecs[0]) {
+			t.Fatalf("Wrong vector returned: %v", vec)
+		}
+		vec, _ = s.GetVector("0")
+		if !reflect.DeepEqual(vec, []float64{-1, -1, -1, -1}) {
+			t.Error("Value read before the concurrent write must not be cached")
+		}
+	})
+
+	t.Run("Buckets", func(t *testing.T) {
+		err := s.SetHashes([]store.BucketKey{key, key}, []string{"0", "1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		reads := inner.bucketReads
+		for i := 0; i < 3; i++ {
+			it, err := s.GetHashIterator(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(storetest.ReadIds(it), []string{"0", "1"}) {
+				t.Error("Returned wrong vectors uids")
+			}
+		}
+		if inner.bucketReads-reads != 1 {
+			t.Errorf("Bucket must be read once, got %v reads", inner.bucketReads-reads)
+		}
+		it, _ := s.GetHashIterator(key)
+		page := it.NextN(1)
+		_ = append(page, "garbage")
+		if rest := storetest.ReadIds(it); len(rest) != 1 || rest[0] == "garbage" || rest[0] == page[0] {
+			t.Error("Appending to the page must not modify the cached bucket")
+		}
+		err = s.SetHash(key, "2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		it, _ = s.GetHashIterator(key)
+		if !reflect.DeepEqual(storetest.ReadIds(it), []string{"0", "1", "2"}) {
+			t.Error("Updated bucket must not be returned from cache")
+		}
+		for _, id := range []string{"0", "1", "2"} {
+			err = s.RemoveHash(key, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, err = s.GetHashIterator(key)
+		if err == nil {
+			t.Error("Removed bucket must not be returned from cache")
+		}
+	})
+
+	t.Run("Clear", func(t *testing.T) {
+		err := s.Clear()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.GetVector("1")
+		if err == nil {
+			t.Error("Cleared vector must not be returned from cache")
+		}
+		if stats := s.Stats(); stats.Entries != 0 || stats.Bytes != 0 {
+			t.Errorf("Cache must be purged: %+v", stats)
+		}
+	})
+}
+
+func TestConformance(t *testing.T) {
+	storetest.RunConformance(t, func(t *testing.T) (store.Store, func()) {
+		// NOTE: small cache to check the eviction as well
+		return NewCachedStore(kv.NewKVStore(), Config{MaxBytes: 4 << 10}), nil
+	})
+}
+
+func TestNamespaces(t *testing.T) {
+	storetest.RunNamespaceConformance(t, func(t *testing.T) (store.Store, func()) {
+		return NewCachedStore(kv.NewKVStore(), Config{MaxBytes: 4 << 10}), nil
+	})
+}
+
+func TestPayloads(t *testing.T) {
+	storetest.RunPayloadConformance(t, func(t *testing.T) (store.Store, func()) {
+		return NewCachedStore(kv.NewKVStore(), Config{MaxBytes: 4 << 10}), nil
+	})
+}
@@ -0,0 +1,78 @@
+package compact
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+// postingList holds sorted unique internal ids, delta-encoded with varints
+type postingList struct {
+	data  []byte
+	last  uint32
+	count int
+}
+
+// decode returns all ids of the list
+func (pl *postingList) decode() []uint32 {
+	ids := make([]uint32, 0, pl.count)
+	var id uint32
+	for pos := 0; pos < len(pl.data); {
+		delta, n := binary.Uvarint(pl.data[pos:])
+		pos += n
+		id += uint32(delta)
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// encode replaces list content with the given sorted ids
+func (pl *postingList) encode(ids []uint32) {
+	buf := make([]byte, binary.MaxVarintLen32)
+	data := make([]byte, 0, len(ids)*2)
+	var last uint32
+	for _, id := range ids {
+		n := binary.PutUvarint(buf, uint64(id-last))
+		data = append(data, buf[:n]...)
+		last = id
+	}
+	pl.data = data
+	pl.last = last
+	pl.count = len(ids)
+}
+
+// add inserts id into the list; returns false if it's already there.
+// Appending the largest id is cheap, other ids lead to the list re-encoding
+func (pl *postingList) add(id uint32) bool {
+	if pl.count == 0 || id > pl.last {
+		buf := make([]byte, binary.MaxVarintLen32)
+		n := binary.PutUvarint(buf, uint64(id-pl.last))
+		pl.data = append(pl.data, buf[:n]...)
+		pl.last = id
+		pl.count++
+		return true
+	}
+	ids := pl.decode()
+	pos := sort.Search(len(ids), func(i int) bool { return ids[i] >= id })
+	if pos < len(ids) && ids[pos] == id {
+		return false
+	}
+	ids = append(ids, 0)
+	copy(ids[pos+1:], ids[pos:])
+	ids[pos] = id
+	pl.encode(ids)
+	return true
+}
+
+// remove deletes id from the list; returns false if there was no such id
+func (pl *postingList) remove(id uint32) bool {
+	if pl.count == 0 || id > pl.last {
+		return false
+	}
+	ids := pl.decode()
+	pos := sort.Search(len(ids), func(i int) bool { return ids[i] >= id })
+	if pos == len(ids) || ids[pos] != id {
+		return false
+	}
+	pl.encode(append(ids[:pos], ids[pos+1:]...))
+	return true
+}
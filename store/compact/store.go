@@ -0,0 +1,517 @@
+package compact
+
+import (
+	"errors"
+	"github.com/gasparian/lsh-search-go/store"
+	"sync"
+	"unsafe"
+)
+
+var (
+	bucketNotFoundErr = store.BucketNotFoundErr
+	keyNotFoundErr    = store.KeyNotFoundErr
+	lengthMismatchErr = errors.New("Batch slices must have the same length")
+	dimsMismatchErr   = errors.New("Vector dimensions number differs from the stored ones")
+)
+
+// slot describes single internal id
+type slot struct {
+	id      string
+	hasVec  bool
+	hasNorm bool
+	refs    int32 // NOTE: number of buckets which contain the slot
+}
+
+// CompactStore is an in-memory store, which keeps vectors in a single contiguous arena
+// and buckets as delta-compressed posting lists of dense internal uint32 ids.
+// Internal id is reused only when its vector is deleted and it's removed from all buckets
+type CompactStore struct {
+	mx        sync.RWMutex
+	dims      int
+	ids       map[string]uint32
+	slots     []slot
+	free      []uint32
+	arena     []float64
+	norms     []float64
+	payloads  map[uint32][]byte // NOTE: sparse, since payloads are optional
+	nVecs     int
+	buckets   map[uint32]map[uint64]*postingList // NOTE: table -> code -> bucket
+	nBuckets  int
+	nPostings int
+	// NOTE: collections aren't affected by Clear of the store
+	namespaces store.Namespaces
+}
+
+func NewCompactStore() *CompactStore {
+	return &CompactStore{
+		ids:      make(map[string]uint32),
+		payloads: make(map[uint32][]byte),
+		buckets:  make(map[uint32]map[uint64]*postingList),
+	}
+}
+
+// KeysIterator iterates over the snapshot of bucket's vectors uids
+type KeysIterator struct {
+	vecIds []string
+	pos    int
+}
+
+func (it *KeysIterator) Next() (string, bool) {
+	if it.pos >= len(it.vecIds) {
+		return "", false
+	}
+	it.pos++
+	return it.vecIds[it.pos-1], true
+}
+
+func (it *KeysIterator) NextN(n int) []string {
+	end := it.pos + n
+	if end > len(it.vecIds) {
+		end = len(it.vecIds)
+	}
+	if end <= it.pos {
+		return []string{}
+	}
+	vecIds := it.vecIds[it.pos:end]
+	it.pos = end
+	return vecIds
+}
+
+// Close releases the snapshot
+func (it *KeysIterator) Close() error {
+	it.vecIds = nil
+	it.pos = 0
+	return nil
+}
+
+// VectorsIterator walks through the arena slots; it sees concurrent changes of not yet visited slots
+type VectorsIterator struct {
+	s      *CompactStore
+	pos    int
+	closed bool
+}
+
+func (it *VectorsIterator) Next() (string, []float64, bool) {
+	if it.closed {
+		return "", nil, false
+	}
+	it.s.mx.RLock()
+	defer it.s.mx.RUnlock()
+	for it.pos < len(it.s.slots) {
+		idx := it.pos
+		it.pos++
+		if it.s.slots[idx].hasVec {
+			return it.s.slots[idx].id, it.s.getVector(uint32(idx)), true
+		}
+	}
+	return "", nil, false
+}
+
+func (it *VectorsIterator) Close() error {
+	it.closed = true
+	return nil
+}
+
+// alloc returns internal id for the given uid, creating it if needed
+func (s *CompactStore) alloc(id string) uint32 {
+	if idx, ok := s.ids[id]; ok {
+		return idx
+	}
+	var idx uint32
+	if len(s.free) > 0 {
+		idx = s.free[len(s.free)-1]
+		s.free = s.free[:len(s.free)-1]
+	} else {
+		idx = uint32(len(s.slots))
+		s.slots = append(s.slots, slot{})
+		s.norms = append(s.norms, 0)
+	}
+	s.slots[idx] = slot{id: id}
+	s.ids[id] = idx
+	return idx
+}
+
+// release makes internal id available for reuse, when nothing refers to it
+func (s *CompactStore) release(idx uint32) {
+	sl := s.slots[idx]
+	if sl.hasVec || sl.hasNorm || sl.refs > 0 {
+		return
+	}
+	if _, ok := s.payloads[idx]; ok {
+		return
+	}
+	delete(s.ids, sl.id)
+	s.slots[idx] = slot{}
+	s.free = append(s.free, idx)
+}
+
+func (s *CompactStore) setVector(id string, vec []float64) error {
+	if s.dims == 0 {
+		s.dims = len(vec)
+	}
+	if len(vec) != s.dims {
+		return dimsMismatchErr
+	}
+	idx := s.alloc(id)
+	if need := len(s.slots) * s.dims; len(s.arena) < need {
+		s.arena = append(s.arena, make([]float64, need-len(s.arena))...)
+	}
+	copy(s.arena[int(idx)*s.dims:], vec)
+	if !s.slots[idx].hasVec {
+		s.slots[idx].hasVec = true
+		s.nVecs++
+	}
+	return nil
+}
+
+// getVector returns copy of the vector, since arena could be overwritten
+func (s *CompactStore) getVector(idx uint32) []float64 {
+	vec := make([]float64, s.dims)
+	copy(vec, s.arena[int(idx)*s.dims:])
+	return vec
+}
+
+func (s *CompactStore) SetVector(id string, vec []float64) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.setVector(id, vec)
+}
+
+func (s *CompactStore) SetVectors(ids []string, vecs [][]float64) error {
+	if len(ids) != len(vecs) {
+		return lengthMismatchErr
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	for i, id := range ids {
+		err := s.setVector(id, vecs[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *CompactStore) GetVector(id string) ([]float64, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	idx, ok := s.ids[id]
+	if !ok || !s.slots[idx].hasVec {
+		return nil, keyNotFoundErr
+	}
+	return s.getVector(idx), nil
+}
+
+func (s *CompactStore) GetVectors(ids []string) ([][]float64, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	vecs := make([][]float64, len(ids))
+	for i, id := range ids {
+		idx, ok := s.ids[id]
+		if !ok || !s.slots[idx].hasVec {
+			return nil, keyNotFoundErr
+		}
+		vecs[i] = s.getVector(idx)
+	}
+	return vecs, nil
+}
+
+// DeleteVector removes vector, its norm and payload, but not the bucket entries
+func (s *CompactStore) DeleteVector(id string) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	idx, ok := s.ids[id]
+	if !ok || !s.slots[idx].hasVec {
+		return keyNotFoundErr
+	}
+	s.slots[idx].hasVec = false
+	s.slots[idx].hasNorm = false
+	delete(s.payloads, idx)
+	s.nVecs--
+	s.release(idx)
+	return nil
+}
+
+func (s *CompactStore) CountVectors() (int, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	return s.nVecs, nil
+}
+
+func (s *CompactStore) GetVectorIterator() (store.VectorIterator, error) {
+	return &VectorsIterator{s: s}, nil
+}
+
+func (s *CompactStore) SetNorm(id string, norm float64) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	idx := s.alloc(id)
+	s.norms[idx] = norm
+	s.slots[idx].hasNorm = true
+	return nil
+}
+
+func (s *CompactStore) SetNorms(ids []string, norms []float64) error {
+	if len(ids) != len(norms) {
+		return lengthMismatchErr
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	for i, id := range ids {
+		idx := s.alloc(id)
+		s.norms[idx] = norms[i]
+		s.slots[idx].hasNorm = true
+	}
+	return nil
+}
+
+func (s *CompactStore) GetNorm(id string) (float64, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	idx, ok := s.ids[id]
+	if !ok || !s.slots[idx].hasNorm {
+		return 0, keyNotFoundErr
+	}
+	return s.norms[idx], nil
+}
+
+func (s *CompactStore) GetNorms(ids []string) ([]float64, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	norms := make([]float64, len(ids))
+	for i, id := range ids {
+		idx, ok := s.ids[id]
+		if !ok || !s.slots[idx].hasNorm {
+			return nil, keyNotFoundErr
+		}
+		norms[i] = s.norms[idx]
+	}
+	return norms, nil
+}
+
+func (s *CompactStore) SetPayloads(ids []string, payloads [][]byte) error {
+	if len(ids) != len(payloads) {
+		return lengthMismatchErr
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	for i, id := range ids {
+		idx := s.alloc(id)
+		s.payloads[idx] = payloads[i]
+	}
+	return nil
+}
+
+// GetPayloads returns nil for the ids without payload
+func (s *CompactStore) GetPayloads(ids []string) ([][]byte, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	payloads := make([][]byte, len(ids))
+	for i, id := range ids {
+		if idx, ok := s.ids[id]; ok && len(s.payloads[idx]) > 0 {
+			payloads[i] = s.payloads[idx]
+		}
+	}
+	return payloads, nil
+}
+
+// setHash adds vector to the bucket; duplicates are ignored
+func (s *CompactStore) setHash(key store.BucketKey, vecId string) {
+	table, ok := s.buckets[key.Table]
+	if !ok {
+		table = make(map[uint64]*postingList)
+		s.buckets[key.Table] = table
+	}
+	bucket, ok := table[key.Code]
+	if !ok {
+		bucket = &postingList{}
+		table[key.Code] = bucket
+		s.nBuckets++
+	}
+	idx := s.alloc(vecId)
+	if bucket.add(idx) {
+		s.slots[idx].refs++
+		s.nPostings++
+	}
+}
+
+func (s *CompactStore) SetHash(key store.BucketKey, vecId string) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.setHash(key, vecId)
+	return nil
+}
+
+func (s *CompactStore) SetHashes(keys []store.BucketKey, vecIds []string) error {
+	if len(keys) != len(vecIds) {
+		return lengthMismatchErr
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	for i, key := range keys {
+		s.setHash(key, vecIds[i])
+	}
+	return nil
+}
+
+// RemoveHash removes vector id from the bucket; empty buckets are removed too
+func (s *CompactStore) RemoveHash(key store.BucketKey, vecId string) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	bucket, ok := s.buckets[key.Table][key.Code]
+	if !ok {
+		return bucketNotFoundErr
+	}
+	idx, ok := s.ids[vecId]
+	if !ok || !bucket.remove(idx) {
+		return nil
+	}
+	s.slots[idx].refs--
+	s.nPostings--
+	s.release(idx)
+	if bucket.count == 0 {
+		delete(s.buckets[key.Table], key.Code)
+		s.nBuckets--
+		if len(s.buckets[key.Table]) == 0 {
+			delete(s.buckets, key.Table)
+		}
+	}
+	return nil
+}
+
+// GetHashIterator returns iterator over the snapshot of bucket made at the moment of the call
+func (s *CompactStore) GetHashIterator(key store.BucketKey) (store.Iterator, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	bucket, ok := s.buckets[key.Table][key.Code]
+	if !ok {
+		return nil, bucketNotFoundErr
+	}
+	idxs := bucket.decode()
+	it := &KeysIterator{
+		vecIds: make([]string, len(idxs)),
+	}
+	for i, idx := range idxs {
+		it.vecIds[i] = s.slots[idx].id
+	}
+	return it, nil
+}
+
+func (s *CompactStore) ListBuckets() ([]store.BucketKey, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	keys := make([]store.BucketKey, 0, s.nBuckets)
+	for tableIdx, table := range s.buckets {
+		for code := range table {
+			keys = append(keys, store.BucketKey{Table: tableIdx, Code: code})
+		}
+	}
+	return keys, nil
+}
+
+func (s *CompactStore) ListTableBuckets(tableIdx uint32) ([]store.BucketKey, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	table := s.buckets[tableIdx]
+	keys := make([]store.BucketKey, 0, len(table))
+	for code := range table {
+		keys = append(keys, store.BucketKey{Table: tableIdx, Code: code})
+	}
+	return keys, nil
+}
+
+// DropTable removes all the buckets of the table and releases the slots referenced only by them
+func (s *CompactStore) DropTable(tableIdx uint32) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	for _, bucket := range s.buckets[tableIdx] {
+		for _, idx := range bucket.decode() {
+			s.slots[idx].refs--
+			s.nPostings--
+			s.release(idx)
+		}
+		s.nBuckets--
+	}
+	delete(s.buckets, tableIdx)
+	return nil
+}
+
+func (s *CompactStore) Clear() error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.dims = 0
+	s.ids = make(map[string]uint32)
+	s.slots = nil
+	s.free = nil
+	s.arena = nil
+	s.norms = nil
+	s.payloads = make(map[uint32][]byte)
+	s.nVecs = 0
+	s.buckets = make(map[uint32]map[uint64]*postingList)
+	s.nBuckets = 0
+	s.nPostings = 0
+	return nil
+}
+
+// MemoryReport holds approximate memory usage of the store's parts, in bytes
+type MemoryReport struct {
+	Vectors  int
+	Buckets  int
+	Postings int
+	Arena    int
+	Norms    int
+	Payloads int
+	Ids      int
+	Lists    int
+	Total    int
+}
+
+// NOTE: rough estimation of the go map entry overhead
+const mapEntryOverhead = 48
+
+// MemoryUsage estimates how much memory the store occupies
+func (s *CompactStore) MemoryUsage() MemoryReport {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	report := MemoryReport{
+		Vectors:  s.nVecs,
+		Buckets:  s.nBuckets,
+		Postings: s.nPostings,
+		Arena:    cap(s.arena) * 8,
+		Norms:    cap(s.norms) * 8,
+	}
+	for _, payload := range s.payloads {
+		report.Payloads += cap(payload) + mapEntryOverhead
+	}
+	report.Ids = cap(s.slots)*int(unsafe.Sizeof(slot{})) + cap(s.free)*4
+	for id := range s.ids {
+		report.Ids += len(id) + mapEntryOverhead
+	}
+	for _, table := range s.buckets {
+		report.Lists += mapEntryOverhead
+		for _, bucket := range table {
+			report.Lists += cap(bucket.data) + int(unsafe.Sizeof(*bucket)) + mapEntryOverhead
+		}
+	}
+	report.Total = report.Arena + report.Norms + report.Payloads + report.Ids + report.Lists
+	return report
+}
+
+// Namespace returns the isolated in-memory collection, which is created on the first call
+func (s *CompactStore) Namespace(name string) (store.Store, error) {
+	return s.namespaces.Open(name, func() (store.Store, error) {
+		return NewCompactStore(), nil
+	})
+}
+
+func (s *CompactStore) ListNamespaces() ([]string, error) {
+	return s.namespaces.Names(), nil
+}
+
+func (s *CompactStore) DropNamespace(name string) error {
+	ns, err := s.namespaces.Remove(name)
+	if err != nil {
+		return err
+	}
+	return ns.Clear()
+}
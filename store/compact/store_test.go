@@ -0,0 +1,216 @@
+package compact
+
+import (
+	"errors"
+	"github.com/gasparian/lsh-search-go/store"
+	"github.com/gasparian/lsh-search-go/store/kv"
+	"github.com/gasparian/lsh-search-go/store/storetest"
+	"math/rand"
+	"reflect"
+	"runtime"
+	"strconv"
+	"testing"
+)
+
+var (
+	bucketKey = store.BucketKey{Table: 1, Code: 42}
+)
+
+var (
+	vectorsAreNotEqualErr   = errors.New("Vectors are not equal")
+	wrongKeysErr            = errors.New("Returned wrong vectors uids")
+	vectorShouldNotExistErr = errors.New("Vector should not exist in a store")
+	dimsMismatchShouldFail  = errors.New("Vector with different dimensions number should not be stored")
+)
+
+func TestPostingList(t *testing.T) {
+	pl := &postingList{}
+	for _, id := range []uint32{5, 1, 300, 5, 0, 70000, 300} {
+		pl.add(id)
+	}
+	expected := []uint32{0, 1, 5, 300, 70000}
+	if !reflect.DeepEqual(pl.decode(), expected) {
+		t.Fatalf("Posting list must be sorted and unique: %v", pl.decode())
+	}
+	if pl.remove(2) {
+		t.Fatal("Absent id can't be removed")
+	}
+	if !pl.remove(5) || !pl.remove(70000) {
+		t.Fatal("Existing id must be removed")
+	}
+	if !reflect.DeepEqual(pl.decode(), []uint32{0, 1, 300}) || pl.last != 300 {
+		t.Fatalf("Wrong posting list after removal: %v", pl.decode())
+	}
+	pl.add(301)
+	if pl.count != 4 {
+		t.Fatalf("Posting list must hold 4 ids, got %v", pl.count)
+	}
+}
+
+func TestCompactStore(t *testing.T) {
+	s := NewCompactStore()
+	vec := []float64{1, 2}
+
+	t.Run("SetVector", func(t *testing.T) {
+		err := s.SetVectors([]string{"0", "1"}, [][]float64{vec, {3, 4}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		vecReturned, err := s.GetVector("0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(vec, vecReturned) {
+			t.Error(vectorsAreNotEqualErr)
+		}
+		vecReturned[0] = 42
+		vecReturned, _ = s.GetVector("0")
+		if !reflect.DeepEqual(vec, vecReturned) {
+			t.Error("Returned vector must be a copy")
+		}
+		err = s.SetVector("2", []float64{1, 2, 3})
+		if err == nil {
+			t.Error(dimsMismatchShouldFail)
+		}
+	})
+
+	t.Run("SetHash", func(t *testing.T) {
+		err := s.SetHashes([]store.BucketKey{bucketKey, bucketKey, bucketKey}, []string{"1", "0", "1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		it, err := s.GetHashIterator(bucketKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ids := storetest.ReadIds(it); !reflect.DeepEqual(ids, []string{"0", "1"}) {
+			t.Error(wrongKeysErr)
+		}
+		keys, err := s.ListTableBuckets(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(keys, []store.BucketKey{bucketKey}) {
+			t.Errorf("Wrong table buckets list: %v", keys)
+		}
+		report := s.MemoryUsage()
+		if report.Postings != 2 || report.Buckets != 1 || report.Vectors != 2 {
+			t.Errorf("Wrong memory report: %+v", report)
+		}
+	})
+
+	t.Run("Reuse", func(t *testing.T) {
+		idx := s.ids["0"]
+		err := s.DeleteVector("0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.SetVector("3", []float64{5, 6})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.ids["3"] == idx {
+			t.Fatal("Internal id must not be reused while bucket refers to it")
+		}
+		err = s.RemoveHash(bucketKey, "0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.SetVector("4", []float64{7, 8})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.ids["4"] != idx {
+			t.Fatal("Released internal id must be reused")
+		}
+		it, _ := s.GetHashIterator(bucketKey)
+		if !reflect.DeepEqual(storetest.ReadIds(it), []string{"1"}) {
+			t.Error(wrongKeysErr)
+		}
+	})
+
+	t.Run("Clear", func(t *testing.T) {
+		s.Clear()
+		_, err := s.GetVector("1")
+		if err == nil {
+			t.Error(vectorShouldNotExistErr)
+		}
+		err = s.SetVector("0", []float64{1, 2, 3})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// benchmarkStoreFill fills store like the LSH index does and reports its memory usage
+func benchmarkStoreFill(b *testing.B, newStore func() store.Store) {
+	const (
+		nVecs    = 10000
+		nDims    = 128
+		nTrees   = 10
+		nBuckets = 100
+	)
+	rand.Seed(42)
+	ids := make([]string, nVecs)
+	vecs := make([][]float64, nVecs)
+	bucketKeys := make([]store.BucketKey, 0, nVecs*nTrees)
+	bucketIds := make([]string, 0, nVecs*nTrees)
+	for i := range ids {
+		ids[i] = strconv.Itoa(i)
+		vecs[i] = make([]float64, nDims)
+		for j := range vecs[i] {
+			vecs[i][j] = rand.Float64()
+		}
+		for perm := 0; perm < nTrees; perm++ {
+			bucketKeys = append(bucketKeys, store.BucketKey{Table: uint32(perm), Code: uint64(rand.Intn(nBuckets))})
+			bucketIds = append(bucketIds, ids[i])
+		}
+	}
+	b.ResetTimer()
+	var memStats runtime.MemStats
+	for i := 0; i < b.N; i++ {
+		runtime.GC()
+		runtime.ReadMemStats(&memStats)
+		before := memStats.HeapAlloc
+		s := newStore()
+		// NOTE: vectors are copied like they've been just loaded, since some stores keep the passed slices
+		loaded := make([][]float64, len(vecs))
+		for j, vec := range vecs {
+			loaded[j] = make([]float64, len(vec))
+			copy(loaded[j], vec)
+		}
+		s.SetVectors(ids, loaded)
+		loaded = nil
+		s.SetHashes(bucketKeys, bucketIds)
+		runtime.GC()
+		runtime.ReadMemStats(&memStats)
+		b.ReportMetric(float64(memStats.HeapAlloc-before)/(1<<20), "heap-MB")
+		runtime.KeepAlive(s)
+	}
+}
+
+func BenchmarkFillKVStore(b *testing.B) {
+	benchmarkStoreFill(b, func() store.Store { return kv.NewKVStore() })
+}
+
+func BenchmarkFillCompactStore(b *testing.B) {
+	benchmarkStoreFill(b, func() store.Store { return NewCompactStore() })
+}
+
+func TestConformance(t *testing.T) {
+	storetest.RunConformance(t, func(t *testing.T) (store.Store, func()) {
+		return NewCompactStore(), nil
+	})
+}
+
+func TestNamespaces(t *testing.T) {
+	storetest.RunNamespaceConformance(t, func(t *testing.T) (store.Store, func()) {
+		return NewCompactStore(), nil
+	})
+}
+
+func TestPayloads(t *testing.T) {
+	storetest.RunPayloadConformance(t, func(t *testing.T) (store.Store, func()) {
+		return NewCompactStore(), nil
+	})
+}
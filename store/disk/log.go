@@ -0,0 +1,340 @@
+package disk
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/gasparian/lsh-search-go/store"
+	"hash/crc32"
+	"io"
+	"math"
+)
+
+var (
+	corruptedRecordErr = errors.New("Log record is corrupted")
+)
+
+// Record types of the data log
+const (
+	setVectorRecord byte = iota + 1
+	deleteVectorRecord
+	setNormRecord
+	setHashRecord
+	removeHashRecord
+	setPayloadRecord
+	batchRecord // NOTE: precedes the records of the multi-record batch, holds their number
+)
+
+// NOTE: record is crc32 (4 bytes) + payload length (4 bytes) + type (1 byte) + payload;
+// checksum covers the type and the payload
+const headerSize = 9
+
+// NOTE: protects from the huge allocations, when the length field itself is corrupted
+const maxPayloadSize = 1 << 30
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// record is a single decoded log entry
+type record struct {
+	kind  byte
+	id    string
+	vec   []float64
+	norm  float64
+	data  []byte // NOTE: vector payload, don't confuse with the record payload
+	key   store.BucketKey
+	count int   // NOTE: number of the records in the batch
+	size  int64 // NOTE: size of the whole record, with header
+	start int64 // NOTE: offset of the record in the log
+}
+
+func recordSize(payloadLen int) int64 {
+	return int64(headerSize + payloadLen)
+}
+
+func uvarintLen(x uint64) int {
+	n := 1
+	for x >= 0x80 {
+		x >>= 7
+		n++
+	}
+	return n
+}
+
+func idLen(id string) int {
+	return uvarintLen(uint64(len(id))) + len(id)
+}
+
+func normRecordSize(id string) int64 {
+	return recordSize(idLen(id) + 8)
+}
+
+func hashRecordSize(key store.BucketKey, id string) int64 {
+	return recordSize(uvarintLen(uint64(key.Table)) + uvarintLen(key.Code) + idLen(id))
+}
+
+// appendRecord encodes record to the end of buf
+func appendRecord(buf []byte, kind byte, payload func([]byte) []byte) []byte {
+	start := len(buf)
+	buf = append(buf, make([]byte, headerSize)...)
+	buf[start+8] = kind
+	buf = payload(buf)
+	binary.LittleEndian.PutUint32(buf[start+4:], uint32(len(buf)-start-headerSize))
+	binary.LittleEndian.PutUint32(buf[start:], crc32.Checksum(buf[start+8:], crcTable))
+	return buf
+}
+
+func appendUvarint(buf []byte, x uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], x)
+	return append(buf, tmp[:n]...)
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = appendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+func appendFloat(buf []byte, f float64) []byte {
+	var tmp [8]byte
+	binary.LittleEndian.PutUint64(tmp[:], math.Float64bits(f))
+	return append(buf, tmp[:]...)
+}
+
+func appendSetVector(buf []byte, id string, vec []float64) []byte {
+	return appendRecord(buf, setVectorRecord, func(buf []byte) []byte {
+		buf = appendString(buf, id)
+		buf = appendUvarint(buf, uint64(len(vec)))
+		for _, v := range vec {
+			buf = appendFloat(buf, v)
+		}
+		return buf
+	})
+}
+
+func appendDeleteVector(buf []byte, id string) []byte {
+	return appendRecord(buf, deleteVectorRecord, func(buf []byte) []byte {
+		return appendString(buf, id)
+	})
+}
+
+func appendSetNorm(buf []byte, id string, norm float64) []byte {
+	return appendRecord(buf, setNormRecord, func(buf []byte) []byte {
+		buf = appendString(buf, id)
+		return appendFloat(buf, norm)
+	})
+}
+
+func appendSetPayload(buf []byte, id string, data []byte) []byte {
+	return appendRecord(buf, setPayloadRecord, func(buf []byte) []byte {
+		buf = appendString(buf, id)
+		return append(buf, data...)
+	})
+}
+
+func appendHash(buf []byte, kind byte, key store.BucketKey, id string) []byte {
+	return appendRecord(buf, kind, func(buf []byte) []byte {
+		buf = appendUvarint(buf, uint64(key.Table))
+		buf = appendUvarint(buf, key.Code)
+		return appendString(buf, id)
+	})
+}
+
+func appendBatch(buf []byte, count int) []byte {
+	return appendRecord(buf, batchRecord, func(buf []byte) []byte {
+		return appendUvarint(buf, uint64(count))
+	})
+}
+
+// batch collects encoded records along with their metadata, so the index
+// can be updated after the write without decoding them back
+type batch struct {
+	buf  []byte
+	recs []record
+}
+
+// header returns the batch record, which makes the replay apply the whole batch or nothing;
+// single records are atomic by themselves, so they aren't framed
+func (b *batch) header() []byte {
+	if len(b.recs) < 2 {
+		return nil
+	}
+	return appendBatch(nil, len(b.recs))
+}
+
+func (b *batch) add(rec record, start int) {
+	rec.size = int64(len(b.buf) - start)
+	b.recs = append(b.recs, rec)
+}
+
+func (b *batch) setVector(id string, vec []float64) {
+	start := len(b.buf)
+	b.buf = appendSetVector(b.buf, id, vec)
+	b.add(record{kind: setVectorRecord, id: id}, start)
+}
+
+func (b *batch) deleteVector(id string) {
+	start := len(b.buf)
+	b.buf = appendDeleteVector(b.buf, id)
+	b.add(record{kind: deleteVectorRecord, id: id}, start)
+}
+
+func (b *batch) setNorm(id string, norm float64) {
+	start := len(b.buf)
+	b.buf = appendSetNorm(b.buf, id, norm)
+	b.add(record{kind: setNormRecord, id: id, norm: norm}, start)
+}
+
+func (b *batch) setPayload(id string, data []byte) {
+	start := len(b.buf)
+	b.buf = appendSetPayload(b.buf, id, data)
+	b.add(record{kind: setPayloadRecord, id: id}, start)
+}
+
+func (b *batch) hash(kind byte, key store.BucketKey, id string) {
+	start := len(b.buf)
+	b.buf = appendHash(b.buf, kind, key, id)
+	b.add(record{kind: kind, id: id, key: key}, start)
+}
+
+// payloadReader decodes payload fields, remembering the first error
+type payloadReader struct {
+	data []byte
+	err  error
+}
+
+func (r *payloadReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	x, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.err = corruptedRecordErr
+		return 0
+	}
+	r.data = r.data[n:]
+	return x
+}
+
+func (r *payloadReader) string() string {
+	n := r.uvarint()
+	if r.err != nil || uint64(len(r.data)) < n {
+		r.err = corruptedRecordErr
+		return ""
+	}
+	s := string(r.data[:n])
+	r.data = r.data[n:]
+	return s
+}
+
+func (r *payloadReader) float() float64 {
+	if r.err != nil || len(r.data) < 8 {
+		r.err = corruptedRecordErr
+		return 0
+	}
+	f := math.Float64frombits(binary.LittleEndian.Uint64(r.data))
+	r.data = r.data[8:]
+	return f
+}
+
+// decodeRecord parses the whole record, starting with header
+func decodeRecord(data []byte) (*record, error) {
+	if len(data) < headerSize {
+		return nil, corruptedRecordErr
+	}
+	length := binary.LittleEndian.Uint32(data[4:])
+	if uint64(len(data)) != uint64(headerSize)+uint64(length) {
+		return nil, corruptedRecordErr
+	}
+	if binary.LittleEndian.Uint32(data) != crc32.Checksum(data[8:], crcTable) {
+		return nil, corruptedRecordErr
+	}
+	rec := &record{kind: data[8], size: int64(len(data))}
+	r := &payloadReader{data: data[headerSize:]}
+	switch rec.kind {
+	case setVectorRecord:
+		rec.id = r.string()
+		dims := r.uvarint()
+		if r.err == nil && uint64(len(r.data)) != dims*8 {
+			return nil, corruptedRecordErr
+		}
+		rec.vec = make([]float64, dims)
+		for i := range rec.vec {
+			rec.vec[i] = r.float()
+		}
+	case deleteVectorRecord:
+		rec.id = r.string()
+	case setNormRecord:
+		rec.id = r.string()
+		rec.norm = r.float()
+	case setHashRecord, removeHashRecord:
+		table := r.uvarint()
+		if table > math.MaxUint32 {
+			return nil, corruptedRecordErr
+		}
+		rec.key = store.BucketKey{Table: uint32(table), Code: r.uvarint()}
+		rec.id = r.string()
+	case setPayloadRecord:
+		rec.id = r.string()
+		if r.err == nil {
+			// NOTE: the rest of the record is the vector payload
+			rec.data = append([]byte{}, r.data...)
+		}
+	case batchRecord:
+		count := r.uvarint()
+		if r.err == nil && (count < 2 || count > maxPayloadSize) {
+			return nil, corruptedRecordErr
+		}
+		rec.count = int(count)
+	default:
+		return nil, corruptedRecordErr
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return rec, nil
+}
+
+// readRecord reads the next record from the log; io.EOF means the clean end of the log,
+// any other error - the torn or corrupted tail
+func readRecord(r io.Reader) (*record, error) {
+	header := make([]byte, headerSize)
+	n, err := io.ReadFull(r, header)
+	if err == io.EOF {
+		return nil, io.EOF
+	}
+	if err != nil || n < headerSize {
+		return nil, corruptedRecordErr
+	}
+	length := binary.LittleEndian.Uint32(header[4:])
+	if length > maxPayloadSize {
+		return nil, corruptedRecordErr
+	}
+	data := make([]byte, headerSize+int(length))
+	copy(data, header)
+	_, err = io.ReadFull(r, data[headerSize:])
+	if err != nil {
+		return nil, corruptedRecordErr
+	}
+	return decodeRecord(data)
+}
+
+// readBatch reads the next record, or the whole batch of records along with the size of its header;
+// io.EOF means the clean end of the log, any other error - the torn or corrupted tail,
+// which starts at the batch header, if the batch isn't complete
+func readBatch(r io.Reader) ([]*record, int64, error) {
+	rec, err := readRecord(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	if rec.kind != batchRecord {
+		return []*record{rec}, 0, nil
+	}
+	recs := make([]*record, 0)
+	for len(recs) < rec.count {
+		next, err := readRecord(r)
+		if err != nil || next.kind == batchRecord {
+			return nil, 0, corruptedRecordErr
+		}
+		recs = append(recs, next)
+	}
+	return recs, rec.size, nil
+}
@@ -0,0 +1,836 @@
+package disk
+
+import (
+	"bufio"
+	"errors"
+	"github.com/gasparian/lsh-search-go/store"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	bucketNotFoundErr    = store.BucketNotFoundErr
+	keyNotFoundErr       = store.KeyNotFoundErr
+	lengthMismatchErr    = errors.New("Batch slices must have the same length")
+	storeClosedErr       = errors.New("Store is closed")
+	emptyDirErr          = errors.New("Store directory must be set")
+	namespaceNotFoundErr = errors.New("Namespace not found")
+)
+
+const (
+	logFileName     = "data.log"
+	compactFileName = "data.log.compact"
+	namespacesDir   = "namespaces" // NOTE: every collection is a store in its own subdirectory
+)
+
+// SyncPolicy defines when the log is flushed to the stable storage
+type SyncPolicy int
+
+const (
+	// SyncInterval fsyncs the log in background every Config.Interval;
+	// writes made after the last sync could be lost on the crash
+	SyncInterval SyncPolicy = iota
+	// SyncAlways fsyncs the log before every write call returns
+	SyncAlways
+	// SyncNever leaves flushing to the OS
+	SyncNever
+)
+
+// Config holds disk store parameters; zero values are replaced with defaults
+type Config struct {
+	Dir      string
+	Sync     SyncPolicy
+	Interval time.Duration // NOTE: period of background sync and compaction checks
+	// CompactRatio is the share of garbage in the log which triggers compaction;
+	// negative value disables background compaction
+	CompactRatio   float64
+	CompactMinSize int64 // NOTE: logs smaller than this are never compacted in background
+}
+
+func (c *Config) setDefaults() {
+	if c.Interval <= 0 {
+		c.Interval = time.Second
+	}
+	if c.CompactRatio == 0 {
+		c.CompactRatio = 0.5
+	}
+	if c.CompactMinSize <= 0 {
+		c.CompactMinSize = 1 << 20
+	}
+}
+
+// vecRef points to the latest vector or payload record in the log
+type vecRef struct {
+	off  int64
+	size int64
+}
+
+// DiskStore keeps vectors and payloads in the append-only log on disk, while only their
+// offsets, norms and buckets are held in memory. Every change is appended to the log,
+// so the in-memory index is restored by the log replay on the start; the torn tail
+// left by a crash is truncated, along with the batch it belongs to. Overwritten and deleted records are dropped by compaction,
+// which rewrites live records into the new log and atomically replaces the old one.
+type DiskStore struct {
+	mx       sync.RWMutex
+	config   Config
+	file     *os.File
+	size     int64
+	live     int64 // NOTE: bytes of the log which hold live records
+	dirty    bool
+	closed   bool
+	vecs     map[string]vecRef
+	norms    map[string]float64
+	payloads map[string]vecRef
+	buckets  map[store.BucketKey]map[string]struct{}
+	done     chan struct{}
+	wg       sync.WaitGroup
+	// NOTE: opened collections are closed along with the store
+	namespaces store.Namespaces
+}
+
+// NewDiskStore opens the store in the config directory, creating it if needed,
+// and replays the log; store must be closed after use
+func NewDiskStore(config Config) (*DiskStore, error) {
+	if config.Dir == "" {
+		return nil, emptyDirErr
+	}
+	config.setDefaults()
+	err := os.MkdirAll(config.Dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	// NOTE: unfinished compaction leaves the temporary file, the old log is still valid
+	err = os.Remove(filepath.Join(config.Dir, compactFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	s := &DiskStore{
+		config: config,
+		done:   make(chan struct{}),
+	}
+	s.reset()
+	err = s.open()
+	if err != nil {
+		return nil, err
+	}
+	s.wg.Add(1)
+	go s.run()
+	return s, nil
+}
+
+func (s *DiskStore) reset() {
+	s.size = 0
+	s.live = 0
+	s.vecs = make(map[string]vecRef)
+	s.norms = make(map[string]float64)
+	s.payloads = make(map[string]vecRef)
+	s.buckets = make(map[store.BucketKey]map[string]struct{})
+}
+
+// open reads the log, restores the index and truncates the corrupted tail
+func (s *DiskStore) open() error {
+	file, err := os.OpenFile(filepath.Join(s.config.Dir, logFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(file)
+	for {
+		recs, framing, err := readBatch(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// NOTE: records after the first broken one can't be trusted, as well as the rest of its batch
+			err = file.Truncate(s.size)
+			if err != nil {
+				file.Close()
+				return err
+			}
+			break
+		}
+		s.size += framing
+		for _, rec := range recs {
+			rec.start = s.size
+			s.apply(rec)
+			s.size += rec.size
+		}
+	}
+	s.file = file
+	return nil
+}
+
+// apply updates in-memory index with the record written to the log
+func (s *DiskStore) apply(rec *record) {
+	switch rec.kind {
+	case setVectorRecord:
+		if old, ok := s.vecs[rec.id]; ok {
+			s.live -= old.size
+		}
+		s.vecs[rec.id] = vecRef{off: rec.start, size: rec.size}
+		s.live += rec.size
+	case deleteVectorRecord:
+		if old, ok := s.vecs[rec.id]; ok {
+			s.live -= old.size
+			delete(s.vecs, rec.id)
+		}
+		if _, ok := s.norms[rec.id]; ok {
+			s.live -= normRecordSize(rec.id)
+			delete(s.norms, rec.id)
+		}
+		if old, ok := s.payloads[rec.id]; ok {
+			s.live -= old.size
+			delete(s.payloads, rec.id)
+		}
+	case setNormRecord:
+		if _, ok := s.norms[rec.id]; !ok {
+			s.live += rec.size
+		}
+		s.norms[rec.id] = rec.norm
+	case setPayloadRecord:
+		if old, ok := s.payloads[rec.id]; ok {
+			s.live -= old.size
+		}
+		s.payloads[rec.id] = vecRef{off: rec.start, size: rec.size}
+		s.live += rec.size
+	case setHashRecord:
+		bucket, ok := s.buckets[rec.key]
+		if !ok {
+			bucket = make(map[string]struct{})
+			s.buckets[rec.key] = bucket
+		}
+		if _, ok := bucket[rec.id]; !ok {
+			bucket[rec.id] = struct{}{}
+			s.live += rec.size
+		}
+	case removeHashRecord:
+		bucket, ok := s.buckets[rec.key]
+		if !ok {
+			return
+		}
+		if _, ok := bucket[rec.id]; ok {
+			delete(bucket, rec.id)
+			s.live -= hashRecordSize(rec.key, rec.id)
+		}
+		if len(bucket) == 0 {
+			delete(s.buckets, rec.key)
+		}
+	}
+}
+
+// write appends batch to the log and applies it to the index;
+// on failure the log is truncated back, so it never holds a partial batch.
+// Batch is framed by the header, so the batch torn by a crash is dropped whole on replay
+func (s *DiskStore) write(b *batch) error {
+	if s.closed {
+		return storeClosedErr
+	}
+	header := b.header()
+	_, err := s.file.WriteAt(header, s.size)
+	if err == nil {
+		_, err = s.file.WriteAt(b.buf, s.size+int64(len(header)))
+	}
+	if err != nil {
+		s.file.Truncate(s.size)
+		return err
+	}
+	if s.config.Sync == SyncAlways {
+		err = s.file.Sync()
+		if err != nil {
+			s.file.Truncate(s.size)
+			return err
+		}
+	} else {
+		s.dirty = true
+	}
+	s.size += int64(len(header)) // NOTE: header is never live, so it's dropped by compaction
+	for i := range b.recs {
+		b.recs[i].start = s.size
+		s.apply(&b.recs[i])
+		s.size += b.recs[i].size
+	}
+	return nil
+}
+
+// run syncs and compacts the log in background, depending on config
+func (s *DiskStore) run() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			if s.config.Sync == SyncInterval {
+				s.Sync()
+			}
+			if s.needsCompaction() {
+				s.Compact()
+			}
+		}
+	}
+}
+
+func (s *DiskStore) needsCompaction() bool {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	if s.closed || s.config.CompactRatio < 0 || s.size < s.config.CompactMinSize {
+		return false
+	}
+	return float64(s.size-s.live)/float64(s.size) >= s.config.CompactRatio
+}
+
+// Sync flushes the log to the stable storage
+func (s *DiskStore) Sync() error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.closed {
+		return storeClosedErr
+	}
+	if !s.dirty {
+		return nil
+	}
+	err := s.file.Sync()
+	if err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// Size returns the log size and the size of live records in it, in bytes
+func (s *DiskStore) Size() (int64, int64) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	return s.size, s.live
+}
+
+// Compact rewrites live records into the new log and replaces the old one with it.
+// Store is locked during compaction
+func (s *DiskStore) Compact() error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.closed {
+		return storeClosedErr
+	}
+	path := filepath.Join(s.config.Dir, compactFileName)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	vecs, payloads, size, err := s.writeLive(file)
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(path)
+		return err
+	}
+	err = os.Rename(path, filepath.Join(s.config.Dir, logFileName))
+	if err != nil {
+		file.Close()
+		os.Remove(path)
+		return err
+	}
+	syncDir(s.config.Dir)
+	s.file.Close()
+	s.file = file
+	s.vecs = vecs
+	s.payloads = payloads
+	s.size = size
+	s.live = size
+	s.dirty = false
+	return nil
+}
+
+// writeLive copies vector and payload records as is and encodes norms and buckets anew
+func (s *DiskStore) writeLive(file *os.File) (map[string]vecRef, map[string]vecRef, int64, error) {
+	w := bufio.NewWriter(file)
+	var size int64
+	copyRefs := func(refs map[string]vecRef) (map[string]vecRef, error) {
+		copied := make(map[string]vecRef, len(refs))
+		for id, ref := range refs {
+			data := make([]byte, ref.size)
+			_, err := s.file.ReadAt(data, ref.off)
+			if err != nil {
+				return nil, err
+			}
+			_, err = w.Write(data)
+			if err != nil {
+				return nil, err
+			}
+			copied[id] = vecRef{off: size, size: ref.size}
+			size += ref.size
+		}
+		return copied, nil
+	}
+	vecs, err := copyRefs(s.vecs)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	payloads, err := copyRefs(s.payloads)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	buf := make([]byte, 0)
+	flush := func() error {
+		_, err := w.Write(buf)
+		size += int64(len(buf))
+		buf = buf[:0]
+		return err
+	}
+	for id, norm := range s.norms {
+		buf = appendSetNorm(buf, id, norm)
+		if len(buf) > 1<<16 {
+			if err := flush(); err != nil {
+				return nil, nil, 0, err
+			}
+		}
+	}
+	for key, bucket := range s.buckets {
+		for id := range bucket {
+			buf = appendHash(buf, setHashRecord, key, id)
+		}
+		if len(buf) > 1<<16 {
+			if err := flush(); err != nil {
+				return nil, nil, 0, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return nil, nil, 0, err
+	}
+	return vecs, payloads, size, w.Flush()
+}
+
+// syncDir makes the file rename durable; errors are ignored, since not all systems support it
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
+
+// Close stops background work, syncs and closes the log, and closes the opened collections
+func (s *DiskStore) Close() error {
+	s.mx.Lock()
+	if s.closed {
+		s.mx.Unlock()
+		return storeClosedErr
+	}
+	for _, name := range s.namespaces.Names() {
+		ns, err := s.namespaces.Remove(name)
+		if err == nil {
+			ns.(*DiskStore).Close()
+		}
+	}
+	s.closed = true
+	close(s.done)
+	err := s.file.Sync()
+	closeErr := s.file.Close()
+	s.mx.Unlock()
+	s.wg.Wait()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// KeysIterator iterates over the snapshot of bucket's vectors uids
+type KeysIterator struct {
+	vecIds []string
+	pos    int
+}
+
+func (it *KeysIterator) Next() (string, bool) {
+	if it.pos >= len(it.vecIds) {
+		return "", false
+	}
+	it.pos++
+	return it.vecIds[it.pos-1], true
+}
+
+func (it *KeysIterator) NextN(n int) []string {
+	end := it.pos + n
+	if end > len(it.vecIds) {
+		end = len(it.vecIds)
+	}
+	if end <= it.pos {
+		return []string{}
+	}
+	vecIds := it.vecIds[it.pos:end]
+	it.pos = end
+	return vecIds
+}
+
+// Close releases the snapshot
+func (it *KeysIterator) Close() error {
+	it.vecIds = nil
+	it.pos = 0
+	return nil
+}
+
+// VectorsIterator iterates over the snapshot of uids, while vectors are read lazily;
+// vectors deleted after the snapshot has been made are skipped
+type VectorsIterator struct {
+	s   *DiskStore
+	ids []string
+	pos int
+}
+
+func (it *VectorsIterator) Next() (string, []float64, bool) {
+	for it.pos < len(it.ids) {
+		id := it.ids[it.pos]
+		it.pos++
+		vec, err := it.s.GetVector(id)
+		if err == nil {
+			return id, vec, true
+		}
+	}
+	return "", nil, false
+}
+
+// Close releases the snapshot
+func (it *VectorsIterator) Close() error {
+	it.ids = nil
+	it.pos = 0
+	return nil
+}
+
+func (s *DiskStore) SetVector(id string, vec []float64) error {
+	b := &batch{}
+	b.setVector(id, vec)
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.write(b)
+}
+
+// SetVectors appends the whole batch with a single write
+func (s *DiskStore) SetVectors(ids []string, vecs [][]float64) error {
+	if len(ids) != len(vecs) {
+		return lengthMismatchErr
+	}
+	b := &batch{}
+	for i, id := range ids {
+		b.setVector(id, vecs[i])
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.write(b)
+}
+
+// readRef reads and decodes the record referenced from the index; must be called under the lock
+func (s *DiskStore) readRef(ref vecRef) (*record, error) {
+	data := make([]byte, ref.size)
+	_, err := s.file.ReadAt(data, ref.off)
+	if err != nil {
+		return nil, err
+	}
+	return decodeRecord(data)
+}
+
+// getVector reads and decodes vector record; must be called under the lock
+func (s *DiskStore) getVector(id string) ([]float64, error) {
+	if s.closed {
+		return nil, storeClosedErr
+	}
+	ref, ok := s.vecs[id]
+	if !ok {
+		return nil, keyNotFoundErr
+	}
+	rec, err := s.readRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	return rec.vec, nil
+}
+
+func (s *DiskStore) GetVector(id string) ([]float64, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	return s.getVector(id)
+}
+
+func (s *DiskStore) GetVectors(ids []string) ([][]float64, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	vecs := make([][]float64, len(ids))
+	for i, id := range ids {
+		vec, err := s.getVector(id)
+		if err != nil {
+			return nil, err
+		}
+		vecs[i] = vec
+	}
+	return vecs, nil
+}
+
+// DeleteVector removes vector, its norm and payload, but not the bucket entries
+func (s *DiskStore) DeleteVector(id string) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if _, ok := s.vecs[id]; !ok {
+		return keyNotFoundErr
+	}
+	b := &batch{}
+	b.deleteVector(id)
+	return s.write(b)
+}
+
+func (s *DiskStore) CountVectors() (int, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	return len(s.vecs), nil
+}
+
+func (s *DiskStore) GetVectorIterator() (store.VectorIterator, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	it := &VectorsIterator{
+		s:   s,
+		ids: make([]string, 0, len(s.vecs)),
+	}
+	for id := range s.vecs {
+		it.ids = append(it.ids, id)
+	}
+	return it, nil
+}
+
+func (s *DiskStore) SetNorm(id string, norm float64) error {
+	b := &batch{}
+	b.setNorm(id, norm)
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.write(b)
+}
+
+func (s *DiskStore) SetNorms(ids []string, norms []float64) error {
+	if len(ids) != len(norms) {
+		return lengthMismatchErr
+	}
+	b := &batch{}
+	for i, id := range ids {
+		b.setNorm(id, norms[i])
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.write(b)
+}
+
+func (s *DiskStore) GetNorm(id string) (float64, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	norm, ok := s.norms[id]
+	if !ok {
+		return 0, keyNotFoundErr
+	}
+	return norm, nil
+}
+
+func (s *DiskStore) GetNorms(ids []string) ([]float64, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	norms := make([]float64, len(ids))
+	for i, id := range ids {
+		norm, ok := s.norms[id]
+		if !ok {
+			return nil, keyNotFoundErr
+		}
+		norms[i] = norm
+	}
+	return norms, nil
+}
+
+// SetPayloads appends the whole batch with a single write
+func (s *DiskStore) SetPayloads(ids []string, payloads [][]byte) error {
+	if len(ids) != len(payloads) {
+		return lengthMismatchErr
+	}
+	b := &batch{}
+	for i, id := range ids {
+		b.setPayload(id, payloads[i])
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.write(b)
+}
+
+// GetPayloads reads payloads from the log; nil is returned for the ids without payload
+func (s *DiskStore) GetPayloads(ids []string) ([][]byte, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	if s.closed {
+		return nil, storeClosedErr
+	}
+	payloads := make([][]byte, len(ids))
+	for i, id := range ids {
+		ref, ok := s.payloads[id]
+		if !ok {
+			continue
+		}
+		rec, err := s.readRef(ref)
+		if err != nil {
+			return nil, err
+		}
+		if len(rec.data) > 0 {
+			payloads[i] = rec.data
+		}
+	}
+	return payloads, nil
+}
+
+func (s *DiskStore) SetHash(key store.BucketKey, vecId string) error {
+	b := &batch{}
+	b.hash(setHashRecord, key, vecId)
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.write(b)
+}
+
+func (s *DiskStore) SetHashes(keys []store.BucketKey, vecIds []string) error {
+	if len(keys) != len(vecIds) {
+		return lengthMismatchErr
+	}
+	b := &batch{}
+	for i, key := range keys {
+		b.hash(setHashRecord, key, vecIds[i])
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.write(b)
+}
+
+// RemoveHash removes vector id from the bucket; empty buckets are removed too
+func (s *DiskStore) RemoveHash(key store.BucketKey, vecId string) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	bucket, ok := s.buckets[key]
+	if !ok {
+		return bucketNotFoundErr
+	}
+	if _, ok := bucket[vecId]; !ok {
+		return nil
+	}
+	b := &batch{}
+	b.hash(removeHashRecord, key, vecId)
+	return s.write(b)
+}
+
+// GetHashIterator returns iterator over the snapshot of bucket made at the moment of the call
+func (s *DiskStore) GetHashIterator(key store.BucketKey) (store.Iterator, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	bucket, ok := s.buckets[key]
+	if !ok {
+		return nil, bucketNotFoundErr
+	}
+	it := &KeysIterator{
+		vecIds: make([]string, 0, len(bucket)),
+	}
+	for vecId := range bucket {
+		it.vecIds = append(it.vecIds, vecId)
+	}
+	return it, nil
+}
+
+func (s *DiskStore) ListBuckets() ([]store.BucketKey, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	keys := make([]store.BucketKey, 0, len(s.buckets))
+	for key := range s.buckets {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (s *DiskStore) ListTableBuckets(table uint32) ([]store.BucketKey, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	keys := make([]store.BucketKey, 0)
+	for key := range s.buckets {
+		if key.Table == table {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// Clear truncates the log
+func (s *DiskStore) Clear() error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.closed {
+		return storeClosedErr
+	}
+	err := s.file.Truncate(0)
+	if err != nil {
+		return err
+	}
+	err = s.file.Sync()
+	if err != nil {
+		return err
+	}
+	s.reset()
+	s.dirty = false
+	return nil
+}
+
+// Namespace opens the collection stored in the subdirectory with the same config
+func (s *DiskStore) Namespace(name string) (store.Store, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	if s.closed {
+		return nil, storeClosedErr
+	}
+	return s.namespaces.Open(name, func() (store.Store, error) {
+		config := s.config
+		config.Dir = filepath.Join(s.config.Dir, namespacesDir, name)
+		return NewDiskStore(config)
+	})
+}
+
+// ListNamespaces returns all the collections found in the store directory
+func (s *DiskStore) ListNamespaces() ([]string, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(s.config.Dir, namespacesDir))
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() && store.ValidateNamespace(entry.Name()) == nil {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+// DropNamespace closes the collection and removes its directory
+func (s *DiskStore) DropNamespace(name string) error {
+	err := store.ValidateNamespace(name)
+	if err != nil {
+		return err
+	}
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	if s.closed {
+		return storeClosedErr
+	}
+	if ns, err := s.namespaces.Remove(name); err == nil {
+		ns.(*DiskStore).Close()
+	}
+	dir := filepath.Join(s.config.Dir, namespacesDir, name)
+	if _, err = os.Stat(dir); os.IsNotExist(err) {
+		return namespaceNotFoundErr
+	}
+	return os.RemoveAll(dir)
+}
@@ -0,0 +1,405 @@
+package disk
+
+import (
+	"errors"
+	"github.com/gasparian/lsh-search-go/store"
+	"github.com/gasparian/lsh-search-go/store/storetest"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var (
+	vectorsAreNotEqualErr   = errors.New("Vectors are not equal")
+	normsAreNotEqualErr     = errors.New("Norms are not equal")
+	wrongKeysErr            = errors.New("Returned wrong vectors uids")
+	vectorShouldNotExistErr = errors.New("Vector should not exist in a store")
+)
+
+func newTestStore(t *testing.T, dir string) *DiskStore {
+	s, err := NewDiskStore(Config{Dir: dir, Sync: SyncNever, CompactRatio: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestRecords(t *testing.T) {
+	key := store.BucketKey{Table: 1<<32 - 1, Code: 1<<64 - 1}
+	b := &batch{}
+	b.setVector("vec", []float64{1.5, -2})
+	b.setNorm("vec", 2.5)
+	b.hash(setHashRecord, key, "vec")
+	b.setPayload("vec", []byte("payload"))
+	if b.recs[1].size != normRecordSize("vec") || b.recs[2].size != hashRecordSize(key, "vec") {
+		t.Fatal("Wrong records size estimation")
+	}
+	var pos int64
+	for _, expected := range b.recs {
+		rec, err := decodeRecord(b.buf[pos : pos+expected.size])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rec.kind != expected.kind || rec.id != expected.id || rec.key != expected.key || rec.norm != expected.norm {
+			t.Errorf("Record decoded wrong: %+v", rec)
+		}
+		if rec.kind == setPayloadRecord && string(rec.data) != "payload" {
+			t.Errorf("Payload decoded wrong: %q", rec.data)
+		}
+		pos += rec.size
+	}
+	if rec, err := decodeRecord(b.header()); err != nil || rec.kind != batchRecord || rec.count != len(b.recs) {
+		t.Errorf("Batch header decoded wrong: %+v, %v", rec, err)
+	}
+	b.buf[headerSize+1] ^= 0xff
+	if _, err := decodeRecord(b.buf[:b.recs[0].size]); err == nil {
+		t.Error("Corrupted record must not be decoded")
+	}
+}
+
+func TestDiskStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "disk-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := newTestStore(t, dir)
+	ids := []string{"0", "1", "2"}
+	vecs := [][]float64{{1, 2}, {3, 4}, {5, 6}}
+	norms := []float64{1, 2, 3}
+	bucketKey := store.BucketKey{Table: 1, Code: 42}
+
+	// NOTE: the contents are checked by the conformance suite, here they are only replayed
+	err = s.SetVectors(ids, vecs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.SetNorms(ids, norms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.SetHashes([]store.BucketKey{bucketKey, bucketKey, bucketKey}, ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Reopen", func(t *testing.T) {
+		err := s.SetVector("0", []float64{7, 8})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.DeleteVector("2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.RemoveHash(bucketKey, "2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.GetVector("0")
+		if err == nil {
+			t.Fatal("Closed store must not be readable")
+		}
+		s = newTestStore(t, dir)
+		vec, err := s.GetVector("0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(vec, []float64{7, 8}) {
+			t.Error(vectorsAreNotEqualErr)
+		}
+		_, err = s.GetVector("2")
+		if err == nil {
+			t.Error(vectorShouldNotExistErr)
+		}
+		normsReturned, err := s.GetNorms(ids[:2])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(normsReturned, norms[:2]) {
+			t.Error(normsAreNotEqualErr)
+		}
+		it, err := s.GetHashIterator(bucketKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(storetest.ReadIds(it), []string{"0", "1"}) {
+			t.Error(wrongKeysErr)
+		}
+	})
+
+	t.Run("Compact", func(t *testing.T) {
+		for i := 0; i < 10; i++ {
+			err := s.SetVector("1", []float64{float64(i), 0})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		sizeBefore, live := s.Size()
+		err := s.Compact()
+		if err != nil {
+			t.Fatal(err)
+		}
+		size, _ := s.Size()
+		if size != live || size >= sizeBefore {
+			t.Fatalf("Compacted log must hold live records only: %v, %v -> %v", sizeBefore, live, size)
+		}
+		s.Close()
+		s = newTestStore(t, dir)
+		vec, err := s.GetVector("1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(vec, []float64{9, 0}) {
+			t.Error(vectorsAreNotEqualErr)
+		}
+		count, _ := s.CountVectors()
+		if count != 2 {
+			t.Errorf("Store must contain 2 vectors, got %v", count)
+		}
+		if reopened, _ := s.Size(); reopened != size {
+			t.Errorf("Replayed log size must be %v, got %v", size, reopened)
+		}
+	})
+
+	t.Run("Recovery", func(t *testing.T) {
+		size, _ := s.Size()
+		s.Close()
+		path := filepath.Join(dir, logFileName)
+		// NOTE: simulate the torn write of the last record
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := &batch{}
+		b.setVector("3", []float64{1, 1})
+		f.Write(b.buf[:len(b.buf)-3])
+		f.Close()
+
+		s = newTestStore(t, dir)
+		if recovered, _ := s.Size(); recovered != size {
+			t.Fatalf("Torn tail must be truncated: expected %v, got %v", size, recovered)
+		}
+		_, err = s.GetVector("3")
+		if err == nil {
+			t.Error(vectorShouldNotExistErr)
+		}
+		err = s.SetVector("3", []float64{1, 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Close()
+		s = newTestStore(t, dir)
+		if _, err := s.GetVector("3"); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("TornBatch", func(t *testing.T) {
+		size, _ := s.Size()
+		s.Close()
+		path := filepath.Join(dir, logFileName)
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// NOTE: simulate the crash in the middle of the batch, after its first records are written
+		b := &batch{}
+		b.setVector("4", []float64{1, 1})
+		b.setVector("5", []float64{1, 1})
+		b.setVector("6", []float64{1, 1})
+		f.Write(b.header())
+		f.Write(b.buf[:b.recs[0].size+b.recs[1].size+3])
+		f.Close()
+
+		s = newTestStore(t, dir)
+		if recovered, _ := s.Size(); recovered != size {
+			t.Fatalf("Torn batch must be truncated: expected %v, got %v", size, recovered)
+		}
+		for _, id := range []string{"4", "5", "6"} {
+			if _, err := s.GetVector(id); err == nil {
+				t.Fatalf("Vector %v of the torn batch must not be applied", id)
+			}
+		}
+		err = s.SetVectors([]string{"4", "5"}, [][]float64{{1, 1}, {2, 2}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Close()
+		s = newTestStore(t, dir)
+		if vecs, err := s.GetVectors([]string{"4", "5"}); err != nil || vecs[1][0] != 2 {
+			t.Errorf("Complete batch must be replayed: %v, %v", vecs, err)
+		}
+	})
+
+	t.Run("Clear", func(t *testing.T) {
+		err := s.Clear()
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Close()
+		s = newTestStore(t, dir)
+		defer s.Close()
+		count, _ := s.CountVectors()
+		buckets, _ := s.ListBuckets()
+		if count != 0 || len(buckets) != 0 {
+			t.Error(vectorShouldNotExistErr)
+		}
+	})
+}
+
+func TestBackgroundCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "disk-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := NewDiskStore(Config{Dir: dir, Interval: 10 * time.Millisecond, CompactMinSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for i := 0; i < 100; i++ {
+		s.SetVector(strconv.Itoa(i%10), []float64{float64(i)})
+	}
+	for i := 0; i < 100; i++ {
+		size, live := s.Size()
+		if size == live {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Log hasn't been compacted in background")
+}
+
+func TestConformance(t *testing.T) {
+	storetest.RunConformance(t, func(t *testing.T) (store.Store, func()) {
+		dir, err := ioutil.TempDir("", "disk-store")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := newTestStore(t, dir)
+		return s, func() {
+			s.Close()
+			os.RemoveAll(dir)
+		}
+	})
+}
+
+func TestNamespaces(t *testing.T) {
+	storetest.RunNamespaceConformance(t, func(t *testing.T) (store.Store, func()) {
+		dir, err := ioutil.TempDir("", "disk-store")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := newTestStore(t, dir)
+		return s, func() {
+			s.Close()
+			os.RemoveAll(dir)
+		}
+	})
+
+	t.Run("Reopen", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "disk-store")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		s := newTestStore(t, dir)
+		ns, err := s.Namespace("docs")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ns.SetVector("0", []float64{1, 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = ns.GetVector("0"); err == nil {
+			t.Error("Collection must be closed along with the store")
+		}
+		s = newTestStore(t, dir)
+		defer s.Close()
+		names, err := s.ListNamespaces()
+		if err != nil || !reflect.DeepEqual(names, []string{"docs"}) {
+			t.Fatalf("Collection must be listed after reopening: %v, %v", names, err)
+		}
+		ns, err = s.Namespace("docs")
+		if err != nil {
+			t.Fatal(err)
+		}
+		vec, err := ns.GetVector("0")
+		if err != nil || !reflect.DeepEqual(vec, []float64{1, 2}) {
+			t.Errorf("Collection must be restored: %v, %v", vec, err)
+		}
+	})
+}
+
+func TestPayloads(t *testing.T) {
+	storetest.RunPayloadConformance(t, func(t *testing.T) (store.Store, func()) {
+		dir, err := ioutil.TempDir("", "disk-store")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := newTestStore(t, dir)
+		return s, func() {
+			s.Close()
+			os.RemoveAll(dir)
+		}
+	})
+
+	t.Run("Compact", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "disk-store")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		s := newTestStore(t, dir)
+		err = s.SetVectors([]string{"0", "1"}, [][]float64{{0, 0}, {1, 1}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 10; i++ {
+			err = s.SetPayloads([]string{"0", "1"}, [][]byte{[]byte("a" + strconv.Itoa(i)), []byte("b")})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = s.DeleteVector("1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.Compact()
+		if err != nil {
+			t.Fatal(err)
+		}
+		size, live := s.Size()
+		if size != live {
+			t.Errorf("Compacted log must hold live records only: %v, %v", size, live)
+		}
+		s.Close()
+		s = newTestStore(t, dir)
+		defer s.Close()
+		payloads, err := s.GetPayloads([]string{"0", "1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(payloads[0]) != "a9" || payloads[1] != nil {
+			t.Errorf("Payloads must survive compaction and reopening: %q", payloads)
+		}
+		if _, reopened := s.Size(); reopened != live {
+			t.Errorf("Replayed live size must be %v, got %v", live, reopened)
+		}
+	})
+}
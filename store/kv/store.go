@@ -2,100 +2,363 @@ package kv
 
 import (
 	"errors"
-	"fmt"
 	"github.com/gasparian/lsh-search-go/store"
-	guuid "github.com/google/uuid"
 	"sync"
 )
 
 var (
-	bucketNotFoundErr = errors.New("Bucket not found")
-	keyNotFoundErr    = errors.New("Key not found")
+	bucketNotFoundErr = store.BucketNotFoundErr
+	keyNotFoundErr    = store.KeyNotFoundErr
+	lengthMismatchErr = errors.New("Batch slices must have the same length")
 )
 
 type KVStore struct {
-	mx sync.RWMutex
-	m  map[string]map[string]interface{}
+	mx       sync.RWMutex
+	vecs     map[string][]float64
+	norms    map[string]float64
+	payloads map[string][]byte
+	buckets  map[uint32]map[uint64]map[string]interface{} // NOTE: table -> code -> bucket, keyed by vectors ids
+	// NOTE: collections aren't affected by Clear of the store
+	namespaces store.Namespaces
 }
 
 func NewKVStore() *KVStore {
 	return &KVStore{
-		m: make(map[string]map[string]interface{}),
+		vecs:     make(map[string][]float64),
+		norms:    make(map[string]float64),
+		payloads: make(map[string][]byte),
+		buckets:  make(map[uint32]map[uint64]map[string]interface{}),
 	}
 }
 
+// KeysIterator iterates over the snapshot of bucket's vectors ids
 type KeysIterator struct {
-	vecIds chan string
+	vecIds []string
+	pos    int
 }
 
 func (it *KeysIterator) Next() (string, bool) {
-	vecId, opened := <-it.vecIds
-	if !opened {
+	if it.pos >= len(it.vecIds) {
 		return "", false
 	}
-	return vecId, true
+	it.pos++
+	return it.vecIds[it.pos-1], true
 }
 
-func getBucketName(perm int, hash uint64) string {
-	return fmt.Sprintf("%v_%v", perm, hash)
+func (it *KeysIterator) NextN(n int) []string {
+	end := it.pos + n
+	if end > len(it.vecIds) {
+		end = len(it.vecIds)
+	}
+	if end <= it.pos {
+		return []string{}
+	}
+	vecIds := it.vecIds[it.pos:end]
+	it.pos = end
+	return vecIds
+}
+
+// Close releases the snapshot
+func (it *KeysIterator) Close() error {
+	it.vecIds = nil
+	it.pos = 0
+	return nil
+}
+
+// VectorsIterator iterates over the snapshot of stored vectors
+type VectorsIterator struct {
+	ids  []string
+	vecs [][]float64
+	pos  int
+}
+
+func (it *VectorsIterator) Next() (string, []float64, bool) {
+	if it.pos >= len(it.ids) {
+		return "", nil, false
+	}
+	it.pos++
+	return it.ids[it.pos-1], it.vecs[it.pos-1], true
+}
+
+// Close releases the snapshot
+func (it *VectorsIterator) Close() error {
+	it.ids = nil
+	it.vecs = nil
+	it.pos = 0
+	return nil
 }
 
 func (s *KVStore) SetVector(id string, vec []float64) error {
 	s.mx.Lock()
 	defer s.mx.Unlock()
-	if _, ok := s.m["vec"]; !ok {
-		s.m["vec"] = make(map[string]interface{})
+	s.vecs[id] = vec
+	return nil
+}
+
+func (s *KVStore) SetVectors(ids []string, vecs [][]float64) error {
+	if len(ids) != len(vecs) {
+		return lengthMismatchErr
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	for i, id := range ids {
+		s.vecs[id] = vecs[i]
 	}
-	s.m["vec"][id] = vec
 	return nil
 }
 
 func (s *KVStore) GetVector(id string) ([]float64, error) {
 	s.mx.RLock()
 	defer s.mx.RUnlock()
-	vecTmp, ok := s.m["vec"][id]
+	vec, ok := s.vecs[id]
 	if !ok {
 		return nil, keyNotFoundErr
 	}
-	vec := vecTmp.([]float64)
 	return vec, nil
 }
 
-func (s *KVStore) SetHash(bucketName, vecId string) error {
+func (s *KVStore) GetVectors(ids []string) ([][]float64, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	vecs := make([][]float64, len(ids))
+	for i, id := range ids {
+		vec, ok := s.vecs[id]
+		if !ok {
+			return nil, keyNotFoundErr
+		}
+		vecs[i] = vec
+	}
+	return vecs, nil
+}
+
+// DeleteVector removes vector, its norm and payload, but not the bucket entries
+func (s *KVStore) DeleteVector(id string) error {
 	s.mx.Lock()
 	defer s.mx.Unlock()
-	if _, ok := s.m[bucketName]; !ok {
-		s.m[bucketName] = make(map[string]interface{})
+	if _, ok := s.vecs[id]; !ok {
+		return keyNotFoundErr
 	}
-	uid := guuid.NewString()
-	s.m[bucketName][uid] = vecId
+	delete(s.vecs, id)
+	delete(s.norms, id)
+	delete(s.payloads, id)
 	return nil
 }
 
-func (s *KVStore) GetHashIterator(bucketName string) (store.Iterator, error) {
+func (s *KVStore) CountVectors() (int, error) {
 	s.mx.RLock()
 	defer s.mx.RUnlock()
+	return len(s.vecs), nil
+}
 
-	bucket, ok := s.m[bucketName]
+// GetVectorIterator returns iterator over the snapshot of vectors made at the moment of the call
+func (s *KVStore) GetVectorIterator() (store.VectorIterator, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	it := &VectorsIterator{
+		ids:  make([]string, 0, len(s.vecs)),
+		vecs: make([][]float64, 0, len(s.vecs)),
+	}
+	for id, vec := range s.vecs {
+		it.ids = append(it.ids, id)
+		it.vecs = append(it.vecs, vec)
+	}
+	return it, nil
+}
+
+func (s *KVStore) SetNorm(id string, norm float64) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.norms[id] = norm
+	return nil
+}
+
+func (s *KVStore) SetNorms(ids []string, norms []float64) error {
+	if len(ids) != len(norms) {
+		return lengthMismatchErr
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	for i, id := range ids {
+		s.norms[id] = norms[i]
+	}
+	return nil
+}
+
+func (s *KVStore) GetNorm(id string) (float64, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	norm, ok := s.norms[id]
 	if !ok {
-		return nil, bucketNotFoundErr
+		return 0, keyNotFoundErr
 	}
-	hashCh := make(chan string)
-	go func() {
-		for _, v := range bucket {
-			hashCh <- v.(string)
+	return norm, nil
+}
+
+func (s *KVStore) GetNorms(ids []string) ([]float64, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	norms := make([]float64, len(ids))
+	for i, id := range ids {
+		norm, ok := s.norms[id]
+		if !ok {
+			return nil, keyNotFoundErr
 		}
-		close(hashCh)
-	}()
+		norms[i] = norm
+	}
+	return norms, nil
+}
+
+func (s *KVStore) SetPayloads(ids []string, payloads [][]byte) error {
+	if len(ids) != len(payloads) {
+		return lengthMismatchErr
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	for i, id := range ids {
+		s.payloads[id] = payloads[i]
+	}
+	return nil
+}
+
+// GetPayloads returns nil for the ids without payload
+func (s *KVStore) GetPayloads(ids []string) ([][]byte, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	payloads := make([][]byte, len(ids))
+	for i, id := range ids {
+		if payload := s.payloads[id]; len(payload) > 0 {
+			payloads[i] = payload
+		}
+	}
+	return payloads, nil
+}
+
+// setHash adds vector to the bucket; duplicates are ignored
+func (s *KVStore) setHash(key store.BucketKey, vecId string) {
+	table, ok := s.buckets[key.Table]
+	if !ok {
+		table = make(map[uint64]map[string]interface{})
+		s.buckets[key.Table] = table
+	}
+	bucket, ok := table[key.Code]
+	if !ok {
+		bucket = make(map[string]interface{})
+		table[key.Code] = bucket
+	}
+	bucket[vecId] = vecId
+}
+
+func (s *KVStore) SetHash(key store.BucketKey, vecId string) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.setHash(key, vecId)
+	return nil
+}
+
+func (s *KVStore) SetHashes(keys []store.BucketKey, vecIds []string) error {
+	if len(keys) != len(vecIds) {
+		return lengthMismatchErr
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	for i, key := range keys {
+		s.setHash(key, vecIds[i])
+	}
+	return nil
+}
+
+// RemoveHash removes vector id from the bucket; empty buckets are removed too
+func (s *KVStore) RemoveHash(key store.BucketKey, vecId string) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	bucket, ok := s.buckets[key.Table][key.Code]
+	if !ok {
+		return bucketNotFoundErr
+	}
+	delete(bucket, vecId)
+	if len(bucket) == 0 {
+		delete(s.buckets[key.Table], key.Code)
+		if len(s.buckets[key.Table]) == 0 {
+			delete(s.buckets, key.Table)
+		}
+	}
+	return nil
+}
+
+// GetHashIterator returns iterator over the snapshot of bucket made at the moment of the call
+func (s *KVStore) GetHashIterator(key store.BucketKey) (store.Iterator, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	bucket, ok := s.buckets[key.Table][key.Code]
+	if !ok {
+		return nil, bucketNotFoundErr
+	}
 	it := &KeysIterator{
-		vecIds: hashCh,
+		vecIds: make([]string, 0, len(bucket)),
+	}
+	for _, v := range bucket {
+		it.vecIds = append(it.vecIds, v.(string))
 	}
 	return it, nil
 }
 
+func (s *KVStore) ListBuckets() ([]store.BucketKey, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	keys := make([]store.BucketKey, 0)
+	for tableIdx, table := range s.buckets {
+		for code := range table {
+			keys = append(keys, store.BucketKey{Table: tableIdx, Code: code})
+		}
+	}
+	return keys, nil
+}
+
+func (s *KVStore) ListTableBuckets(tableIdx uint32) ([]store.BucketKey, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	table := s.buckets[tableIdx]
+	keys := make([]store.BucketKey, 0, len(table))
+	for code := range table {
+		keys = append(keys, store.BucketKey{Table: tableIdx, Code: code})
+	}
+	return keys, nil
+}
+
+// DropTable removes all the buckets of the table
+func (s *KVStore) DropTable(tableIdx uint32) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	delete(s.buckets, tableIdx)
+	return nil
+}
+
 func (s *KVStore) Clear() error {
 	s.mx.Lock()
 	defer s.mx.Unlock()
-	s.m = make(map[string]map[string]interface{})
+	s.vecs = make(map[string][]float64)
+	s.norms = make(map[string]float64)
+	s.payloads = make(map[string][]byte)
+	s.buckets = make(map[uint32]map[uint64]map[string]interface{})
 	return nil
 }
+
+// Namespace returns the isolated in-memory collection, which is created on the first call
+func (s *KVStore) Namespace(name string) (store.Store, error) {
+	return s.namespaces.Open(name, func() (store.Store, error) {
+		return NewKVStore(), nil
+	})
+}
+
+func (s *KVStore) ListNamespaces() ([]string, error) {
+	return s.namespaces.Names(), nil
+}
+
+func (s *KVStore) DropNamespace(name string) error {
+	ns, err := s.namespaces.Remove(name)
+	if err != nil {
+		return err
+	}
+	return ns.Clear()
+}
@@ -2,20 +2,35 @@ package kv
 
 import (
 	"errors"
+	"github.com/gasparian/lsh-search-go/store"
+	"github.com/gasparian/lsh-search-go/store/storetest"
 	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
 	"testing"
 )
 
 var (
-	vectorsAreNotEqualErr   = errors.New("Vectors are not equal")
-	cantFindVecKey          = errors.New("Can not find vector uid")
-	wrongKeyErr             = errors.New("Returned wrong vector uid")
-	iteratorNotClosedErr    = errors.New("Iterator not closed, but it should")
-	vectorShouldNotExistErr = errors.New("Vector should not exist in a store")
+	bucket0 = store.BucketKey{Table: 0, Code: 0}
+	bucket1 = store.BucketKey{Table: 0, Code: 1}
+	bucket2 = store.BucketKey{Table: 1, Code: 0}
+)
+
+var (
+	vectorsAreNotEqualErr        = errors.New("Vectors are not equal")
+	cantFindVecKey               = errors.New("Can not find vector uid")
+	wrongKeyErr                  = errors.New("Returned wrong vector uid")
+	iteratorNotClosedErr         = errors.New("Iterator not closed, but it should")
+	vectorShouldNotExistErr      = errors.New("Vector should not exist in a store")
+	normsAreNotEqualErr          = errors.New("Norms are not equal")
+	normShouldNotExistErr        = errors.New("Norm should not exist in a store")
+	lengthMismatchShouldFailErr  = errors.New("Batch with slices of different length should fail")
+	emptyBucketShouldNotExistErr = errors.New("Empty bucket should not exist in a store")
 )
 
 func TestKvStore(t *testing.T) {
-	store := NewKVStore()
+	s := NewKVStore()
 	vecIds := map[string]bool{
 		"0": true,
 		"1": true,
@@ -24,12 +39,12 @@ func TestKvStore(t *testing.T) {
 
 	t.Run("SetVector", func(t *testing.T) {
 		for k := range vecIds {
-			err := store.SetVector(k, vec)
+			err := s.SetVector(k, vec)
 			if err != nil {
 				t.Fatal(err)
 			}
 		}
-		vecReturned, err := store.GetVector("0")
+		vecReturned, err := s.GetVector("0")
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -38,15 +53,33 @@ func TestKvStore(t *testing.T) {
 		}
 	})
 
+	t.Run("SetNorm", func(t *testing.T) {
+		err := s.SetNorm("0", 42.0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		norm, err := s.GetNorm("0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if norm != 42.0 {
+			t.Error(normsAreNotEqualErr)
+		}
+		_, err = s.GetNorm("1")
+		if err == nil {
+			t.Error(normShouldNotExistErr)
+		}
+	})
+
 	t.Run("SetHash", func(t *testing.T) {
 		for k := range vecIds {
-			err := store.SetHash("0", k)
+			err := s.SetHash(bucket0, k)
 			if err != nil {
 				t.Fatal(err)
 			}
 		}
 
-		it, err := store.GetHashIterator("0")
+		it, err := s.GetHashIterator(bucket0)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -66,11 +99,200 @@ func TestKvStore(t *testing.T) {
 		}
 	})
 
+	t.Run("Batch", func(t *testing.T) {
+		ids := []string{"2", "3"}
+		vecs := [][]float64{{3, 4}, {5, 6}}
+		err := s.SetVectors(ids, vecs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vecsReturned, err := s.GetVectors(ids)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(vecs, vecsReturned) {
+			t.Error(vectorsAreNotEqualErr)
+		}
+		_, err = s.GetVectors([]string{"2", "42"})
+		if err == nil {
+			t.Error(vectorShouldNotExistErr)
+		}
+		err = s.SetVectors(ids, vecs[:1])
+		if err == nil {
+			t.Error(lengthMismatchShouldFailErr)
+		}
+
+		norms := []float64{5, 7.8}
+		err = s.SetNorms(ids, norms)
+		if err != nil {
+			t.Fatal(err)
+		}
+		normsReturned, err := s.GetNorms(ids)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(norms, normsReturned) {
+			t.Error(normsAreNotEqualErr)
+		}
+
+		err = s.SetHashes([]store.BucketKey{bucket1, bucket1}, ids)
+		if err != nil {
+			t.Fatal(err)
+		}
+		it, err := s.GetHashIterator(bucket1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := make(map[string]bool)
+		for {
+			id, ok := it.Next()
+			if !ok {
+				break
+			}
+			found[id] = true
+		}
+		if len(found) != len(ids) {
+			t.Error(cantFindVecKey)
+		}
+	})
+
+	t.Run("Scan", func(t *testing.T) {
+		count, err := s.CountVectors()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 4 {
+			t.Fatalf("Store must contain 4 vectors, got %v", count)
+		}
+		it, err := s.GetVectorIterator()
+		if err != nil {
+			t.Fatal(err)
+		}
+		scanned := 0
+		for {
+			id, vec, ok := it.Next()
+			if !ok {
+				break
+			}
+			vecReturned, err := s.GetVector(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(vec, vecReturned) {
+				t.Error(vectorsAreNotEqualErr)
+			}
+			scanned++
+		}
+		if scanned != count {
+			t.Errorf("Iterator must return %v vectors, got %v", count, scanned)
+		}
+		err = s.SetHash(bucket2, "0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		buckets, err := s.ListBuckets()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Slice(buckets, func(i, j int) bool { return buckets[i].String() < buckets[j].String() })
+		if !reflect.DeepEqual(buckets, []store.BucketKey{bucket0, bucket1, bucket2}) {
+			t.Errorf("Wrong buckets list: %v", buckets)
+		}
+		buckets, err = s.ListTableBuckets(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(buckets, []store.BucketKey{bucket2}) {
+			t.Errorf("Wrong table buckets list: %v", buckets)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		err := s.DeleteVector("2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.GetVector("2")
+		if err == nil {
+			t.Error(vectorShouldNotExistErr)
+		}
+		_, err = s.GetNorm("2")
+		if err == nil {
+			t.Error(normShouldNotExistErr)
+		}
+		err = s.DeleteVector("2")
+		if err == nil {
+			t.Error(vectorShouldNotExistErr)
+		}
+
+		err = s.RemoveHash(bucket1, "2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.RemoveHash(bucket1, "3")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.GetHashIterator(bucket1)
+		if err == nil {
+			t.Error(emptyBucketShouldNotExistErr)
+		}
+	})
+
 	t.Run("Clear", func(t *testing.T) {
-		store.Clear()
-		_, err := store.GetVector("0")
+		s.Clear()
+		_, err := s.GetVector("0")
 		if err == nil {
 			t.Error(vectorShouldNotExistErr)
 		}
 	})
 }
+
+func TestIteratorsLeak(t *testing.T) {
+	s := NewKVStore()
+	for i := 0; i < 100; i++ {
+		err := s.SetHash(bucket0, strconv.Itoa(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	before := runtime.NumGoroutine()
+	for i := 0; i < 100; i++ {
+		it, err := s.GetHashIterator(bucket0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// NOTE: abandon iterator before it's exhausted, like the search does
+		if ids := it.NextN(10); len(ids) != 10 {
+			t.Fatalf("Iterator must return 10 ids, got %v", len(ids))
+		}
+		err = it.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := it.Next(); ok {
+			t.Fatal(iteratorNotClosedErr)
+		}
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Fatalf("Abandoned iterators leaked %v goroutines", after-before)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	storetest.RunConformance(t, func(t *testing.T) (store.Store, func()) {
+		return NewKVStore(), nil
+	})
+}
+
+func TestNamespaces(t *testing.T) {
+	storetest.RunNamespaceConformance(t, func(t *testing.T) (store.Store, func()) {
+		return NewKVStore(), nil
+	})
+}
+
+func TestPayloads(t *testing.T) {
+	storetest.RunPayloadConformance(t, func(t *testing.T) (store.Store, func()) {
+		return NewKVStore(), nil
+	})
+}
@@ -0,0 +1,132 @@
+package mmap
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/gasparian/lsh-search-go/store"
+	"reflect"
+	"unsafe"
+)
+
+var (
+	corruptedFileErr  = errors.New("Index file is corrupted")
+	wrongByteOrderErr = errors.New("Memory-mapped index requires little-endian host")
+	unknownVersionErr = errors.New("Index file version is not supported")
+	dimsMismatchErr   = errors.New("Vector dimensions number differs from the stored ones")
+	emptyIndexErr     = errors.New("Source store doesn't contain vectors")
+	bucketNotFoundErr = store.BucketNotFoundErr
+	keyNotFoundErr    = store.KeyNotFoundErr
+	readOnlyErr       = errors.New("Memory-mapped store is read-only")
+	storeClosedErr    = errors.New("Store is closed")
+)
+
+var (
+	vectorsFileMagic = [4]byte{'L', 'S', 'H', 'V'}
+	idsFileMagic     = [4]byte{'L', 'S', 'H', 'I'}
+	bucketsFileMagic = [4]byte{'L', 'S', 'H', 'B'}
+	endiannessProbe  = uint16(1)
+)
+
+const (
+	vectorsFileName    = "vectors.bin"
+	idsFileName        = "ids.bin"
+	bucketsFileName    = "buckets.bin"
+	formatVersion      = uint32(1)
+	headerSize         = 64
+	headerCountsOffset = 8
+	bucketEntryWords   = 4 // NOTE: table, code, postings start and end
+)
+
+// Files layout; all numbers are little-endian, sections are 8-bytes aligned.
+// Every file starts with 64-bytes header: magic (4 bytes), version (uint32) and file-specific counters.
+//
+// vectors.bin: dims (uint64), count (uint64) | count*dims float64 | count float64 norms (NaN if missing)
+// ids.bin: count (uint64) | count+1 uint64 offsets of ids in the blob (internal order) |
+//          count uint32 internal ids sorted by the id string (padded to 8 bytes) | ids blob
+// buckets.bin: buckets count (uint64), postings count (uint64) | postings uint32 (padded to 8 bytes) |
+//              buckets sorted by key, 4 uint64 each: table, code, postings start, postings end
+
+func putHeader(header []byte, magic [4]byte, counters ...uint64) {
+	copy(header, magic[:])
+	binary.LittleEndian.PutUint32(header[4:], formatVersion)
+	for i, c := range counters {
+		binary.LittleEndian.PutUint64(header[headerCountsOffset+8*i:], c)
+	}
+}
+
+// checkHeader validates header and returns its counters
+func checkHeader(data []byte, magic [4]byte, nCounters int) ([]uint64, error) {
+	if len(data) < headerSize || string(data[:4]) != string(magic[:]) {
+		return nil, corruptedFileErr
+	}
+	if binary.LittleEndian.Uint32(data[4:]) != formatVersion {
+		return nil, unknownVersionErr
+	}
+	counters := make([]uint64, nCounters)
+	for i := range counters {
+		counters[i] = binary.LittleEndian.Uint64(data[headerCountsOffset+8*i:])
+	}
+	return counters, nil
+}
+
+// vectorsSize returns the size of the vectors section by the header counters, checking that the vectors
+// and norms sections fill the rest of the file of the given size; counters are checked before
+// the multiplication, so the corrupted ones can't overflow it
+func vectorsSize(dims, count, fileSize uint64) (uint64, bool) {
+	if dims == 0 || fileSize < headerSize {
+		return 0, false
+	}
+	available := fileSize - headerSize
+	if count != 0 && dims > available/8/count {
+		return 0, false
+	}
+	vecsSize := dims * count * 8
+	return vecsSize, available == vecsSize+count*8
+}
+
+func isLittleEndian() bool {
+	return *(*byte)(unsafe.Pointer(&endiannessProbe)) == 1
+}
+
+func align8(n uint64) uint64 {
+	return (n + 7) &^ 7
+}
+
+// NOTE: the following functions reinterpret mapped bytes without copying;
+// data must be 8-bytes aligned and outlive the returned slices
+
+func float64s(data []byte) []float64 {
+	var out []float64
+	if len(data) == 0 {
+		return out
+	}
+	h := (*reflect.SliceHeader)(unsafe.Pointer(&out))
+	h.Data = uintptr(unsafe.Pointer(&data[0]))
+	h.Len = len(data) / 8
+	h.Cap = h.Len
+	return out
+}
+
+func uint64s(data []byte) []uint64 {
+	var out []uint64
+	if len(data) == 0 {
+		return out
+	}
+	h := (*reflect.SliceHeader)(unsafe.Pointer(&out))
+	h.Data = uintptr(unsafe.Pointer(&data[0]))
+	h.Len = len(data) / 8
+	h.Cap = h.Len
+	return out
+}
+
+func uint32s(data []byte) []uint32 {
+	var out []uint32
+	if len(data) == 0 {
+		return out
+	}
+	h := (*reflect.SliceHeader)(unsafe.Pointer(&out))
+	h.Data = uintptr(unsafe.Pointer(&data[0]))
+	h.Len = len(data) / 4
+	h.Cap = h.Len
+	return out
+}
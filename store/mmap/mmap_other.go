@@ -0,0 +1,18 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package mmap
+
+import (
+	"io/ioutil"
+	"os"
+)
+
+// mapFile reads the whole file into memory on systems without mmap support
+func mapFile(f *os.File) ([]byte, error) {
+	return ioutil.ReadAll(f)
+}
+
+func unmapFile(data []byte) error {
+	return nil
+}
@@ -0,0 +1,448 @@
+package mmap
+
+import (
+	"github.com/gasparian/lsh-search-go/store"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// MmapStore serves the index written by WriteIndex through the memory-mapped files,
+// so processes on the same host share it via page cache and the start doesn't require loading.
+// Store is read-only: all write methods return error.
+// Vectors are returned without copying: they must not be modified
+// and must not be used after the store is closed
+type MmapStore struct {
+	mx        sync.RWMutex
+	closed    bool
+	mapped    [][]byte
+	dims      int
+	count     int
+	vecs      []float64
+	norms     []float64
+	idOffsets []uint64
+	idSorted  []uint32
+	idBlob    []byte
+	postings  []uint32
+	buckets   []uint64
+}
+
+// NewMmapStore maps index files from the directory; store must be closed after use
+func NewMmapStore(dir string) (*MmapStore, error) {
+	if !isLittleEndian() {
+		return nil, wrongByteOrderErr
+	}
+	s := &MmapStore{}
+	err := s.open(dir)
+	if err != nil {
+		s.unmap()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *MmapStore) mapFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	// NOTE: mapping stays valid after the file is closed
+	defer f.Close()
+	data, err := mapFile(f)
+	if err != nil {
+		return nil, err
+	}
+	s.mapped = append(s.mapped, data)
+	return data, nil
+}
+
+func (s *MmapStore) open(dir string) error {
+	err := s.openVectors(filepath.Join(dir, vectorsFileName))
+	if err != nil {
+		return err
+	}
+	err = s.openIds(filepath.Join(dir, idsFileName))
+	if err != nil {
+		return err
+	}
+	return s.openBuckets(filepath.Join(dir, bucketsFileName))
+}
+
+func (s *MmapStore) openVectors(path string) error {
+	data, err := s.mapFile(path)
+	if err != nil {
+		return err
+	}
+	counters, err := checkHeader(data, vectorsFileMagic, 2)
+	if err != nil {
+		return err
+	}
+	dims, count := counters[0], counters[1]
+	vecsSize, ok := vectorsSize(dims, count, uint64(len(data)))
+	if !ok {
+		return corruptedFileErr
+	}
+	s.dims = int(dims)
+	s.count = int(count)
+	s.vecs = float64s(data[headerSize : headerSize+vecsSize])
+	s.norms = float64s(data[headerSize+vecsSize:])
+	return nil
+}
+
+func (s *MmapStore) openIds(path string) error {
+	data, err := s.mapFile(path)
+	if err != nil {
+		return err
+	}
+	counters, err := checkHeader(data, idsFileMagic, 1)
+	if err != nil {
+		return err
+	}
+	count := counters[0]
+	if count != uint64(s.count) {
+		return corruptedFileErr
+	}
+	sortedStart := headerSize + (count+1)*8
+	blobStart := sortedStart + align8(count*4)
+	if uint64(len(data)) < blobStart {
+		return corruptedFileErr
+	}
+	s.idOffsets = uint64s(data[headerSize:sortedStart])
+	s.idSorted = uint32s(data[sortedStart : sortedStart+count*4])
+	s.idBlob = data[blobStart:]
+	// NOTE: ids are sliced by the offsets, so they're checked once here instead of every lookup
+	if s.idOffsets[0] != 0 || s.idOffsets[count] != uint64(len(s.idBlob)) {
+		return corruptedFileErr
+	}
+	for i := uint64(0); i < count; i++ {
+		if s.idOffsets[i] > s.idOffsets[i+1] || uint64(s.idSorted[i]) >= count {
+			return corruptedFileErr
+		}
+	}
+	return nil
+}
+
+func (s *MmapStore) openBuckets(path string) error {
+	data, err := s.mapFile(path)
+	if err != nil {
+		return err
+	}
+	counters, err := checkHeader(data, bucketsFileMagic, 2)
+	if err != nil {
+		return err
+	}
+	nBuckets, nPostings := counters[0], counters[1]
+	if nBuckets > uint64(len(data)) || nPostings > uint64(len(data)) {
+		return corruptedFileErr
+	}
+	tableStart := headerSize + align8(nPostings*4)
+	if uint64(len(data)) != tableStart+nBuckets*bucketEntryWords*8 {
+		return corruptedFileErr
+	}
+	s.postings = uint32s(data[headerSize : headerSize+nPostings*4])
+	s.buckets = uint64s(data[tableStart:])
+	for i := 0; i < len(s.buckets); i += bucketEntryWords {
+		if s.buckets[i+2] > s.buckets[i+3] || s.buckets[i+3] > nPostings {
+			return corruptedFileErr
+		}
+	}
+	return nil
+}
+
+func (s *MmapStore) unmap() error {
+	var err error
+	for _, data := range s.mapped {
+		if e := unmapFile(data); e != nil {
+			err = e
+		}
+	}
+	s.mapped = nil
+	s.vecs, s.norms = nil, nil
+	s.idOffsets, s.idSorted, s.idBlob = nil, nil, nil
+	s.postings, s.buckets = nil, nil
+	return err
+}
+
+// Close unmaps the files; vectors returned before become invalid
+func (s *MmapStore) Close() error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.closed {
+		return storeClosedErr
+	}
+	s.closed = true
+	return s.unmap()
+}
+
+// idBytes returns id of the internal index without copying
+func (s *MmapStore) idBytes(idx uint32) []byte {
+	return s.idBlob[s.idOffsets[idx]:s.idOffsets[idx+1]]
+}
+
+// lookup finds internal index of the id with binary search over the sorted ids table
+func (s *MmapStore) lookup(id string) (uint32, bool) {
+	pos := sort.Search(s.count, func(i int) bool {
+		return string(s.idBytes(s.idSorted[i])) >= id
+	})
+	if pos == s.count || string(s.idBytes(s.idSorted[pos])) != id {
+		return 0, false
+	}
+	return s.idSorted[pos], true
+}
+
+func (s *MmapStore) getVector(idx uint32) []float64 {
+	start := int(idx) * s.dims
+	end := start + s.dims
+	return s.vecs[start:end:end]
+}
+
+// findBucket returns position of the bucket in the buckets table
+func (s *MmapStore) findBucket(key store.BucketKey) (int, bool) {
+	n := len(s.buckets) / bucketEntryWords
+	pos := sort.Search(n, func(i int) bool {
+		return !keyLess(s.bucketKey(i), key)
+	})
+	if pos == n || s.bucketKey(pos) != key {
+		return 0, false
+	}
+	return pos, true
+}
+
+func (s *MmapStore) bucketKey(pos int) store.BucketKey {
+	entry := s.buckets[pos*bucketEntryWords:]
+	return store.BucketKey{Table: uint32(entry[0]), Code: entry[1]}
+}
+
+// KeysIterator iterates over the copy of bucket's vectors uids
+type KeysIterator struct {
+	vecIds []string
+	pos    int
+}
+
+func (it *KeysIterator) Next() (string, bool) {
+	if it.pos >= len(it.vecIds) {
+		return "", false
+	}
+	it.pos++
+	return it.vecIds[it.pos-1], true
+}
+
+func (it *KeysIterator) NextN(n int) []string {
+	end := it.pos + n
+	if end > len(it.vecIds) {
+		end = len(it.vecIds)
+	}
+	if end <= it.pos {
+		return []string{}
+	}
+	vecIds := it.vecIds[it.pos:end]
+	it.pos = end
+	return vecIds
+}
+
+// Close releases the snapshot
+func (it *KeysIterator) Close() error {
+	it.vecIds = nil
+	it.pos = 0
+	return nil
+}
+
+// VectorsIterator walks through the vectors in the file order
+type VectorsIterator struct {
+	s   *MmapStore
+	pos int
+}
+
+func (it *VectorsIterator) Next() (string, []float64, bool) {
+	if it.s == nil {
+		return "", nil, false
+	}
+	it.s.mx.RLock()
+	defer it.s.mx.RUnlock()
+	if it.s.closed || it.pos >= it.s.count {
+		return "", nil, false
+	}
+	idx := uint32(it.pos)
+	it.pos++
+	return string(it.s.idBytes(idx)), it.s.getVector(idx), true
+}
+
+func (it *VectorsIterator) Close() error {
+	it.s = nil
+	return nil
+}
+
+func (s *MmapStore) SetVector(id string, vec []float64) error {
+	return readOnlyErr
+}
+
+func (s *MmapStore) SetVectors(ids []string, vecs [][]float64) error {
+	return readOnlyErr
+}
+
+func (s *MmapStore) GetVector(id string) ([]float64, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	if s.closed {
+		return nil, storeClosedErr
+	}
+	idx, ok := s.lookup(id)
+	if !ok {
+		return nil, keyNotFoundErr
+	}
+	return s.getVector(idx), nil
+}
+
+func (s *MmapStore) GetVectors(ids []string) ([][]float64, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	if s.closed {
+		return nil, storeClosedErr
+	}
+	vecs := make([][]float64, len(ids))
+	for i, id := range ids {
+		idx, ok := s.lookup(id)
+		if !ok {
+			return nil, keyNotFoundErr
+		}
+		vecs[i] = s.getVector(idx)
+	}
+	return vecs, nil
+}
+
+func (s *MmapStore) DeleteVector(id string) error {
+	return readOnlyErr
+}
+
+func (s *MmapStore) CountVectors() (int, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	if s.closed {
+		return 0, storeClosedErr
+	}
+	return s.count, nil
+}
+
+func (s *MmapStore) GetVectorIterator() (store.VectorIterator, error) {
+	return &VectorsIterator{s: s}, nil
+}
+
+func (s *MmapStore) SetNorm(id string, norm float64) error {
+	return readOnlyErr
+}
+
+func (s *MmapStore) SetNorms(ids []string, norms []float64) error {
+	return readOnlyErr
+}
+
+func (s *MmapStore) getNorm(id string) (float64, error) {
+	idx, ok := s.lookup(id)
+	if !ok || math.IsNaN(s.norms[idx]) {
+		return 0, keyNotFoundErr
+	}
+	return s.norms[idx], nil
+}
+
+func (s *MmapStore) GetNorm(id string) (float64, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	if s.closed {
+		return 0, storeClosedErr
+	}
+	return s.getNorm(id)
+}
+
+func (s *MmapStore) GetNorms(ids []string) ([]float64, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	if s.closed {
+		return nil, storeClosedErr
+	}
+	norms := make([]float64, len(ids))
+	for i, id := range ids {
+		norm, err := s.getNorm(id)
+		if err != nil {
+			return nil, err
+		}
+		norms[i] = norm
+	}
+	return norms, nil
+}
+
+func (s *MmapStore) SetHash(key store.BucketKey, vecId string) error {
+	return readOnlyErr
+}
+
+func (s *MmapStore) SetHashes(keys []store.BucketKey, vecIds []string) error {
+	return readOnlyErr
+}
+
+func (s *MmapStore) RemoveHash(key store.BucketKey, vecId string) error {
+	return readOnlyErr
+}
+
+// GetHashIterator returns iterator over the bucket's uids, copied from the mapped file
+func (s *MmapStore) GetHashIterator(key store.BucketKey) (store.Iterator, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	if s.closed {
+		return nil, storeClosedErr
+	}
+	pos, ok := s.findBucket(key)
+	if !ok {
+		return nil, bucketNotFoundErr
+	}
+	entry := s.buckets[pos*bucketEntryWords:]
+	if entry[2] > entry[3] || entry[3] > uint64(len(s.postings)) {
+		return nil, corruptedFileErr
+	}
+	postings := s.postings[entry[2]:entry[3]]
+	it := &KeysIterator{
+		vecIds: make([]string, len(postings)),
+	}
+	for i, idx := range postings {
+		if int(idx) >= s.count {
+			return nil, corruptedFileErr
+		}
+		it.vecIds[i] = string(s.idBytes(idx))
+	}
+	return it, nil
+}
+
+func (s *MmapStore) ListBuckets() ([]store.BucketKey, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	if s.closed {
+		return nil, storeClosedErr
+	}
+	n := len(s.buckets) / bucketEntryWords
+	keys := make([]store.BucketKey, n)
+	for i := range keys {
+		keys[i] = s.bucketKey(i)
+	}
+	return keys, nil
+}
+
+// ListTableBuckets is a range scan, since buckets are sorted by table first
+func (s *MmapStore) ListTableBuckets(table uint32) ([]store.BucketKey, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	if s.closed {
+		return nil, storeClosedErr
+	}
+	n := len(s.buckets) / bucketEntryWords
+	pos := sort.Search(n, func(i int) bool {
+		return s.bucketKey(i).Table >= table
+	})
+	keys := make([]store.BucketKey, 0)
+	for ; pos < n && s.bucketKey(pos).Table == table; pos++ {
+		keys = append(keys, s.bucketKey(pos))
+	}
+	return keys, nil
+}
+
+func (s *MmapStore) Clear() error {
+	return readOnlyErr
+}
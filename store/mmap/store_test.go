@@ -0,0 +1,192 @@
+package mmap
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/gasparian/lsh-search-go/store"
+	"github.com/gasparian/lsh-search-go/store/kv"
+	"github.com/gasparian/lsh-search-go/store/storetest"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+var (
+	vectorsAreNotEqualErr = errors.New("Vectors are not equal")
+	wrongKeysErr          = errors.New("Returned wrong vectors uids")
+)
+
+// fillSource makes kv store with 100 vectors, norms for the even ones and 3 tables with 5 buckets each
+func fillSource(t *testing.T) *kv.KVStore {
+	src := kv.NewKVStore()
+	for i := 0; i < 100; i++ {
+		id := "vec" + strconv.Itoa(i)
+		err := src.SetVector(id, []float64{float64(i), float64(-i), 0.5})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i%2 == 0 {
+			src.SetNorm(id, float64(i))
+		}
+		for table := 0; table < 3; table++ {
+			src.SetHash(store.BucketKey{Table: uint32(table), Code: uint64(i % 5)}, id)
+		}
+	}
+	// NOTE: entries of the absent vectors must be skipped
+	src.SetHash(store.BucketKey{Table: 0, Code: 0}, "absent")
+	return src
+}
+
+func TestMmapStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mmap-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := fillSource(t)
+	err = WriteIndex(dir, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewMmapStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// NOTE: the read path and the read-only writes are checked by the conformance suite
+	t.Run("ZeroCopy", func(t *testing.T) {
+		vecs, err := s.GetVectors([]string{"vec1", "vec1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if &vecs[0][0] != &vecs[1][0] || cap(vecs[0]) != len(vecs[0]) {
+			t.Error("Vectors must be returned without copying and with capacity limited by length")
+		}
+	})
+
+	t.Run("AbsentEntries", func(t *testing.T) {
+		key := store.BucketKey{Table: 0, Code: 0}
+		expectedIt, _ := src.GetHashIterator(key)
+		expected := storetest.ReadIds(expectedIt)[1:] // NOTE: "absent" goes first
+		it, err := s.GetHashIterator(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(storetest.ReadIds(it), expected) {
+			t.Error(wrongKeysErr)
+		}
+	})
+
+	t.Run("Shared", func(t *testing.T) {
+		other, err := NewMmapStore(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vec, _ := other.GetVector("vec7")
+		expected, _ := s.GetVector("vec7")
+		if !reflect.DeepEqual(vec, expected) {
+			t.Error(vectorsAreNotEqualErr)
+		}
+		err = other.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = other.GetVector("vec7")
+		if err == nil {
+			t.Error("Closed store must not be readable")
+		}
+	})
+
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCorruptedIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mmap-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = WriteIndex(dir, kv.NewKVStore())
+	if err == nil {
+		t.Fatal("Empty store must not be written")
+	}
+	err = WriteIndex(dir, fillSource(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{vectorsFileName, idsFileName, bucketsFileName} {
+		path := filepath.Join(dir, name)
+		data, _ := ioutil.ReadFile(path)
+		ioutil.WriteFile(path, data[:len(data)-4], 0644)
+		_, err = NewMmapStore(dir)
+		if err == nil {
+			t.Errorf("Truncated %v must not be opened", name)
+		}
+		ioutil.WriteFile(path, data, 0644)
+	}
+
+	// NOTE: sizes match, but the offsets point outside of the data
+	corrupt := func(name string, offset int) {
+		path := filepath.Join(dir, name)
+		data, _ := ioutil.ReadFile(path)
+		corrupted := append([]byte{}, data...)
+		binary.LittleEndian.PutUint64(corrupted[offset:], 1<<40)
+		ioutil.WriteFile(path, corrupted, 0644)
+		_, err = NewMmapStore(dir)
+		if err != corruptedFileErr {
+			t.Errorf("File %v with the corrupted offset at %v must not be opened, got %v", name, offset, err)
+		}
+		ioutil.WriteFile(path, data, 0644)
+	}
+	corrupt(idsFileName, headerSize+8)
+	buckets, _ := ioutil.ReadFile(filepath.Join(dir, bucketsFileName))
+	corrupt(bucketsFileName, len(buckets)-8)
+
+	t.Run("Overflow", func(t *testing.T) {
+		// NOTE: dims*count*8 wraps to zero, so the norms section alone would match the file size
+		dims, count := uint64(1<<31), uint64(1<<31)
+		if _, ok := vectorsSize(dims, count, headerSize+count*8); ok {
+			t.Error("Overflowed vectors size must be rejected")
+		}
+		size, ok := vectorsSize(3, 2, headerSize+3*2*8+2*8)
+		if !ok || size != 3*2*8 {
+			t.Errorf("Vectors size must be calculated, got %v", size)
+		}
+		if _, ok := vectorsSize(3, 0, headerSize); !ok {
+			t.Error("Empty vectors section must be accepted")
+		}
+	})
+}
+
+func TestConformance(t *testing.T) {
+	storetest.RunReadOnlyConformance(t, func(t *testing.T, fill func(store.Store) error) (store.Store, func()) {
+		dir, err := ioutil.TempDir("", "mmap-store")
+		if err != nil {
+			t.Fatal(err)
+		}
+		src := kv.NewKVStore()
+		err = fill(src)
+		if err == nil {
+			err = WriteIndex(dir, src)
+		}
+		if err != nil {
+			os.RemoveAll(dir)
+			t.Fatal(err)
+		}
+		s, err := NewMmapStore(dir)
+		if err != nil {
+			os.RemoveAll(dir)
+			t.Fatal(err)
+		}
+		return s, func() {
+			s.Close()
+			os.RemoveAll(dir)
+		}
+	})
+}
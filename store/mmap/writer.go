@@ -0,0 +1,313 @@
+package mmap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"github.com/gasparian/lsh-search-go/store"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// fileWriter writes little-endian numbers to the temporary file,
+// which replaces the target one only after it's been fully written
+type fileWriter struct {
+	path    string
+	file    *os.File
+	w       *bufio.Writer
+	written uint64
+	buf     [8]byte
+}
+
+func newFileWriter(path string) (*fileWriter, error) {
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	fw := &fileWriter{
+		path: path,
+		file: file,
+		w:    bufio.NewWriterSize(file, 1<<20),
+	}
+	// NOTE: header is written the last, when all counters are known
+	fw.write(make([]byte, headerSize))
+	return fw, nil
+}
+
+func (fw *fileWriter) write(data []byte) error {
+	n, err := fw.w.Write(data)
+	fw.written += uint64(n)
+	return err
+}
+
+func (fw *fileWriter) uint64(x uint64) error {
+	binary.LittleEndian.PutUint64(fw.buf[:], x)
+	return fw.write(fw.buf[:])
+}
+
+func (fw *fileWriter) uint32(x uint32) error {
+	binary.LittleEndian.PutUint32(fw.buf[:4], x)
+	return fw.write(fw.buf[:4])
+}
+
+func (fw *fileWriter) float64(f float64) error {
+	return fw.uint64(math.Float64bits(f))
+}
+
+func (fw *fileWriter) pad() error {
+	return fw.write(make([]byte, align8(fw.written)-fw.written))
+}
+
+// commit writes header, syncs the file and moves it to the target path
+func (fw *fileWriter) commit(magic [4]byte, counters ...uint64) error {
+	err := fw.w.Flush()
+	if err != nil {
+		return err
+	}
+	header := make([]byte, headerSize)
+	putHeader(header, magic, counters...)
+	_, err = fw.file.WriteAt(header, 0)
+	if err != nil {
+		return err
+	}
+	err = fw.file.Sync()
+	if err != nil {
+		return err
+	}
+	err = fw.file.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(fw.path+".tmp", fw.path)
+}
+
+func (fw *fileWriter) abort() {
+	fw.file.Close()
+	os.Remove(fw.path + ".tmp")
+}
+
+// WriteIndex dumps vectors, norms and buckets of the source store into the directory,
+// so it can be served by MmapStore. Vectors must have the same dimensions number;
+// bucket entries which refer to the absent vectors are skipped
+func WriteIndex(dir string, src store.Store) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	ids, err := writeVectors(filepath.Join(dir, vectorsFileName), src)
+	if err != nil {
+		return err
+	}
+	err = writeIds(filepath.Join(dir, idsFileName), ids)
+	if err != nil {
+		return err
+	}
+	return writeBuckets(filepath.Join(dir, bucketsFileName), src, ids)
+}
+
+func writeVectors(path string, src store.Store) ([]string, error) {
+	fw, err := newFileWriter(path)
+	if err != nil {
+		return nil, err
+	}
+	ids, dims, err := writeVectorsData(fw, src)
+	if err != nil {
+		fw.abort()
+		return nil, err
+	}
+	err = fw.commit(vectorsFileMagic, uint64(dims), uint64(len(ids)))
+	if err != nil {
+		fw.abort()
+		return nil, err
+	}
+	return ids, nil
+}
+
+func writeVectorsData(fw *fileWriter, src store.Store) ([]string, int, error) {
+	it, err := src.GetVectorIterator()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer it.Close()
+	ids := make([]string, 0)
+	dims := 0
+	for {
+		id, vec, ok := it.Next()
+		if !ok {
+			break
+		}
+		if dims == 0 {
+			dims = len(vec)
+		}
+		if len(vec) != dims {
+			return nil, 0, dimsMismatchErr
+		}
+		for _, v := range vec {
+			err = fw.float64(v)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 || dims == 0 {
+		return nil, 0, emptyIndexErr
+	}
+	for _, id := range ids {
+		norm, err := src.GetNorm(id)
+		if err != nil {
+			norm = math.NaN()
+		}
+		err = fw.float64(norm)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	return ids, dims, nil
+}
+
+func writeIds(path string, ids []string) error {
+	fw, err := newFileWriter(path)
+	if err != nil {
+		return err
+	}
+	err = writeIdsData(fw, ids)
+	if err == nil {
+		err = fw.commit(idsFileMagic, uint64(len(ids)))
+	}
+	if err != nil {
+		fw.abort()
+	}
+	return err
+}
+
+func writeIdsData(fw *fileWriter, ids []string) error {
+	var offset uint64
+	for _, id := range ids {
+		err := fw.uint64(offset)
+		if err != nil {
+			return err
+		}
+		offset += uint64(len(id))
+	}
+	err := fw.uint64(offset)
+	if err != nil {
+		return err
+	}
+	sorted := make([]uint32, len(ids))
+	for i := range sorted {
+		sorted[i] = uint32(i)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return ids[sorted[i]] < ids[sorted[j]] })
+	for _, idx := range sorted {
+		err = fw.uint32(idx)
+		if err != nil {
+			return err
+		}
+	}
+	err = fw.pad()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		err = fw.write([]byte(id))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeBuckets(path string, src store.Store, ids []string) error {
+	fw, err := newFileWriter(path)
+	if err != nil {
+		return err
+	}
+	nBuckets, nPostings, err := writeBucketsData(fw, src, ids)
+	if err == nil {
+		err = fw.commit(bucketsFileMagic, nBuckets, nPostings)
+	}
+	if err != nil {
+		fw.abort()
+	}
+	return err
+}
+
+// writeBucketsData streams postings first, since the buckets table is small enough
+// to be kept in memory until all postings are written
+func writeBucketsData(fw *fileWriter, src store.Store, ids []string) (uint64, uint64, error) {
+	idxs := make(map[string]uint32, len(ids))
+	for i, id := range ids {
+		idxs[id] = uint32(i)
+	}
+	keys, err := src.ListBuckets()
+	if err != nil {
+		return 0, 0, err
+	}
+	sort.Slice(keys, func(i, j int) bool { return keyLess(keys[i], keys[j]) })
+	table := make([]uint64, 0, len(keys)*bucketEntryWords)
+	var nPostings uint64
+	for _, key := range keys {
+		postings, err := readPostings(src, key, idxs)
+		if err != nil {
+			return 0, 0, err
+		}
+		if len(postings) == 0 {
+			continue
+		}
+		for _, idx := range postings {
+			err = fw.uint32(idx)
+			if err != nil {
+				return 0, 0, err
+			}
+		}
+		table = append(table, uint64(key.Table), key.Code, nPostings, nPostings+uint64(len(postings)))
+		nPostings += uint64(len(postings))
+	}
+	err = fw.pad()
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, word := range table {
+		err = fw.uint64(word)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	return uint64(len(table) / bucketEntryWords), nPostings, nil
+}
+
+// readPostings returns sorted unique internal ids of the bucket
+func readPostings(src store.Store, key store.BucketKey, idxs map[string]uint32) ([]uint32, error) {
+	it, err := src.GetHashIterator(key)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+	postings := make([]uint32, 0)
+	for {
+		id, ok := it.Next()
+		if !ok {
+			break
+		}
+		if idx, ok := idxs[id]; ok {
+			postings = append(postings, idx)
+		}
+	}
+	sort.Slice(postings, func(i, j int) bool { return postings[i] < postings[j] })
+	unique := postings[:0]
+	for i, idx := range postings {
+		if i == 0 || idx != postings[i-1] {
+			unique = append(unique, idx)
+		}
+	}
+	return unique, nil
+}
+
+func keyLess(l, r store.BucketKey) bool {
+	if l.Table != r.Table {
+		return l.Table < r.Table
+	}
+	return l.Code < r.Code
+}
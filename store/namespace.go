@@ -0,0 +1,92 @@
+package store
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+var (
+	namespaceNameErr     = errors.New("Namespace name must consist of 1-64 lowercase letters, digits and underscores")
+	namespaceNotFoundErr = errors.New("Namespace not found")
+)
+
+// Namespacer is implemented by stores, which keep several isolated collections in one backend.
+// Namespace opens the collection, creating it if needed; the same name always refers to the same collection,
+// so it can be opened again after restart. The store itself is the default collection:
+// its Clear doesn't touch the other ones, while DropNamespace removes the collection with all its data.
+// NOTE: the collection returned by Namespace must not be used after it's dropped
+type Namespacer interface {
+	Namespace(name string) (Store, error)
+	ListNamespaces() ([]string, error)
+	DropNamespace(name string) error
+}
+
+// ValidateNamespace checks that the name can be safely embedded into keys, tables and file names
+func ValidateNamespace(name string) error {
+	if len(name) == 0 || len(name) > 64 {
+		return namespaceNameErr
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '_' {
+			return namespaceNameErr
+		}
+	}
+	return nil
+}
+
+// Namespaces holds the opened collections, so every one of them is opened once;
+// Namespacer implementations use it to keep the collections, which can't be opened twice
+// (like in-memory ones). The zero value is ready to use
+type Namespaces struct {
+	mx     sync.Mutex
+	stores map[string]Store
+}
+
+// Open returns the already opened collection or opens it with the given function
+func (n *Namespaces) Open(name string, open func() (Store, error)) (Store, error) {
+	err := ValidateNamespace(name)
+	if err != nil {
+		return nil, err
+	}
+	n.mx.Lock()
+	defer n.mx.Unlock()
+	if s, ok := n.stores[name]; ok {
+		return s, nil
+	}
+	s, err := open()
+	if err != nil {
+		return nil, err
+	}
+	if n.stores == nil {
+		n.stores = make(map[string]Store)
+	}
+	n.stores[name] = s
+	return s, nil
+}
+
+// Names returns sorted names of the opened collections
+func (n *Namespaces) Names() []string {
+	n.mx.Lock()
+	defer n.mx.Unlock()
+	names := make([]string, 0, len(n.stores))
+	for name := range n.stores {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Remove forgets the collection and returns it, so the caller can release its resources;
+// the error is returned if the collection hasn't been opened
+func (n *Namespaces) Remove(name string) (Store, error) {
+	n.mx.Lock()
+	defer n.mx.Unlock()
+	s, ok := n.stores[name]
+	if !ok {
+		return nil, namespaceNotFoundErr
+	}
+	delete(n.stores, name)
+	return s, nil
+}
@@ -0,0 +1,180 @@
+package redis
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// command holds the command name and its arguments
+type command [][]byte
+
+func newCommand(name string, args ...[]byte) command {
+	cmd := make(command, 0, len(args)+1)
+	cmd = append(cmd, []byte(name))
+	return append(cmd, args...)
+}
+
+func (c command) add(args ...[]byte) command {
+	return append(c, args...)
+}
+
+func (c command) addString(args ...string) command {
+	for _, arg := range args {
+		c = append(c, []byte(arg))
+	}
+	return c
+}
+
+func itoa(n int64) []byte {
+	return strconv.AppendInt(nil, n, 10)
+}
+
+type conn struct {
+	nc net.Conn
+	r  *bufio.Reader
+	w  *bufio.Writer
+}
+
+// client keeps the pool of idle connections; connections are dialed on demand,
+// so the number of the open ones isn't limited by the pool size
+type client struct {
+	config Config
+	mx     sync.Mutex
+	idle   []*conn
+	closed bool
+}
+
+func newClient(config Config) *client {
+	return &client{
+		config: config,
+		idle:   make([]*conn, 0, config.PoolSize),
+	}
+}
+
+func (c *client) dial() (*conn, error) {
+	nc, err := net.DialTimeout("tcp", c.config.Addr, c.config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	cn := &conn{
+		nc: nc,
+		r:  bufio.NewReader(nc),
+		w:  bufio.NewWriter(nc),
+	}
+	init := make([]command, 0, 2)
+	if c.config.Password != "" {
+		init = append(init, newCommand("AUTH").addString(c.config.Password))
+	}
+	if c.config.DB != 0 {
+		init = append(init, newCommand("SELECT", itoa(int64(c.config.DB))))
+	}
+	if len(init) == 0 {
+		return cn, nil
+	}
+	replies, err := cn.pipeline(init, c.config.Timeout)
+	if err == nil {
+		for _, reply := range replies {
+			if err = replyErr(reply); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return cn, nil
+}
+
+// pipeline sends all commands at once and then reads their replies
+func (cn *conn) pipeline(cmds []command, timeout time.Duration) ([]interface{}, error) {
+	if timeout > 0 {
+		cn.nc.SetDeadline(time.Now().Add(timeout))
+	}
+	for _, cmd := range cmds {
+		err := writeCommand(cn.w, cmd)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := cn.w.Flush()
+	if err != nil {
+		return nil, err
+	}
+	replies := make([]interface{}, len(cmds))
+	for i := range replies {
+		replies[i], err = readReply(cn.r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return replies, nil
+}
+
+func (c *client) get() (*conn, error) {
+	c.mx.Lock()
+	if c.closed {
+		c.mx.Unlock()
+		return nil, closedErr
+	}
+	if n := len(c.idle); n > 0 {
+		cn := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mx.Unlock()
+		return cn, nil
+	}
+	c.mx.Unlock()
+	return c.dial()
+}
+
+func (c *client) put(cn *conn) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if c.closed || len(c.idle) >= c.config.PoolSize {
+		cn.nc.Close()
+		return
+	}
+	c.idle = append(c.idle, cn)
+}
+
+// do runs commands in a single pipeline; replies may contain ServerError values.
+// Connection is dropped after network or protocol error, since its state is unknown
+func (c *client) do(cmds ...command) ([]interface{}, error) {
+	cn, err := c.get()
+	if err != nil {
+		return nil, err
+	}
+	replies, err := cn.pipeline(cmds, c.config.Timeout)
+	if err != nil {
+		cn.nc.Close()
+		return nil, err
+	}
+	c.put(cn)
+	return replies, nil
+}
+
+// doOne runs the single command and returns the server error as error
+func (c *client) doOne(cmd command) (interface{}, error) {
+	replies, err := c.do(cmd)
+	if err != nil {
+		return nil, err
+	}
+	return replies[0], replyErr(replies[0])
+}
+
+func (c *client) close() error {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	c.closed = true
+	var err error
+	for _, cn := range c.idle {
+		if e := cn.nc.Close(); e != nil {
+			err = e
+		}
+	}
+	c.idle = nil
+	return err
+}
@@ -0,0 +1,201 @@
+package redis
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strconv"
+)
+
+var (
+	protocolErr = errors.New("Malformed RESP reply")
+	nilReplyErr = errors.New("Nil reply")
+)
+
+// maxBulkSize is the bulk string size limit of Redis itself (512MB)
+const maxBulkSize = 512 << 20
+
+// ServerError is an error reply ("-ERR ...") sent by the server
+type ServerError string
+
+func (e ServerError) Error() string {
+	return string(e)
+}
+
+// writeCommand encodes command as the array of bulk strings
+func writeCommand(w *bufio.Writer, args [][]byte) error {
+	buf := make([]byte, 0, 16)
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	_, err := w.Write(buf)
+	if err != nil {
+		return err
+	}
+	for _, arg := range args {
+		buf = append(buf[:0], '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		w.Write(buf)
+		w.Write(arg)
+		_, err = w.WriteString("\r\n")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readLine returns the line without trailing "\r\n"
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, protocolErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, protocolErr
+	}
+	return line[:len(line)-2], nil
+}
+
+func parseInt(b []byte) (int64, error) {
+	n, err := strconv.ParseInt(string(b), 10, 64)
+	if err != nil {
+		return 0, protocolErr
+	}
+	return n, nil
+}
+
+// readReply decodes a single reply: simple strings are returned as string, bulk strings as []byte,
+// integers as int64, arrays as []interface{} and nil bulk strings or arrays as nil.
+// Error replies are returned as ServerError values, not as errors, so the pipeline can go on reading
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	switch line[0] {
+	case '+':
+		return string(line[1:]), nil
+	case '-':
+		return ServerError(line[1:]), nil
+	case ':':
+		return parseInt(line[1:])
+	case '$':
+		size, err := parseInt(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		if size > maxBulkSize {
+			return nil, protocolErr
+		}
+		data := make([]byte, size+2)
+		_, err = io.ReadFull(r, data)
+		if err != nil {
+			return nil, err
+		}
+		if data[size] != '\r' || data[size+1] != '\n' {
+			return nil, protocolErr
+		}
+		return data[:size], nil
+	case '*':
+		size, err := parseInt(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		if size > maxBulkSize {
+			return nil, protocolErr
+		}
+		items := make([]interface{}, size)
+		for i := range items {
+			items[i], err = readReply(r)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, protocolErr
+}
+
+// replyErr returns the server error, if reply is the one
+func replyErr(reply interface{}) error {
+	if err, ok := reply.(ServerError); ok {
+		return err
+	}
+	return nil
+}
+
+func asInt(reply interface{}) (int64, error) {
+	if err := replyErr(reply); err != nil {
+		return 0, err
+	}
+	n, ok := reply.(int64)
+	if !ok {
+		return 0, protocolErr
+	}
+	return n, nil
+}
+
+// asBytes returns nilReplyErr for the missing key
+func asBytes(reply interface{}) ([]byte, error) {
+	if err := replyErr(reply); err != nil {
+		return nil, err
+	}
+	switch v := reply.(type) {
+	case nil:
+		return nil, nilReplyErr
+	case []byte:
+		return v, nil
+	case string:
+		return []byte(v), nil
+	}
+	return nil, protocolErr
+}
+
+func asArray(reply interface{}) ([]interface{}, error) {
+	if err := replyErr(reply); err != nil {
+		return nil, err
+	}
+	items, ok := reply.([]interface{})
+	if !ok {
+		return nil, protocolErr
+	}
+	return items, nil
+}
+
+// asScan decodes SCAN-family reply: next cursor and the page of elements
+func asScan(reply interface{}) ([]byte, [][]byte, error) {
+	items, err := asArray(reply)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(items) != 2 {
+		return nil, nil, protocolErr
+	}
+	cursor, err := asBytes(items[0])
+	if err != nil {
+		return nil, nil, protocolErr
+	}
+	elems, err := asArray(items[1])
+	if err != nil {
+		return nil, nil, err
+	}
+	page := make([][]byte, len(elems))
+	for i, elem := range elems {
+		page[i], err = asBytes(elem)
+		if err != nil {
+			return nil, nil, protocolErr
+		}
+	}
+	return cursor, page, nil
+}
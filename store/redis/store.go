@@ -0,0 +1,762 @@
+package redis
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/gasparian/lsh-search-go/store"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	bucketNotFoundErr    = store.BucketNotFoundErr
+	keyNotFoundErr       = store.KeyNotFoundErr
+	lengthMismatchErr    = errors.New("Batch slices must have the same length")
+	corruptedVectorErr   = errors.New("Stored vector has wrong size")
+	corruptedNormErr     = errors.New("Stored norm has wrong size")
+	closedErr            = errors.New("Store has been closed")
+	namespaceNotFoundErr = errors.New("Namespace not found")
+)
+
+// Config holds connection and store parameters; zero values are replaced with defaults
+type Config struct {
+	Addr     string // NOTE: "localhost:6379" by default
+	Password string
+	DB       int
+	Prefix   string // NOTE: "lsh:" by default; stores with different prefixes don't interfere
+	PoolSize int    // max number of idle connections
+	// BatchSize is the max number of keys in a single MSET, MGET or SSCAN page
+	BatchSize int
+	Timeout   time.Duration // dial and pipeline round-trip timeout
+}
+
+func (c *Config) setDefaults() {
+	if c.Addr == "" {
+		c.Addr = "localhost:6379"
+	}
+	if c.Prefix == "" {
+		c.Prefix = "lsh:"
+	}
+	if c.PoolSize <= 0 {
+		c.PoolSize = 8
+	}
+	if c.BatchSize <= 0 {
+		c.BatchSize = 500
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = 10 * time.Second
+	}
+}
+
+// RedisStore keeps the index in Redis (or any server speaking its protocol), so several
+// search processes can share it. Keys layout, with the default prefix:
+//
+//	lsh:v:<id>            vector as little-endian float64 values
+//	lsh:n:<id>            norm as little-endian float64
+//	lsh:p:<id>            payload as is
+//	lsh:ids               set of the stored vectors ids
+//	lsh:b:<table>:<code>  bucket, as a set of vectors ids
+//	lsh:t:<table>         set of the non-empty buckets codes of the table
+//	lsh:tables            set of the tables with buckets
+//	lsh:namespaces        set of the collections names
+//	lsh:ns:<name>:...     keys of the collection, with the same layout
+//
+// Every batch method sends its commands in a single pipeline
+type RedisStore struct {
+	config Config
+	c      *client
+	// NOTE: collections share connections of the store, which are closed along with it
+	ownsClient bool
+}
+
+// NewRedisStore checks that the server is reachable
+func NewRedisStore(config Config) (*RedisStore, error) {
+	config.setDefaults()
+	s := &RedisStore{
+		config:     config,
+		c:          newClient(config),
+		ownsClient: true,
+	}
+	_, err := s.c.doOne(newCommand("PING"))
+	if err != nil {
+		s.c.close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Close closes idle connections; data stays on the server. Closing the collection does nothing
+func (s *RedisStore) Close() error {
+	if !s.ownsClient {
+		return nil
+	}
+	return s.c.close()
+}
+
+func (s *RedisStore) key(parts ...string) []byte {
+	return []byte(s.config.Prefix + strings.Join(parts, ":"))
+}
+
+func (s *RedisStore) bucketKey(key store.BucketKey) []byte {
+	return s.key("b", strconv.FormatUint(uint64(key.Table), 10), strconv.FormatUint(key.Code, 10))
+}
+
+func (s *RedisStore) tableKey(table uint32) []byte {
+	return s.key("t", strconv.FormatUint(uint64(table), 10))
+}
+
+func encodeVector(vec []float64) []byte {
+	data := make([]byte, len(vec)*8)
+	for i, v := range vec {
+		binary.LittleEndian.PutUint64(data[i*8:], math.Float64bits(v))
+	}
+	return data
+}
+
+func decodeVector(data []byte) ([]float64, error) {
+	if len(data)%8 != 0 {
+		return nil, corruptedVectorErr
+	}
+	vec := make([]float64, len(data)/8)
+	for i := range vec {
+		vec[i] = math.Float64frombits(binary.LittleEndian.Uint64(data[i*8:]))
+	}
+	return vec, nil
+}
+
+// checkReplies returns the first server error among the replies
+func checkReplies(replies []interface{}) error {
+	for _, reply := range replies {
+		if err := replyErr(reply); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mget reads values of the given keys kind ("v", "n" or "p") with MGET per batch, all in one pipeline;
+// missing value causes keyNotFoundErr, unless it's optional, then it's returned as nil
+func (s *RedisStore) mget(kind string, ids []string, optional bool) ([][]byte, error) {
+	cmds := make([]command, 0, len(ids)/s.config.BatchSize+1)
+	for start := 0; start < len(ids); start += s.config.BatchSize {
+		end := start + s.config.BatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		cmd := newCommand("MGET")
+		for _, id := range ids[start:end] {
+			cmd = cmd.add(s.key(kind, id))
+		}
+		cmds = append(cmds, cmd)
+	}
+	if len(cmds) == 0 {
+		return [][]byte{}, nil
+	}
+	replies, err := s.c.do(cmds...)
+	if err != nil {
+		return nil, err
+	}
+	values := make([][]byte, 0, len(ids))
+	for _, reply := range replies {
+		items, err := asArray(reply)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			value, err := asBytes(item)
+			if err == nilReplyErr {
+				if !optional {
+					return nil, keyNotFoundErr
+				}
+				value, err = nil, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+	}
+	if len(values) != len(ids) {
+		return nil, protocolErr
+	}
+	return values, nil
+}
+
+// mset writes values with MSET per batch, registering ids in the ids set, if asked
+func (s *RedisStore) mset(kind string, ids []string, values [][]byte, register bool) error {
+	cmds := make([]command, 0, 2*(len(ids)/s.config.BatchSize+1))
+	for start := 0; start < len(ids); start += s.config.BatchSize {
+		end := start + s.config.BatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		mset := newCommand("MSET")
+		for i := start; i < end; i++ {
+			mset = mset.add(s.key(kind, ids[i]), values[i])
+		}
+		cmds = append(cmds, mset)
+		if register {
+			cmds = append(cmds, newCommand("SADD", s.key("ids")).addString(ids[start:end]...))
+		}
+	}
+	if len(cmds) == 0 {
+		return nil
+	}
+	replies, err := s.c.do(cmds...)
+	if err != nil {
+		return err
+	}
+	return checkReplies(replies)
+}
+
+func (s *RedisStore) SetVector(id string, vec []float64) error {
+	return s.SetVectors([]string{id}, [][]float64{vec})
+}
+
+func (s *RedisStore) SetVectors(ids []string, vecs [][]float64) error {
+	if len(ids) != len(vecs) {
+		return lengthMismatchErr
+	}
+	values := make([][]byte, len(vecs))
+	for i, vec := range vecs {
+		values[i] = encodeVector(vec)
+	}
+	return s.mset("v", ids, values, true)
+}
+
+func (s *RedisStore) GetVector(id string) ([]float64, error) {
+	vecs, err := s.GetVectors([]string{id})
+	if err != nil {
+		return nil, err
+	}
+	return vecs[0], nil
+}
+
+func (s *RedisStore) GetVectors(ids []string) ([][]float64, error) {
+	values, err := s.mget("v", ids, false)
+	if err != nil {
+		return nil, err
+	}
+	vecs := make([][]float64, len(values))
+	for i, value := range values {
+		vecs[i], err = decodeVector(value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return vecs, nil
+}
+
+// DeleteVector removes vector, its norm and payload, but not the bucket entries
+func (s *RedisStore) DeleteVector(id string) error {
+	replies, err := s.c.do(
+		newCommand("SREM", s.key("ids")).addString(id),
+		newCommand("DEL", s.key("v", id), s.key("n", id), s.key("p", id)),
+	)
+	if err != nil {
+		return err
+	}
+	if err = checkReplies(replies); err != nil {
+		return err
+	}
+	removed, err := asInt(replies[0])
+	if err != nil {
+		return err
+	}
+	if removed == 0 {
+		return keyNotFoundErr
+	}
+	return nil
+}
+
+func (s *RedisStore) CountVectors() (int, error) {
+	reply, err := s.c.doOne(newCommand("SCARD", s.key("ids")))
+	if err != nil {
+		return 0, err
+	}
+	count, err := asInt(reply)
+	return int(count), err
+}
+
+// scanner pages through the set with SSCAN; page may contain already returned
+// elements, as SSCAN doesn't guarantee uniqueness when the set is modified during the scan
+type scanner struct {
+	s      *RedisStore
+	key    []byte
+	cursor []byte
+	done   bool
+}
+
+func (sc *scanner) next() ([][]byte, error) {
+	for !sc.done {
+		reply, err := sc.s.c.doOne(
+			newCommand("SSCAN", sc.key, sc.cursor).addString("COUNT", strconv.Itoa(sc.s.config.BatchSize)),
+		)
+		if err != nil {
+			return nil, err
+		}
+		cursor, page, err := asScan(reply)
+		if err != nil {
+			return nil, err
+		}
+		sc.cursor = cursor
+		sc.done = string(cursor) == "0"
+		// NOTE: SSCAN may return empty pages before the end
+		if len(page) > 0 {
+			return page, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *RedisStore) newScanner(key []byte) *scanner {
+	return &scanner{s: s, key: key, cursor: []byte("0")}
+}
+
+func (s *RedisStore) scanAll(key []byte) ([]string, error) {
+	sc := s.newScanner(key)
+	elems := make([]string, 0)
+	for {
+		page, err := sc.next()
+		if err != nil {
+			return nil, err
+		}
+		if len(page) == 0 {
+			return elems, nil
+		}
+		for _, elem := range page {
+			elems = append(elems, string(elem))
+		}
+	}
+}
+
+// VectorsIterator scans ids set page by page and reads vectors of each page with MGET;
+// vectors deleted during the scan are skipped
+type VectorsIterator struct {
+	sc   *scanner
+	ids  []string
+	vecs [][]float64
+	pos  int
+}
+
+func (it *VectorsIterator) fetch() error {
+	it.ids, it.vecs, it.pos = it.ids[:0], it.vecs[:0], 0
+	page, err := it.sc.next()
+	if err != nil || len(page) == 0 {
+		return err
+	}
+	mget := newCommand("MGET")
+	for _, id := range page {
+		mget = mget.add(it.sc.s.key("v", string(id)))
+	}
+	reply, err := it.sc.s.c.doOne(mget)
+	if err != nil {
+		return err
+	}
+	items, err := asArray(reply)
+	if err != nil {
+		return err
+	}
+	if len(items) != len(page) {
+		return protocolErr
+	}
+	for i, item := range items {
+		value, err := asBytes(item)
+		if err == nilReplyErr {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		vec, err := decodeVector(value)
+		if err != nil {
+			return err
+		}
+		it.ids = append(it.ids, string(page[i]))
+		it.vecs = append(it.vecs, vec)
+	}
+	return nil
+}
+
+// Next stops on the server error as well as on the end of the set
+func (it *VectorsIterator) Next() (string, []float64, bool) {
+	for it.pos >= len(it.ids) {
+		err := it.fetch()
+		if err != nil || len(it.ids) == 0 && it.sc.done {
+			it.sc.done = true
+			return "", nil, false
+		}
+	}
+	it.pos++
+	return it.ids[it.pos-1], it.vecs[it.pos-1], true
+}
+
+func (it *VectorsIterator) Close() error {
+	it.sc.done = true
+	it.ids, it.vecs, it.pos = nil, nil, 0
+	return nil
+}
+
+func (s *RedisStore) GetVectorIterator() (store.VectorIterator, error) {
+	return &VectorsIterator{sc: s.newScanner(s.key("ids"))}, nil
+}
+
+func (s *RedisStore) SetNorm(id string, norm float64) error {
+	return s.SetNorms([]string{id}, []float64{norm})
+}
+
+func (s *RedisStore) SetNorms(ids []string, norms []float64) error {
+	if len(ids) != len(norms) {
+		return lengthMismatchErr
+	}
+	values := make([][]byte, len(norms))
+	for i, norm := range norms {
+		values[i] = make([]byte, 8)
+		binary.LittleEndian.PutUint64(values[i], math.Float64bits(norm))
+	}
+	return s.mset("n", ids, values, false)
+}
+
+func (s *RedisStore) GetNorm(id string) (float64, error) {
+	norms, err := s.GetNorms([]string{id})
+	if err != nil {
+		return 0, err
+	}
+	return norms[0], nil
+}
+
+func (s *RedisStore) GetNorms(ids []string) ([]float64, error) {
+	values, err := s.mget("n", ids, false)
+	if err != nil {
+		return nil, err
+	}
+	norms := make([]float64, len(values))
+	for i, value := range values {
+		if len(value) != 8 {
+			return nil, corruptedNormErr
+		}
+		norms[i] = math.Float64frombits(binary.LittleEndian.Uint64(value))
+	}
+	return norms, nil
+}
+
+func (s *RedisStore) SetPayloads(ids []string, payloads [][]byte) error {
+	if len(ids) != len(payloads) {
+		return lengthMismatchErr
+	}
+	return s.mset("p", ids, payloads, false)
+}
+
+// GetPayloads returns nil for the ids without payload
+// GetPayloads returns nil for the ids without payload or with the empty one
+func (s *RedisStore) GetPayloads(ids []string) ([][]byte, error) {
+	payloads, err := s.mget("p", ids, true)
+	if err != nil {
+		return nil, err
+	}
+	for i, payload := range payloads {
+		if len(payload) == 0 {
+			payloads[i] = nil
+		}
+	}
+	return payloads, nil
+}
+
+func (s *RedisStore) SetHash(key store.BucketKey, vecId string) error {
+	return s.SetHashes([]store.BucketKey{key}, []string{vecId})
+}
+
+// SetHashes groups entries by buckets, so each bucket gets a single SADD;
+// buckets are registered in their tables after the entries are added
+func (s *RedisStore) SetHashes(keys []store.BucketKey, vecIds []string) error {
+	if len(keys) != len(vecIds) {
+		return lengthMismatchErr
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	order := make([]store.BucketKey, 0)
+	buckets := make(map[store.BucketKey][]string)
+	for i, key := range keys {
+		if _, ok := buckets[key]; !ok {
+			order = append(order, key)
+		}
+		buckets[key] = append(buckets[key], vecIds[i])
+	}
+	tables := make(map[uint32][]string)
+	cmds := make([]command, 0, 2*len(order)+1)
+	for _, key := range order {
+		cmds = append(cmds, newCommand("SADD", s.bucketKey(key)).addString(buckets[key]...))
+		tables[key.Table] = append(tables[key.Table], strconv.FormatUint(key.Code, 10))
+	}
+	registry := newCommand("SADD", s.key("tables"))
+	for table, codes := range tables {
+		cmds = append(cmds, newCommand("SADD", s.tableKey(table)).addString(codes...))
+		registry = registry.addString(strconv.FormatUint(uint64(table), 10))
+	}
+	replies, err := s.c.do(append(cmds, registry)...)
+	if err != nil {
+		return err
+	}
+	return checkReplies(replies)
+}
+
+// removeHashScript removes the id from the bucket (KEYS[1]) and the code (ARGV[2]) of the emptied bucket
+// from its table (KEYS[2]); returns the number of removed ids and the bucket's size
+const removeHashScript = `local removed = redis.call('SREM', KEYS[1], ARGV[1])
+local size = redis.call('SCARD', KEYS[1])
+if size == 0 then
+	redis.call('SREM', KEYS[2], ARGV[2])
+end
+return {removed, size}`
+
+// RemoveHash removes vector id from the bucket and unregisters the bucket, when it becomes empty.
+// Both are done by the single script, which runs atomically, while SetHashes fills the bucket
+// before registering it, so the non-empty bucket is never left unregistered
+func (s *RedisStore) RemoveHash(key store.BucketKey, vecId string) error {
+	cmd := newCommand("EVAL", []byte(removeHashScript), []byte("2"), s.bucketKey(key), s.tableKey(key.Table))
+	reply, err := s.c.doOne(cmd.addString(vecId, strconv.FormatUint(key.Code, 10)))
+	if err != nil {
+		return err
+	}
+	if err = replyErr(reply); err != nil {
+		return err
+	}
+	items, ok := reply.([]interface{})
+	if !ok || len(items) != 2 {
+		return protocolErr
+	}
+	removed, err := asInt(items[0])
+	if err != nil {
+		return err
+	}
+	size, err := asInt(items[1])
+	if err != nil {
+		return err
+	}
+	if removed == 0 && size == 0 {
+		return bucketNotFoundErr
+	}
+	return nil
+}
+
+// KeysIterator reads the bucket lazily with SSCAN, so the big buckets aren't loaded
+// at once, while search often stops after the first pages
+type KeysIterator struct {
+	sc   *scanner
+	page []string
+	pos  int
+}
+
+func (it *KeysIterator) fill() bool {
+	for it.pos >= len(it.page) {
+		page, err := it.sc.next()
+		if err != nil || len(page) == 0 {
+			it.sc.done = true
+			return false
+		}
+		it.page, it.pos = it.page[:0], 0
+		for _, id := range page {
+			it.page = append(it.page, string(id))
+		}
+	}
+	return true
+}
+
+func (it *KeysIterator) Next() (string, bool) {
+	if !it.fill() {
+		return "", false
+	}
+	it.pos++
+	return it.page[it.pos-1], true
+}
+
+func (it *KeysIterator) NextN(n int) []string {
+	vecIds := make([]string, 0, n)
+	for len(vecIds) < n && it.fill() {
+		end := it.pos + n - len(vecIds)
+		if end > len(it.page) {
+			end = len(it.page)
+		}
+		vecIds = append(vecIds, it.page[it.pos:end]...)
+		it.pos = end
+	}
+	return vecIds
+}
+
+func (it *KeysIterator) Close() error {
+	it.sc.done = true
+	it.page, it.pos = nil, 0
+	return nil
+}
+
+// GetHashIterator reads the first page eagerly, to report the absent bucket
+func (s *RedisStore) GetHashIterator(key store.BucketKey) (store.Iterator, error) {
+	it := &KeysIterator{sc: s.newScanner(s.bucketKey(key))}
+	page, err := it.sc.next()
+	if err != nil {
+		return nil, err
+	}
+	if len(page) == 0 {
+		return nil, bucketNotFoundErr
+	}
+	it.page = make([]string, len(page))
+	for i, id := range page {
+		it.page[i] = string(id)
+	}
+	return it, nil
+}
+
+func (s *RedisStore) ListBuckets() ([]store.BucketKey, error) {
+	tables, err := s.scanAll(s.key("tables"))
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]store.BucketKey, 0)
+	for _, t := range tables {
+		table, err := strconv.ParseUint(t, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		tableKeys, err := s.ListTableBuckets(uint32(table))
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, tableKeys...)
+	}
+	return keys, nil
+}
+
+func (s *RedisStore) ListTableBuckets(table uint32) ([]store.BucketKey, error) {
+	codes, err := s.scanAll(s.tableKey(table))
+	if err != nil {
+		return nil, err
+	}
+	// NOTE: SSCAN could return the same code twice
+	seen := make(map[uint64]bool, len(codes))
+	keys := make([]store.BucketKey, 0, len(codes))
+	for _, c := range codes {
+		code, err := strconv.ParseUint(c, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		if seen[code] {
+			continue
+		}
+		seen[code] = true
+		keys = append(keys, store.BucketKey{Table: table, Code: code})
+	}
+	return keys, nil
+}
+
+// escapeGlob escapes the glob special characters of the keys prefix
+func escapeGlob(s string) string {
+	var sb strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			sb.WriteByte('\\')
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+// isNamespaceKey returns true for the keys of collections, which aren't affected by Clear
+func (s *RedisStore) isNamespaceKey(key []byte) bool {
+	return strings.HasPrefix(string(key), s.config.Prefix+"ns:") || string(key) == string(s.key("namespaces"))
+}
+
+// Clear deletes all the keys with the store's prefix, except the collections ones
+func (s *RedisStore) Clear() error {
+	pattern := escapeGlob(s.config.Prefix) + "*"
+	cursor := []byte("0")
+	for {
+		reply, err := s.c.doOne(
+			newCommand("SCAN", cursor).addString("MATCH", pattern, "COUNT", strconv.Itoa(s.config.BatchSize)),
+		)
+		if err != nil {
+			return err
+		}
+		next, page, err := asScan(reply)
+		if err != nil {
+			return err
+		}
+		keys := page[:0]
+		for _, key := range page {
+			if !s.isNamespaceKey(key) {
+				keys = append(keys, key)
+			}
+		}
+		if len(keys) > 0 {
+			_, err = s.c.doOne(newCommand("DEL", keys...))
+			if err != nil {
+				return err
+			}
+		}
+		if string(next) == "0" {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+func (s *RedisStore) namespace(name string) *RedisStore {
+	config := s.config
+	config.Prefix = s.config.Prefix + "ns:" + name + ":"
+	return &RedisStore{config: config, c: s.c}
+}
+
+// Namespace registers the collection; its keys are prefixed with "<prefix>ns:<name>:"
+func (s *RedisStore) Namespace(name string) (store.Store, error) {
+	err := store.ValidateNamespace(name)
+	if err != nil {
+		return nil, err
+	}
+	_, err = s.c.doOne(newCommand("SADD", s.key("namespaces"), []byte(name)))
+	if err != nil {
+		return nil, err
+	}
+	return s.namespace(name), nil
+}
+
+func (s *RedisStore) ListNamespaces() ([]string, error) {
+	names, err := s.scanAll(s.key("namespaces"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	// NOTE: SSCAN could return the same name twice
+	unique := names[:0]
+	for i, name := range names {
+		if i == 0 || name != names[i-1] {
+			unique = append(unique, name)
+		}
+	}
+	return unique, nil
+}
+
+// DropNamespace deletes keys of the collection and then unregisters it,
+// so the failed drop can be repeated
+func (s *RedisStore) DropNamespace(name string) error {
+	err := store.ValidateNamespace(name)
+	if err != nil {
+		return err
+	}
+	reply, err := s.c.doOne(newCommand("SISMEMBER", s.key("namespaces"), []byte(name)))
+	if err != nil {
+		return err
+	}
+	if n, err := asInt(reply); err != nil || n == 0 {
+		return namespaceNotFoundErr
+	}
+	err = s.namespace(name).Clear()
+	if err != nil {
+		return err
+	}
+	_, err = s.c.doOne(newCommand("SREM", s.key("namespaces"), []byte(name)))
+	return err
+}
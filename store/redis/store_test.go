@@ -0,0 +1,494 @@
+package redis
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"github.com/gasparian/lsh-search-go/store"
+	"github.com/gasparian/lsh-search-go/store/storetest"
+	"net"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var vectorsAreNotEqualErr = errors.New("Vectors are not equal")
+
+// fakeServer is an in-process stand-in for Redis, which supports only the commands used by the store.
+type fakeServer struct {
+	ln       net.Listener
+	password string
+	mx       sync.Mutex
+	strs     map[string][]byte
+	sets     map[string]map[string]struct{}
+	commands int
+}
+
+func newFakeServer(t *testing.T, password string) *fakeServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &fakeServer{
+		ln:       ln,
+		password: password,
+		strs:     make(map[string][]byte),
+		sets:     make(map[string]map[string]struct{}),
+	}
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go srv.serve(nc)
+		}
+	}()
+	return srv
+}
+
+func (srv *fakeServer) addr() string {
+	return srv.ln.Addr().String()
+}
+
+func (srv *fakeServer) close() {
+	srv.ln.Close()
+}
+
+func writeReply(w *bufio.Writer, reply interface{}) {
+	switch v := reply.(type) {
+	case nil:
+		w.WriteString("$-1\r\n")
+	case string:
+		w.WriteString("+" + v + "\r\n")
+	case ServerError:
+		w.WriteString("-" + string(v) + "\r\n")
+	case int64:
+		w.WriteString(":" + strconv.FormatInt(v, 10) + "\r\n")
+	case []byte:
+		w.WriteString("$" + strconv.Itoa(len(v)) + "\r\n")
+		w.Write(v)
+		w.WriteString("\r\n")
+	case []interface{}:
+		w.WriteString("*" + strconv.Itoa(len(v)) + "\r\n")
+		for _, item := range v {
+			writeReply(w, item)
+		}
+	}
+}
+
+func (srv *fakeServer) serve(nc net.Conn) {
+	defer nc.Close()
+	r, w := bufio.NewReader(nc), bufio.NewWriter(nc)
+	authed := srv.password == ""
+	for {
+		req, err := readReply(r)
+		if err != nil {
+			return
+		}
+		items, _ := req.([]interface{})
+		args := make([]string, len(items))
+		for i, item := range items {
+			arg, _ := item.([]byte)
+			args[i] = string(arg)
+		}
+		var reply interface{}
+		switch {
+		case len(args) == 0:
+			reply = ServerError("ERR empty command")
+		case strings.ToUpper(args[0]) == "AUTH":
+			authed = len(args) == 2 && args[1] == srv.password
+			reply = "OK"
+			if !authed {
+				reply = ServerError("WRONGPASS invalid password")
+			}
+		case !authed:
+			reply = ServerError("NOAUTH Authentication required")
+		default:
+			reply = srv.exec(strings.ToUpper(args[0]), args[1:])
+		}
+		writeReply(w, reply)
+		// NOTE: flush only when the whole pipeline has been read
+		if r.Buffered() == 0 && w.Flush() != nil {
+			return
+		}
+	}
+}
+
+func (srv *fakeServer) members(key string) []interface{} {
+	members := make([]string, 0, len(srv.sets[key]))
+	for member := range srv.sets[key] {
+		members = append(members, member)
+	}
+	sort.Strings(members)
+	items := make([]interface{}, len(members))
+	for i, member := range members {
+		items[i] = []byte(member)
+	}
+	return items
+}
+
+// scan returns the page of sorted items following the cursor; cursor holds the last returned item,
+// so the scan is stable when keys are deleted, like the real one
+func scan(items []interface{}, args []string) interface{} {
+	count := 10
+	for i := 1; i+1 < len(args); i += 2 {
+		if strings.ToUpper(args[i]) == "COUNT" {
+			count, _ = strconv.Atoi(args[i+1])
+		}
+	}
+	start := 0
+	if args[0] != "0" {
+		last := strings.TrimPrefix(args[0], "@")
+		start = sort.Search(len(items), func(i int) bool {
+			return string(items[i].([]byte)) > last
+		})
+	}
+	end := start + count
+	if end >= len(items) {
+		return []interface{}{[]byte("0"), items[start:]}
+	}
+	return []interface{}{[]byte("@" + string(items[end-1].([]byte))), items[start:end]}
+}
+
+func (srv *fakeServer) exec(name string, args []string) interface{} {
+	srv.mx.Lock()
+	defer srv.mx.Unlock()
+	srv.commands++
+	wrongType := ServerError("WRONGTYPE Operation against a key holding the wrong kind of value")
+	switch name {
+	case "PING":
+		return "PONG"
+	case "SELECT":
+		return "OK"
+	case "MSET":
+		for i := 0; i+1 < len(args); i += 2 {
+			if _, ok := srv.sets[args[i]]; ok {
+				delete(srv.sets, args[i])
+			}
+			srv.strs[args[i]] = []byte(args[i+1])
+		}
+		return "OK"
+	case "MGET":
+		items := make([]interface{}, len(args))
+		for i, key := range args {
+			if value, ok := srv.strs[key]; ok {
+				items[i] = value
+			}
+		}
+		return items
+	case "DEL":
+		var n int64
+		for _, key := range args {
+			_, isStr := srv.strs[key]
+			_, isSet := srv.sets[key]
+			if isStr || isSet {
+				n++
+			}
+			delete(srv.strs, key)
+			delete(srv.sets, key)
+		}
+		return n
+	case "SADD", "SREM", "SCARD", "SISMEMBER", "SSCAN":
+		if len(args) == 0 {
+			return ServerError("ERR wrong number of arguments")
+		}
+		if _, ok := srv.strs[args[0]]; ok {
+			return wrongType
+		}
+		set := srv.sets[args[0]]
+		var n int64
+		switch name {
+		case "SADD":
+			if set == nil {
+				set = make(map[string]struct{})
+				srv.sets[args[0]] = set
+			}
+			for _, member := range args[1:] {
+				if _, ok := set[member]; !ok {
+					set[member] = struct{}{}
+					n++
+				}
+			}
+		case "SREM":
+			for _, member := range args[1:] {
+				if _, ok := set[member]; ok {
+					delete(set, member)
+					n++
+				}
+			}
+			if len(set) == 0 {
+				delete(srv.sets, args[0])
+			}
+		case "SCARD":
+			n = int64(len(set))
+		case "SISMEMBER":
+			if len(args) != 2 {
+				return ServerError("ERR wrong number of arguments")
+			}
+			if _, ok := set[args[1]]; ok {
+				n = 1
+			}
+		case "SSCAN":
+			return scan(srv.members(args[0]), args[1:])
+		}
+		return n
+	case "EVAL":
+		// NOTE: Lua isn't interpreted, only the store's script is recognized and run atomically
+		if len(args) != 6 || args[0] != removeHashScript || args[1] != "2" {
+			return ServerError("ERR unknown script")
+		}
+		bucket, table, member, code := args[2], args[3], args[4], args[5]
+		var removed int64
+		if _, ok := srv.sets[bucket][member]; ok {
+			delete(srv.sets[bucket], member)
+			removed = 1
+		}
+		size := int64(len(srv.sets[bucket]))
+		if size == 0 {
+			delete(srv.sets, bucket)
+			delete(srv.sets[table], code)
+			if len(srv.sets[table]) == 0 {
+				delete(srv.sets, table)
+			}
+		}
+		return []interface{}{removed, size}
+	case "SCAN":
+		keys := make([]string, 0)
+		pattern := "*"
+		for i := 1; i+1 < len(args); i += 2 {
+			if strings.ToUpper(args[i]) == "MATCH" {
+				pattern = args[i+1]
+			}
+		}
+		for key := range srv.strs {
+			keys = append(keys, key)
+		}
+		for key := range srv.sets {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		items := make([]interface{}, 0, len(keys))
+		for _, key := range keys {
+			if ok, _ := path.Match(pattern, key); ok {
+				items = append(items, []byte(key))
+			}
+		}
+		return scan(items, args)
+	}
+	return ServerError("ERR unknown command '" + name + "'")
+}
+
+func TestRESP(t *testing.T) {
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	err := writeCommand(w, newCommand("SET", []byte("key"), []byte("a\r\nb")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Flush()
+	expected := "*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$4\r\na\r\nb\r\n"
+	if buf.String() != expected {
+		t.Fatalf("Wrong command encoding: %q", buf.String())
+	}
+	reply, err := readReply(bufio.NewReader(strings.NewReader("*3\r\n:42\r\n$-1\r\n*2\r\n+OK\r\n-ERR fail\r\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedReply := []interface{}{int64(42), nil, []interface{}{"OK", ServerError("ERR fail")}}
+	if !reflect.DeepEqual(reply, expectedReply) {
+		t.Errorf("Wrong reply: %#v", reply)
+	}
+	for _, malformed := range []string{"$5\r\nabc\r\n", "?1\r\n", ":abc\r\n", "$3\r\nabcde\r\n", "+OK\n"} {
+		_, err = readReply(bufio.NewReader(strings.NewReader(malformed)))
+		if err == nil {
+			t.Errorf("Malformed reply must not be parsed: %q", malformed)
+		}
+	}
+}
+
+func TestRedisStore(t *testing.T) {
+	srv := newFakeServer(t, "secret")
+	defer srv.close()
+	_, err := NewRedisStore(Config{Addr: srv.addr(), Password: "wrong"})
+	if err == nil {
+		t.Fatal("Store must not be created with the wrong password")
+	}
+	// NOTE: small batches to check the paging
+	s, err := NewRedisStore(Config{Addr: srv.addr(), Password: "secret", DB: 1, BatchSize: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ids := make([]string, 10)
+	vecs := make([][]float64, len(ids))
+	norms := make([]float64, len(ids))
+	for i := range ids {
+		ids[i] = strconv.Itoa(i)
+		vecs[i] = []float64{float64(i), -1.5}
+		norms[i] = float64(i) / 2
+	}
+	key := store.BucketKey{Table: 1, Code: 1<<64 - 1}
+
+	// NOTE: the contents are checked by the conformance suite, here it's how they're sent
+	t.Run("Pipeline", func(t *testing.T) {
+		srv.mx.Lock()
+		before := srv.commands
+		srv.mx.Unlock()
+		err := s.SetVectors(ids, vecs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.GetVectors(ids)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.SetNorms(ids, norms)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.GetNorms(ids)
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv.mx.Lock()
+		sent := srv.commands - before
+		srv.mx.Unlock()
+		// NOTE: 4 pairs of MSET and SADD, 4 MGETs, 4 MSETs and 4 MGETs
+		if sent != 8+4+4+4 {
+			t.Errorf("Wrong number of commands sent: %v", sent)
+		}
+	})
+
+	t.Run("Paging", func(t *testing.T) {
+		keys := make([]store.BucketKey, len(ids))
+		for i := range keys {
+			keys[i] = key
+		}
+		err := s.SetHashes(keys, ids)
+		if err != nil {
+			t.Fatal(err)
+		}
+		it, err := s.GetHashIterator(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if page := it.NextN(4); len(page) != 4 {
+			t.Errorf("NextN must read across the pages, got %v", page)
+		}
+		if page := it.NextN(100); len(page) != len(ids)-4 {
+			t.Errorf("NextN must return the rest of the bucket, got %v", page)
+		}
+		if page := it.NextN(1); len(page) != 0 {
+			t.Errorf("Exhausted iterator must return empty page, got %v", page)
+		}
+		it.Close()
+	})
+
+	t.Run("Shared", func(t *testing.T) {
+		other, err := NewRedisStore(Config{Addr: srv.addr(), Password: "secret"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer other.Close()
+		vec, err := other.GetVector("7")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(vec, vecs[7]) {
+			t.Error(vectorsAreNotEqualErr)
+		}
+		isolated, err := NewRedisStore(Config{Addr: srv.addr(), Password: "secret", Prefix: "other:"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer isolated.Close()
+		err = isolated.SetVector("7", []float64{1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		count, _ := isolated.CountVectors()
+		if count != 1 {
+			t.Errorf("Stores with different prefixes must not interfere, got %v vectors", count)
+		}
+	})
+
+	t.Run("ServerError", func(t *testing.T) {
+		// NOTE: vector key of the first store collides with the bucket key of the second one
+		writer, _ := NewRedisStore(Config{Addr: srv.addr(), Password: "secret", Prefix: "p:"})
+		defer writer.Close()
+		err := writer.SetVector("b:1:0", []float64{1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader, _ := NewRedisStore(Config{Addr: srv.addr(), Password: "secret", Prefix: "p:v:"})
+		defer reader.Close()
+		err = reader.SetHash(store.BucketKey{Table: 1, Code: 0}, "0")
+		if _, ok := err.(ServerError); !ok {
+			t.Errorf("Server error must be returned, got %v", err)
+		}
+		writer.Clear()
+	})
+
+	t.Run("Clear", func(t *testing.T) {
+		err := s.Clear()
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv.mx.Lock()
+		left := len(srv.strs)
+		srv.mx.Unlock()
+		if left != 1 {
+			t.Errorf("Only keys with the store's prefix must be deleted, %v keys left", left)
+		}
+	})
+}
+
+func TestConformance(t *testing.T) {
+	storetest.RunConformance(t, func(t *testing.T) (store.Store, func()) {
+		srv := newFakeServer(t, "")
+		s, err := NewRedisStore(Config{Addr: srv.addr(), BatchSize: 7})
+		if err != nil {
+			srv.close()
+			t.Fatal(err)
+		}
+		return s, func() {
+			s.Close()
+			srv.close()
+		}
+	})
+}
+
+func TestNamespaces(t *testing.T) {
+	storetest.RunNamespaceConformance(t, func(t *testing.T) (store.Store, func()) {
+		srv := newFakeServer(t, "")
+		s, err := NewRedisStore(Config{Addr: srv.addr(), BatchSize: 7})
+		if err != nil {
+			srv.close()
+			t.Fatal(err)
+		}
+		return s, func() {
+			s.Close()
+			srv.close()
+		}
+	})
+}
+
+func TestPayloads(t *testing.T) {
+	storetest.RunPayloadConformance(t, func(t *testing.T) (store.Store, func()) {
+		srv := newFakeServer(t, "")
+		s, err := NewRedisStore(Config{Addr: srv.addr(), BatchSize: 7})
+		if err != nil {
+			srv.close()
+			t.Fatal(err)
+		}
+		return s, func() {
+			s.Close()
+			srv.close()
+		}
+	})
+}
@@ -0,0 +1,308 @@
+package retry
+
+import (
+	"errors"
+	"github.com/gasparian/lsh-search-go/store"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var (
+	namespacesUnsupportedErr = errors.New("Wrapped store doesn't support namespaces")
+	payloadsUnsupportedErr   = errors.New("Wrapped store doesn't support payloads")
+)
+
+// Config holds the retry policy; zero values are replaced with defaults
+type Config struct {
+	MaxAttempts    int           // NOTE: including the first one, 5 by default
+	InitialBackoff time.Duration // NOTE: 10ms by default
+	MaxBackoff     time.Duration // NOTE: 1s by default
+	Multiplier     float64       // NOTE: backoff growth per attempt, 2 by default
+	Jitter         float64       // NOTE: fraction of the backoff which is randomized, 0.2 by default
+	// IsTransient decides whether the call failed with the error is worth retrying, IsTransient by default
+	IsTransient func(err error) bool
+}
+
+func (c *Config) setDefaults() {
+	if c.MaxAttempts <= 0 {
+		c.MaxAttempts = 5
+	}
+	if c.InitialBackoff <= 0 {
+		c.InitialBackoff = 10 * time.Millisecond
+	}
+	if c.MaxBackoff <= 0 {
+		c.MaxBackoff = time.Second
+	}
+	if c.Multiplier < 1 {
+		c.Multiplier = 2
+	}
+	if c.Jitter <= 0 || c.Jitter > 1 {
+		c.Jitter = 0.2
+	}
+	if c.IsTransient == nil {
+		c.IsTransient = IsTransient
+	}
+}
+
+// IsTransient reports whether any error in the chain has Temporary() or Timeout() method returning true,
+// like the network errors do
+func IsTransient(err error) bool {
+	var temporary interface{ Temporary() bool }
+	if errors.As(err, &temporary) && temporary.Temporary() {
+		return true
+	}
+	var timeout interface{ Timeout() bool }
+	return errors.As(err, &timeout) && timeout.Timeout()
+}
+
+// RetryStore wraps any store and retries calls failed with transient errors, backing off exponentially.
+// Reading from the returned iterators isn't retried, since iterators can't report errors.
+// NOTE: the failed call could still be applied by the wrapped store (e.g. when the response has timed out),
+// so the retried DeleteVector and RemoveHash could fail with "not found" errors
+type RetryStore struct {
+	inner  store.Store
+	config Config
+	mx     sync.Mutex
+	rnd    *rand.Rand
+	sleep  func(time.Duration)
+}
+
+func NewRetryStore(inner store.Store, config Config) *RetryStore {
+	config.setDefaults()
+	return &RetryStore{
+		inner:  inner,
+		config: config,
+		rnd:    rand.New(rand.NewSource(time.Now().UnixNano())),
+		sleep:  time.Sleep,
+	}
+}
+
+// backoff returns the pause before the given retry, starting from zero
+func (s *RetryStore) backoff(retry int) time.Duration {
+	backoff := float64(s.config.InitialBackoff)
+	for i := 0; i < retry && backoff < float64(s.config.MaxBackoff); i++ {
+		backoff *= s.config.Multiplier
+	}
+	if backoff > float64(s.config.MaxBackoff) {
+		backoff = float64(s.config.MaxBackoff)
+	}
+	s.mx.Lock()
+	jitter := (2*s.rnd.Float64() - 1) * s.config.Jitter
+	s.mx.Unlock()
+	return time.Duration(backoff * (1 + jitter))
+}
+
+// do calls f until it succeeds, fails with a non-transient error or attempts are exhausted;
+// the last error is returned
+func (s *RetryStore) do(f func() error) error {
+	var err error
+	for attempt := 0; attempt < s.config.MaxAttempts; attempt++ {
+		if attempt > 0 {
+			s.sleep(s.backoff(attempt - 1))
+		}
+		err = f()
+		if err == nil || !s.config.IsTransient(err) {
+			return err
+		}
+	}
+	return err
+}
+
+func (s *RetryStore) SetVector(id string, vec []float64) error {
+	return s.do(func() error {
+		return s.inner.SetVector(id, vec)
+	})
+}
+
+func (s *RetryStore) SetVectors(ids []string, vecs [][]float64) error {
+	return s.do(func() error {
+		return s.inner.SetVectors(ids, vecs)
+	})
+}
+
+func (s *RetryStore) GetVector(id string) ([]float64, error) {
+	var vec []float64
+	err := s.do(func() (err error) {
+		vec, err = s.inner.GetVector(id)
+		return err
+	})
+	return vec, err
+}
+
+func (s *RetryStore) GetVectors(ids []string) ([][]float64, error) {
+	var vecs [][]float64
+	err := s.do(func() (err error) {
+		vecs, err = s.inner.GetVectors(ids)
+		return err
+	})
+	return vecs, err
+}
+
+func (s *RetryStore) DeleteVector(id string) error {
+	return s.do(func() error {
+		return s.inner.DeleteVector(id)
+	})
+}
+
+func (s *RetryStore) CountVectors() (int, error) {
+	var count int
+	err := s.do(func() (err error) {
+		count, err = s.inner.CountVectors()
+		return err
+	})
+	return count, err
+}
+
+func (s *RetryStore) GetVectorIterator() (store.VectorIterator, error) {
+	var iter store.VectorIterator
+	err := s.do(func() (err error) {
+		iter, err = s.inner.GetVectorIterator()
+		return err
+	})
+	return iter, err
+}
+
+func (s *RetryStore) SetNorm(id string, norm float64) error {
+	return s.do(func() error {
+		return s.inner.SetNorm(id, norm)
+	})
+}
+
+func (s *RetryStore) SetNorms(ids []string, norms []float64) error {
+	return s.do(func() error {
+		return s.inner.SetNorms(ids, norms)
+	})
+}
+
+func (s *RetryStore) GetNorm(id string) (float64, error) {
+	var norm float64
+	err := s.do(func() (err error) {
+		norm, err = s.inner.GetNorm(id)
+		return err
+	})
+	return norm, err
+}
+
+func (s *RetryStore) GetNorms(ids []string) ([]float64, error) {
+	var norms []float64
+	err := s.do(func() (err error) {
+		norms, err = s.inner.GetNorms(ids)
+		return err
+	})
+	return norms, err
+}
+
+func (s *RetryStore) SetPayloads(ids []string, payloads [][]byte) error {
+	payloadStore, ok := s.inner.(store.PayloadStore)
+	if !ok {
+		return payloadsUnsupportedErr
+	}
+	return s.do(func() error {
+		return payloadStore.SetPayloads(ids, payloads)
+	})
+}
+
+func (s *RetryStore) GetPayloads(ids []string) ([][]byte, error) {
+	payloadStore, ok := s.inner.(store.PayloadStore)
+	if !ok {
+		return nil, payloadsUnsupportedErr
+	}
+	var payloads [][]byte
+	err := s.do(func() (err error) {
+		payloads, err = payloadStore.GetPayloads(ids)
+		return err
+	})
+	return payloads, err
+}
+
+func (s *RetryStore) SetHash(key store.BucketKey, vecId string) error {
+	return s.do(func() error {
+		return s.inner.SetHash(key, vecId)
+	})
+}
+
+func (s *RetryStore) SetHashes(keys []store.BucketKey, vecIds []string) error {
+	return s.do(func() error {
+		return s.inner.SetHashes(keys, vecIds)
+	})
+}
+
+func (s *RetryStore) RemoveHash(key store.BucketKey, vecId string) error {
+	return s.do(func() error {
+		return s.inner.RemoveHash(key, vecId)
+	})
+}
+
+func (s *RetryStore) GetHashIterator(key store.BucketKey) (store.Iterator, error) {
+	var iter store.Iterator
+	err := s.do(func() (err error) {
+		iter, err = s.inner.GetHashIterator(key)
+		return err
+	})
+	return iter, err
+}
+
+func (s *RetryStore) ListBuckets() ([]store.BucketKey, error) {
+	var keys []store.BucketKey
+	err := s.do(func() (err error) {
+		keys, err = s.inner.ListBuckets()
+		return err
+	})
+	return keys, err
+}
+
+func (s *RetryStore) ListTableBuckets(table uint32) ([]store.BucketKey, error) {
+	var keys []store.BucketKey
+	err := s.do(func() (err error) {
+		keys, err = s.inner.ListTableBuckets(table)
+		return err
+	})
+	return keys, err
+}
+
+func (s *RetryStore) Clear() error {
+	return s.do(s.inner.Clear)
+}
+
+// Namespace wraps the collection of the wrapped store with the same retry policy
+func (s *RetryStore) Namespace(name string) (store.Store, error) {
+	namespacer, ok := s.inner.(store.Namespacer)
+	if !ok {
+		return nil, namespacesUnsupportedErr
+	}
+	var ns store.Store
+	err := s.do(func() (err error) {
+		ns, err = namespacer.Namespace(name)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	wrapped := NewRetryStore(ns, s.config)
+	wrapped.sleep = s.sleep
+	return wrapped, nil
+}
+
+func (s *RetryStore) ListNamespaces() ([]string, error) {
+	namespacer, ok := s.inner.(store.Namespacer)
+	if !ok {
+		return nil, namespacesUnsupportedErr
+	}
+	var names []string
+	err := s.do(func() (err error) {
+		names, err = namespacer.ListNamespaces()
+		return err
+	})
+	return names, err
+}
+
+func (s *RetryStore) DropNamespace(name string) error {
+	namespacer, ok := s.inner.(store.Namespacer)
+	if !ok {
+		return namespacesUnsupportedErr
+	}
+	return s.do(func() error {
+		return namespacer.DropNamespace(name)
+	})
+}
@@ -0,0 +1,163 @@
+package retry
+
+import (
+	"errors"
+	"github.com/gasparian/lsh-search-go/store"
+	"github.com/gasparian/lsh-search-go/store/kv"
+	"github.com/gasparian/lsh-search-go/store/storetest"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var permanentErr = errors.New("Permanent failure")
+
+type temporaryErr struct{}
+
+func (temporaryErr) Error() string   { return "Temporary failure" }
+func (temporaryErr) Temporary() bool { return true }
+
+type timeoutErr struct{}
+
+func (timeoutErr) Error() string   { return "Timed out" }
+func (timeoutErr) Timeout() bool   { return true }
+func (timeoutErr) Temporary() bool { return false }
+
+// flakyStore fails the given number of vectors writes before passing them to the wrapped store
+type flakyStore struct {
+	*kv.KVStore
+	failures int
+	err      error
+	calls    int
+}
+
+func (s *flakyStore) SetVectors(ids []string, vecs [][]float64) error {
+	s.calls++
+	if s.failures > 0 {
+		s.failures--
+		return s.err
+	}
+	return s.KVStore.SetVectors(ids, vecs)
+}
+
+func newTestStore(inner store.Store, config Config) (*RetryStore, *[]time.Duration) {
+	s := NewRetryStore(inner, config)
+	pauses := make([]time.Duration, 0)
+	s.sleep = func(d time.Duration) {
+		pauses = append(pauses, d)
+	}
+	return s, &pauses
+}
+
+func TestIsTransient(t *testing.T) {
+	cases := []struct {
+		err       error
+		transient bool
+	}{
+		{temporaryErr{}, true},
+		{&net.OpError{Op: "read", Err: timeoutErr{}}, true},
+		{&os.PathError{Op: "open", Path: "x", Err: temporaryErr{}}, true},
+		{permanentErr, false},
+		{&os.PathError{Op: "open", Path: "x", Err: os.ErrNotExist}, false},
+	}
+	for _, c := range cases {
+		if IsTransient(c.err) != c.transient {
+			t.Errorf("Error %q must be transient: %v", c.err, c.transient)
+		}
+	}
+}
+
+func TestRetryStore(t *testing.T) {
+	config := Config{
+		MaxAttempts:    4,
+		InitialBackoff: 10 * time.Millisecond,
+		MaxBackoff:     25 * time.Millisecond,
+		Multiplier:     2,
+		Jitter:         0.1,
+	}
+	ids := []string{"0", "1"}
+	vecs := [][]float64{{0, 1}, {1, 0}}
+
+	t.Run("Transient", func(t *testing.T) {
+		inner := &flakyStore{KVStore: kv.NewKVStore(), failures: 3, err: temporaryErr{}}
+		s, pauses := newTestStore(inner, config)
+		err := s.SetVectors(ids, vecs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if inner.calls != 4 {
+			t.Errorf("Write must be attempted 4 times, got %v", inner.calls)
+		}
+		got, err := s.GetVectors(ids)
+		if err != nil || !reflect.DeepEqual(got, vecs) {
+			t.Errorf("Vectors must be written after retries: %v", got)
+		}
+		expected := []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 25 * time.Millisecond}
+		if len(*pauses) != len(expected) {
+			t.Fatalf("Wrong number of pauses: %v", *pauses)
+		}
+		for i, pause := range *pauses {
+			if pause < expected[i]*9/10 || pause > expected[i]*11/10 {
+				t.Errorf("Pause %v must be about %v", pause, expected[i])
+			}
+		}
+	})
+
+	t.Run("Exhausted", func(t *testing.T) {
+		inner := &flakyStore{KVStore: kv.NewKVStore(), failures: 10, err: temporaryErr{}}
+		s, _ := newTestStore(inner, config)
+		err := s.SetVectors(ids, vecs)
+		if _, ok := err.(temporaryErr); !ok {
+			t.Errorf("The last error must be returned, got %v", err)
+		}
+		if inner.calls != config.MaxAttempts {
+			t.Errorf("Write must be attempted %v times, got %v", config.MaxAttempts, inner.calls)
+		}
+	})
+
+	t.Run("Permanent", func(t *testing.T) {
+		inner := &flakyStore{KVStore: kv.NewKVStore(), failures: 1, err: permanentErr}
+		s, pauses := newTestStore(inner, config)
+		err := s.SetVectors(ids, vecs)
+		if err != permanentErr || inner.calls != 1 || len(*pauses) != 0 {
+			t.Errorf("Permanent error must not be retried: %v, %v calls", err, inner.calls)
+		}
+		_, err = s.GetVector("absent")
+		if err == nil {
+			t.Error("Absent vector must not be returned")
+		}
+	})
+
+	t.Run("Classifier", func(t *testing.T) {
+		custom := config
+		custom.IsTransient = func(err error) bool {
+			return err == permanentErr
+		}
+		inner := &flakyStore{KVStore: kv.NewKVStore(), failures: 2, err: permanentErr}
+		s, _ := newTestStore(inner, custom)
+		err := s.SetVectors(ids, vecs)
+		if err != nil || inner.calls != 3 {
+			t.Errorf("Custom classifier must be used: %v, %v calls", err, inner.calls)
+		}
+	})
+}
+
+func TestConformance(t *testing.T) {
+	storetest.RunConformance(t, func(t *testing.T) (store.Store, func()) {
+		return NewRetryStore(kv.NewKVStore(), Config{}), nil
+	})
+}
+
+func TestNamespaces(t *testing.T) {
+	storetest.RunNamespaceConformance(t, func(t *testing.T) (store.Store, func()) {
+		return NewRetryStore(kv.NewKVStore(), Config{}), nil
+	})
+}
+
+func TestPayloads(t *testing.T) {
+	storetest.RunPayloadConformance(t, func(t *testing.T) (store.Store, func()) {
+		return NewRetryStore(kv.NewKVStore(), Config{}), nil
+	})
+}
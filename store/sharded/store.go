@@ -0,0 +1,501 @@
+package sharded
+
+import (
+	"errors"
+	"github.com/gasparian/lsh-search-go/store"
+	"runtime"
+	"sync"
+)
+
+var (
+	bucketNotFoundErr = store.BucketNotFoundErr
+	keyNotFoundErr    = store.KeyNotFoundErr
+	lengthMismatchErr = errors.New("Batch slices must have the same length")
+)
+
+// shard holds the part of vectors and buckets, guarded by its own lock
+type shard struct {
+	mx       sync.RWMutex
+	vecs     map[string][]float64
+	norms    map[string]float64
+	payloads map[string][]byte
+	buckets  map[store.BucketKey]map[string]struct{}
+}
+
+func newShard() *shard {
+	return &shard{
+		vecs:     make(map[string][]float64),
+		norms:    make(map[string]float64),
+		payloads: make(map[string][]byte),
+		buckets:  make(map[store.BucketKey]map[string]struct{}),
+	}
+}
+
+// ShardedStore is an in-memory store split into lock-striped shards:
+// vectors, norms and payloads are distributed by uid hash, buckets - by bucket key hash,
+// so concurrent writers and readers mostly don't wait for each other
+type ShardedStore struct {
+	shards []*shard
+	// NOTE: collections aren't affected by Clear of the store
+	namespaces store.Namespaces
+}
+
+// NewShardedStore creates store with the given number of shards;
+// non-positive number means 4 shards per available core
+func NewShardedStore(nShards int) *ShardedStore {
+	if nShards <= 0 {
+		nShards = 4 * runtime.GOMAXPROCS(0)
+	}
+	s := &ShardedStore{
+		shards: make([]*shard, nShards),
+	}
+	for i := range s.shards {
+		s.shards[i] = newShard()
+	}
+	return s
+}
+
+// hashString is an inlined FNV-1a, which doesn't allocate
+func hashString(s string) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= 1099511628211
+	}
+	return h
+}
+
+// hashKey mixes table and code with the splitmix64 finalizer,
+// since codes of the neighboring buckets differ in a few bits only
+func hashKey(key store.BucketKey) uint64 {
+	h := key.Code ^ (uint64(key.Table) * 0x9e3779b97f4a7c15)
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
+
+func (s *ShardedStore) vecShard(id string) int {
+	return int(hashString(id) % uint64(len(s.shards)))
+}
+
+func (s *ShardedStore) bucketShard(key store.BucketKey) int {
+	return int(hashKey(key) % uint64(len(s.shards)))
+}
+
+// groupIds returns positions of the ids, grouped by their shards
+func (s *ShardedStore) groupIds(ids []string) [][]int {
+	groups := make([][]int, len(s.shards))
+	for i, id := range ids {
+		idx := s.vecShard(id)
+		groups[idx] = append(groups[idx], i)
+	}
+	return groups
+}
+
+// KeysIterator iterates over the snapshot of bucket's vectors uids
+type KeysIterator struct {
+	vecIds []string
+	pos    int
+}
+
+func (it *KeysIterator) Next() (string, bool) {
+	if it.pos >= len(it.vecIds) {
+		return "", false
+	}
+	it.pos++
+	return it.vecIds[it.pos-1], true
+}
+
+func (it *KeysIterator) NextN(n int) []string {
+	end := it.pos + n
+	if end > len(it.vecIds) {
+		end = len(it.vecIds)
+	}
+	if end <= it.pos {
+		return []string{}
+	}
+	vecIds := it.vecIds[it.pos:end]
+	it.pos = end
+	return vecIds
+}
+
+// Close releases the snapshot
+func (it *KeysIterator) Close() error {
+	it.vecIds = nil
+	it.pos = 0
+	return nil
+}
+
+// VectorsIterator makes snapshot of a single shard at a time,
+// so the whole store is never locked during the scan
+type VectorsIterator struct {
+	s     *ShardedStore
+	shard int
+	ids   []string
+	vecs  [][]float64
+	pos   int
+}
+
+func (it *VectorsIterator) Next() (string, []float64, bool) {
+	for it.pos >= len(it.ids) {
+		if it.s == nil || it.shard >= len(it.s.shards) {
+			return "", nil, false
+		}
+		sh := it.s.shards[it.shard]
+		it.shard++
+		sh.mx.RLock()
+		it.ids = make([]string, 0, len(sh.vecs))
+		it.vecs = make([][]float64, 0, len(sh.vecs))
+		for id, vec := range sh.vecs {
+			it.ids = append(it.ids, id)
+			it.vecs = append(it.vecs, vec)
+		}
+		sh.mx.RUnlock()
+		it.pos = 0
+	}
+	it.pos++
+	return it.ids[it.pos-1], it.vecs[it.pos-1], true
+}
+
+// Close releases the current shard's snapshot
+func (it *VectorsIterator) Close() error {
+	it.s = nil
+	it.ids = nil
+	it.vecs = nil
+	it.pos = 0
+	return nil
+}
+
+func (s *ShardedStore) SetVector(id string, vec []float64) error {
+	sh := s.shards[s.vecShard(id)]
+	sh.mx.Lock()
+	defer sh.mx.Unlock()
+	sh.vecs[id] = vec
+	return nil
+}
+
+// SetVectors locks every affected shard once
+func (s *ShardedStore) SetVectors(ids []string, vecs [][]float64) error {
+	if len(ids) != len(vecs) {
+		return lengthMismatchErr
+	}
+	for shardIdx, group := range s.groupIds(ids) {
+		if len(group) == 0 {
+			continue
+		}
+		sh := s.shards[shardIdx]
+		sh.mx.Lock()
+		for _, i := range group {
+			sh.vecs[ids[i]] = vecs[i]
+		}
+		sh.mx.Unlock()
+	}
+	return nil
+}
+
+func (s *ShardedStore) GetVector(id string) ([]float64, error) {
+	sh := s.shards[s.vecShard(id)]
+	sh.mx.RLock()
+	defer sh.mx.RUnlock()
+	vec, ok := sh.vecs[id]
+	if !ok {
+		return nil, keyNotFoundErr
+	}
+	return vec, nil
+}
+
+func (s *ShardedStore) GetVectors(ids []string) ([][]float64, error) {
+	vecs := make([][]float64, len(ids))
+	for shardIdx, group := range s.groupIds(ids) {
+		if len(group) == 0 {
+			continue
+		}
+		sh := s.shards[shardIdx]
+		sh.mx.RLock()
+		for _, i := range group {
+			vec, ok := sh.vecs[ids[i]]
+			if !ok {
+				sh.mx.RUnlock()
+				return nil, keyNotFoundErr
+			}
+			vecs[i] = vec
+		}
+		sh.mx.RUnlock()
+	}
+	return vecs, nil
+}
+
+// DeleteVector removes vector and its norm, but not the bucket entries
+func (s *ShardedStore) DeleteVector(id string) error {
+	sh := s.shards[s.vecShard(id)]
+	sh.mx.Lock()
+	defer sh.mx.Unlock()
+	if _, ok := sh.vecs[id]; !ok {
+		return keyNotFoundErr
+	}
+	delete(sh.vecs, id)
+	delete(sh.norms, id)
+	delete(sh.payloads, id)
+	return nil
+}
+
+func (s *ShardedStore) CountVectors() (int, error) {
+	count := 0
+	for _, sh := range s.shards {
+		sh.mx.RLock()
+		count += len(sh.vecs)
+		sh.mx.RUnlock()
+	}
+	return count, nil
+}
+
+func (s *ShardedStore) GetVectorIterator() (store.VectorIterator, error) {
+	return &VectorsIterator{s: s}, nil
+}
+
+func (s *ShardedStore) SetNorm(id string, norm float64) error {
+	sh := s.shards[s.vecShard(id)]
+	sh.mx.Lock()
+	defer sh.mx.Unlock()
+	sh.norms[id] = norm
+	return nil
+}
+
+func (s *ShardedStore) SetNorms(ids []string, norms []float64) error {
+	if len(ids) != len(norms) {
+		return lengthMismatchErr
+	}
+	for shardIdx, group := range s.groupIds(ids) {
+		if len(group) == 0 {
+			continue
+		}
+		sh := s.shards[shardIdx]
+		sh.mx.Lock()
+		for _, i := range group {
+			sh.norms[ids[i]] = norms[i]
+		}
+		sh.mx.Unlock()
+	}
+	return nil
+}
+
+func (s *ShardedStore) GetNorm(id string) (float64, error) {
+	sh := s.shards[s.vecShard(id)]
+	sh.mx.RLock()
+	defer sh.mx.RUnlock()
+	norm, ok := sh.norms[id]
+	if !ok {
+		return 0, keyNotFoundErr
+	}
+	return norm, nil
+}
+
+func (s *ShardedStore) GetNorms(ids []string) ([]float64, error) {
+	norms := make([]float64, len(ids))
+	for shardIdx, group := range s.groupIds(ids) {
+		if len(group) == 0 {
+			continue
+		}
+		sh := s.shards[shardIdx]
+		sh.mx.RLock()
+		for _, i := range group {
+			norm, ok := sh.norms[ids[i]]
+			if !ok {
+				sh.mx.RUnlock()
+				return nil, keyNotFoundErr
+			}
+			norms[i] = norm
+		}
+		sh.mx.RUnlock()
+	}
+	return norms, nil
+}
+
+func (s *ShardedStore) SetPayloads(ids []string, payloads [][]byte) error {
+	if len(ids) != len(payloads) {
+		return lengthMismatchErr
+	}
+	for shardIdx, group := range s.groupIds(ids) {
+		if len(group) == 0 {
+			continue
+		}
+		sh := s.shards[shardIdx]
+		sh.mx.Lock()
+		for _, i := range group {
+			sh.payloads[ids[i]] = payloads[i]
+		}
+		sh.mx.Unlock()
+	}
+	return nil
+}
+
+// GetPayloads returns nil for the ids without payload
+func (s *ShardedStore) GetPayloads(ids []string) ([][]byte, error) {
+	payloads := make([][]byte, len(ids))
+	for shardIdx, group := range s.groupIds(ids) {
+		if len(group) == 0 {
+			continue
+		}
+		sh := s.shards[shardIdx]
+		sh.mx.RLock()
+		for _, i := range group {
+			if payload := sh.payloads[ids[i]]; len(payload) > 0 {
+				payloads[i] = payload
+			}
+		}
+		sh.mx.RUnlock()
+	}
+	return payloads, nil
+}
+
+// setHash adds vector to the bucket; duplicates are ignored
+func (sh *shard) setHash(key store.BucketKey, vecId string) {
+	bucket, ok := sh.buckets[key]
+	if !ok {
+		bucket = make(map[string]struct{})
+		sh.buckets[key] = bucket
+	}
+	bucket[vecId] = struct{}{}
+}
+
+func (s *ShardedStore) SetHash(key store.BucketKey, vecId string) error {
+	sh := s.shards[s.bucketShard(key)]
+	sh.mx.Lock()
+	defer sh.mx.Unlock()
+	sh.setHash(key, vecId)
+	return nil
+}
+
+// SetHashes locks every affected shard once
+func (s *ShardedStore) SetHashes(keys []store.BucketKey, vecIds []string) error {
+	if len(keys) != len(vecIds) {
+		return lengthMismatchErr
+	}
+	groups := make([][]int, len(s.shards))
+	for i, key := range keys {
+		idx := s.bucketShard(key)
+		groups[idx] = append(groups[idx], i)
+	}
+	for shardIdx, group := range groups {
+		if len(group) == 0 {
+			continue
+		}
+		sh := s.shards[shardIdx]
+		sh.mx.Lock()
+		for _, i := range group {
+			sh.setHash(keys[i], vecIds[i])
+		}
+		sh.mx.Unlock()
+	}
+	return nil
+}
+
+// RemoveHash removes vector id from the bucket; empty buckets are removed too
+func (s *ShardedStore) RemoveHash(key store.BucketKey, vecId string) error {
+	sh := s.shards[s.bucketShard(key)]
+	sh.mx.Lock()
+	defer sh.mx.Unlock()
+	bucket, ok := sh.buckets[key]
+	if !ok {
+		return bucketNotFoundErr
+	}
+	delete(bucket, vecId)
+	if len(bucket) == 0 {
+		delete(sh.buckets, key)
+	}
+	return nil
+}
+
+// GetHashIterator returns iterator over the snapshot of bucket made at the moment of the call
+func (s *ShardedStore) GetHashIterator(key store.BucketKey) (store.Iterator, error) {
+	sh := s.shards[s.bucketShard(key)]
+	sh.mx.RLock()
+	defer sh.mx.RUnlock()
+	bucket, ok := sh.buckets[key]
+	if !ok {
+		return nil, bucketNotFoundErr
+	}
+	it := &KeysIterator{
+		vecIds: make([]string, 0, len(bucket)),
+	}
+	for vecId := range bucket {
+		it.vecIds = append(it.vecIds, vecId)
+	}
+	return it, nil
+}
+
+func (s *ShardedStore) ListBuckets() ([]store.BucketKey, error) {
+	keys := make([]store.BucketKey, 0)
+	for _, sh := range s.shards {
+		sh.mx.RLock()
+		for key := range sh.buckets {
+			keys = append(keys, key)
+		}
+		sh.mx.RUnlock()
+	}
+	return keys, nil
+}
+
+// ListTableBuckets has to scan all shards, since buckets of a table are spread across them
+func (s *ShardedStore) ListTableBuckets(table uint32) ([]store.BucketKey, error) {
+	keys := make([]store.BucketKey, 0)
+	for _, sh := range s.shards {
+		sh.mx.RLock()
+		for key := range sh.buckets {
+			if key.Table == table {
+				keys = append(keys, key)
+			}
+		}
+		sh.mx.RUnlock()
+	}
+	return keys, nil
+}
+
+// DropTable removes all the buckets of the table, shard by shard
+func (s *ShardedStore) DropTable(table uint32) error {
+	for _, sh := range s.shards {
+		sh.mx.Lock()
+		for key := range sh.buckets {
+			if key.Table == table {
+				delete(sh.buckets, key)
+			}
+		}
+		sh.mx.Unlock()
+	}
+	return nil
+}
+
+// Clear empties shards one by one
+func (s *ShardedStore) Clear() error {
+	for _, sh := range s.shards {
+		sh.mx.Lock()
+		sh.vecs = make(map[string][]float64)
+		sh.norms = make(map[string]float64)
+		sh.payloads = make(map[string][]byte)
+		sh.buckets = make(map[store.BucketKey]map[string]struct{})
+		sh.mx.Unlock()
+	}
+	return nil
+}
+
+// Namespace returns the isolated in-memory collection, which is created on the first call
+func (s *ShardedStore) Namespace(name string) (store.Store, error) {
+	return s.namespaces.Open(name, func() (store.Store, error) {
+		return NewShardedStore(len(s.shards)), nil
+	})
+}
+
+func (s *ShardedStore) ListNamespaces() ([]string, error) {
+	return s.namespaces.Names(), nil
+}
+
+func (s *ShardedStore) DropNamespace(name string) error {
+	ns, err := s.namespaces.Remove(name)
+	if err != nil {
+		return err
+	}
+	return ns.Clear()
+}
@@ -0,0 +1,171 @@
+package sharded
+
+import (
+	"github.com/gasparian/lsh-search-go/store"
+	"github.com/gasparian/lsh-search-go/store/kv"
+	"github.com/gasparian/lsh-search-go/store/storetest"
+	"math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestConcurrentAccess(t *testing.T) {
+	s := NewShardedStore(0)
+	wg := sync.WaitGroup{}
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				id := strconv.Itoa(w*1000 + i)
+				key := store.BucketKey{Table: uint32(i % 4), Code: uint64(w)}
+				s.SetVector(id, []float64{float64(i)})
+				s.SetHash(key, id)
+				if it, err := s.GetHashIterator(key); err == nil {
+					ids := storetest.ReadIds(it)
+					if _, err := s.GetVectors(ids); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	count, _ := s.CountVectors()
+	if count != 8*200 {
+		t.Fatalf("Store must contain %v vectors, got %v", 8*200, count)
+	}
+}
+
+const (
+	benchVecs    = 20000
+	benchDims    = 64
+	benchTrees   = 10
+	benchBuckets = 1000
+	benchBatch   = 500
+)
+
+type benchData struct {
+	ids  []string
+	vecs [][]float64
+	keys [][]store.BucketKey
+}
+
+func newBenchData() *benchData {
+	rand.Seed(42)
+	data := &benchData{
+		ids:  make([]string, benchVecs),
+		vecs: make([][]float64, benchVecs),
+		keys: make([][]store.BucketKey, benchVecs),
+	}
+	for i := range data.ids {
+		data.ids[i] = strconv.Itoa(i)
+		data.vecs[i] = make([]float64, benchDims)
+		for j := range data.vecs[i] {
+			data.vecs[i][j] = rand.Float64()
+		}
+		data.keys[i] = make([]store.BucketKey, benchTrees)
+		for perm := range data.keys[i] {
+			data.keys[i][perm] = store.BucketKey{Table: uint32(perm), Code: uint64(rand.Intn(benchBuckets))}
+		}
+	}
+	return data
+}
+
+// benchmarkTrain writes batches concurrently, the same way as the LSH index training does
+func benchmarkTrain(b *testing.B, newStore func() store.Store) {
+	data := newBenchData()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		s := newStore()
+		wg := sync.WaitGroup{}
+		for i := 0; i < benchVecs; i += benchBatch {
+			wg.Add(1)
+			go func(start, end int) {
+				defer wg.Done()
+				keys := make([]store.BucketKey, 0, (end-start)*benchTrees)
+				keyIds := make([]string, 0, (end-start)*benchTrees)
+				for j := start; j < end; j++ {
+					keys = append(keys, data.keys[j]...)
+					for range data.keys[j] {
+						keyIds = append(keyIds, data.ids[j])
+					}
+				}
+				s.SetVectors(data.ids[start:end], data.vecs[start:end])
+				s.SetHashes(keys, keyIds)
+			}(i, i+benchBatch)
+		}
+		wg.Wait()
+	}
+}
+
+// benchmarkMixed runs searches-like reads along with the 10% of writes;
+// run it with -cpu=1,2,4,8 to see how throughput scales
+func benchmarkMixed(b *testing.B, s store.Store) {
+	data := newBenchData()
+	keyIds := make([]string, benchTrees)
+	for i := range data.ids {
+		s.SetVector(data.ids[i], data.vecs[i])
+		for perm := range keyIds {
+			keyIds[perm] = data.ids[i]
+		}
+		s.SetHashes(data.keys[i], keyIds)
+	}
+	var counter int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := int(atomic.AddInt64(&counter, 1))
+			idx := i % benchVecs
+			if i%10 == 0 {
+				s.SetVector(data.ids[idx], data.vecs[idx])
+				s.SetHash(data.keys[idx][i%benchTrees], data.ids[idx])
+				continue
+			}
+			it, err := s.GetHashIterator(data.keys[idx][i%benchTrees])
+			if err != nil {
+				continue
+			}
+			ids := it.NextN(16)
+			it.Close()
+			s.GetVectors(ids)
+		}
+	})
+}
+
+func BenchmarkTrainKVStore(b *testing.B) {
+	benchmarkTrain(b, func() store.Store { return kv.NewKVStore() })
+}
+
+func BenchmarkTrainShardedStore(b *testing.B) {
+	benchmarkTrain(b, func() store.Store { return NewShardedStore(0) })
+}
+
+func BenchmarkMixedKVStore(b *testing.B) {
+	benchmarkMixed(b, kv.NewKVStore())
+}
+
+func BenchmarkMixedShardedStore(b *testing.B) {
+	benchmarkMixed(b, NewShardedStore(0))
+}
+
+func TestConformance(t *testing.T) {
+	storetest.RunConformance(t, func(t *testing.T) (store.Store, func()) {
+		return NewShardedStore(4), nil
+	})
+}
+
+func TestNamespaces(t *testing.T) {
+	storetest.RunNamespaceConformance(t, func(t *testing.T) (store.Store, func()) {
+		return NewShardedStore(4), nil
+	})
+}
+
+func TestPayloads(t *testing.T) {
+	storetest.RunPayloadConformance(t, func(t *testing.T) (store.Store, func()) {
+		return NewShardedStore(4), nil
+	})
+}
@@ -0,0 +1,240 @@
+package sql
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Dialect defines SQL syntax differences between databases
+type Dialect int
+
+const (
+	// SQLite uses "?" placeholders and BLOB type; requires SQLite 3.24+ for upserts
+	SQLite Dialect = iota
+	// Postgres uses "$N" placeholders and BYTEA type; requires PostgreSQL 9.5+ for upserts
+	Postgres
+)
+
+func (d Dialect) placeholder(n int) string {
+	if d == Postgres {
+		return "$" + strconv.Itoa(n)
+	}
+	return "?"
+}
+
+func (d Dialect) blobType() string {
+	if d == Postgres {
+		return "BYTEA"
+	}
+	return "BLOB"
+}
+
+// Schema (with the default "lsh_" tables prefix):
+//
+//	CREATE TABLE lsh_vectors (
+//	    id  TEXT PRIMARY KEY,
+//	    vec BLOB NOT NULL              -- little-endian float64 values
+//	);
+//	CREATE TABLE lsh_norms (
+//	    id   TEXT PRIMARY KEY,
+//	    norm DOUBLE PRECISION NOT NULL
+//	);
+//	CREATE TABLE lsh_payloads (
+//	    id   TEXT PRIMARY KEY,
+//	    data BLOB NOT NULL             -- opaque bytes, see store.PayloadStore
+//	);
+//	CREATE TABLE lsh_buckets (
+//	    tbl  BIGINT NOT NULL,          -- BucketKey.Table
+//	    code BIGINT NOT NULL,          -- BucketKey.Code, uint64 bits stored as signed integer
+//	    id   TEXT NOT NULL,
+//	    PRIMARY KEY (tbl, code, id)    -- serves as the index on bucket key and prevents duplicates
+//	);
+//
+// Norms and payloads are kept in the separate tables, since they could be set independently from vectors.
+// Bucket entries aren't removed along with vectors, as in other stores.
+// Collections (see SQLStore.Namespace) are registered in the table created on the first use:
+//
+//	CREATE TABLE lsh_namespaces (
+//	    name TEXT PRIMARY KEY
+//	);
+//
+// and keep their data in the same tables with the "lsh_ns_<name>_" prefix.
+func schema(prefix string, d Dialect) []string {
+	return []string{
+		"CREATE TABLE IF NOT EXISTS " + prefix + "vectors (" +
+			"id TEXT PRIMARY KEY, " +
+			"vec " + d.blobType() + " NOT NULL)",
+		"CREATE TABLE IF NOT EXISTS " + prefix + "norms (" +
+			"id TEXT PRIMARY KEY, " +
+			"norm DOUBLE PRECISION NOT NULL)",
+		"CREATE TABLE IF NOT EXISTS " + prefix + "payloads (" +
+			"id TEXT PRIMARY KEY, " +
+			"data " + d.blobType() + " NOT NULL)",
+		"CREATE TABLE IF NOT EXISTS " + prefix + "buckets (" +
+			"tbl BIGINT NOT NULL, " +
+			"code BIGINT NOT NULL, " +
+			"id TEXT NOT NULL, " +
+			"PRIMARY KEY (tbl, code, id))",
+	}
+}
+
+// valuesList returns "(?, ?), (?, ?)"-like list of rows placeholders
+func (d Dialect) valuesList(rows, cols int) string {
+	var sb strings.Builder
+	n := 1
+	for r := 0; r < rows; r++ {
+		if r > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteByte('(')
+		for c := 0; c < cols; c++ {
+			if c > 0 {
+				sb.WriteString(", ")
+			}
+			sb.WriteString(d.placeholder(n))
+			n++
+		}
+		sb.WriteByte(')')
+	}
+	return sb.String()
+}
+
+// inList returns "(?, ?, ?)"-like list of placeholders, numbered starting from the given one
+func (d Dialect) inList(n, start int) string {
+	var sb strings.Builder
+	sb.WriteByte('(')
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString(d.placeholder(start + i))
+	}
+	sb.WriteByte(')')
+	return sb.String()
+}
+
+// queries holds statements text for the given tables prefix and dialect
+type queries struct {
+	d      Dialect
+	prefix string
+}
+
+func (q queries) setVectors(rows int) string {
+	return "INSERT INTO " + q.prefix + "vectors (id, vec) VALUES " + q.d.valuesList(rows, 2) +
+		" ON CONFLICT (id) DO UPDATE SET vec = excluded.vec"
+}
+
+func (q queries) getVectors(n int) string {
+	return "SELECT id, vec FROM " + q.prefix + "vectors WHERE id IN " + q.d.inList(n, 1)
+}
+
+func (q queries) deleteVector() string {
+	return "DELETE FROM " + q.prefix + "vectors WHERE id = " + q.d.placeholder(1)
+}
+
+func (q queries) deleteNorm() string {
+	return "DELETE FROM " + q.prefix + "norms WHERE id = " + q.d.placeholder(1)
+}
+
+func (q queries) countVectors() string {
+	return "SELECT COUNT(*) FROM " + q.prefix + "vectors"
+}
+
+// scanVectors pages through vectors ordered by id, so no cursor is held between pages
+func (q queries) scanVectors() string {
+	return "SELECT id, vec FROM " + q.prefix + "vectors WHERE id > " + q.d.placeholder(1) +
+		" ORDER BY id LIMIT " + q.d.placeholder(2)
+}
+
+func (q queries) setNorms(rows int) string {
+	return "INSERT INTO " + q.prefix + "norms (id, norm) VALUES " + q.d.valuesList(rows, 2) +
+		" ON CONFLICT (id) DO UPDATE SET norm = excluded.norm"
+}
+
+func (q queries) getNorms(n int) string {
+	return "SELECT id, norm FROM " + q.prefix + "norms WHERE id IN " + q.d.inList(n, 1)
+}
+
+func (q queries) setPayloads(rows int) string {
+	return "INSERT INTO " + q.prefix + "payloads (id, data) VALUES " + q.d.valuesList(rows, 2) +
+		" ON CONFLICT (id) DO UPDATE SET data = excluded.data"
+}
+
+func (q queries) getPayloads(n int) string {
+	return "SELECT id, data FROM " + q.prefix + "payloads WHERE id IN " + q.d.inList(n, 1)
+}
+
+func (q queries) deletePayload() string {
+	return "DELETE FROM " + q.prefix + "payloads WHERE id = " + q.d.placeholder(1)
+}
+
+func (q queries) setHashes(rows int) string {
+	return "INSERT INTO " + q.prefix + "buckets (tbl, code, id) VALUES " + q.d.valuesList(rows, 3) +
+		" ON CONFLICT DO NOTHING"
+}
+
+func (q queries) removeHash() string {
+	return "DELETE FROM " + q.prefix + "buckets WHERE tbl = " + q.d.placeholder(1) +
+		" AND code = " + q.d.placeholder(2) + " AND id = " + q.d.placeholder(3)
+}
+
+func (q queries) dropTable() string {
+	return "DELETE FROM " + q.prefix + "buckets WHERE tbl = " + q.d.placeholder(1)
+}
+
+func (q queries) getHash() string {
+	return "SELECT id FROM " + q.prefix + "buckets WHERE tbl = " + q.d.placeholder(1) +
+		" AND code = " + q.d.placeholder(2)
+}
+
+func (q queries) bucketExists() string {
+	return "SELECT 1 FROM " + q.prefix + "buckets WHERE tbl = " + q.d.placeholder(1) +
+		" AND code = " + q.d.placeholder(2) + " LIMIT 1"
+}
+
+func (q queries) listBuckets() string {
+	return "SELECT DISTINCT tbl, code FROM " + q.prefix + "buckets"
+}
+
+func (q queries) listTableBuckets() string {
+	return "SELECT DISTINCT code FROM " + q.prefix + "buckets WHERE tbl = " + q.d.placeholder(1)
+}
+
+func (q queries) createNamespaces() string {
+	return "CREATE TABLE IF NOT EXISTS " + q.prefix + "namespaces (name TEXT PRIMARY KEY)"
+}
+
+func (q queries) addNamespace() string {
+	return "INSERT INTO " + q.prefix + "namespaces (name) VALUES (" + q.d.placeholder(1) + ") ON CONFLICT DO NOTHING"
+}
+
+func (q queries) listNamespaces() string {
+	return "SELECT name FROM " + q.prefix + "namespaces ORDER BY name"
+}
+
+func (q queries) removeNamespace() string {
+	return "DELETE FROM " + q.prefix + "namespaces WHERE name = " + q.d.placeholder(1)
+}
+
+// namespacePrefix returns the tables prefix of the collection
+func (q queries) namespacePrefix(name string) string {
+	return q.prefix + "ns_" + name + "_"
+}
+
+func (q queries) dropTables() []string {
+	return []string{
+		"DROP TABLE IF EXISTS " + q.prefix + "vectors",
+		"DROP TABLE IF EXISTS " + q.prefix + "norms",
+		"DROP TABLE IF EXISTS " + q.prefix + "payloads",
+		"DROP TABLE IF EXISTS " + q.prefix + "buckets",
+	}
+}
+
+func (q queries) clear() []string {
+	return []string{
+		"DELETE FROM " + q.prefix + "vectors",
+		"DELETE FROM " + q.prefix + "norms",
+		"DELETE FROM " + q.prefix + "payloads",
+		"DELETE FROM " + q.prefix + "buckets",
+	}
+}
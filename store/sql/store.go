@@ -0,0 +1,750 @@
+package sql
+
+import (
+	dbsql "database/sql"
+	"encoding/binary"
+	"errors"
+	"github.com/gasparian/lsh-search-go/store"
+	"math"
+	"sync"
+)
+
+var (
+	bucketNotFoundErr    = store.BucketNotFoundErr
+	keyNotFoundErr       = store.KeyNotFoundErr
+	lengthMismatchErr    = errors.New("Batch slices must have the same length")
+	corruptedVectorErr   = errors.New("Stored vector has wrong size")
+	namespaceNotFoundErr = errors.New("Namespace not found")
+)
+
+// Config holds sql store parameters; zero values are replaced with defaults
+type Config struct {
+	Dialect     Dialect
+	TablePrefix string // NOTE: "lsh_" by default
+	// BatchSize is the max number of rows in a single insert or multi-get statement;
+	// note that databases limit the number of statement parameters (999 in old SQLite versions)
+	BatchSize int
+}
+
+func (c *Config) setDefaults() {
+	if c.TablePrefix == "" {
+		c.TablePrefix = "lsh_"
+	}
+	if c.BatchSize <= 0 {
+		c.BatchSize = 250
+	}
+}
+
+// SQLStore keeps vectors, norms and buckets in the database tables (see schema).
+// Batch methods write in a single transaction with multi-row inserts.
+// Statements of the full batch size and single-row statements are prepared once and reused
+type SQLStore struct {
+	db     *dbsql.DB
+	config Config
+	q      queries
+	mx     sync.Mutex
+	stmts  map[string]*dbsql.Stmt
+	// NOTE: collections are kept opened to reuse their prepared statements
+	namespaces store.Namespaces
+}
+
+// NewSQLStore creates tables, if they don't exist yet
+func NewSQLStore(db *dbsql.DB, config Config) (*SQLStore, error) {
+	config.setDefaults()
+	for _, ddl := range schema(config.TablePrefix, config.Dialect) {
+		_, err := db.Exec(ddl)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &SQLStore{
+		db:     db,
+		config: config,
+		q:      queries{d: config.Dialect, prefix: config.TablePrefix},
+		stmts:  make(map[string]*dbsql.Stmt),
+	}, nil
+}
+
+// Close releases prepared statements of the store and its opened collections; database itself is left open
+func (s *SQLStore) Close() error {
+	for _, name := range s.namespaces.Names() {
+		if ns, err := s.namespaces.Remove(name); err == nil {
+			ns.(*SQLStore).Close()
+		}
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	var err error
+	for query, stmt := range s.stmts {
+		if e := stmt.Close(); e != nil {
+			err = e
+		}
+		delete(s.stmts, query)
+	}
+	return err
+}
+
+// stmt returns prepared statement; statements of the odd sizes aren't cached,
+// so the caller must close them with the returned function
+func (s *SQLStore) stmt(query string, cache bool) (*dbsql.Stmt, func(), error) {
+	if !cache {
+		stmt, err := s.db.Prepare(query)
+		if err != nil {
+			return nil, nil, err
+		}
+		return stmt, func() { stmt.Close() }, nil
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	stmt, ok := s.stmts[query]
+	if !ok {
+		var err error
+		stmt, err = s.db.Prepare(query)
+		if err != nil {
+			return nil, nil, err
+		}
+		s.stmts[query] = stmt
+	}
+	return stmt, func() {}, nil
+}
+
+// chunked calls f for every chunk of n elements, with the prepared statement built by query;
+// statements are prepared before the transaction begins, so it works with a single connection pool
+func (s *SQLStore) chunked(n int, query func(int) string, inTx bool, f func(stmt *dbsql.Stmt, start, end int) error) error {
+	if n == 0 {
+		return nil
+	}
+	var full, tail *dbsql.Stmt
+	if n >= s.config.BatchSize {
+		stmt, _, err := s.stmt(query(s.config.BatchSize), true)
+		if err != nil {
+			return err
+		}
+		full = stmt
+	}
+	if size := n % s.config.BatchSize; size > 0 {
+		stmt, done, err := s.stmt(query(size), size == 1)
+		if err != nil {
+			return err
+		}
+		defer done()
+		tail = stmt
+	}
+	run := func(wrap func(*dbsql.Stmt) *dbsql.Stmt) error {
+		for start := 0; start < n; start += s.config.BatchSize {
+			end := start + s.config.BatchSize
+			stmt := full
+			if end > n {
+				end = n
+				stmt = tail
+			}
+			err := f(wrap(stmt), start, end)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if !inTx {
+		return run(func(stmt *dbsql.Stmt) *dbsql.Stmt { return stmt })
+	}
+	return s.inTx(func(tx *dbsql.Tx) error {
+		return run(tx.Stmt)
+	})
+}
+
+// inTx runs f in transaction, rolling it back on error
+func (s *SQLStore) inTx(f func(tx *dbsql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	err = f(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func encodeVector(vec []float64) []byte {
+	data := make([]byte, len(vec)*8)
+	for i, v := range vec {
+		binary.LittleEndian.PutUint64(data[i*8:], math.Float64bits(v))
+	}
+	return data
+}
+
+func decodeVector(data []byte) ([]float64, error) {
+	if len(data)%8 != 0 {
+		return nil, corruptedVectorErr
+	}
+	vec := make([]float64, len(data)/8)
+	for i := range vec {
+		vec[i] = math.Float64frombits(binary.LittleEndian.Uint64(data[i*8:]))
+	}
+	return vec, nil
+}
+
+// lastPositions returns positions of the last occurrences of the ids,
+// since the upsert can't change the same row twice in some databases
+func lastPositions(ids []string) []int {
+	last := make(map[string]int, len(ids))
+	for i, id := range ids {
+		last[id] = i
+	}
+	positions := make([]int, 0, len(last))
+	for i, id := range ids {
+		if last[id] == i {
+			positions = append(positions, i)
+		}
+	}
+	return positions
+}
+
+func (s *SQLStore) SetVector(id string, vec []float64) error {
+	return s.SetVectors([]string{id}, [][]float64{vec})
+}
+
+func (s *SQLStore) SetVectors(ids []string, vecs [][]float64) error {
+	if len(ids) != len(vecs) {
+		return lengthMismatchErr
+	}
+	positions := lastPositions(ids)
+	return s.chunked(len(positions), s.q.setVectors, true, func(stmt *dbsql.Stmt, start, end int) error {
+		args := make([]interface{}, 0, (end-start)*2)
+		for _, i := range positions[start:end] {
+			args = append(args, ids[i], encodeVector(vecs[i]))
+		}
+		_, err := stmt.Exec(args...)
+		return err
+	})
+}
+
+func (s *SQLStore) GetVector(id string) ([]float64, error) {
+	vecs, err := s.GetVectors([]string{id})
+	if err != nil {
+		return nil, err
+	}
+	return vecs[0], nil
+}
+
+func (s *SQLStore) GetVectors(ids []string) ([][]float64, error) {
+	vecs := make([][]float64, len(ids))
+	found := make(map[string][]float64, len(ids))
+	err := s.chunked(len(ids), s.q.getVectors, false, func(stmt *dbsql.Stmt, start, end int) error {
+		args := make([]interface{}, 0, end-start)
+		for _, id := range ids[start:end] {
+			args = append(args, id)
+		}
+		rows, err := stmt.Query(args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id string
+			var data []byte
+			err = rows.Scan(&id, &data)
+			if err != nil {
+				return err
+			}
+			found[id], err = decodeVector(data)
+			if err != nil {
+				return err
+			}
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i, id := range ids {
+		vec, ok := found[id]
+		if !ok {
+			return nil, keyNotFoundErr
+		}
+		vecs[i] = vec
+	}
+	return vecs, nil
+}
+
+// DeleteVector removes vector and its norm, but not the bucket entries
+func (s *SQLStore) DeleteVector(id string) error {
+	deleteVector, _, err := s.stmt(s.q.deleteVector(), true)
+	if err != nil {
+		return err
+	}
+	deleteNorm, _, err := s.stmt(s.q.deleteNorm(), true)
+	if err != nil {
+		return err
+	}
+	deletePayload, _, err := s.stmt(s.q.deletePayload(), true)
+	if err != nil {
+		return err
+	}
+	return s.inTx(func(tx *dbsql.Tx) error {
+		res, err := tx.Stmt(deleteVector).Exec(id)
+		if err != nil {
+			return err
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if affected == 0 {
+			return keyNotFoundErr
+		}
+		_, err = tx.Stmt(deleteNorm).Exec(id)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Stmt(deletePayload).Exec(id)
+		return err
+	})
+}
+
+func (s *SQLStore) CountVectors() (int, error) {
+	stmt, _, err := s.stmt(s.q.countVectors(), true)
+	if err != nil {
+		return 0, err
+	}
+	var count int
+	err = stmt.QueryRow().Scan(&count)
+	return count, err
+}
+
+// VectorsIterator reads vectors page by page ordered by id, without holding a cursor
+// between the pages; vectors inserted behind the current position are not visited
+type VectorsIterator struct {
+	s      *SQLStore
+	lastId string
+	ids    []string
+	vecs   [][]float64
+	pos    int
+	done   bool
+}
+
+func (it *VectorsIterator) fetch() error {
+	stmt, _, err := it.s.stmt(it.s.q.scanVectors(), true)
+	if err != nil {
+		return err
+	}
+	rows, err := stmt.Query(it.lastId, it.s.config.BatchSize)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	it.ids, it.vecs, it.pos = it.ids[:0], it.vecs[:0], 0
+	for rows.Next() {
+		var id string
+		var data []byte
+		err = rows.Scan(&id, &data)
+		if err != nil {
+			return err
+		}
+		vec, err := decodeVector(data)
+		if err != nil {
+			return err
+		}
+		it.ids = append(it.ids, id)
+		it.vecs = append(it.vecs, vec)
+	}
+	if len(it.ids) < it.s.config.BatchSize {
+		it.done = true
+	}
+	if len(it.ids) > 0 {
+		it.lastId = it.ids[len(it.ids)-1]
+	}
+	return rows.Err()
+}
+
+// Next stops on the database error as well as on the end of the table
+func (it *VectorsIterator) Next() (string, []float64, bool) {
+	if it.pos >= len(it.ids) {
+		if it.done || it.fetch() != nil || len(it.ids) == 0 {
+			it.done = true
+			return "", nil, false
+		}
+	}
+	it.pos++
+	return it.ids[it.pos-1], it.vecs[it.pos-1], true
+}
+
+func (it *VectorsIterator) Close() error {
+	it.done = true
+	it.ids, it.vecs, it.pos = nil, nil, 0
+	return nil
+}
+
+func (s *SQLStore) GetVectorIterator() (store.VectorIterator, error) {
+	return &VectorsIterator{s: s}, nil
+}
+
+func (s *SQLStore) SetNorm(id string, norm float64) error {
+	return s.SetNorms([]string{id}, []float64{norm})
+}
+
+func (s *SQLStore) SetNorms(ids []string, norms []float64) error {
+	if len(ids) != len(norms) {
+		return lengthMismatchErr
+	}
+	positions := lastPositions(ids)
+	return s.chunked(len(positions), s.q.setNorms, true, func(stmt *dbsql.Stmt, start, end int) error {
+		args := make([]interface{}, 0, (end-start)*2)
+		for _, i := range positions[start:end] {
+			args = append(args, ids[i], norms[i])
+		}
+		_, err := stmt.Exec(args...)
+		return err
+	})
+}
+
+func (s *SQLStore) GetNorm(id string) (float64, error) {
+	norms, err := s.GetNorms([]string{id})
+	if err != nil {
+		return 0, err
+	}
+	return norms[0], nil
+}
+
+func (s *SQLStore) GetNorms(ids []string) ([]float64, error) {
+	norms := make([]float64, len(ids))
+	found := make(map[string]float64, len(ids))
+	err := s.chunked(len(ids), s.q.getNorms, false, func(stmt *dbsql.Stmt, start, end int) error {
+		args := make([]interface{}, 0, end-start)
+		for _, id := range ids[start:end] {
+			args = append(args, id)
+		}
+		rows, err := stmt.Query(args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id string
+			var norm float64
+			err = rows.Scan(&id, &norm)
+			if err != nil {
+				return err
+			}
+			found[id] = norm
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i, id := range ids {
+		norm, ok := found[id]
+		if !ok {
+			return nil, keyNotFoundErr
+		}
+		norms[i] = norm
+	}
+	return norms, nil
+}
+
+func (s *SQLStore) SetPayloads(ids []string, payloads [][]byte) error {
+	if len(ids) != len(payloads) {
+		return lengthMismatchErr
+	}
+	positions := lastPositions(ids)
+	return s.chunked(len(positions), s.q.setPayloads, true, func(stmt *dbsql.Stmt, start, end int) error {
+		args := make([]interface{}, 0, (end-start)*2)
+		for _, i := range positions[start:end] {
+			// NOTE: nil would violate NOT NULL constraint, empty payload is read as nil
+			data := payloads[i]
+			if data == nil {
+				data = []byte{}
+			}
+			args = append(args, ids[i], data)
+		}
+		_, err := stmt.Exec(args...)
+		return err
+	})
+}
+
+// GetPayloads returns nil for the ids without payload or with the empty one
+func (s *SQLStore) GetPayloads(ids []string) ([][]byte, error) {
+	found := make(map[string][]byte, len(ids))
+	err := s.chunked(len(ids), s.q.getPayloads, false, func(stmt *dbsql.Stmt, start, end int) error {
+		args := make([]interface{}, 0, end-start)
+		for _, id := range ids[start:end] {
+			args = append(args, id)
+		}
+		rows, err := stmt.Query(args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id string
+			var data []byte
+			err = rows.Scan(&id, &data)
+			if err != nil {
+				return err
+			}
+			if len(data) > 0 {
+				found[id] = data
+			}
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	payloads := make([][]byte, len(ids))
+	for i, id := range ids {
+		payloads[i] = found[id]
+	}
+	return payloads, nil
+}
+
+func (s *SQLStore) SetHash(key store.BucketKey, vecId string) error {
+	return s.SetHashes([]store.BucketKey{key}, []string{vecId})
+}
+
+// SetHashes ignores entries, which are already in the buckets
+func (s *SQLStore) SetHashes(keys []store.BucketKey, vecIds []string) error {
+	if len(keys) != len(vecIds) {
+		return lengthMismatchErr
+	}
+	return s.chunked(len(keys), s.q.setHashes, true, func(stmt *dbsql.Stmt, start, end int) error {
+		args := make([]interface{}, 0, (end-start)*3)
+		for i := start; i < end; i++ {
+			args = append(args, int64(keys[i].Table), int64(keys[i].Code), vecIds[i])
+		}
+		_, err := stmt.Exec(args...)
+		return err
+	})
+}
+
+// RemoveHash removes vector id from the bucket; bucket exists while it has entries
+func (s *SQLStore) RemoveHash(key store.BucketKey, vecId string) error {
+	exists, _, err := s.stmt(s.q.bucketExists(), true)
+	if err != nil {
+		return err
+	}
+	var one int
+	err = exists.QueryRow(int64(key.Table), int64(key.Code)).Scan(&one)
+	if err == dbsql.ErrNoRows {
+		return bucketNotFoundErr
+	}
+	if err != nil {
+		return err
+	}
+	stmt, _, err := s.stmt(s.q.removeHash(), true)
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(int64(key.Table), int64(key.Code), vecId)
+	return err
+}
+
+// DropTable removes all the buckets of the table with a single statement
+func (s *SQLStore) DropTable(table uint32) error {
+	stmt, _, err := s.stmt(s.q.dropTable(), true)
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(int64(table))
+	return err
+}
+
+// KeysIterator iterates over the snapshot of bucket's vectors uids
+type KeysIterator struct {
+	vecIds []string
+	pos    int
+}
+
+func (it *KeysIterator) Next() (string, bool) {
+	if it.pos >= len(it.vecIds) {
+		return "", false
+	}
+	it.pos++
+	return it.vecIds[it.pos-1], true
+}
+
+func (it *KeysIterator) NextN(n int) []string {
+	end := it.pos + n
+	if end > len(it.vecIds) {
+		end = len(it.vecIds)
+	}
+	if end <= it.pos {
+		return []string{}
+	}
+	vecIds := it.vecIds[it.pos:end]
+	it.pos = end
+	return vecIds
+}
+
+// Close releases the snapshot
+func (it *KeysIterator) Close() error {
+	it.vecIds = nil
+	it.pos = 0
+	return nil
+}
+
+// GetHashIterator reads the whole bucket at once, so no cursor is left open
+func (s *SQLStore) GetHashIterator(key store.BucketKey) (store.Iterator, error) {
+	stmt, _, err := s.stmt(s.q.getHash(), true)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := stmt.Query(int64(key.Table), int64(key.Code))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	it := &KeysIterator{
+		vecIds: make([]string, 0),
+	}
+	for rows.Next() {
+		var id string
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		it.vecIds = append(it.vecIds, id)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(it.vecIds) == 0 {
+		return nil, bucketNotFoundErr
+	}
+	return it, nil
+}
+
+func (s *SQLStore) ListBuckets() ([]store.BucketKey, error) {
+	stmt, _, err := s.stmt(s.q.listBuckets(), true)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := stmt.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := make([]store.BucketKey, 0)
+	for rows.Next() {
+		var table, code int64
+		err = rows.Scan(&table, &code)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, store.BucketKey{Table: uint32(table), Code: uint64(code)})
+	}
+	return keys, rows.Err()
+}
+
+func (s *SQLStore) ListTableBuckets(table uint32) ([]store.BucketKey, error) {
+	stmt, _, err := s.stmt(s.q.listTableBuckets(), true)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := stmt.Query(int64(table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := make([]store.BucketKey, 0)
+	for rows.Next() {
+		var code int64
+		err = rows.Scan(&code)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, store.BucketKey{Table: table, Code: uint64(code)})
+	}
+	return keys, rows.Err()
+}
+
+func (s *SQLStore) Clear() error {
+	return s.inTx(func(tx *dbsql.Tx) error {
+		for _, query := range s.q.clear() {
+			_, err := tx.Exec(query)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Namespace creates tables of the collection (see schema), if they don't exist yet, and registers it
+func (s *SQLStore) Namespace(name string) (store.Store, error) {
+	return s.namespaces.Open(name, func() (store.Store, error) {
+		config := s.config
+		config.TablePrefix = s.q.namespacePrefix(name)
+		ns, err := NewSQLStore(s.db, config)
+		if err != nil {
+			return nil, err
+		}
+		_, err = s.db.Exec(s.q.createNamespaces())
+		if err == nil {
+			_, err = s.db.Exec(s.q.addNamespace(), name)
+		}
+		if err != nil {
+			ns.Close()
+			return nil, err
+		}
+		return ns, nil
+	})
+}
+
+// ListNamespaces returns the registered collections
+func (s *SQLStore) ListNamespaces() ([]string, error) {
+	_, err := s.db.Exec(s.q.createNamespaces())
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.db.Query(s.q.listNamespaces())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	names := make([]string, 0)
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// DropNamespace drops tables of the collection and unregisters it in a single transaction
+func (s *SQLStore) DropNamespace(name string) error {
+	err := store.ValidateNamespace(name)
+	if err != nil {
+		return err
+	}
+	if ns, err := s.namespaces.Remove(name); err == nil {
+		ns.(*SQLStore).Close()
+	}
+	_, err = s.db.Exec(s.q.createNamespaces())
+	if err != nil {
+		return err
+	}
+	return s.inTx(func(tx *dbsql.Tx) error {
+		res, err := tx.Exec(s.q.removeNamespace(), name)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			return namespaceNotFoundErr
+		}
+		ns := queries{d: s.config.Dialect, prefix: s.q.namespacePrefix(name)}
+		for _, ddl := range ns.dropTables() {
+			_, err = tx.Exec(ddl)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
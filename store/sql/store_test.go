@@ -0,0 +1,154 @@
+package sql
+
+import (
+	dbsql "database/sql"
+	"errors"
+	"github.com/gasparian/lsh-search-go/store"
+	"github.com/gasparian/lsh-search-go/store/storetest"
+	_ "github.com/mattn/go-sqlite3"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+var vectorsAreNotEqualErr = errors.New("Vectors are not equal")
+
+func openSQLite(t *testing.T) (*dbsql.DB, func()) {
+	dir, err := ioutil.TempDir("", "sql-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := dbsql.Open("sqlite3", filepath.Join(dir, "index.db")+"?_busy_timeout=5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// NOTE: SQLite allows the single writer only
+	db.SetMaxOpenConns(1)
+	return db, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestQueries(t *testing.T) {
+	q := queries{d: Postgres, prefix: "p_"}
+	expected := "INSERT INTO p_buckets (tbl, code, id) VALUES ($1, $2, $3), ($4, $5, $6) ON CONFLICT DO NOTHING"
+	if query := q.setHashes(2); query != expected {
+		t.Errorf("Wrong query: %v", query)
+	}
+	q = queries{d: SQLite, prefix: "s_"}
+	expected = "SELECT id, vec FROM s_vectors WHERE id IN (?, ?, ?)"
+	if query := q.getVectors(3); query != expected {
+		t.Errorf("Wrong query: %v", query)
+	}
+}
+
+func TestSQLStore(t *testing.T) {
+	db, cleanup := openSQLite(t)
+	defer cleanup()
+	s, err := NewSQLStore(db, Config{BatchSize: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ids := make([]string, 10)
+	vecs := make([][]float64, len(ids))
+	for i := range ids {
+		ids[i] = strconv.Itoa(i)
+		vecs[i] = []float64{float64(i), -1.5}
+	}
+	// NOTE: the contents are checked by the conformance suite
+	err = s.SetVectors(ids, vecs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Scan", func(t *testing.T) {
+		it, _ := s.GetVectorIterator()
+		scanned := 0
+		for {
+			id, vec, ok := it.Next()
+			if !ok {
+				break
+			}
+			idx, _ := strconv.Atoi(id)
+			if !reflect.DeepEqual(vec, vecs[idx]) {
+				t.Error(vectorsAreNotEqualErr)
+			}
+			// NOTE: iterator must not block writes
+			err := s.SetNorm(id, float64(idx))
+			if err != nil {
+				t.Fatal(err)
+			}
+			scanned++
+		}
+		it.Close()
+		if scanned != len(ids) {
+			t.Errorf("Iterator must return %v vectors, got %v", len(ids), scanned)
+		}
+	})
+
+	t.Run("Reopen", func(t *testing.T) {
+		other, err := NewSQLStore(db, Config{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer other.Close()
+		count, _ := other.CountVectors()
+		if count != len(ids) {
+			t.Errorf("Store must contain %v vectors, got %v", len(ids), count)
+		}
+		norm, err := other.GetNorm("3")
+		if err != nil || norm != 3 {
+			t.Errorf("Norm written during the scan must be stored: %v, %v", norm, err)
+		}
+	})
+}
+
+func TestConformance(t *testing.T) {
+	storetest.RunConformance(t, func(t *testing.T) (store.Store, func()) {
+		db, cleanup := openSQLite(t)
+		s, err := NewSQLStore(db, Config{BatchSize: 7})
+		if err != nil {
+			cleanup()
+			t.Fatal(err)
+		}
+		return s, func() {
+			s.Close()
+			cleanup()
+		}
+	})
+}
+
+func TestNamespaces(t *testing.T) {
+	storetest.RunNamespaceConformance(t, func(t *testing.T) (store.Store, func()) {
+		db, cleanup := openSQLite(t)
+		s, err := NewSQLStore(db, Config{BatchSize: 7})
+		if err != nil {
+			cleanup()
+			t.Fatal(err)
+		}
+		return s, func() {
+			s.Close()
+			cleanup()
+		}
+	})
+}
+
+func TestPayloads(t *testing.T) {
+	storetest.RunPayloadConformance(t, func(t *testing.T) (store.Store, func()) {
+		db, cleanup := openSQLite(t)
+		s, err := NewSQLStore(db, Config{BatchSize: 7})
+		if err != nil {
+			cleanup()
+			t.Fatal(err)
+		}
+		return s, func() {
+			s.Close()
+			cleanup()
+		}
+	})
+}
@@ -1,18 +1,108 @@
 package store
 
-// Iterator consists from only one method which returns uid of the next vector
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var (
+	bucketKeyFormatErr = errors.New("Bucket key must be formatted as <table>_<code>")
+	// KeyNotFoundErr is returned by the bundled stores when the vector, its norm or payload is absent,
+	// so the callers can tell it from the backend failures
+	KeyNotFoundErr = errors.New("Key not found")
+	// BucketNotFoundErr is returned by the bundled stores when the bucket is absent or has been emptied
+	BucketNotFoundErr = errors.New("Bucket not found")
+)
+
+// BucketKey identifies a bucket by the hash table (tree) index and the hash code inside it
+type BucketKey struct {
+	Table uint32
+	Code  uint64
+}
+
+// String encodes key as "<table>_<code>", for backends which can only keep string keys
+func (k BucketKey) String() string {
+	buf := make([]byte, 0, 32)
+	buf = strconv.AppendUint(buf, uint64(k.Table), 10)
+	buf = append(buf, '_')
+	buf = strconv.AppendUint(buf, k.Code, 10)
+	return string(buf)
+}
+
+// ParseBucketKey decodes key from its string representation
+func ParseBucketKey(s string) (BucketKey, error) {
+	sep := strings.IndexByte(s, '_')
+	if sep < 0 {
+		return BucketKey{}, bucketKeyFormatErr
+	}
+	table, err := strconv.ParseUint(s[:sep], 10, 32)
+	if err != nil {
+		return BucketKey{}, bucketKeyFormatErr
+	}
+	code, err := strconv.ParseUint(s[sep+1:], 10, 64)
+	if err != nil {
+		return BucketKey{}, bucketKeyFormatErr
+	}
+	return BucketKey{Table: uint32(table), Code: code}, nil
+}
+
+// Iterator returns uids of the vectors stored in a bucket;
+// NextN returns up to n next uids (empty slice when iterator is exhausted).
+// Iterator must be closed when it's not needed anymore, even if it hasn't been exhausted
 type Iterator interface {
 	Next() (string, bool)
+	NextN(n int) []string
+	Close() error
+}
+
+// VectorIterator returns stored vectors one by one along with their uids;
+// it must be closed after use, like the Iterator
+type VectorIterator interface {
+	Next() (string, []float64, bool)
+	Close() error
 }
 
 // Store methods to be able to hold and use search index
 // It implies storage vectors at one place, and
 // LSH hashes with vectors uid in other places
-// to not duplicate vectors themselves
+// to not duplicate vectors themselves.
+// Batch methods take slices of the same length, where i-th elements form a single record;
+// multi-get methods return values in the order of requested ids and fail if any of them is missing.
+// Buckets hold every vector id once, so setting the same hash again changes nothing.
+// ListTableBuckets returns keys of the single hash table only
 type Store interface {
 	SetVector(id string, vec []float64) error
+	SetVectors(ids []string, vecs [][]float64) error
 	GetVector(id string) ([]float64, error)
-	SetHash(bucketName, vecId string) error
-	GetHashIterator(bucketName string) (Iterator, error)
+	GetVectors(ids []string) ([][]float64, error)
+	DeleteVector(id string) error
+	CountVectors() (int, error)
+	GetVectorIterator() (VectorIterator, error)
+	SetNorm(id string, norm float64) error
+	SetNorms(ids []string, norms []float64) error
+	GetNorm(id string) (float64, error)
+	GetNorms(ids []string) ([]float64, error)
+	SetHash(key BucketKey, vecId string) error
+	SetHashes(keys []BucketKey, vecIds []string) error
+	RemoveHash(key BucketKey, vecId string) error
+	GetHashIterator(key BucketKey) (Iterator, error)
+	ListBuckets() ([]BucketKey, error)
+	ListTableBuckets(table uint32) ([]BucketKey, error)
 	Clear() error
 }
+
+// PayloadStore is implemented by stores, which keep arbitrary payloads along with vectors.
+// Payloads are deleted along with vectors by DeleteVector and Clear;
+// GetPayloads returns nil for ids without payload instead of failing,
+// the same goes for ids with nil or empty payload
+type PayloadStore interface {
+	SetPayloads(ids []string, payloads [][]byte) error
+	GetPayloads(ids []string) ([][]byte, error)
+}
+
+// TableDropper is implemented by stores, which can remove all the buckets of the hash table at once,
+// instead of removing their entries one by one; dropping the absent table succeeds
+type TableDropper interface {
+	DropTable(table uint32) error
+}
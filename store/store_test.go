@@ -0,0 +1,27 @@
+package store
+
+import (
+	"testing"
+)
+
+func TestBucketKey(t *testing.T) {
+	keys := []BucketKey{
+		{},
+		{Table: 3, Code: 42},
+		{Table: 1<<32 - 1, Code: 1<<64 - 1},
+	}
+	for _, key := range keys {
+		parsed, err := ParseBucketKey(key.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed != key {
+			t.Errorf("Key %v parsed as %v", key, parsed)
+		}
+	}
+	for _, s := range []string{"", "1", "1_", "_1", "a_1", "4294967296_1"} {
+		if _, err := ParseBucketKey(s); err == nil {
+			t.Errorf("Key %q must not be parsed", s)
+		}
+	}
+}
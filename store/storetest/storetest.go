@@ -0,0 +1,895 @@
+package storetest
+
+import (
+	"errors"
+	"github.com/gasparian/lsh-search-go/store"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+const (
+	nVectors = 60
+	nTables  = 3
+	nCodes   = 5
+)
+
+// Factory creates an empty store; cleanup may be nil
+type Factory func(t *testing.T) (s store.Store, cleanup func())
+
+// Builder creates a read-only store with the contents of the source store, filled by fill
+type Builder func(t *testing.T, fill func(src store.Store) error) (s store.Store, cleanup func())
+
+// extremeKey checks that the whole range of the key fields survives the round trip
+var extremeKey = store.BucketKey{Table: math.MaxUint32, Code: math.MaxUint64}
+
+func vecId(i int) string {
+	return "vec" + strconv.Itoa(i)
+}
+
+func vector(i int) []float64 {
+	return []float64{float64(i), -float64(i), 0.5, float64(i) / 3}
+}
+
+// bucketKeys returns buckets of the i-th vector, one per table
+func bucketKeys(i int) []store.BucketKey {
+	keys := make([]store.BucketKey, 0, nTables+1)
+	for table := 0; table < nTables; table++ {
+		keys = append(keys, store.BucketKey{Table: uint32(table), Code: uint64((i + table) % nCodes)})
+	}
+	if i%10 == 0 {
+		keys = append(keys, extremeKey)
+	}
+	return keys
+}
+
+// Fill writes the reference contents: vectors, norms of the even ones and buckets in several tables
+func Fill(s store.Store) error {
+	ids := make([]string, 0, nVectors)
+	vecs := make([][]float64, 0, nVectors)
+	normIds := make([]string, 0, nVectors/2)
+	norms := make([]float64, 0, nVectors/2)
+	keys := make([]store.BucketKey, 0, nVectors*nTables)
+	keyIds := make([]string, 0, nVectors*nTables)
+	for i := 0; i < nVectors; i++ {
+		ids = append(ids, vecId(i))
+		vecs = append(vecs, vector(i))
+		if i%2 == 0 {
+			normIds = append(normIds, vecId(i))
+			norms = append(norms, float64(i))
+		}
+		for _, key := range bucketKeys(i) {
+			keys = append(keys, key)
+			keyIds = append(keyIds, vecId(i))
+		}
+	}
+	// NOTE: single-item methods are used for the part of the data
+	half := nVectors / 2
+	err := s.SetVectors(ids[:half], vecs[:half])
+	if err != nil {
+		return err
+	}
+	for i := half; i < nVectors; i++ {
+		err = s.SetVector(ids[i], vecs[i])
+		if err != nil {
+			return err
+		}
+	}
+	err = s.SetNorms(normIds[1:], norms[1:])
+	if err != nil {
+		return err
+	}
+	err = s.SetNorm(normIds[0], norms[0])
+	if err != nil {
+		return err
+	}
+	err = s.SetHashes(keys[1:], keyIds[1:])
+	if err != nil {
+		return err
+	}
+	return s.SetHash(keys[0], keyIds[0])
+}
+
+// expectedBuckets returns the reference bucket contents
+func expectedBuckets() map[store.BucketKey][]string {
+	buckets := make(map[store.BucketKey][]string)
+	for i := 0; i < nVectors; i++ {
+		for _, key := range bucketKeys(i) {
+			buckets[key] = append(buckets[key], vecId(i))
+		}
+	}
+	for _, ids := range buckets {
+		sort.Strings(ids)
+	}
+	return buckets
+}
+
+func sortKeys(keys []store.BucketKey) []store.BucketKey {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Table != keys[j].Table {
+			return keys[i].Table < keys[j].Table
+		}
+		return keys[i].Code < keys[j].Code
+	})
+	return keys
+}
+
+func drainIds(it store.Iterator) []string {
+	ids := make([]string, 0)
+	for {
+		id, ok := it.Next()
+		if !ok {
+			break
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// ReadIds exhausts and closes the iterator and returns the sorted ids
+func ReadIds(it store.Iterator) []string {
+	ids := drainIds(it)
+	it.Close()
+	sort.Strings(ids)
+	return ids
+}
+
+// readIds exhausts the iterator and checks that it stays exhausted
+func readIds(t *testing.T, it store.Iterator) []string {
+	ids := drainIds(it)
+	if _, ok := it.Next(); ok {
+		t.Error("Exhausted iterator must not return more ids")
+	}
+	if page := it.NextN(10); page == nil || len(page) != 0 {
+		t.Errorf("Exhausted iterator must return empty page, got %v", page)
+	}
+	err := it.Close()
+	if err != nil {
+		t.Error(err)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// readVectors exhausts the iterator, failing on the repeated ids;
+// it's called from the concurrent readers, so it doesn't stop the test
+func readVectors(t *testing.T, s store.Store) map[string][]float64 {
+	vecs := make(map[string][]float64)
+	it, err := s.GetVectorIterator()
+	if err != nil {
+		t.Error(err)
+		return vecs
+	}
+	for {
+		id, vec, ok := it.Next()
+		if !ok {
+			break
+		}
+		if _, ok := vecs[id]; ok {
+			t.Errorf("Vector %v returned twice", id)
+		}
+		vecs[id] = vec
+	}
+	if _, _, ok := it.Next(); ok {
+		t.Error("Exhausted iterator must not return more vectors")
+	}
+	err = it.Close()
+	if err != nil {
+		t.Error(err)
+	}
+	return vecs
+}
+
+// checkContents verifies that the store holds exactly the data written by Fill
+func checkContents(t *testing.T, s store.Store) {
+	count, err := s.CountVectors()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != nVectors {
+		t.Fatalf("Store must contain %v vectors, got %v", nVectors, count)
+	}
+	ids := make([]string, 0, nVectors)
+	for i := nVectors - 1; i >= 0; i-- {
+		ids = append(ids, vecId(i))
+	}
+	vecs, err := s.GetVectors(ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for j, vec := range vecs {
+		if !reflect.DeepEqual(vec, vector(nVectors-1-j)) {
+			t.Fatalf("Vectors must be returned in the order of ids: %v got %v", ids[j], vec)
+		}
+	}
+	vec, err := s.GetVector(vecId(7))
+	if err != nil || !reflect.DeepEqual(vec, vector(7)) {
+		t.Errorf("Wrong vector returned: %v, %v", vec, err)
+	}
+	_, err = s.GetVector("absent")
+	if err == nil {
+		t.Error("Absent vector must not be returned")
+	}
+	_, err = s.GetVectors([]string{vecId(0), "absent"})
+	if err == nil {
+		t.Error("Multi-get must fail when any vector is absent")
+	}
+	vecs, err = s.GetVectors([]string{})
+	if err != nil || len(vecs) != 0 {
+		t.Errorf("Empty multi-get must return nothing: %v, %v", vecs, err)
+	}
+
+	norms, err := s.GetNorms([]string{vecId(4), vecId(0)})
+	if err != nil || !reflect.DeepEqual(norms, []float64{4, 0}) {
+		t.Errorf("Wrong norms returned: %v, %v", norms, err)
+	}
+	norm, err := s.GetNorm(vecId(2))
+	if err != nil || norm != 2 {
+		t.Errorf("Wrong norm returned: %v, %v", norm, err)
+	}
+	_, err = s.GetNorm(vecId(1))
+	if err == nil {
+		t.Error("Absent norm must not be returned")
+	}
+	_, err = s.GetNorms([]string{vecId(0), vecId(1)})
+	if err == nil {
+		t.Error("Multi-get must fail when any norm is absent")
+	}
+
+	scanned := readVectors(t, s)
+	if len(scanned) != nVectors {
+		t.Errorf("Iterator must return %v vectors, got %v", nVectors, len(scanned))
+	}
+	for id, vec := range scanned {
+		idx, _ := strconv.Atoi(id[len("vec"):])
+		if !reflect.DeepEqual(vec, vector(idx)) {
+			t.Fatalf("Iterator returned wrong vector for %v: %v", id, vec)
+		}
+	}
+
+	expected := expectedBuckets()
+	expectedKeys := make([]store.BucketKey, 0, len(expected))
+	for key, ids := range expected {
+		expectedKeys = append(expectedKeys, key)
+		it, err := s.GetHashIterator(key)
+		if err != nil {
+			t.Fatalf("Bucket %v must exist: %v", key, err)
+		}
+		if bucket := readIds(t, it); !reflect.DeepEqual(bucket, ids) {
+			t.Fatalf("Wrong contents of bucket %v: %v", key, bucket)
+		}
+	}
+	_, err = s.GetHashIterator(store.BucketKey{Table: nTables, Code: 0})
+	if err == nil {
+		t.Error("Absent bucket must not be returned")
+	}
+	keys, err := s.ListBuckets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(sortKeys(keys), sortKeys(expectedKeys)) {
+		t.Errorf("Wrong buckets list: %v", keys)
+	}
+	keys, err = s.ListTableBuckets(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != nCodes {
+		t.Errorf("Table must contain %v buckets, got %v", nCodes, keys)
+	}
+	for _, key := range keys {
+		if key.Table != 1 {
+			t.Errorf("Bucket of the other table returned: %v", key)
+		}
+	}
+	keys, err = s.ListTableBuckets(nTables)
+	if err != nil || len(keys) != 0 {
+		t.Errorf("Absent table must have no buckets: %v, %v", keys, err)
+	}
+
+	it, _ := s.GetHashIterator(store.BucketKey{Table: 0, Code: 0})
+	read := make([]string, 0)
+	for page := it.NextN(5); len(page) > 0; page = it.NextN(5) {
+		if len(page) > 5 {
+			t.Fatalf("NextN returned more than asked: %v", page)
+		}
+		read = append(read, page...)
+	}
+	it.Close()
+	sort.Strings(read)
+	if !reflect.DeepEqual(read, expected[store.BucketKey{Table: 0, Code: 0}]) {
+		t.Errorf("NextN must return all the bucket ids, got %v", read)
+	}
+}
+
+// RunConformance checks that the store follows the store.Store contract.
+// Every subtest gets a fresh store from the factory; run the suite with -race
+// to check the concurrent access as well
+func RunConformance(t *testing.T, factory Factory) {
+	run := func(name string, test func(t *testing.T, s store.Store)) {
+		t.Run(name, func(t *testing.T) {
+			s, cleanup := factory(t)
+			if cleanup != nil {
+				defer cleanup()
+			}
+			test(t, s)
+		})
+	}
+
+	run("Contents", func(t *testing.T, s store.Store) {
+		err := Fill(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkContents(t, s)
+	})
+
+	run("Empty", func(t *testing.T, s store.Store) {
+		count, err := s.CountVectors()
+		if err != nil || count != 0 {
+			t.Errorf("Empty store must have no vectors: %v, %v", count, err)
+		}
+		if vecs := readVectors(t, s); len(vecs) != 0 {
+			t.Errorf("Empty store iterator must return nothing, got %v", vecs)
+		}
+		keys, err := s.ListBuckets()
+		if err != nil || len(keys) != 0 {
+			t.Errorf("Empty store must have no buckets: %v, %v", keys, err)
+		}
+		_, err = s.GetHashIterator(store.BucketKey{})
+		if !errors.Is(err, store.BucketNotFoundErr) {
+			t.Errorf("Absent bucket must be reported with store.BucketNotFoundErr, got %v", err)
+		}
+		_, err = s.GetVector(vecId(0))
+		if !errors.Is(err, store.KeyNotFoundErr) {
+			t.Errorf("Absent vector must be reported with store.KeyNotFoundErr, got %v", err)
+		}
+		err = s.RemoveHash(store.BucketKey{}, vecId(0))
+		if err == nil {
+			t.Error("Absent bucket must not be modified")
+		}
+		err = s.DeleteVector(vecId(0))
+		if err == nil {
+			t.Error("Absent vector must not be deleted")
+		}
+	})
+
+	run("LengthMismatch", func(t *testing.T, s store.Store) {
+		if s.SetVectors([]string{vecId(0)}, [][]float64{}) == nil {
+			t.Error("SetVectors must check slices length")
+		}
+		if s.SetNorms([]string{}, []float64{1}) == nil {
+			t.Error("SetNorms must check slices length")
+		}
+		if s.SetHashes([]store.BucketKey{{}}, []string{}) == nil {
+			t.Error("SetHashes must check slices length")
+		}
+	})
+
+	run("Overwrite", func(t *testing.T, s store.Store) {
+		err := Fill(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.SetVectors([]string{vecId(3), vecId(3)}, [][]float64{vector(100), vector(101)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		vec, _ := s.GetVector(vecId(3))
+		if !reflect.DeepEqual(vec, vector(101)) {
+			t.Errorf("The last written vector must win, got %v", vec)
+		}
+		err = s.SetNorm(vecId(3), 42)
+		if err != nil {
+			t.Fatal(err)
+		}
+		norm, _ := s.GetNorm(vecId(3))
+		if norm != 42 {
+			t.Errorf("Norm must be overwritten, got %v", norm)
+		}
+		count, _ := s.CountVectors()
+		if count != nVectors {
+			t.Errorf("Overwrite must not change the vectors count, got %v", count)
+		}
+	})
+
+	run("DuplicateHashes", func(t *testing.T, s store.Store) {
+		err := Fill(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := expectedBuckets()[extremeKey]
+		err = s.SetHashes([]store.BucketKey{extremeKey, extremeKey}, []string{expected[0], expected[0]})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.SetHash(extremeKey, expected[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		it, _ := s.GetHashIterator(extremeKey)
+		if ids := readIds(t, it); !reflect.DeepEqual(ids, expected) {
+			t.Errorf("Bucket must hold every vector id once, got %v", ids)
+		}
+	})
+
+	run("Delete", func(t *testing.T, s store.Store) {
+		err := Fill(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.DeleteVector(vecId(0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = s.GetVector(vecId(0)); err == nil {
+			t.Error("Deleted vector must not be returned")
+		}
+		if _, err = s.GetNorm(vecId(0)); err == nil {
+			t.Error("Norm must be deleted along with the vector")
+		}
+		if err = s.DeleteVector(vecId(0)); err == nil {
+			t.Error("Vector must not be deleted twice")
+		}
+		count, _ := s.CountVectors()
+		if count != nVectors-1 {
+			t.Errorf("Store must contain %v vectors, got %v", nVectors-1, count)
+		}
+		if _, ok := readVectors(t, s)[vecId(0)]; ok {
+			t.Error("Iterator must skip deleted vector")
+		}
+		// NOTE: bucket entries are left for the caller to remove
+		it, err := s.GetHashIterator(extremeKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ids := readIds(t, it); len(ids) != nVectors/10 {
+			t.Errorf("Bucket entries must not be removed along with the vector, got %v", ids)
+		}
+	})
+
+	run("RemoveHash", func(t *testing.T, s store.Store) {
+		err := Fill(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := expectedBuckets()[extremeKey]
+		err = s.RemoveHash(extremeKey, "absent")
+		if err != nil {
+			t.Errorf("Removing absent id from the existing bucket must succeed: %v", err)
+		}
+		err = s.RemoveHash(extremeKey, expected[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		it, _ := s.GetHashIterator(extremeKey)
+		if ids := readIds(t, it); !reflect.DeepEqual(ids, expected[1:]) {
+			t.Errorf("Wrong bucket contents after removal: %v", ids)
+		}
+		for _, id := range expected[1:] {
+			err = s.RemoveHash(extremeKey, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err = s.GetHashIterator(extremeKey); err == nil {
+			t.Error("Empty bucket must not be returned")
+		}
+		keys, _ := s.ListBuckets()
+		for _, key := range keys {
+			if key == extremeKey {
+				t.Error("Empty bucket must not be listed")
+			}
+		}
+		keys, _ = s.ListTableBuckets(extremeKey.Table)
+		if len(keys) != 0 {
+			t.Errorf("Empty bucket must not be listed in its table, got %v", keys)
+		}
+		if _, err = s.GetVector(expected[0]); err != nil {
+			t.Error("Vector must not be removed along with the bucket entry")
+		}
+	})
+
+	run("DropTable", func(t *testing.T, s store.Store) {
+		dropper, ok := s.(store.TableDropper)
+		if !ok {
+			t.Skip("Store doesn't implement the store.TableDropper")
+		}
+		err := Fill(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = dropper.DropTable(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = dropper.DropTable(nTables); err != nil {
+			t.Errorf("Dropping absent table must succeed: %v", err)
+		}
+		keys, err := s.ListTableBuckets(1)
+		if err != nil || len(keys) != 0 {
+			t.Errorf("Dropped table must have no buckets: %v, %v", keys, err)
+		}
+		if _, err = s.GetHashIterator(store.BucketKey{Table: 1, Code: 0}); err == nil {
+			t.Error("Bucket of the dropped table must not be returned")
+		}
+		keys, _ = s.ListBuckets()
+		if len(keys) != (nTables-1)*nCodes+1 {
+			t.Errorf("Buckets of the other tables must be kept, got %v", keys)
+		}
+		count, _ := s.CountVectors()
+		if count != nVectors {
+			t.Errorf("Vectors must not be removed along with the table, got %v", count)
+		}
+		err = s.SetHash(store.BucketKey{Table: 1, Code: 0}, vecId(0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		it, err := s.GetHashIterator(store.BucketKey{Table: 1, Code: 0})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ids := readIds(t, it); !reflect.DeepEqual(ids, []string{vecId(0)}) {
+			t.Errorf("Dropped table must be writable again, got %v", ids)
+		}
+	})
+
+	run("Iterators", func(t *testing.T, s store.Store) {
+		err := Fill(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		it, _ := s.GetHashIterator(store.BucketKey{Table: 0, Code: 0})
+		if _, ok := it.Next(); !ok {
+			t.Error("Bucket iterator must return ids")
+		}
+		err = it.Close()
+		if err != nil {
+			t.Error(err)
+		}
+		if _, ok := it.Next(); ok {
+			t.Error("Closed iterator must not return ids")
+		}
+		vit, _ := s.GetVectorIterator()
+		if _, _, ok := vit.Next(); !ok {
+			t.Error("Vector iterator must return vectors")
+		}
+		err = vit.Close()
+		if err != nil {
+			t.Error(err)
+		}
+		if _, _, ok := vit.Next(); ok {
+			t.Error("Closed iterator must not return vectors")
+		}
+	})
+
+	run("Clear", func(t *testing.T, s store.Store) {
+		err := Fill(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.Clear()
+		if err != nil {
+			t.Fatal(err)
+		}
+		count, _ := s.CountVectors()
+		if count != 0 {
+			t.Errorf("Cleared store must have no vectors, got %v", count)
+		}
+		if _, err = s.GetVector(vecId(0)); err == nil {
+			t.Error("Cleared store must have no vectors")
+		}
+		if _, err = s.GetNorm(vecId(0)); err == nil {
+			t.Error("Cleared store must have no norms")
+		}
+		if vecs := readVectors(t, s); len(vecs) != 0 {
+			t.Errorf("Cleared store iterator must return nothing, got %v", len(vecs))
+		}
+		if keys, _ := s.ListBuckets(); len(keys) != 0 {
+			t.Errorf("Cleared store must have no buckets, got %v", keys)
+		}
+		if _, err = s.GetHashIterator(extremeKey); err == nil {
+			t.Error("Cleared store must have no buckets")
+		}
+		// NOTE: store must stay usable
+		err = Fill(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkContents(t, s)
+	})
+
+	run("Concurrent", func(t *testing.T, s store.Store) {
+		const nWriters = 4
+		var wg sync.WaitGroup
+		errs := make(chan error, 2*nWriters)
+		for w := 0; w < nWriters; w++ {
+			wg.Add(2)
+			// NOTE: every writer owns its own range of ids
+			go func(w int) {
+				defer wg.Done()
+				for i := w; i < nVectors; i += nWriters {
+					id := vecId(i)
+					err := s.SetVectors([]string{id}, [][]float64{vector(i)})
+					if err == nil {
+						err = s.SetNorms([]string{id}, []float64{float64(i)})
+					}
+					if err == nil {
+						keys := bucketKeys(i)
+						ids := make([]string, len(keys))
+						for j := range ids {
+							ids[j] = id
+						}
+						err = s.SetHashes(keys, ids)
+					}
+					if err != nil {
+						errs <- err
+						return
+					}
+				}
+				errs <- nil
+			}(w)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < nVectors/nWriters; i++ {
+					if _, err := s.CountVectors(); err != nil {
+						errs <- err
+						return
+					}
+					readVectors(t, s)
+					if it, err := s.GetHashIterator(store.BucketKey{Table: 0, Code: uint64(i % nCodes)}); err == nil {
+						readIds(t, it)
+					}
+					if _, err := s.ListBuckets(); err != nil {
+						errs <- err
+						return
+					}
+				}
+				errs <- nil
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		count, _ := s.CountVectors()
+		if count != nVectors {
+			t.Errorf("Store must contain %v vectors, got %v", nVectors, count)
+		}
+		for key, ids := range expectedBuckets() {
+			it, err := s.GetHashIterator(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bucket := readIds(t, it); !reflect.DeepEqual(bucket, ids) {
+				t.Errorf("Wrong contents of bucket %v: %v", key, bucket)
+			}
+		}
+	})
+}
+
+// RunReadOnlyConformance checks the read path of the store built from the reference contents
+// and that all the write methods fail
+func RunReadOnlyConformance(t *testing.T, build Builder) {
+	s, cleanup := build(t, Fill)
+	if cleanup != nil {
+		defer cleanup()
+	}
+
+	t.Run("Contents", func(t *testing.T) {
+		checkContents(t, s)
+	})
+
+	t.Run("Writes", func(t *testing.T) {
+		key := store.BucketKey{Table: 0, Code: 0}
+		errs := []error{
+			s.SetVector(vecId(0), vector(1)),
+			s.SetVectors([]string{vecId(0)}, [][]float64{vector(1)}),
+			s.DeleteVector(vecId(0)),
+			s.SetNorm(vecId(0), 1),
+			s.SetNorms([]string{vecId(0)}, []float64{1}),
+			s.SetHash(key, vecId(1)),
+			s.SetHashes([]store.BucketKey{key}, []string{vecId(1)}),
+			s.RemoveHash(key, vecId(0)),
+			s.Clear(),
+		}
+		for i, err := range errs {
+			if err == nil {
+				t.Errorf("Write method #%v must fail on the read-only store", i)
+			}
+		}
+		checkContents(t, s)
+	})
+}
+
+func checkEmpty(t *testing.T, s store.Store) {
+	count, err := s.CountVectors()
+	if err != nil || count != 0 {
+		t.Errorf("Store must have no vectors: %v, %v", count, err)
+	}
+	keys, err := s.ListBuckets()
+	if err != nil || len(keys) != 0 {
+		t.Errorf("Store must have no buckets: %v, %v", keys, err)
+	}
+}
+
+// RunNamespaceConformance checks that the store implements the store.Namespacer
+// and keeps collections isolated from each other and from the store itself
+func RunNamespaceConformance(t *testing.T, factory Factory) {
+	s, cleanup := factory(t)
+	if cleanup != nil {
+		defer cleanup()
+	}
+	namespacer, ok := s.(store.Namespacer)
+	if !ok {
+		t.Fatal("Store must implement the store.Namespacer")
+	}
+	open := func(t *testing.T, name string) store.Store {
+		ns, err := namespacer.Namespace(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ns
+	}
+
+	t.Run("Isolation", func(t *testing.T) {
+		a := open(t, "a")
+		b := open(t, "b_2")
+		err := Fill(a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkContents(t, a)
+		checkEmpty(t, b)
+		checkEmpty(t, s)
+		err = Fill(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.Clear()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = b.Clear()
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkContents(t, a)
+		checkContents(t, open(t, "a"))
+	})
+
+	t.Run("List", func(t *testing.T) {
+		names, err := namespacer.ListNamespaces()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(names, []string{"a", "b_2"}) {
+			t.Errorf("Wrong namespaces: %v", names)
+		}
+		for _, name := range []string{"", "A", "a-b", "a:b", "a/b", string(make([]byte, 65))} {
+			if _, err := namespacer.Namespace(name); err == nil {
+				t.Errorf("Namespace %q must not be opened", name)
+			}
+		}
+	})
+
+	t.Run("Drop", func(t *testing.T) {
+		err := namespacer.DropNamespace("a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = namespacer.DropNamespace("a"); err == nil {
+			t.Error("Namespace must not be dropped twice")
+		}
+		names, err := namespacer.ListNamespaces()
+		if err != nil || !reflect.DeepEqual(names, []string{"b_2"}) {
+			t.Errorf("Dropped namespace must not be listed: %v, %v", names, err)
+		}
+		checkEmpty(t, open(t, "a"))
+	})
+}
+
+// RunPayloadConformance checks that the store implements the store.PayloadStore
+// and keeps payloads along with vectors
+func RunPayloadConformance(t *testing.T, factory Factory) {
+	run := func(name string, test func(t *testing.T, s store.Store, ps store.PayloadStore)) {
+		t.Run(name, func(t *testing.T) {
+			s, cleanup := factory(t)
+			if cleanup != nil {
+				defer cleanup()
+			}
+			ps, ok := s.(store.PayloadStore)
+			if !ok {
+				t.Fatal("Store must implement the store.PayloadStore")
+			}
+			err := Fill(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			test(t, s, ps)
+		})
+	}
+	payload := func(i int) []byte {
+		return []byte(`{"title":"` + vecId(i) + `"}`)
+	}
+
+	run("RoundTrip", func(t *testing.T, s store.Store, ps store.PayloadStore) {
+		ids := make([]string, nVectors)
+		payloads := make([][]byte, nVectors)
+		for i := range ids {
+			ids[i] = vecId(i)
+			payloads[i] = payload(i)
+		}
+		err := ps.SetPayloads(ids, payloads)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ps.SetPayloads([]string{vecId(1), vecId(1)}, [][]byte{[]byte("old"), []byte("new")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		payloads[1] = []byte("new")
+		read, err := ps.GetPayloads(append(ids, "absent"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(read[:nVectors], payloads) {
+			t.Errorf("Payloads are not equal: %q", read)
+		}
+		if read[nVectors] != nil {
+			t.Errorf("Absent payload must be nil, got %q", read[nVectors])
+		}
+		if err = ps.SetPayloads(ids[:2], payloads[:1]); err == nil {
+			t.Error("Payloads with mismatched lengths must not be set")
+		}
+		// NOTE: payloads don't touch the vectors
+		checkContents(t, s)
+	})
+
+	run("Empty", func(t *testing.T, s store.Store, ps store.PayloadStore) {
+		ids := []string{vecId(0), vecId(1), vecId(2)}
+		err := ps.SetPayloads(ids, [][]byte{payload(0), nil, {}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		read, err := ps.GetPayloads(ids)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(read[0], payload(0)) || read[1] != nil || read[2] != nil {
+			t.Errorf("Nil and empty payloads must be read as nil: %q", read)
+		}
+	})
+
+	run("Delete", func(t *testing.T, s store.Store, ps store.PayloadStore) {
+		err := ps.SetPayloads([]string{vecId(0), vecId(1)}, [][]byte{payload(0), payload(1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.DeleteVector(vecId(0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		read, err := ps.GetPayloads([]string{vecId(0), vecId(1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if read[0] != nil || !reflect.DeepEqual(read[1], payload(1)) {
+			t.Errorf("Payload must be deleted along with vector only: %q", read)
+		}
+		err = s.Clear()
+		if err != nil {
+			t.Fatal(err)
+		}
+		read, err = ps.GetPayloads([]string{vecId(1)})
+		if err != nil || read[0] != nil {
+			t.Errorf("Payloads must be cleared: %q, %v", read, err)
+		}
+	})
+}
@@ -0,0 +1,305 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/gasparian/lsh-search-go/store"
+	"hash/crc32"
+	"io"
+	"math"
+)
+
+var (
+	corruptedRecordErr = errors.New("Log record is corrupted")
+)
+
+// Record types of the log; every record holds the whole mutation call,
+// so the batch is replayed entirely or not at all
+const (
+	setVectorsRecord byte = iota + 1
+	deleteVectorRecord
+	setNormsRecord
+	setPayloadsRecord
+	setHashesRecord
+	removeHashRecord
+	clearRecord
+	snapshotRecord // NOTE: the first record of the snapshot file, holds the first segment to replay over it
+	failedRecord   // NOTE: follows the mutation the wrapped store has failed, so replay expects it to fail again
+)
+
+// NOTE: record is crc32 (4 bytes) + payload length (4 bytes) + type (1 byte) + payload;
+// checksum covers the type and the payload
+const headerSize = 9
+
+// NOTE: protects from the huge allocations, when the length field itself is corrupted
+const maxPayloadSize = 1 << 30
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// record is a single mutation of the store; slices have the same length,
+// single-item mutations are kept as batches of one
+type record struct {
+	kind     byte
+	ids      []string
+	vecs     [][]float64
+	norms    []float64
+	payloads [][]byte
+	keys     []store.BucketKey
+	segment  uint64
+}
+
+func appendUvarint(buf []byte, x uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], x)
+	return append(buf, tmp[:n]...)
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = appendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+func appendFloat(buf []byte, f float64) []byte {
+	var tmp [8]byte
+	binary.LittleEndian.PutUint64(tmp[:], math.Float64bits(f))
+	return append(buf, tmp[:]...)
+}
+
+// encode appends the record with header to the end of buf
+func (rec *record) encode(buf []byte) []byte {
+	start := len(buf)
+	buf = append(buf, make([]byte, headerSize)...)
+	buf[start+8] = rec.kind
+	switch rec.kind {
+	case setVectorsRecord:
+		buf = appendUvarint(buf, uint64(len(rec.ids)))
+		for i, id := range rec.ids {
+			buf = appendString(buf, id)
+			buf = appendUvarint(buf, uint64(len(rec.vecs[i])))
+			for _, v := range rec.vecs[i] {
+				buf = appendFloat(buf, v)
+			}
+		}
+	case deleteVectorRecord:
+		buf = appendString(buf, rec.ids[0])
+	case setNormsRecord:
+		buf = appendUvarint(buf, uint64(len(rec.ids)))
+		for i, id := range rec.ids {
+			buf = appendString(buf, id)
+			buf = appendFloat(buf, rec.norms[i])
+		}
+	case setPayloadsRecord:
+		buf = appendUvarint(buf, uint64(len(rec.ids)))
+		for i, id := range rec.ids {
+			buf = appendString(buf, id)
+			// NOTE: zero length marks the nil payload
+			if rec.payloads[i] == nil {
+				buf = appendUvarint(buf, 0)
+				continue
+			}
+			buf = appendUvarint(buf, uint64(len(rec.payloads[i]))+1)
+			buf = append(buf, rec.payloads[i]...)
+		}
+	case setHashesRecord, removeHashRecord:
+		buf = appendUvarint(buf, uint64(len(rec.ids)))
+		for i, id := range rec.ids {
+			buf = appendUvarint(buf, uint64(rec.keys[i].Table))
+			buf = appendUvarint(buf, rec.keys[i].Code)
+			buf = appendString(buf, id)
+		}
+	case snapshotRecord:
+		buf = appendUvarint(buf, rec.segment)
+	}
+	binary.LittleEndian.PutUint32(buf[start+4:], uint32(len(buf)-start-headerSize))
+	binary.LittleEndian.PutUint32(buf[start:], crc32.Checksum(buf[start+8:], crcTable))
+	return buf
+}
+
+// payloadReader decodes payload fields, remembering the first error
+type payloadReader struct {
+	data []byte
+	err  error
+}
+
+func (r *payloadReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	x, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.err = corruptedRecordErr
+		return 0
+	}
+	r.data = r.data[n:]
+	return x
+}
+
+// count reads the number of the batch items; every item takes at least a byte,
+// so the larger count can only be read from the corrupted record
+func (r *payloadReader) count() int {
+	n := r.uvarint()
+	if r.err == nil && n > uint64(len(r.data)) {
+		r.err = corruptedRecordErr
+	}
+	if r.err != nil {
+		return 0
+	}
+	return int(n)
+}
+
+func (r *payloadReader) bytes(n uint64) []byte {
+	if r.err != nil || uint64(len(r.data)) < n {
+		r.err = corruptedRecordErr
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *payloadReader) string() string {
+	return string(r.bytes(r.uvarint()))
+}
+
+func (r *payloadReader) float() float64 {
+	b := r.bytes(8)
+	if r.err != nil {
+		return 0
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(b))
+}
+
+func (r *payloadReader) key() store.BucketKey {
+	table := r.uvarint()
+	if table > math.MaxUint32 {
+		r.err = corruptedRecordErr
+	}
+	return store.BucketKey{Table: uint32(table), Code: r.uvarint()}
+}
+
+// decodeRecord parses the whole record, starting with header
+func decodeRecord(data []byte) (*record, error) {
+	if len(data) < headerSize {
+		return nil, corruptedRecordErr
+	}
+	length := binary.LittleEndian.Uint32(data[4:])
+	if uint64(len(data)) != uint64(headerSize)+uint64(length) {
+		return nil, corruptedRecordErr
+	}
+	if binary.LittleEndian.Uint32(data) != crc32.Checksum(data[8:], crcTable) {
+		return nil, corruptedRecordErr
+	}
+	rec := &record{kind: data[8]}
+	r := &payloadReader{data: data[headerSize:]}
+	switch rec.kind {
+	case setVectorsRecord:
+		n := r.count()
+		rec.ids = make([]string, n)
+		rec.vecs = make([][]float64, n)
+		for i := 0; i < n && r.err == nil; i++ {
+			rec.ids[i] = r.string()
+			dims := r.uvarint()
+			if r.err == nil && dims > uint64(len(r.data))/8 {
+				return nil, corruptedRecordErr
+			}
+			rec.vecs[i] = make([]float64, dims)
+			for j := range rec.vecs[i] {
+				rec.vecs[i][j] = r.float()
+			}
+		}
+	case deleteVectorRecord:
+		rec.ids = []string{r.string()}
+	case setNormsRecord:
+		n := r.count()
+		rec.ids = make([]string, n)
+		rec.norms = make([]float64, n)
+		for i := 0; i < n && r.err == nil; i++ {
+			rec.ids[i] = r.string()
+			rec.norms[i] = r.float()
+		}
+	case setPayloadsRecord:
+		n := r.count()
+		rec.ids = make([]string, n)
+		rec.payloads = make([][]byte, n)
+		for i := 0; i < n && r.err == nil; i++ {
+			rec.ids[i] = r.string()
+			size := r.uvarint()
+			if size > 0 {
+				rec.payloads[i] = append([]byte{}, r.bytes(size-1)...)
+			}
+		}
+	case setHashesRecord, removeHashRecord:
+		n := r.count()
+		rec.ids = make([]string, n)
+		rec.keys = make([]store.BucketKey, n)
+		for i := 0; i < n && r.err == nil; i++ {
+			rec.keys[i] = r.key()
+			rec.ids[i] = r.string()
+		}
+	case clearRecord, failedRecord:
+	case snapshotRecord:
+		rec.segment = r.uvarint()
+	default:
+		return nil, corruptedRecordErr
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if len(r.data) > 0 {
+		return nil, corruptedRecordErr
+	}
+	return rec, nil
+}
+
+// readRecord reads the next record and returns it along with its size; io.EOF means the clean end of the log,
+// any other error - the torn or corrupted tail
+func readRecord(r io.Reader) (*record, int64, error) {
+	header := make([]byte, headerSize)
+	n, err := io.ReadFull(r, header)
+	if err == io.EOF {
+		return nil, 0, io.EOF
+	}
+	if err != nil || n < headerSize {
+		return nil, 0, corruptedRecordErr
+	}
+	length := binary.LittleEndian.Uint32(header[4:])
+	if length > maxPayloadSize {
+		return nil, 0, corruptedRecordErr
+	}
+	data := make([]byte, headerSize+int(length))
+	copy(data, header)
+	_, err = io.ReadFull(r, data[headerSize:])
+	if err != nil {
+		return nil, 0, corruptedRecordErr
+	}
+	rec, err := decodeRecord(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	return rec, int64(len(data)), nil
+}
+
+// apply makes the mutation of the record in the store
+func apply(s store.Store, rec *record) error {
+	switch rec.kind {
+	case setVectorsRecord:
+		return s.SetVectors(rec.ids, rec.vecs)
+	case deleteVectorRecord:
+		return s.DeleteVector(rec.ids[0])
+	case setNormsRecord:
+		return s.SetNorms(rec.ids, rec.norms)
+	case setPayloadsRecord:
+		payloadStore, ok := s.(store.PayloadStore)
+		if !ok {
+			return payloadsUnsupportedErr
+		}
+		return payloadStore.SetPayloads(rec.ids, rec.payloads)
+	case setHashesRecord:
+		return s.SetHashes(rec.keys, rec.ids)
+	case removeHashRecord:
+		return s.RemoveHash(rec.keys[0], rec.ids[0])
+	case clearRecord:
+		return s.Clear()
+	}
+	return nil
+}
@@ -0,0 +1,765 @@
+package wal
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/gasparian/lsh-search-go/store"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	lengthMismatchErr        = errors.New("Batch slices must have the same length")
+	storeClosedErr           = errors.New("Store is closed")
+	emptyDirErr              = errors.New("Store directory must be set")
+	brokenSegmentErr         = errors.New("WAL segment is corrupted before its end")
+	brokenSnapshotErr        = errors.New("WAL snapshot is corrupted")
+	namespaceNotFoundErr     = errors.New("Namespace not found")
+	namespacesUnsupportedErr = errors.New("Wrapped store doesn't support namespaces")
+	payloadsUnsupportedErr   = errors.New("Wrapped store doesn't support payloads")
+)
+
+const (
+	segmentExt          = ".wal"
+	snapshotFileName    = "snapshot"
+	snapshotTmpFileName = "snapshot.tmp"
+	namespacesDir       = "namespaces" // NOTE: every collection has its own log in the subdirectory
+	snapshotBatchSize   = 1024
+)
+
+// SyncPolicy defines when the log is flushed to the stable storage
+type SyncPolicy int
+
+const (
+	// SyncInterval fsyncs the log in background every Config.Interval;
+	// mutations made after the last sync could be lost on the crash
+	SyncInterval SyncPolicy = iota
+	// SyncAlways fsyncs the log before every mutation is applied
+	SyncAlways
+	// SyncNever leaves flushing to the OS
+	SyncNever
+)
+
+// Config holds the log parameters; zero values are replaced with defaults
+type Config struct {
+	Dir         string
+	Sync        SyncPolicy
+	Interval    time.Duration // NOTE: period of background sync and snapshot checks
+	SegmentSize int64         // NOTE: segment is rotated once it grows over this size, 64MB by default
+	// SnapshotSegments is the number of segments written since the last snapshot, which triggers the new one,
+	// 4 by default; negative value disables background snapshots
+	SnapshotSegments int
+}
+
+func (c *Config) setDefaults() {
+	if c.Interval <= 0 {
+		c.Interval = time.Second
+	}
+	if c.SegmentSize <= 0 {
+		c.SegmentSize = 64 << 20
+	}
+	if c.SnapshotSegments == 0 {
+		c.SnapshotSegments = 4
+	}
+}
+
+func segmentName(n uint64) string {
+	return fmt.Sprintf("%020d", n) + segmentExt
+}
+
+// listSegments returns sorted numbers of the segments found in the directory
+func listSegments(dir string) ([]uint64, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	segments := make([]uint64, 0, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		n, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, n)
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+// WALStore wraps any store, usually the in-memory one, with the write-ahead log, so it survives restarts.
+// Every mutation is appended to the current log segment before it's applied to the wrapped store,
+// and the log is replayed on the start on top of the last snapshot. Segments are rotated by size,
+// and the snapshot of the wrapped store contents makes the segments written before it unnecessary,
+// so they are removed. Reads go straight to the wrapped store.
+// Mutations the wrapped store has failed stay in the log, marked as failed, and are applied again on replay,
+// so the restored store matches the partially applied batches as well.
+// NOTE: only norms and payloads of the stored vectors get into the snapshot
+type WALStore struct {
+	mx         sync.Mutex // NOTE: serializes mutations, so they are applied in the log order
+	snapshotMx sync.Mutex
+	inner      store.Store
+	config     Config
+	file       *os.File
+	segment    uint64 // NOTE: number of the current segment
+	size       int64  // NOTE: size of the current segment
+	first      uint64 // NOTE: the first segment, which isn't covered by the snapshot
+	dirty      bool
+	rotateErr  error // NOTE: error of the last rotation, until it succeeds
+	closed     bool
+	done       chan struct{}
+	wg         sync.WaitGroup
+	// NOTE: opened collections are closed along with the store
+	namespaces store.Namespaces
+}
+
+// NewWALStore restores the wrapped store contents from the snapshot and the log in the config directory,
+// creating it if needed; the wrapped store is cleared first. Store must be closed after use
+func NewWALStore(inner store.Store, config Config) (*WALStore, error) {
+	if config.Dir == "" {
+		return nil, emptyDirErr
+	}
+	config.setDefaults()
+	err := os.MkdirAll(config.Dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	// NOTE: unfinished snapshot leaves the temporary file, the previous snapshot is still valid
+	err = os.Remove(filepath.Join(config.Dir, snapshotTmpFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	s := &WALStore{
+		inner:  inner,
+		config: config,
+		done:   make(chan struct{}),
+	}
+	err = s.recover()
+	if err != nil {
+		return nil, err
+	}
+	s.wg.Add(1)
+	go s.run()
+	return s, nil
+}
+
+// recover loads the snapshot, replays the segments written after it and opens the last one for writing
+func (s *WALStore) recover() error {
+	err := s.inner.Clear()
+	if err != nil {
+		return err
+	}
+	first, err := s.loadSnapshot()
+	if err != nil {
+		return err
+	}
+	segments, err := listSegments(s.config.Dir)
+	if err != nil {
+		return err
+	}
+	live := make([]uint64, 0, len(segments))
+	for _, n := range segments {
+		if n >= first {
+			live = append(live, n)
+			continue
+		}
+		// NOTE: segments covered by the snapshot are left by the interrupted truncation
+		err = os.Remove(filepath.Join(s.config.Dir, segmentName(n)))
+		if err != nil {
+			return err
+		}
+	}
+	s.first, s.segment = first, first
+	for i, n := range live {
+		s.segment = n
+		s.size, err = s.replay(n, i == len(live)-1)
+		if err != nil {
+			return err
+		}
+	}
+	s.file, err = os.OpenFile(filepath.Join(s.config.Dir, segmentName(s.segment)), os.O_RDWR|os.O_CREATE, 0644)
+	return err
+}
+
+// loadSnapshot applies the snapshot to the wrapped store and returns the first segment to replay over it
+func (s *WALStore) loadSnapshot() (uint64, error) {
+	file, err := os.Open(filepath.Join(s.config.Dir, snapshotFileName))
+	if os.IsNotExist(err) {
+		return 1, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	r := bufio.NewReader(file)
+	header, _, err := readRecord(r)
+	if err != nil || header.kind != snapshotRecord {
+		return 0, brokenSnapshotErr
+	}
+	for {
+		rec, _, err := readRecord(r)
+		if err == io.EOF {
+			return header.segment, nil
+		}
+		if err != nil {
+			// NOTE: snapshot is renamed into place only when it's completely written
+			return 0, brokenSnapshotErr
+		}
+		err = apply(s.inner, rec)
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// replay applies the records of the segment and returns its size; the torn tail of the last segment
+// left by a crash is truncated, while the broken record in the middle of the log fails the replay.
+// Errors of the records marked as failed are ignored, as well as the not found errors:
+// the snapshot could already hold the result of the mutations written after its start, so the removed data
+// could be absent, while the rest of the mutations overwrite data, and buckets don't keep duplicates.
+// NOTE: the failed mutation could be the last record, if the crash has happened before the mark is written
+func (s *WALStore) replay(segment uint64, last bool) (int64, error) {
+	file, err := os.OpenFile(filepath.Join(s.config.Dir, segmentName(segment)), os.O_RDWR, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	r := bufio.NewReader(file)
+	var size int64
+	var applyErr error // NOTE: error of the previous record, which is returned unless the record is marked
+	for {
+		rec, n, err := readRecord(r)
+		if err == io.EOF {
+			if !last && applyErr != nil {
+				return 0, applyErr
+			}
+			return size, nil
+		}
+		if err != nil {
+			if !last {
+				return 0, brokenSegmentErr
+			}
+			// NOTE: records after the first broken one can't be trusted
+			return size, file.Truncate(size)
+		}
+		size += n
+		if rec.kind == failedRecord {
+			applyErr = nil
+			continue
+		}
+		if applyErr != nil {
+			return 0, applyErr
+		}
+		err = apply(s.inner, rec)
+		if err != nil && !errors.Is(err, store.KeyNotFoundErr) && !errors.Is(err, store.BucketNotFoundErr) {
+			applyErr = err
+		}
+	}
+}
+
+// write appends the record to the current segment and then applies it to the wrapped store.
+// The record is kept even if the wrapped store fails to apply it, since the batch could be applied partially:
+// it's marked as failed, and replay applies it again, so the restored store matches the one the failure has left.
+// If the mark can't be written, the record is removed, so the failure doesn't break the replay
+func (s *WALStore) write(rec *record) error {
+	buf := rec.encode(nil)
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.closed {
+		return storeClosedErr
+	}
+	_, err := s.file.WriteAt(buf, s.size)
+	if err != nil {
+		s.file.Truncate(s.size)
+		return err
+	}
+	if s.config.Sync == SyncAlways {
+		err = s.file.Sync()
+		if err != nil {
+			s.file.Truncate(s.size)
+			return err
+		}
+	} else {
+		s.dirty = true
+	}
+	s.size += int64(len(buf))
+	err = apply(s.inner, rec)
+	if err != nil {
+		mark := (&record{kind: failedRecord}).encode(nil)
+		_, markErr := s.file.WriteAt(mark, s.size)
+		if markErr != nil {
+			s.size -= int64(len(buf))
+			s.file.Truncate(s.size)
+		} else {
+			s.size += int64(len(mark))
+		}
+	}
+	if s.size >= s.config.SegmentSize {
+		// NOTE: the mutation is already logged, so the failed rotation is retried by the next one
+		// and reported by Sync and Close
+		s.rotateErr = s.rotate()
+	}
+	return err
+}
+
+// rotate syncs and closes the current segment and starts the next one; must be called under the lock
+func (s *WALStore) rotate() error {
+	file, err := os.OpenFile(filepath.Join(s.config.Dir, segmentName(s.segment+1)), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	err = s.file.Sync()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.file.Close()
+	s.file, s.segment, s.size, s.dirty = file, s.segment+1, 0, false
+	return nil
+}
+
+// run syncs the log and takes snapshots in background, depending on config
+func (s *WALStore) run() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			if s.config.Sync == SyncInterval {
+				s.Sync()
+			}
+			if s.needsSnapshot() {
+				s.Snapshot()
+			}
+		}
+	}
+}
+
+func (s *WALStore) needsSnapshot() bool {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.closed || s.config.SnapshotSegments < 0 {
+		return false
+	}
+	return s.segment-s.first >= uint64(s.config.SnapshotSegments)
+}
+
+// Sync flushes the current segment to the stable storage; it retries the failed rotation of the segment
+// and returns its error, if it fails again
+func (s *WALStore) Sync() error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.closed {
+		return storeClosedErr
+	}
+	if s.rotateErr != nil {
+		s.rotateErr = s.rotate()
+		return s.rotateErr
+	}
+	if !s.dirty {
+		return nil
+	}
+	err := s.file.Sync()
+	if err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// Segments returns numbers of the first segment, which isn't covered by the snapshot, and of the current one
+func (s *WALStore) Segments() (uint64, uint64) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.first, s.segment
+}
+
+// Snapshot writes the wrapped store contents into the new snapshot, which replaces the old one,
+// and removes the segments it covers. Mutations aren't blocked meanwhile: the segment is rotated first,
+// and the mutations of the new segment, which get into the snapshot, are just applied again on replay
+func (s *WALStore) Snapshot() error {
+	s.snapshotMx.Lock()
+	defer s.snapshotMx.Unlock()
+	s.mx.Lock()
+	if s.closed {
+		s.mx.Unlock()
+		return storeClosedErr
+	}
+	var err error
+	if s.size > 0 {
+		err = s.rotate()
+	}
+	first := s.segment
+	s.mx.Unlock()
+	if err != nil {
+		return err
+	}
+	err = s.writeSnapshot(first)
+	if err != nil {
+		return err
+	}
+	s.mx.Lock()
+	s.first = first
+	s.mx.Unlock()
+	segments, err := listSegments(s.config.Dir)
+	if err != nil {
+		return err
+	}
+	for _, n := range segments {
+		if n >= first {
+			break
+		}
+		err = os.Remove(filepath.Join(s.config.Dir, segmentName(n)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeSnapshot writes the wrapped store contents into the temporary file and renames it into place
+func (s *WALStore) writeSnapshot(first uint64) error {
+	path := filepath.Join(s.config.Dir, snapshotTmpFileName)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	err = s.dump(w, first)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(path, filepath.Join(s.config.Dir, snapshotFileName))
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
+
+// dump writes the header and the records, which restore the wrapped store contents, in batches
+func (s *WALStore) dump(w io.Writer, first uint64) error {
+	buf := (&record{kind: snapshotRecord, segment: first}).encode(nil)
+	_, err := w.Write(buf)
+	if err != nil {
+		return err
+	}
+	writeRecord := func(rec *record) error {
+		if len(rec.ids) == 0 {
+			return nil
+		}
+		buf = rec.encode(buf[:0])
+		_, err := w.Write(buf)
+		return err
+	}
+	iter, err := s.inner.GetVectorIterator()
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+	for {
+		vecs := &record{kind: setVectorsRecord}
+		for len(vecs.ids) < snapshotBatchSize {
+			id, vec, ok := iter.Next()
+			if !ok {
+				break
+			}
+			vecs.ids = append(vecs.ids, id)
+			vecs.vecs = append(vecs.vecs, vec)
+		}
+		if len(vecs.ids) == 0 {
+			break
+		}
+		norms := &record{kind: setNormsRecord}
+		for _, id := range vecs.ids {
+			norm, err := s.inner.GetNorm(id)
+			if errors.Is(err, store.KeyNotFoundErr) {
+				continue // NOTE: norm hasn't been set
+			}
+			if err != nil {
+				return err
+			}
+			norms.ids = append(norms.ids, id)
+			norms.norms = append(norms.norms, norm)
+		}
+		payloads := &record{kind: setPayloadsRecord}
+		if payloadStore, ok := s.inner.(store.PayloadStore); ok {
+			data, err := payloadStore.GetPayloads(vecs.ids)
+			if err != nil {
+				return err
+			}
+			for i, id := range vecs.ids {
+				if data[i] != nil {
+					payloads.ids = append(payloads.ids, id)
+					payloads.payloads = append(payloads.payloads, data[i])
+				}
+			}
+		}
+		for _, rec := range []*record{vecs, norms, payloads} {
+			err = writeRecord(rec)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	buckets, err := s.inner.ListBuckets()
+	if err != nil {
+		return err
+	}
+	for _, key := range buckets {
+		it, err := s.inner.GetHashIterator(key)
+		if errors.Is(err, store.BucketNotFoundErr) {
+			continue // NOTE: bucket could be removed after listing
+		}
+		if err != nil {
+			return err
+		}
+		for {
+			page := it.NextN(snapshotBatchSize)
+			if len(page) == 0 {
+				break
+			}
+			hashes := &record{kind: setHashesRecord, ids: page, keys: make([]store.BucketKey, len(page))}
+			for i := range hashes.keys {
+				hashes.keys[i] = key
+			}
+			err = writeRecord(hashes)
+			if err != nil {
+				it.Close()
+				return err
+			}
+		}
+		err = it.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close stops the background work and closes the log along with the opened collections;
+// the wrapped store isn't closed
+func (s *WALStore) Close() error {
+	s.mx.Lock()
+	if s.closed {
+		s.mx.Unlock()
+		return storeClosedErr
+	}
+	for _, name := range s.namespaces.Names() {
+		ns, err := s.namespaces.Remove(name)
+		if err == nil {
+			ns.(*WALStore).Close()
+		}
+	}
+	s.closed = true
+	close(s.done)
+	err := s.file.Sync()
+	closeErr := s.file.Close()
+	rotateErr := s.rotateErr
+	s.mx.Unlock()
+	s.wg.Wait()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	return rotateErr
+}
+
+func (s *WALStore) SetVector(id string, vec []float64) error {
+	return s.write(&record{kind: setVectorsRecord, ids: []string{id}, vecs: [][]float64{vec}})
+}
+
+// SetVectors appends the whole batch as a single record
+func (s *WALStore) SetVectors(ids []string, vecs [][]float64) error {
+	if len(ids) != len(vecs) {
+		return lengthMismatchErr
+	}
+	return s.write(&record{kind: setVectorsRecord, ids: ids, vecs: vecs})
+}
+
+func (s *WALStore) GetVector(id string) ([]float64, error) {
+	return s.inner.GetVector(id)
+}
+
+func (s *WALStore) GetVectors(ids []string) ([][]float64, error) {
+	return s.inner.GetVectors(ids)
+}
+
+func (s *WALStore) DeleteVector(id string) error {
+	return s.write(&record{kind: deleteVectorRecord, ids: []string{id}})
+}
+
+func (s *WALStore) CountVectors() (int, error) {
+	return s.inner.CountVectors()
+}
+
+func (s *WALStore) GetVectorIterator() (store.VectorIterator, error) {
+	return s.inner.GetVectorIterator()
+}
+
+func (s *WALStore) SetNorm(id string, norm float64) error {
+	return s.write(&record{kind: setNormsRecord, ids: []string{id}, norms: []float64{norm}})
+}
+
+func (s *WALStore) SetNorms(ids []string, norms []float64) error {
+	if len(ids) != len(norms) {
+		return lengthMismatchErr
+	}
+	return s.write(&record{kind: setNormsRecord, ids: ids, norms: norms})
+}
+
+func (s *WALStore) GetNorm(id string) (float64, error) {
+	return s.inner.GetNorm(id)
+}
+
+func (s *WALStore) GetNorms(ids []string) ([]float64, error) {
+	return s.inner.GetNorms(ids)
+}
+
+// SetPayloads fails if the wrapped store doesn't implement store.PayloadStore
+func (s *WALStore) SetPayloads(ids []string, payloads [][]byte) error {
+	if _, ok := s.inner.(store.PayloadStore); !ok {
+		return payloadsUnsupportedErr
+	}
+	if len(ids) != len(payloads) {
+		return lengthMismatchErr
+	}
+	return s.write(&record{kind: setPayloadsRecord, ids: ids, payloads: payloads})
+}
+
+func (s *WALStore) GetPayloads(ids []string) ([][]byte, error) {
+	payloadStore, ok := s.inner.(store.PayloadStore)
+	if !ok {
+		return nil, payloadsUnsupportedErr
+	}
+	return payloadStore.GetPayloads(ids)
+}
+
+func (s *WALStore) SetHash(key store.BucketKey, vecId string) error {
+	return s.write(&record{kind: setHashesRecord, ids: []string{vecId}, keys: []store.BucketKey{key}})
+}
+
+func (s *WALStore) SetHashes(keys []store.BucketKey, vecIds []string) error {
+	if len(keys) != len(vecIds) {
+		return lengthMismatchErr
+	}
+	return s.write(&record{kind: setHashesRecord, ids: vecIds, keys: keys})
+}
+
+func (s *WALStore) RemoveHash(key store.BucketKey, vecId string) error {
+	return s.write(&record{kind: removeHashRecord, ids: []string{vecId}, keys: []store.BucketKey{key}})
+}
+
+func (s *WALStore) GetHashIterator(key store.BucketKey) (store.Iterator, error) {
+	return s.inner.GetHashIterator(key)
+}
+
+func (s *WALStore) ListBuckets() ([]store.BucketKey, error) {
+	return s.inner.ListBuckets()
+}
+
+func (s *WALStore) ListTableBuckets(table uint32) ([]store.BucketKey, error) {
+	return s.inner.ListTableBuckets(table)
+}
+
+// Clear is logged as any other mutation; the segments before it are removed by the next snapshot
+func (s *WALStore) Clear() error {
+	return s.write(&record{kind: clearRecord})
+}
+
+// Namespace opens the collection of the wrapped store with its own log in the subdirectory
+func (s *WALStore) Namespace(name string) (store.Store, error) {
+	namespacer, ok := s.inner.(store.Namespacer)
+	if !ok {
+		return nil, namespacesUnsupportedErr
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.closed {
+		return nil, storeClosedErr
+	}
+	return s.namespaces.Open(name, func() (store.Store, error) {
+		inner, err := namespacer.Namespace(name)
+		if err != nil {
+			return nil, err
+		}
+		config := s.config
+		config.Dir = filepath.Join(s.config.Dir, namespacesDir, name)
+		return NewWALStore(inner, config)
+	})
+}
+
+// ListNamespaces returns all the collections found in the store directory
+func (s *WALStore) ListNamespaces() ([]string, error) {
+	if _, ok := s.inner.(store.Namespacer); !ok {
+		return nil, namespacesUnsupportedErr
+	}
+	entries, err := ioutil.ReadDir(filepath.Join(s.config.Dir, namespacesDir))
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() && store.ValidateNamespace(entry.Name()) == nil {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+// DropNamespace closes the collection, removes its log and drops it from the wrapped store
+func (s *WALStore) DropNamespace(name string) error {
+	namespacer, ok := s.inner.(store.Namespacer)
+	if !ok {
+		return namespacesUnsupportedErr
+	}
+	err := store.ValidateNamespace(name)
+	if err != nil {
+		return err
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.closed {
+		return storeClosedErr
+	}
+	if ns, err := s.namespaces.Remove(name); err == nil {
+		ns.(*WALStore).Close()
+	}
+	dir := filepath.Join(s.config.Dir, namespacesDir, name)
+	if _, err = os.Stat(dir); os.IsNotExist(err) {
+		return namespaceNotFoundErr
+	}
+	err = os.RemoveAll(dir)
+	if err != nil {
+		return err
+	}
+	// NOTE: the wrapped collection could have not been opened since the restart
+	namespacer.DropNamespace(name)
+	return nil
+}
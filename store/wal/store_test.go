@@ -0,0 +1,497 @@
+package wal
+
+import (
+	"errors"
+	"github.com/gasparian/lsh-search-go/store"
+	"github.com/gasparian/lsh-search-go/store/compact"
+	"github.com/gasparian/lsh-search-go/store/kv"
+	"github.com/gasparian/lsh-search-go/store/storetest"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var readFailedErr = errors.New("Read failed")
+
+func newTestStore(t *testing.T, dir string, config Config) *WALStore {
+	config.Dir = dir
+	config.Sync = SyncNever
+	s, err := NewWALStore(kv.NewKVStore(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// contents holds everything the snapshot keeps, so the stores can be compared
+type contents struct {
+	vecs     map[string][]float64
+	norms    map[string]float64
+	payloads map[string][]byte
+	buckets  map[store.BucketKey][]string
+}
+
+func readContents(t *testing.T, s *WALStore) contents {
+	c := contents{
+		vecs:     make(map[string][]float64),
+		norms:    make(map[string]float64),
+		payloads: make(map[string][]byte),
+		buckets:  make(map[store.BucketKey][]string),
+	}
+	iter, err := s.GetVectorIterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		id, vec, ok := iter.Next()
+		if !ok {
+			break
+		}
+		c.vecs[id] = vec
+		if norm, err := s.GetNorm(id); err == nil {
+			c.norms[id] = norm
+		}
+		payloads, err := s.GetPayloads([]string{id})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if payloads[0] != nil {
+			c.payloads[id] = payloads[0]
+		}
+	}
+	iter.Close()
+	keys, err := s.ListBuckets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		it, err := s.GetHashIterator(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := it.NextN(1 << 20)
+		it.Close()
+		sort.Strings(ids)
+		c.buckets[key] = ids
+	}
+	return c
+}
+
+// mutate writes vectors with the given numbers along with their norms, payloads and buckets,
+// then deletes every third of them
+func mutate(t *testing.T, s *WALStore, from, to int) {
+	for i := from; i < to; i++ {
+		id := strconv.Itoa(i)
+		key := store.BucketKey{Table: uint32(i % 3), Code: uint64(i % 5)}
+		err := s.SetVectors([]string{id}, [][]float64{{float64(i), -float64(i)}})
+		if err == nil {
+			err = s.SetNorm(id, float64(i))
+		}
+		if err == nil {
+			err = s.SetPayloads([]string{id}, [][]byte{[]byte("payload " + id)})
+		}
+		if err == nil {
+			err = s.SetHashes([]store.BucketKey{key, {Table: 7, Code: 1<<64 - 1}}, []string{id, id})
+		}
+		if err == nil && i%3 == 0 {
+			err = s.DeleteVector(id)
+			if err == nil {
+				err = s.RemoveHash(key, id)
+			}
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRecords(t *testing.T) {
+	records := []*record{
+		{kind: setVectorsRecord, ids: []string{"a", "b"}, vecs: [][]float64{{1.5, -2}, {}}},
+		{kind: deleteVectorRecord, ids: []string{"a"}},
+		{kind: setNormsRecord, ids: []string{"a"}, norms: []float64{2.5}},
+		{kind: setPayloadsRecord, ids: []string{"a", "b"}, payloads: [][]byte{[]byte("payload"), nil}},
+		{kind: setHashesRecord, ids: []string{"a"}, keys: []store.BucketKey{{Table: 1<<32 - 1, Code: 1<<64 - 1}}},
+		{kind: removeHashRecord, ids: []string{"a"}, keys: []store.BucketKey{{Table: 1, Code: 2}}},
+		{kind: clearRecord},
+		{kind: snapshotRecord, segment: 42},
+	}
+	for _, expected := range records {
+		buf := expected.encode(nil)
+		rec, err := decodeRecord(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(rec, expected) {
+			t.Errorf("Record decoded wrong: expected %+v, got %+v", expected, rec)
+		}
+		buf[len(buf)-1] ^= 0xff
+		if _, err := decodeRecord(buf); err == nil {
+			t.Errorf("Corrupted record must not be decoded: %+v", expected)
+		}
+	}
+}
+
+func TestWALStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := Config{SegmentSize: 1 << 10, SnapshotSegments: -1}
+	s := newTestStore(t, dir, config)
+	defer func() { s.Close() }()
+
+	t.Run("Replay", func(t *testing.T) {
+		mutate(t, s, 0, 30)
+		expected := readContents(t, s)
+		if len(expected.vecs) != 20 {
+			t.Fatalf("Store must contain 20 vectors, got %v", len(expected.vecs))
+		}
+		if err := s.DeleteVector("0"); err == nil {
+			t.Fatal("Absent vector must not be deleted")
+		}
+		s.Close()
+		if err := s.SetVector("42", []float64{1}); err != storeClosedErr {
+			t.Fatalf("Closed store must not be written, got %v", err)
+		}
+		s = newTestStore(t, dir, config)
+		if replayed := readContents(t, s); !reflect.DeepEqual(replayed, expected) {
+			t.Fatalf("Replayed store differs: expected %+v, got %+v", expected, replayed)
+		}
+	})
+
+	t.Run("Rotation", func(t *testing.T) {
+		first, current := s.Segments()
+		if current-first < 2 {
+			t.Fatalf("Segments must be rotated by size: %v, %v", first, current)
+		}
+		err := s.Snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		first, current = s.Segments()
+		segments, err := listSegments(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first != current || !reflect.DeepEqual(segments, []uint64{current}) {
+			t.Fatalf("Segments covered by the snapshot must be removed: %v, %v, %v", first, current, segments)
+		}
+		mutate(t, s, 30, 40)
+		expected := readContents(t, s)
+		s.Close()
+		s = newTestStore(t, dir, config)
+		if restored := readContents(t, s); !reflect.DeepEqual(restored, expected) {
+			t.Fatalf("Restored store differs: expected %+v, got %+v", expected, restored)
+		}
+	})
+
+	t.Run("Recovery", func(t *testing.T) {
+		expected := readContents(t, s)
+		_, current := s.Segments()
+		s.Close()
+		path := filepath.Join(dir, segmentName(current))
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// NOTE: simulate the torn write of the last record
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := (&record{kind: setVectorsRecord, ids: []string{"torn"}, vecs: [][]float64{{1, 1}}}).encode(nil)
+		f.Write(buf[:len(buf)-3])
+		f.Close()
+
+		s = newTestStore(t, dir, config)
+		if recovered := readContents(t, s); !reflect.DeepEqual(recovered, expected) {
+			t.Fatalf("Recovered store differs: expected %+v, got %+v", expected, recovered)
+		}
+		if truncated, err := os.Stat(path); err != nil || truncated.Size() != info.Size() {
+			t.Fatalf("Torn tail must be truncated: %v, %v", info.Size(), err)
+		}
+		err = s.SetVector("torn", []float64{1, 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Close()
+		s = newTestStore(t, dir, config)
+		if _, err := s.GetVector("torn"); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("Clear", func(t *testing.T) {
+		err := s.Clear()
+		if err != nil {
+			t.Fatal(err)
+		}
+		mutate(t, s, 0, 2)
+		s.Close()
+		s = newTestStore(t, dir, config)
+		count, _ := s.CountVectors()
+		buckets, _ := s.ListBuckets()
+		if count != 1 || len(buckets) != 2 {
+			t.Errorf("Store must be cleared before the last mutations: %v vectors, %v buckets", count, len(buckets))
+		}
+	})
+}
+
+// normsStore fails norms reads with the given error
+type normsStore struct {
+	*kv.KVStore
+	err error
+}
+
+func (s *normsStore) GetNorm(id string) (float64, error) {
+	return 0, s.err
+}
+
+func TestFailures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := Config{Dir: dir, Sync: SyncNever, SegmentSize: 1 << 10, SnapshotSegments: -1}
+	s, err := NewWALStore(compact.NewCompactStore(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { s.Close() }()
+
+	t.Run("PartialApply", func(t *testing.T) {
+		err := s.SetVector("a", []float64{1, 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// NOTE: the compact store keeps vectors written before the one with the wrong dimensions
+		err = s.SetVectors([]string{"b", "c"}, [][]float64{{3, 4}, {5}})
+		if err == nil {
+			t.Fatal("Vector with the wrong dimensions must not be stored")
+		}
+		expected := readContents(t, s)
+		s.Close()
+		s, err = NewWALStore(compact.NewCompactStore(), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if replayed := readContents(t, s); !reflect.DeepEqual(replayed, expected) || len(replayed.vecs) != 2 {
+			t.Fatalf("Replayed store differs: expected %+v, got %+v", expected, replayed)
+		}
+	})
+
+	t.Run("Unmarked", func(t *testing.T) {
+		s.Close()
+		_, current := s.Segments()
+		path := filepath.Join(dir, segmentName(current))
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		appendRecord := func(rec *record) {
+			file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			_, err = file.Write(rec.encode(nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		// NOTE: the crash could happen before the failed mutation is marked, so it's tolerated at the tail only
+		appendRecord(&record{kind: setVectorsRecord, ids: []string{"d"}, vecs: [][]float64{{6}}})
+		s, err = NewWALStore(compact.NewCompactStore(), config)
+		if err != nil {
+			t.Fatalf("Unmarked failed mutation at the tail must be replayed: %v", err)
+		}
+		s.Close()
+		appendRecord(&record{kind: deleteVectorRecord, ids: []string{"a"}})
+		if _, err = NewWALStore(compact.NewCompactStore(), config); err == nil {
+			t.Error("Unmarked failed mutation must fail the replay")
+		}
+		err = os.Truncate(path, info.Size())
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err = NewWALStore(compact.NewCompactStore(), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Overlap", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "wal-store")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		overlapped := newTestStore(t, dir, Config{SnapshotSegments: -1})
+		defer func() { overlapped.Close() }()
+		mutate(t, overlapped, 0, 10)
+		expected := readContents(t, overlapped)
+		// NOTE: the snapshot holds the results of the whole segment, which is replayed over it
+		_, current := overlapped.Segments()
+		err = overlapped.writeSnapshot(current)
+		if err != nil {
+			t.Fatal(err)
+		}
+		overlapped.Close()
+		overlapped = newTestStore(t, dir, Config{SnapshotSegments: -1})
+		if replayed := readContents(t, overlapped); !reflect.DeepEqual(replayed, expected) {
+			t.Errorf("Replayed store differs: expected %+v, got %+v", expected, replayed)
+		}
+	})
+
+	t.Run("Snapshot", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "wal-store")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		failing, err := NewWALStore(&normsStore{KVStore: kv.NewKVStore(), err: readFailedErr}, Config{Dir: dir, SnapshotSegments: -1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer failing.Close()
+		err = failing.SetVector("a", []float64{1, 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = failing.Snapshot(); !errors.Is(err, readFailedErr) {
+			t.Errorf("Norms read errors must fail the snapshot, got %v", err)
+		}
+	})
+
+	t.Run("Rotation", func(t *testing.T) {
+		err := os.RemoveAll(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, current := s.Segments()
+		for i := 0; i < 100; i++ {
+			err = s.SetVector(strconv.Itoa(i), []float64{float64(i), 0})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err = s.Sync(); err == nil {
+			t.Fatal("Rotation failure must be returned")
+		}
+		err = os.MkdirAll(dir, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.Sync()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, next := s.Segments(); next != current+1 {
+			t.Errorf("Failed rotation must be retried by Sync: %v, %v", current, next)
+		}
+	})
+}
+
+func TestBackgroundSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := newTestStore(t, dir, Config{Interval: 10 * time.Millisecond, SegmentSize: 1, SnapshotSegments: 2})
+	defer s.Close()
+	mutate(t, s, 0, 10)
+	for i := 0; i < 100; i++ {
+		segments, err := listSegments(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(segments) <= 3 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Snapshot hasn't been taken in background")
+}
+
+func TestConformance(t *testing.T) {
+	storetest.RunConformance(t, func(t *testing.T) (store.Store, func()) {
+		dir, err := ioutil.TempDir("", "wal-store")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := newTestStore(t, dir, Config{})
+		return s, func() {
+			s.Close()
+			os.RemoveAll(dir)
+		}
+	})
+}
+
+func TestNamespaces(t *testing.T) {
+	storetest.RunNamespaceConformance(t, func(t *testing.T) (store.Store, func()) {
+		dir, err := ioutil.TempDir("", "wal-store")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := newTestStore(t, dir, Config{})
+		return s, func() {
+			s.Close()
+			os.RemoveAll(dir)
+		}
+	})
+
+	t.Run("Reopen", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "wal-store")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		s := newTestStore(t, dir, Config{})
+		ns, err := s.Namespace("docs")
+		if err != nil {
+			t.Fatal(err)
+		}
+		mutate(t, ns.(*WALStore), 0, 10)
+		expected := readContents(t, ns.(*WALStore))
+		s.Close()
+		s = newTestStore(t, dir, Config{})
+		defer s.Close()
+		names, err := s.ListNamespaces()
+		if err != nil || !reflect.DeepEqual(names, []string{"docs"}) {
+			t.Fatalf("Collection must be listed after restart: %v, %v", names, err)
+		}
+		ns, err = s.Namespace("docs")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if restored := readContents(t, ns.(*WALStore)); !reflect.DeepEqual(restored, expected) {
+			t.Fatalf("Restored collection differs: expected %+v, got %+v", expected, restored)
+		}
+		if count, _ := s.CountVectors(); count != 0 {
+			t.Error("Collection must be isolated from the store")
+		}
+	})
+}
+
+func TestPayloads(t *testing.T) {
+	storetest.RunPayloadConformance(t, func(t *testing.T) (store.Store, func()) {
+		dir, err := ioutil.TempDir("", "wal-store")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := newTestStore(t, dir, Config{})
+		return s, func() {
+			s.Close()
+			os.RemoveAll(dir)
+		}
+	})
+}